@@ -0,0 +1,46 @@
+drop table logistics_company_entity;
+
+create table logistics_company_entity (
+  id               integer PRIMARY KEY,
+  code             varchar(255), -- the code saved in logistics_info_entity.company
+  name             varchar(255),
+  aliases          varchar(255), -- separated by comma
+  provider_codes   text,         -- json, the code of provider if different, like {"kuaidi100api":"SF"}
+  number_patterns  text,         -- json, the formats of tracking number, score: 80 letter prefix, 60 digit prefix, 30 length
+  active           integer,      -- 1: active, 0: inactive
+  crt_date         integer,
+  upd_date         integer
+);
+
+DROP TRIGGER logistics_company_entity_i_trigger;
+CREATE TRIGGER logistics_company_entity_i_trigger
+   AFTER INSERT
+   ON logistics_company_entity
+BEGIN
+    UPDATE logistics_company_entity
+       SET crt_date = strftime('%s','now') 
+     WHERE id = NEW.id;
+END;
+
+DROP TRIGGER logistics_company_entity_u_trigger;
+CREATE TRIGGER logistics_company_entity_u_trigger
+   AFTER UPDATE
+   ON logistics_company_entity
+BEGIN
+    UPDATE logistics_company_entity
+       SET upd_date = strftime('%s','now') 
+     WHERE id = OLD.id;
+END;
+
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('shentong', '申通', 'STO', '', '[{"regex":"^(220|268|368|468|568|588|668|868|888|968)\\d{9}$","score":60},{"regex":"^77\\d{11}$","score":60}]', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('ems', 'EMS', '邮政EMS,中国邮政速递', '', '[{"regex":"^[A-Z]{2}\\d{9}[A-Z]{2}$","score":80,"check":"s10"},{"regex":"^(10|11|50|51|95|97|98|99)\\d{11}$","score":60}]', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('shunfeng', '顺丰', 'SF,顺丰速运', '', '[{"regex":"^SF\\d{12,13}$","score":80},{"regex":"^\\d{12}$","score":30}]', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('yuantong', '圆通', 'YTO', '', '[{"regex":"^YT\\d{13}$","score":80},{"regex":"^[DVE]\\d{9}$","score":80},{"regex":"^(1|2|6|8)\\d{9}$","score":30}]', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('zhongtong', '中通', 'ZTO', '', '[{"regex":"^7[35]\\d{12}$","score":60},{"regex":"^(2|3|5|6|7)\\d{11}$","score":30}]', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('rufengda', '如风达', '', '', '[{"regex":"^\\d{16}$","score":30}]', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('yunda', '韵达', 'YD', '', '[{"regex":"^(10|11|12|13|19|31|39|43|46)\\d{11}$","score":60},{"regex":"^\\d{15}$","score":30}]', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('tiantian', '天天', 'TTK', '', '[{"regex":"^(55|56|57|58|59|88)\\d{10}$","score":60}]', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('huitongkuaidi', '汇通', '百世汇通,百世', '', '[{"regex":"^[ABDE]\\d{12}$","score":80},{"regex":"^(35|50|55|70)\\d{11}$","score":60}]', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('quanfengkuaidi', '全峰', '', '', '', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('debangwuliu', '德邦', '', '', '[{"regex":"^DPK\\d{12}$","score":80},{"regex":"^\\d{8,9}$","score":30}]', 1);
+insert into logistics_company_entity (code, name, aliases, provider_codes, number_patterns, active) values ('zhaijisong', '宅急送', 'ZJS', '', '[{"regex":"^ZJS\\d{12}$","score":80},{"regex":"^\\d{10}$","score":30}]', 1);
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	l4g "code.google.com/p/log4go"
 	"encoding/json"
+	"entityresolver"
 	"errors"
 	"fmt"
 	"github.com/robfig/cron"
@@ -28,7 +29,8 @@ type AqiService struct {
 	cron            *cron.Cron
 	dbHelper        *AqiDbHelper
 	cityNameMap     map[string]*AqiCityEntity
-	cityCNNameMap   map[string]*AqiCityEntity
+	cityResolver    *entityresolver.EntityResolver
+	lastStatus      string
 	started         bool
 }
 
@@ -37,6 +39,7 @@ type config struct {
 	AqiPushCron   string `json:"aqiPushCron,omitempty"`
 	AqiUpdateCron string `json:"aqiUpdateCron,omitempty"`
 	LatestHour    int    `json:"latestHour,omitempty"`
+	StatusCity    string `json:"statusCity,omitempty"` // the city whose aqi is shown in status
 }
 
 func (self *AqiService) GetServiceId() string {
@@ -69,6 +72,7 @@ func (self *AqiService) Init(configRawMsg *json.RawMessage, pushCh chan<- *servi
 	})
 	self.cron.AddFunc(c.AqiUpdateCron, func() {
 		self.updateAqiData()
+		self.pushAqiStatus()
 	})
 	self.commandMap = map[string]processFunc{
 		"currentaqi":   (*AqiService).getCurrentAqi,
@@ -86,10 +90,10 @@ func (self *AqiService) Init(configRawMsg *json.RawMessage, pushCh chan<- *servi
 		return getCitiesErr
 	}
 	self.cityNameMap = make(map[string]*AqiCityEntity)
-	self.cityCNNameMap = make(map[string]*AqiCityEntity)
+	self.cityResolver = entityresolver.NewEntityResolver("市")
 	for _, entity := range entities {
 		self.cityNameMap[entity.CityName] = entity
-		self.cityCNNameMap[entity.CityCNName] = entity
+		self.cityResolver.Add(entity.CityName, entity.CityName, entity.CityCNName)
 	}
 	l4g.Debug("init cityMap successful, cities number: %d", len(self.cityNameMap))
 	return nil
@@ -103,28 +107,16 @@ func (self *AqiService) CommandFilter(command string, args []string) bool {
 	if _, ok := self.commandMap[command]; ok {
 		return true
 	}
-	return self.isStatmentCommand(command)
+	return false
 }
 
-const (
-	StatementCommandSuffix1 = "的空气质量"
-	StatementCommandSuffix2 = "空气质量"
-)
-
-func (self *AqiService) isStatmentCommand(command string) bool {
-	return strings.HasSuffix(command, StatementCommandSuffix1) ||
-		strings.HasSuffix(command, StatementCommandSuffix2)
-}
-
-func (self *AqiService) parseStatementCommand(stmtCmd string, args []string) (string, []string) {
-	if strings.HasSuffix(stmtCmd, StatementCommandSuffix1) {
-		city := stmtCmd[0:strings.Index(stmtCmd, StatementCommandSuffix1)]
-		return "currentaqi", []string{city}
-	} else if strings.HasSuffix(stmtCmd, StatementCommandSuffix2) {
-		city := stmtCmd[0:strings.Index(stmtCmd, StatementCommandSuffix2)]
-		return "currentaqi", []string{city}
+func (self *AqiService) GetVoicePhrases() []service.VoicePhrase {
+	return []service.VoicePhrase{
+		{Phrases: []string{"{city}的空气质量", "{city}空气质量", "{city}的空气怎么样", "{city}空气怎么样", "{city}的空气指数"},
+			Command: "currentaqi", Args: []string{"{city}"}},
+		{Phrases: []string{"订阅{city}的空气质量", "订阅{city}空气质量"}, Command: "subaqidata", Args: []string{"{city}"}},
+		{Phrases: []string{"退订{city}的空气质量", "退订{city}空气质量", "取消订阅{city}的空气质量"}, Command: "unsubaqidata", Args: []string{"{city}"}},
 	}
-	return stmtCmd, args
 }
 
 func (self *AqiService) GetHelpMessage() string {
@@ -154,19 +146,17 @@ func (self *AqiService) Stop() error {
 
 func (self *AqiService) Handle(username, command string, args []string) (string, error) {
 	realCommand := command
-	realargs := args
 	comm := self.aliasCommandMap[realCommand]
 	if len(comm) > 0 {
 		realCommand = comm
 	}
 
-	realCommand, realargs = self.parseStatementCommand(realCommand, realargs)
-	l4g.Debug("realCommand, readargs: %s, %s", realCommand, realargs)
+	l4g.Debug("realCommand, args: %s, %s", realCommand, args)
 	f := self.commandMap[realCommand]
 	if f == nil {
 		return "", errors.New("命令错误！请输入\"help\"查询命令！")
 	}
-	return f(self, username, realargs)
+	return f(self, username, args)
 }
 
 func (self *AqiService) getCurrentAqi(username string, args []string) (string, error) {
@@ -288,6 +278,35 @@ func (self *AqiService) updateAqiData() {
 	}
 }
 
+func (self *AqiService) pushAqiStatus() {
+	if self.config.StatusCity == "" {
+		return
+	}
+	cityEntity := self.getCityEntity(strings.ToLower(self.config.StatusCity))
+	if cityEntity == nil {
+		l4g.Error("Unsupported status city: %s", self.config.StatusCity)
+		return
+	}
+	entity, err := self.dbHelper.GetLatestAqiEntity(cityEntity.CityName)
+	if err != nil {
+		l4g.Error("GetLatestAqiEntity error: %v", err)
+		return
+	}
+	status := ""
+	if entity != nil && time.Now().Unix()-entity.Time < int64(self.config.LatestHour)*60*60 {
+		status = fmt.Sprintf("%s AQI: %d (%s)", cityEntity.CityCNName, entity.Aqi, self.getAqiLevel(entity.Aqi))
+	}
+	if status == self.lastStatus {
+		return
+	}
+	self.lastStatus = status
+	pushMsg := &service.PushMessage{}
+	pushMsg.Type = service.Status
+	pushMsg.Source = self.GetServiceId()
+	pushMsg.Message = status
+	self.pushMsgChannel <- pushMsg
+}
+
 func (self *AqiService) pushAqiDataToUser() {
 	userSubEntities, getSubUserError := self.dbHelper.GetSubscribedUser()
 	if getSubUserError != nil {
@@ -420,14 +439,11 @@ func (self *AqiService) formatOutput(city string, aqiData *AqiData) string {
 }
 
 func (self *AqiService) getCityEntity(city string) *AqiCityEntity {
-	if entity, ok := self.cityCNNameMap[city]; ok {
-		return entity
+	cityName, ok := self.cityResolver.Resolve(city)
+	if !ok {
+		return nil
 	}
-
-	if entity, ok := self.cityNameMap[city]; ok {
-		return entity
-	}
-	return nil
+	return self.cityNameMap[cityName]
 }
 
 func (self *AqiService) getAqiLevel(aqi int) string {
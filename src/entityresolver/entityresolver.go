@@ -0,0 +1,239 @@
+package entityresolver
+
+import (
+	"github.com/mozillazg/go-pinyin"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	maxHeteronymCombos = 16
+)
+
+// EntityResolver resolves the name of city, district or company to the key of the
+// entity. Speech recognition often returns the wrong characters with the right sound,
+// so the names are indexed by pinyin with and without tones, and by edit distance.
+type EntityResolver struct {
+	ignoredSuffixes []string
+	exactMap        map[string]string   // name -> key
+	toneMap         map[string][]string // pinyin with tones -> keys
+	plainMap        map[string][]string // pinyin without tones -> keys
+	plainNames      []string            // sorted pinyin without tones, for edit distance
+	mutex           sync.RWMutex
+}
+
+// the ignored suffixes will be removed if the name can not be resolved, like "市" or "区"
+func NewEntityResolver(ignoredSuffixes ...string) *EntityResolver {
+	resolver := &EntityResolver{}
+	resolver.ignoredSuffixes = ignoredSuffixes
+	resolver.exactMap = make(map[string]string)
+	resolver.toneMap = make(map[string][]string)
+	resolver.plainMap = make(map[string][]string)
+	return resolver
+}
+
+// add the names of entity, the names can be chinese name, pinyin and alias
+func (self *EntityResolver) Add(key string, names ...string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, name := range names {
+		name = normalizeName(name)
+		if len(name) == 0 {
+			continue
+		}
+		self.exactMap[name] = key
+		for _, tonePinyin := range toPinyin(name, pinyin.Tone3) {
+			self.toneMap[tonePinyin] = appendKey(self.toneMap[tonePinyin], key)
+		}
+		for _, plainPinyin := range toPinyin(name, pinyin.Normal) {
+			if _, ok := self.plainMap[plainPinyin]; !ok {
+				self.plainNames = append(self.plainNames, plainPinyin)
+			}
+			self.plainMap[plainPinyin] = appendKey(self.plainMap[plainPinyin], key)
+		}
+	}
+	sort.Strings(self.plainNames)
+}
+
+// resolve the name to the key of entity, false if not found or ambiguous
+func (self *EntityResolver) Resolve(name string) (string, bool) {
+	name = normalizeName(name)
+	if key, ok := self.resolve(name); ok {
+		return key, true
+	}
+	for _, suffix := range self.ignoredSuffixes {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			if key, ok := self.resolve(strings.TrimSuffix(name, suffix)); ok {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (self *EntityResolver) resolve(name string) (string, bool) {
+	if len(name) == 0 {
+		return "", false
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if key, ok := self.exactMap[name]; ok {
+		return key, true
+	}
+	if key, ok := self.matchPinyin(self.toneMap, toPinyin(name, pinyin.Tone3)); ok {
+		return key, true
+	}
+	plainPinyins := toPinyin(name, pinyin.Normal)
+	if key, ok := self.matchPinyin(self.plainMap, plainPinyins); ok {
+		return key, true
+	}
+	return self.matchEditDistance(plainPinyins)
+}
+
+// the pinyin must point to only one entity
+func (self *EntityResolver) matchPinyin(pinyinMap map[string][]string, pinyins []string) (string, bool) {
+	keys := make([]string, 0)
+	for _, p := range pinyins {
+		for _, key := range pinyinMap[p] {
+			keys = appendKey(keys, key)
+		}
+	}
+	if len(keys) == 1 {
+		return keys[0], true
+	}
+	return "", false
+}
+
+// the closest entity must be unique and within the max distance, the pinyin of homophones
+// points to more than one entity and is ambiguous. the names are compared in sorted order
+// so the result does not depend on the order of adding
+func (self *EntityResolver) matchEditDistance(pinyins []string) (string, bool) {
+	bestKey := ""
+	bestDistance := -1
+	ambiguous := false
+	for _, p := range pinyins {
+		for _, plainName := range self.plainNames {
+			distance := EditDistance(p, plainName)
+			if distance > maxDistance(plainName) {
+				continue
+			}
+			keys := self.plainMap[plainName]
+			if bestDistance < 0 || distance < bestDistance {
+				bestKey = keys[0]
+				bestDistance = distance
+				ambiguous = len(keys) > 1
+			} else if distance == bestDistance && (len(keys) > 1 || keys[0] != bestKey) {
+				ambiguous = true
+			}
+		}
+	}
+	if bestDistance < 0 || ambiguous {
+		return "", false
+	}
+	return bestKey, true
+}
+
+// short pinyin like "ems" must be exactly matched
+func maxDistance(plainPinyin string) int {
+	l := len(plainPinyin)
+	switch {
+	case l < 6:
+		return 0
+	case l < 10:
+		return 1
+	}
+	return 2
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(name), " ", "", -1))
+}
+
+// return all the pinyin combinations of heteronyms, the name which
+// is not totally chinese is treated as pinyin or alphabet code
+func toPinyin(name string, style int) []string {
+	if !isAllHan(name) {
+		if style == pinyin.Normal && isAllLetter(name) {
+			return []string{name}
+		}
+		return []string{}
+	}
+	args := pinyin.NewArgs()
+	args.Style = style
+	args.Heteronym = true
+	combos := []string{""}
+	for _, readings := range pinyin.Pinyin(name, args) {
+		newCombos := make([]string, 0)
+		for _, combo := range combos {
+			for _, reading := range readings {
+				if len(newCombos) < maxHeteronymCombos {
+					newCombos = appendKey(newCombos, combo+reading)
+				}
+			}
+		}
+		combos = newCombos
+	}
+	if len(combos) == 1 && combos[0] == "" {
+		return []string{}
+	}
+	return combos
+}
+
+func isAllHan(s string) bool {
+	for _, r := range s {
+		if !unicode.Is(unicode.Han, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isAllLetter(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII || !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func appendKey(keys []string, key string) []string {
+	for _, k := range keys {
+		if k == key {
+			return keys
+		}
+	}
+	return append(keys, key)
+}
+
+// levenshtein distance of two strings
+func EditDistance(s, t string) int {
+	a := []rune(s)
+	b := []rune(t)
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
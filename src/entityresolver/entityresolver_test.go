@@ -0,0 +1,93 @@
+package entityresolver
+
+import (
+	"testing"
+)
+
+func createCityResolver() *EntityResolver {
+	resolver := NewEntityResolver("市")
+	resolver.Add("shanghai", "shanghai", "上海")
+	resolver.Add("beijing", "beijing", "北京")
+	resolver.Add("suzhou", "suzhou", "苏州")
+	resolver.Add("xuzhou", "xuzhou", "徐州")
+	resolver.Add("chongqing", "chongqing", "重庆")
+	return resolver
+}
+
+func TestResolve(t *testing.T) {
+	resolver := createCityResolver()
+	cases := map[string]string{
+		"上海":       "shanghai",
+		"Shanghai": "shanghai",
+		"上海市":      "shanghai",
+		"尚海":       "shanghai", // same pinyin and tones
+		"伤海":       "shanghai", // same pinyin without tones
+		"shanhai":  "shanghai", // edit distance
+		"重庆":       "chongqing",
+		"北 京":      "beijing",
+	}
+	for name, expected := range cases {
+		key, ok := resolver.Resolve(name)
+		if !ok || key != expected {
+			t.Fatalf("resolve %s: expect %s, got %s", name, expected, key)
+		}
+	}
+}
+
+func TestResolveAmbiguous(t *testing.T) {
+	resolver := createCityResolver()
+	// "shuzhou" is close to suzhou, but "zuzhou" is as close to suzhou as xuzhou
+	if key, ok := resolver.Resolve("shuzhou"); !ok || key != "suzhou" {
+		t.Fatal("shuzhou should be resolved to suzhou, got", key)
+	}
+	if key, ok := resolver.Resolve("zuzhou"); ok {
+		t.Fatal("zuzhou is ambiguous, got", key)
+	}
+	if key, ok := resolver.Resolve("广州"); ok {
+		t.Fatal("unknown city should not be resolved, got", key)
+	}
+}
+
+func TestResolveHomophone(t *testing.T) {
+	resolver := NewEntityResolver()
+	resolver.Add("suzhou_js", "苏州")
+	resolver.Add("suzhou_ah", "宿州")
+	if key, ok := resolver.Resolve("苏州"); !ok || key != "suzhou_js" {
+		t.Fatal("苏州 should be resolved exactly, got", key)
+	}
+	// the same pinyin without tones and the close pinyin point to both cities
+	for _, name := range []string{"suzhou", "suzhoo"} {
+		if key, ok := resolver.Resolve(name); ok {
+			t.Fatalf("%s is ambiguous, got %s", name, key)
+		}
+	}
+}
+
+func TestResolveTie(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		resolver := NewEntityResolver()
+		resolver.Add("shenzhen", "深圳", "shenzen")
+		resolver.Add("suzhou", "苏州")
+		resolver.Add("xuzhou", "徐州")
+		// the names of the same entity are equally close
+		if key, ok := resolver.Resolve("shenzhn"); !ok || key != "shenzhen" {
+			t.Fatal("shenzhn should be resolved to shenzhen, got", key)
+		}
+		// the names of different entities are equally close
+		if key, ok := resolver.Resolve("zuzhou"); ok {
+			t.Fatal("zuzhou is ambiguous, got", key)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	if d := EditDistance("shanghai", "shanhai"); d != 1 {
+		t.Fatal("unexpected distance:", d)
+	}
+	if d := EditDistance("", "abc"); d != 3 {
+		t.Fatal("unexpected distance:", d)
+	}
+	if d := EditDistance("申通", "中通"); d != 1 {
+		t.Fatal("unexpected distance:", d)
+	}
+}
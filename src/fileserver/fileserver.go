@@ -0,0 +1,133 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	filePathPrefix  = "/files/"
+	randomDirLength = 16 // bytes, the dir name is hex encoded
+)
+
+// FileServer serves the files which are sent to user through http,
+// the published files will be removed after expiration
+type FileServer struct {
+	dir        string
+	addr       string
+	baseUrl    string
+	expiration time.Duration
+	listener   net.Listener
+}
+
+func NewFileServer(dir, addr, baseUrl string, expiration time.Duration) (*FileServer, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if mkdirErr := os.MkdirAll(absDir, 0755); mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	server := &FileServer{}
+	server.dir = absDir
+	server.addr = addr
+	server.baseUrl = strings.TrimRight(baseUrl, "/")
+	server.expiration = expiration
+	return server, nil
+}
+
+func (self *FileServer) Start() error {
+	listener, err := net.Listen("tcp", self.addr)
+	if err != nil {
+		return err
+	}
+	self.listener = listener
+	mux := http.NewServeMux()
+	mux.Handle(filePathPrefix, http.StripPrefix(filePathPrefix, self.fileHandler()))
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// fileHandler serves the published files only, the dirs are not listed
+// so the random dirs of other users can not be found
+func (self *FileServer) fileHandler() http.Handler {
+	fileServer := http.FileServer(http.Dir(self.dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		info, err := os.Stat(filepath.Join(self.dir, filepath.FromSlash(path.Clean("/"+r.URL.Path))))
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+func (self *FileServer) Stop() error {
+	if self.listener == nil {
+		return nil
+	}
+	return self.listener.Close()
+}
+
+// Publish links or copies the file to a random dir of server, return the url of the file
+func (self *FileServer) Publish(filePath string) (string, error) {
+	self.removeExpiredFiles()
+	b := make([]byte, randomDirLength)
+	if _, randErr := rand.Read(b); randErr != nil {
+		return "", randErr
+	}
+	randomDir := hex.EncodeToString(b)
+	if mkdirErr := os.Mkdir(filepath.Join(self.dir, randomDir), 0755); mkdirErr != nil {
+		return "", mkdirErr
+	}
+	fileName := filepath.Base(filePath)
+	publishedPath := filepath.Join(self.dir, randomDir, fileName)
+	if linkErr := os.Link(filePath, publishedPath); linkErr != nil {
+		if copyErr := copyFile(filePath, publishedPath); copyErr != nil {
+			return "", copyErr
+		}
+	}
+	u := &url.URL{Path: filePathPrefix + randomDir + "/" + fileName}
+	return self.baseUrl + u.EscapedPath(), nil
+}
+
+func (self *FileServer) removeExpiredFiles() {
+	dirs, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		if time.Since(d.ModTime()) > self.expiration {
+			os.RemoveAll(filepath.Join(self.dir, d.Name()))
+		}
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,59 @@
+package fileserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileServer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fileserver")
+	defer os.RemoveAll(dir)
+	server, err := NewFileServer(filepath.Join(dir, "files"), "127.0.0.1:18089", "http://127.0.0.1:18089/", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if startErr := server.Start(); startErr != nil {
+		t.Fatal(startErr)
+	}
+	defer server.Stop()
+
+	filePath := filepath.Join(dir, "上海 aqi.txt")
+	ioutil.WriteFile(filePath, []byte("hello"), 0644)
+	url, publishErr := server.Publish(filePath)
+	if publishErr != nil {
+		t.Fatal(publishErr)
+	}
+	resp, getErr := http.Get(url)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatal("unexpected response:", resp.Status, string(body))
+	}
+	if _, statErr := os.Stat(filePath); statErr != nil {
+		t.Fatal("the source file should be kept")
+	}
+
+	// the dirs are not listed
+	randomDir := url[:strings.LastIndex(url, "/")]
+	if name := randomDir[strings.LastIndex(randomDir, "/")+1:]; len(name) != randomDirLength*2 {
+		t.Fatal("unexpected random dir:", name)
+	}
+	for _, dirUrl := range []string{"http://127.0.0.1:18089/files/", randomDir, randomDir + "/"} {
+		dirResp, dirErr := http.Get(dirUrl)
+		if dirErr != nil {
+			t.Fatal(dirErr)
+		}
+		dirResp.Body.Close()
+		if dirResp.StatusCode != http.StatusNotFound {
+			t.Fatal("the dir should not be listed:", dirUrl, dirResp.Status)
+		}
+	}
+}
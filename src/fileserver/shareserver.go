@@ -0,0 +1,191 @@
+package fileserver
+
+import (
+	l4g "code.google.com/p/log4go"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sharePathPrefix = "/share/"
+	tokenLength     = 16 // bytes of hmac in token
+)
+
+// RootResolver returns the dir of the shared root by name, like the download dir of backend
+type RootResolver func(name string) (string, error)
+
+// ShareServer serves the files under the shared roots by the signed links, the link is valid until it expires.
+// the link has the root name and the path relative to the root, the path is checked again when it is served.
+// the range requests are supported for video streaming
+type ShareServer struct {
+	addr     string
+	baseUrl  string
+	secret   []byte
+	roots    RootResolver
+	listener net.Listener
+}
+
+// NewShareServer creates the share server, the links are signed by the secret,
+// and the base url is the LAN address if not given
+func NewShareServer(addr, baseUrl, secret string, roots RootResolver) (*ShareServer, error) {
+	if secret == "" {
+		return nil, errors.New("the secret of share server is required")
+	}
+	if roots == nil {
+		return nil, errors.New("the root resolver of share server is required")
+	}
+	server := &ShareServer{}
+	server.addr = addr
+	server.roots = roots
+	server.secret = []byte(secret)
+	if baseUrl == "" {
+		lanUrl, err := getLanUrl(addr)
+		if err != nil {
+			return nil, err
+		}
+		baseUrl = lanUrl
+	}
+	server.baseUrl = strings.TrimRight(baseUrl, "/")
+	return server, nil
+}
+
+// getLanUrl uses the first IPv4 address which is not loopback if the host of addr is not given
+func getLanUrl(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || host == "0.0.0.0" {
+		addrs, addrErr := net.InterfaceAddrs()
+		if addrErr != nil {
+			return "", addrErr
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				host = ipNet.IP.String()
+				break
+			}
+		}
+		if host == "" || host == "0.0.0.0" {
+			return "", errors.New("no LAN address found")
+		}
+	}
+	return "http://" + net.JoinHostPort(host, port), nil
+}
+
+func (self *ShareServer) Start() error {
+	listener, err := net.Listen("tcp", self.addr)
+	if err != nil {
+		return err
+	}
+	self.listener = listener
+	mux := http.NewServeMux()
+	mux.Handle(sharePathPrefix, self)
+	go http.Serve(listener, mux)
+	return nil
+}
+
+func (self *ShareServer) Stop() error {
+	if self.listener == nil {
+		return nil
+	}
+	return self.listener.Close()
+}
+
+func (self *ShareServer) sign(root, relPath string, expires int64) string {
+	mac := hmac.New(sha256.New, self.secret)
+	mac.Write([]byte(root + "\n" + relPath + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil)[:tokenLength])
+}
+
+// IsInDir checks whether the file is under the dir, the symlinks are resolved
+func IsInDir(dir, filePath string) bool {
+	if dir == "" {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(filePath); err == nil {
+		filePath = resolved
+	}
+	dir, dirErr := filepath.Abs(dir)
+	filePath, fileErr := filepath.Abs(filePath)
+	if dirErr != nil || fileErr != nil {
+		return false
+	}
+	return strings.HasPrefix(filePath, strings.TrimRight(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// Share returns the link of file under the root which expires after ttl, the file path is relative to the root
+func (self *ShareServer) Share(root, relPath string, ttl time.Duration) (string, error) {
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	if root == "" || strings.Contains(root, "/") || filepath.IsAbs(relPath) ||
+		relPath == "." || relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", errors.New("invalid shared path: " + root + " " + relPath)
+	}
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("token", self.sign(root, relPath, expires))
+	u := &url.URL{Path: sharePathPrefix + root + "/" + relPath, RawQuery: query.Encode()}
+	return self.baseUrl + u.String(), nil
+}
+
+func (self *ShareServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, sharePathPrefix), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	root, relPath := parts[0], parts[1]
+	expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+	token, _ := hex.DecodeString(query.Get("token"))
+	expectedToken, _ := hex.DecodeString(self.sign(root, relPath, expires))
+	if !hmac.Equal(token, expectedToken) {
+		l4g.Warn("Share access denied: %s %s/%s", r.RemoteAddr, root, relPath)
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		l4g.Info("Share access expired: %s %s/%s", r.RemoteAddr, root, relPath)
+		http.Error(w, "link expired", http.StatusGone)
+		return
+	}
+	rootDir, rootErr := self.roots(root)
+	if rootErr != nil {
+		l4g.Error("Share root %s error: %v", root, rootErr)
+		http.NotFound(w, r)
+		return
+	}
+	filePath := filepath.Join(rootDir, filepath.FromSlash(relPath))
+	if !IsInDir(rootDir, filePath) {
+		l4g.Warn("Share access out of root: %s %s", r.RemoteAddr, filePath)
+		http.NotFound(w, r)
+		return
+	}
+	f, openErr := os.Open(filePath)
+	if openErr != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, statErr := f.Stat()
+	if statErr != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	l4g.Info("Share access: %s %s, range: %s, agent: %s", r.RemoteAddr, filePath, r.Header.Get("Range"), r.UserAgent())
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
@@ -0,0 +1,104 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareServer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "shareserver")
+	defer os.RemoveAll(dir)
+	roots := func(name string) (string, error) {
+		if name != "pi" {
+			return "", errors.New("unknown root")
+		}
+		return dir, nil
+	}
+	if _, err := NewShareServer("127.0.0.1:18090", "", "", roots); err == nil {
+		t.Fatal("secret should be required")
+	}
+	server, err := NewShareServer("127.0.0.1:18090", "", "secret", roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if startErr := server.Start(); startErr != nil {
+		t.Fatal(startErr)
+	}
+	defer server.Stop()
+
+	filePath := filepath.Join(dir, "电影 1.mp4")
+	ioutil.WriteFile(filePath, []byte("0123456789"), 0644)
+	link, shareErr := server.Share("pi", "电影 1.mp4", time.Hour)
+	if shareErr != nil {
+		t.Fatal(shareErr)
+	}
+	if !strings.HasPrefix(link, "http://127.0.0.1:18090/share/pi/") || strings.Contains(link, "shareserver") {
+		t.Fatalf("unexpected link: %s", link)
+	}
+	req, _ := http.NewRequest("GET", link, nil)
+	req.Header.Set("Range", "bytes=2-5")
+	resp, getErr := http.DefaultClient.Do(req)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "2345" {
+		t.Fatal("unexpected response:", resp.Status, string(body))
+	}
+
+	// the other file can not be accessed by the token
+	otherPath := filepath.Join(dir, "other.txt")
+	ioutil.WriteFile(otherPath, []byte("secret"), 0644)
+	tampered := strings.Replace(link, "%E7%94%B5%E5%BD%B1%201.mp4", "other.txt", -1)
+	if tampered == link {
+		t.Fatal("the link is not tampered: " + link)
+	}
+	if resp, _ := http.Get(tampered); resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("tampered link should be rejected")
+	}
+
+	// the path out of root is rejected even if it is signed
+	outsideDir, _ := ioutil.TempDir("", "outside")
+	defer os.RemoveAll(outsideDir)
+	ioutil.WriteFile(filepath.Join(outsideDir, "passwd"), []byte("secret"), 0644)
+	relPath := "../" + filepath.Base(outsideDir) + "/passwd"
+	if _, err := server.Share("pi", relPath, time.Hour); err == nil {
+		t.Fatal("the path out of root should not be shared")
+	}
+	forged := fmt.Sprintf("http://127.0.0.1:18090/share/pi/%s?expires=%d&token=%s", relPath,
+		time.Now().Add(time.Hour).Unix(), server.sign("pi", relPath, time.Now().Add(time.Hour).Unix()))
+	if resp, _ := http.Get(forged); resp == nil || resp.StatusCode == http.StatusOK {
+		t.Fatal("the path out of root should be rejected")
+	}
+
+	expiredLink, _ := server.Share("pi", "电影 1.mp4", -time.Minute)
+	if resp, _ := http.Get(expiredLink); resp == nil || resp.StatusCode != http.StatusGone {
+		t.Fatal("expired link should be rejected")
+	}
+}
+
+func TestIsInDir(t *testing.T) {
+	for _, c := range []struct {
+		dir, path string
+		in        bool
+	}{
+		{"/data/download", "/data/download/a.mkv", true},
+		{"/data/download/", "/data/download/movie/a.mkv", true},
+		{"/data/download", "/data/download/../passwd", false},
+		{"/data/download", "/data/downloads/a.mkv", false},
+		{"/data/download", "/data/download", false},
+		{"", "/data/download/a.mkv", false},
+	} {
+		if IsInDir(c.dir, c.path) != c.in {
+			t.Errorf("IsInDir(%q, %q) should be %v", c.dir, c.path, c.in)
+		}
+	}
+}
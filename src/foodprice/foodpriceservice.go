@@ -4,11 +4,11 @@ import (
 	"bytes"
 	l4g "code.google.com/p/log4go"
 	"encoding/json"
+	"entityresolver"
 	"errors"
 	"fmt"
 	"github.com/robfig/cron"
 	"service"
-	"strings"
 	"time"
 )
 
@@ -33,6 +33,8 @@ type FoodPriceService struct {
 	dbHelper          *FoodPriceDbHelper
 	cityCNNameMap     map[string]string
 	districtCNNameMap map[string]string
+	cityResolver      *entityresolver.EntityResolver
+	districtResolver  *entityresolver.EntityResolver
 	started           bool
 }
 
@@ -106,6 +108,14 @@ func (self *FoodPriceService) Init(configRawMsg *json.RawMessage, pushCh chan<-
 		"奉贤": "fengxian",
 		"崇明": "chongming",
 	}
+	self.cityResolver = entityresolver.NewEntityResolver("市")
+	for cn, code := range self.cityCNNameMap {
+		self.cityResolver.Add(code, code, cn)
+	}
+	self.districtResolver = entityresolver.NewEntityResolver("区", "县")
+	for cn, code := range self.districtCNNameMap {
+		self.districtResolver.Add(code, code, cn)
+	}
 	return nil
 }
 
@@ -117,28 +127,16 @@ func (self *FoodPriceService) CommandFilter(command string, args []string) bool
 	if _, ok := self.commandMap[command]; ok {
 		return true
 	}
-	return self.isStatmentCommand(command)
-}
-
-const (
-	StatementCommandSuffix1 = "的菜价"
-	StatementCommandSuffix2 = "菜价"
-)
-
-func (self *FoodPriceService) isStatmentCommand(command string) bool {
-	return strings.HasSuffix(command, StatementCommandSuffix1) ||
-		strings.HasSuffix(command, StatementCommandSuffix2)
+	return false
 }
 
-func (self *FoodPriceService) parseStatementCommand(stmtCmd string, args []string) (string, []string) {
-	if strings.HasSuffix(stmtCmd, StatementCommandSuffix1) {
-		cityOrDistrict := stmtCmd[0:strings.Index(stmtCmd, StatementCommandSuffix1)]
-		return "foodprice", []string{cityOrDistrict}
-	} else if strings.HasSuffix(stmtCmd, StatementCommandSuffix2) {
-		cityOrDistrict := stmtCmd[0:strings.Index(stmtCmd, StatementCommandSuffix2)]
-		return "foodprice", []string{cityOrDistrict}
+func (self *FoodPriceService) GetVoicePhrases() []service.VoicePhrase {
+	return []service.VoicePhrase{
+		{Phrases: []string{"{district}的菜价", "{district}菜价", "{district}的菜价多少", "{district}菜价怎么样"},
+			Command: "foodprice", Args: []string{"{district}"}},
+		{Phrases: []string{"订阅{district}的菜价", "订阅{district}菜价"}, Command: "subprice", Args: []string{"{district}"}},
+		{Phrases: []string{"退订{district}的菜价", "退订{district}菜价", "取消订阅{district}的菜价"}, Command: "unsubprice", Args: []string{"{district}"}},
 	}
-	return stmtCmd, args
 }
 
 func (self *FoodPriceService) GetHelpMessage() string {
@@ -168,19 +166,17 @@ func (self *FoodPriceService) Stop() error {
 
 func (self *FoodPriceService) Handle(username, command string, args []string) (string, error) {
 	realCommand := command
-	realargs := args
 	comm := self.aliasCommandMap[realCommand]
 	if len(comm) > 0 {
 		realCommand = comm
 	}
 
-	realCommand, realargs = self.parseStatementCommand(realCommand, realargs)
-	l4g.Debug("realCommand, readargs: %s, %s", realCommand, realargs)
+	l4g.Debug("realCommand, args: %s, %s", realCommand, args)
 	f := self.commandMap[realCommand]
 	if f == nil {
 		return "", errors.New("命令错误！请输入\"help\"查询命令！")
 	}
-	return f(self, username, realargs)
+	return f(self, username, args)
 }
 
 func (self *FoodPriceService) getFoodPrice(username string, args []string) (string, error) {
@@ -211,23 +207,13 @@ func (self *FoodPriceService) getFoodPrice(username string, args []string) (stri
 }
 
 func (self *FoodPriceService) getCityCode(cityOrDistrict string) string {
-	for cn, code := range self.cityCNNameMap {
-		if cn == cityOrDistrict ||
-			code == cityOrDistrict {
-			return code
-		}
-	}
-	return ""
+	code, _ := self.cityResolver.Resolve(cityOrDistrict)
+	return code
 }
 
 func (self *FoodPriceService) getDistrictCode(cityOrDistrict string) string {
-	for cn, code := range self.districtCNNameMap {
-		if cn == cityOrDistrict ||
-			code == cityOrDistrict {
-			return code
-		}
-	}
-	return ""
+	code, _ := self.districtResolver.Resolve(cityOrDistrict)
+	return code
 }
 
 func (self *FoodPriceService) getCityOrDistrictCode(cityOrDistrict string) string {
@@ -9,7 +9,7 @@ import (
 	"github.com/robfig/cron"
 	"service"
 	"sort"
-	"strconv"
+	"sync"
 	"time"
 )
 
@@ -17,21 +17,6 @@ const (
 	LOGISTICS_UPDATE_TIMEOUT = 2 * 24 * 60 * 60
 )
 
-var companyMap = map[string]string{
-	"申通":  "shentong",
-	"EMS": "ems",
-	"顺丰":  "shunfeng",
-	"圆通":  "yuantong",
-	"中通":  "zhongtong",
-	"如风达": "rufengda",
-	"韵达":  "yunda",
-	"天天":  "tiantian",
-	"汇通":  "huitongkuaidi",
-	"全峰":  "quanfengkuaidi",
-	"德邦":  "debangwuliu",
-	"宅急送": "zhaijisong",
-}
-
 type byTime []LogisticsRecordEntity
 
 func (s byTime) Len() int {
@@ -49,12 +34,15 @@ func (s byTime) Less(i, j int) bool {
 type processFunc func(*LogisticsService, string, []string) (string, error)
 
 var commandHelp = map[string]string{
-	"跟踪快递": "订阅某条快递信息，命令格式:跟踪快递 快递名称 物流公司(或代码) 物流单号",
-	"取消快递": "取消订阅某条快递, 命令格式:取消快递 物流公司(或代码) 物流单号 或 取消快递 快递名",
-	"查询快递": "查询某条快递配送进度，在查询前不需要添加跟踪该快递，该物流单号命令格式: 查询快递 物流公司(或代码) 物流单号 或 查询快递 快递名",
-	"快递记录": "查询最近完成的物流单",
-	"我的快递": "查询已跟踪订阅的所有在途快递",
-	"物流公司": "查询支持的物流公司",
+	"跟踪快递":     "订阅某条快递信息，命令格式:跟踪快递 快递名称 物流公司(或代码) 物流单号，省略物流公司时根据单号自动识别",
+	"取消快递":     "取消订阅某条快递, 命令格式:取消快递 物流公司(或代码) 物流单号 或 取消快递 快递名",
+	"查询快递":     "查询某条快递配送进度，在查询前不需要添加跟踪该快递，该物流单号命令格式: 查询快递 物流公司(或代码) 物流单号 或 查询快递 快递名",
+	"快递记录":     "查询最近完成的物流单",
+	"我的快递":     "查询已跟踪订阅的所有在途快递",
+	"物流公司":     "查询支持的物流公司",
+	"addcom":   "添加或修改物流公司(仅限管理员)，命令格式: addcom 公司代码 公司名称 [别名1,别名2]",
+	"aliascom": "添加物流公司的别名(仅限管理员)，命令格式: aliascom 公司代码(或名称) 别名1 [别名2]",
+	"csv文件":    "发送csv文件批量跟踪快递，每行格式:快递名称,物流公司,物流单号，物流公司可省略",
 }
 
 type logisticsTrackingInfo struct {
@@ -67,6 +55,13 @@ type config struct {
 	DbFile              string `json:"dbFile,omitempty"`
 	BeforeLastUpdate    int64  `json:"beforeLastUpdate,omitempty"`
 	LogisticsUpdateCron string `json:"logisticsUpdateCron,omitempty"`
+	// the providers are queried by priority, kuaidi100web is used if not given
+	Providers         []*providerConfig `json:"providers,omitempty"`
+	ProviderMaxErrors int               `json:"providerMaxErrors,omitempty"` // switch provider after continuous errors
+	ProviderCooldown  int64             `json:"providerCooldown,omitempty"`  // seconds before the failed provider is used again
+	// detect the company of tracking number by the autocomplete of providers too
+	ProviderAutocomplete bool     `json:"providerAutocomplete,omitempty"`
+	Admins               []string `json:"admins,omitempty"` // the users who can edit the companies
 }
 
 type LogisticsService struct {
@@ -76,6 +71,11 @@ type LogisticsService struct {
 	config          *config
 	pushMsgChannel  chan<- *service.PushMessage
 	cron            *cron.Cron
+	registry        *companyRegistry
+	registryLock    sync.RWMutex
+	providers       *providerChain
+	choices         *choiceStore
+	lastStatus      string
 	started         bool
 }
 
@@ -102,10 +102,20 @@ func (self *LogisticsService) Init(configRawMsg *json.RawMessage, pushCh chan<-
 	l4g.Debug("Open logistics DB successful: %s", c.DbFile)
 	self.logisticsdb = db
 	self.config = &c
+	providers, providerErr := newProviderChain(c.Providers, c.ProviderMaxErrors, c.ProviderCooldown)
+	if providerErr != nil {
+		return providerErr
+	}
+	self.providers = providers
+	self.choices = newChoiceStore()
+	if loadErr := self.loadCompanies(); loadErr != nil {
+		return loadErr
+	}
 	self.pushMsgChannel = pushCh
 	self.cron = cron.New()
 	self.cron.AddFunc(c.LogisticsUpdateCron, func() {
 		self.updateAndNotifyChangedLogistics()
+		self.pushLogisticsStatus()
 	})
 	self.commandMap = map[string]processFunc{
 		"sublogi":        (*LogisticsService).subLogi,
@@ -114,7 +124,10 @@ func (self *LogisticsService) Init(configRawMsg *json.RawMessage, pushCh chan<-
 		"getrecentsub":   (*LogisticsService).getRecentSubs,
 		"getcurrentlogi": (*LogisticsService).getCurrentLogi,
 		"getcom":         (*LogisticsService).getCompany,
+		"addcom":         (*LogisticsService).addCompany,
+		"aliascom":       (*LogisticsService).aliasCompany,
 		"resetstate":     (*LogisticsService).resetState,
+		"file":           (*LogisticsService).handleFile,
 	}
 	self.aliasCommandMap = map[string]string{
 		"跟踪快递": "sublogi",
@@ -153,6 +166,9 @@ func (self *LogisticsService) GetHelpMessage() string {
 }
 
 func (self *LogisticsService) CommandFilter(command string, args []string) bool {
+	if command == service.FileCommand {
+		return false // file is dispatched by GetFileFilter
+	}
 	if _, ok := self.aliasCommandMap[command]; ok {
 		return true
 	}
@@ -163,6 +179,22 @@ func (self *LogisticsService) CommandFilter(command string, args []string) bool
 	return false
 }
 
+func (self *LogisticsService) GetFileFilter() *service.FileFilter {
+	return &service.FileFilter{
+		Extensions: []string{".csv"},
+		MimeTypes:  []string{"text/csv"},
+	}
+}
+
+func (self *LogisticsService) GetVoicePhrases() []service.VoicePhrase {
+	return []service.VoicePhrase{
+		{Phrases: []string{"我的快递", "我的快递到哪了", "快递到哪了"}, Command: "getcurrentlogi"},
+		{Phrases: []string{"{name}的快递到哪了", "{name}到哪了", "查询快递{name}"}, Command: "getlogi", Args: []string{"{name}"}},
+		{Phrases: []string{"快递记录", "最近的快递"}, Command: "getrecentsub"},
+		{Phrases: []string{"物流公司", "支持哪些快递"}, Command: "getcom"},
+	}
+}
+
 func (self *LogisticsService) Handle(username, command string, args []string) (string, error) {
 	comm := self.aliasCommandMap[command]
 	if comm == "" || len(comm) == 0 {
@@ -177,17 +209,36 @@ func (self *LogisticsService) Handle(username, command string, args []string) (s
 }
 
 func (self *LogisticsService) subLogi(username string, args []string) (string, error) {
-	if len(args) != 3 {
+	var logisticsName, company, logisticsId string
+	switch len(args) {
+	case 3:
+		logisticsName = args[0]
+		logisticsId = args[2]
+		var check bool
+		company, check = self.checkCompany(args[1])
+		if !check {
+			return "", errors.New("错误的公司名称或代码!")
+		}
+	case 2:
+		// the answer of company choice, or the tracking number without company
+		logisticsName = args[0]
+		var chosen bool
+		company, logisticsId, chosen = self.chooseCompany(username, logisticsName, args[1])
+		if !chosen {
+			logisticsId = args[1]
+			detected, candidates, detectErr := self.detectCompany(logisticsId)
+			if detectErr != nil {
+				return "", detectErr
+			}
+			if detected == "" {
+				self.choices.put(username, logisticsName, &companyChoice{logisticsId: logisticsId, candidates: candidates})
+				return formatChoicePrompt(self.getRegistry(), logisticsName, logisticsId, candidates), nil
+			}
+			company = detected
+		}
+	default:
 		return "", errors.New("缺少参数！")
 	}
-	logisticsName := args[0]
-	com := args[1]
-	logisticsId := args[2]
-
-	company, check := self.checkCompany(com)
-	if !check {
-		return "", errors.New("错误的公司名称或代码!")
-	}
 	if err := self.SubscribeLogistics(username, logisticsId, company, logisticsName); err != nil {
 		return "", err
 	}
@@ -201,12 +252,7 @@ func (self *LogisticsService) subLogi(username string, args []string) (string, e
 }
 
 func (self *LogisticsService) checkCompany(company string) (string, bool) {
-	for key, value := range companyMap {
-		if company == key || company == value {
-			return value, true
-		}
-	}
-	return "", false
+	return self.getRegistry().resolve(company)
 }
 
 func (self *LogisticsService) unsubLogi(username string, args []string) (string, error) {
@@ -319,15 +365,6 @@ func (self *LogisticsService) getCurrentLogi(username string, args []string) (st
 	return buffer.String(), nil
 }
 
-func (self *LogisticsService) getCompany(username string, args []string) (string, error) {
-	var buffer bytes.Buffer
-	buffer.WriteString("\n")
-	for company, comCode := range companyMap {
-		buffer.WriteString(fmt.Sprintf("公司名称[%s] ===> 公司代码[%s]\n", company, comCode))
-	}
-	return buffer.String(), nil
-}
-
 func (self *LogisticsService) formatLogiOutput(records []LogisticsRecordEntity) string {
 	if len(records) == 0 {
 		return "无记录"
@@ -509,14 +546,46 @@ func (self *LogisticsService) updateAndNotifyChangedLogistics() {
 	}
 }
 
+// pushLogisticsStatus shows the count of delivering logistics and the time of latest record in status,
+// the details are not shown because the status is visible to all contacts
+func (self *LogisticsService) pushLogisticsStatus() {
+	entities, err := self.logisticsdb.GetDeliveringLogisticsInfos()
+	if err != nil {
+		l4g.Error("GetDeliveringLogisticsInfos error: %v", err)
+		return
+	}
+	status := ""
+	if len(entities) > 0 {
+		var latest int64 = 0
+		for _, entity := range entities {
+			if entity.LastUpdateTime > latest {
+				latest = entity.LastUpdateTime
+			}
+		}
+		status = fmt.Sprintf("快递: %d件在途", len(entities))
+		if latest > 0 {
+			status += "，最新动态 " + time.Unix(latest, 0).Format("01-02 15:04")
+		}
+	}
+	if status == self.lastStatus {
+		return
+	}
+	self.lastStatus = status
+	pushMsg := &service.PushMessage{}
+	pushMsg.Type = service.Status
+	pushMsg.Source = self.GetServiceId()
+	pushMsg.Message = status
+	self.pushMsgChannel <- pushMsg
+}
+
 // return new record
 func (self *LogisticsService) updateLogisticsProgress(lEntity *LogisticsInfoEntity) ([]LogisticsRecordEntity, error) {
-	logisticsInfo, queryErr := Query(lEntity.Company, lEntity.LogisticsId)
+	logisticsInfo, queryErr := self.providers.Query(lEntity.Company, lEntity.LogisticsId)
 	if queryErr != nil {
 		return []LogisticsRecordEntity{}, queryErr
 	}
 
-	if logisticsInfo.Status != "200" {
+	if !logisticsInfo.Found {
 		if (time.Now().Unix() - lEntity.CrtDate) > LOGISTICS_UPDATE_TIMEOUT {
 			// timeout, make state = 701:error, don't update again
 			lEntity.State = 701
@@ -533,15 +602,8 @@ func (self *LogisticsService) updateLogisticsProgress(lEntity *LogisticsInfoEnti
 	lastUpdateTime := lEntity.LastUpdateTime
 	var latestRecTime int64 = lastUpdateTime
 	var records []LogisticsRecordEntity
-	for _, rec := range logisticsInfo.Data {
-		recTime, parseErr := time.Parse("2006-01-02 15:04:05", rec.Time)
-		if parseErr != nil {
-			return []LogisticsRecordEntity{}, parseErr
-		}
-		localT := time.Date(recTime.Year(), recTime.Month(), recTime.Day(),
-			recTime.Hour(), recTime.Minute(), recTime.Second(), recTime.Nanosecond(),
-			time.Local)
-		rT := localT.Unix()
+	for _, rec := range logisticsInfo.Events {
+		rT := rec.Time
 		if rT > lastUpdateTime {
 			recEntity := &LogisticsRecordEntity{
 				LogisticsInfoEntityId: lEntity.Id,
@@ -557,8 +619,7 @@ func (self *LogisticsService) updateLogisticsProgress(lEntity *LogisticsInfoEnti
 			}
 		}
 	}
-	s, _ := strconv.Atoi(logisticsInfo.State)
-	lEntity.State = s
+	lEntity.State = int(logisticsInfo.State)
 	lEntity.LastUpdateTime = latestRecTime
 	updateErr := self.logisticsdb.SaveLogisticsInfo(lEntity)
 	if updateErr != nil {
@@ -598,23 +659,18 @@ func (self *LogisticsService) GetCurrentLogistics(logisticsId, company string) (
 		return records, nil
 	}
 
-	logisticsInfo, queryErr := Query(company, logisticsId)
+	logisticsInfo, queryErr := self.providers.Query(company, logisticsId)
 	if queryErr != nil {
 		return []LogisticsRecordEntity{}, queryErr
 	}
-	if logisticsInfo.Status != "200" {
+	if !logisticsInfo.Found {
 		return []LogisticsRecordEntity{}, errors.New("物流查询错误: " + logisticsInfo.Message)
 	}
 	var records []LogisticsRecordEntity
-	for _, rec := range logisticsInfo.Data {
-		recTime, _ := time.Parse("2006-01-02 15:04:05", rec.Time)
-		localT := time.Date(recTime.Year(), recTime.Month(), recTime.Day(),
-			recTime.Hour(), recTime.Minute(), recTime.Second(), recTime.Nanosecond(),
-			time.Local)
-		rT := localT.Unix()
+	for _, rec := range logisticsInfo.Events {
 		recEntity := LogisticsRecordEntity{
 			Context: rec.Context,
-			Time:    rT}
+			Time:    rec.Time}
 		records = append(records, recEntity)
 	}
 	sort.Sort(byTime(records))
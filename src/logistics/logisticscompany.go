@@ -0,0 +1,357 @@
+package logistics
+
+import (
+	"bytes"
+	l4g "code.google.com/p/log4go"
+	"encoding/json"
+	"entityresolver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const companyMigration = "dbscript/v0.9/logistics_company.sql"
+
+var checkFuncs = map[string]func(string) bool{
+	"s10": checkS10,
+}
+
+type patternConfig struct {
+	Regex string `json:"regex"`
+	Score int    `json:"score,omitempty"`
+	Check string `json:"check,omitempty"` // the name of check digit function, like s10
+}
+
+type logisticsCompany struct {
+	code          string
+	name          string
+	aliases       []string
+	providerCodes map[string]string // provider name -> code
+	patterns      []*numberPattern
+	active        bool
+}
+
+func newLogisticsCompany(entity *LogisticsCompanyEntity) (*logisticsCompany, error) {
+	company := &logisticsCompany{
+		code:          entity.Code,
+		name:          entity.Name,
+		aliases:       splitAliases(entity.Aliases),
+		providerCodes: make(map[string]string),
+		active:        entity.Active == 1,
+	}
+	if entity.ProviderCodes != "" {
+		if err := json.Unmarshal([]byte(entity.ProviderCodes), &company.providerCodes); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid provider codes of %s: %v", entity.Code, err))
+		}
+	}
+	if entity.NumberPatterns != "" {
+		var patterns []*patternConfig
+		if err := json.Unmarshal([]byte(entity.NumberPatterns), &patterns); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid number patterns of %s: %v", entity.Code, err))
+		}
+		for _, p := range patterns {
+			regex, compileErr := regexp.Compile(p.Regex)
+			if compileErr != nil {
+				return nil, errors.New(fmt.Sprintf("invalid number pattern of %s: %v", entity.Code, compileErr))
+			}
+			pattern := &numberPattern{company: entity.Code, regex: regex, score: p.Score}
+			if pattern.score <= 0 {
+				pattern.score = scoreLength
+			}
+			if p.Check != "" {
+				if pattern.check = checkFuncs[p.Check]; pattern.check == nil {
+					return nil, errors.New(fmt.Sprintf("unknown check of %s: %s", entity.Code, p.Check))
+				}
+			}
+			company.patterns = append(company.patterns, pattern)
+		}
+	}
+	return company, nil
+}
+
+func splitAliases(aliases string) []string {
+	list := make([]string, 0)
+	for _, alias := range strings.Split(aliases, ",") {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			list = append(list, alias)
+		}
+	}
+	return list
+}
+
+// companyRegistry is the logistics companies loaded from db, the inactive companies
+// are only used to show the name of the old logistics
+type companyRegistry struct {
+	companies []*logisticsCompany // in the order of id
+	resolver  *entityresolver.EntityResolver
+	mutex     sync.RWMutex
+}
+
+func newCompanyRegistry(entities []LogisticsCompanyEntity) (*companyRegistry, error) {
+	registry := &companyRegistry{}
+	registry.resolver = entityresolver.NewEntityResolver("快递", "速递", "物流")
+	for i := range entities {
+		company, err := newLogisticsCompany(&entities[i])
+		if err != nil {
+			return nil, err
+		}
+		registry.companies = append(registry.companies, company)
+		if company.active {
+			names := append([]string{company.code, company.name}, company.aliases...)
+			registry.resolver.Add(company.code, names...)
+		}
+	}
+	return registry, nil
+}
+
+func (self *companyRegistry) get(code string) *logisticsCompany {
+	for _, company := range self.companies {
+		if company.code == code {
+			return company
+		}
+	}
+	return nil
+}
+
+// resolve returns the code of active company by code, name or alias case-insensitively,
+// the name with suffix or similar pinyin is resolved too
+func (self *companyRegistry) resolve(name string) (string, bool) {
+	lowerName := strings.ToLower(strings.TrimSpace(name))
+	for _, company := range self.companies {
+		if !company.active {
+			continue
+		}
+		if strings.ToLower(company.code) == lowerName || strings.ToLower(company.name) == lowerName {
+			return company.code, true
+		}
+		for _, alias := range company.aliases {
+			if strings.ToLower(alias) == lowerName {
+				return company.code, true
+			}
+		}
+	}
+	return self.resolver.Resolve(name)
+}
+
+func (self *companyRegistry) getName(code string) string {
+	if company := self.get(code); company != nil && company.name != "" {
+		return company.name
+	}
+	return code
+}
+
+func (self *companyRegistry) getPatterns() []*numberPattern {
+	patterns := make([]*numberPattern, 0)
+	for _, company := range self.companies {
+		if company.active {
+			patterns = append(patterns, company.patterns...)
+		}
+	}
+	return patterns
+}
+
+// providerCode returns the code of company used by provider
+func (self *companyRegistry) providerCode(provider, code string) string {
+	if company := self.get(code); company != nil {
+		if providerCode, ok := company.providerCodes[provider]; ok {
+			return providerCode
+		}
+	}
+	return code
+}
+
+// companyByProviderCode returns the company of the code used by provider
+func (self *companyRegistry) companyByProviderCode(provider, providerCode string) string {
+	for _, company := range self.companies {
+		if code, ok := company.providerCodes[provider]; ok && code == providerCode {
+			return company.code
+		}
+	}
+	return providerCode
+}
+
+// isMissingTable checks whether the error is caused by the missing table of sqlite
+func isMissingTable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such table")
+}
+
+// loadCompanies loads the companies from db, the table is created and seeded by companyMigration
+func (self *LogisticsService) loadCompanies() error {
+	entities, err := self.logisticsdb.GetLogisticsCompanies()
+	if isMissingTable(err) {
+		return errors.New(fmt.Sprintf("the table of logistics company is missing, please run %s", companyMigration))
+	}
+	if err != nil {
+		return err
+	}
+	if len(entities) == 0 {
+		l4g.Error("No logistics company in db, please run %s", companyMigration)
+	}
+	registry, registryErr := newCompanyRegistry(entities)
+	if registryErr != nil {
+		return registryErr
+	}
+	self.setRegistry(registry)
+	return nil
+}
+
+// saveCompany saves the company and reloads the companies
+func (self *LogisticsService) saveCompany(entity *LogisticsCompanyEntity) error {
+	if err := self.logisticsdb.SaveLogisticsCompany(entity); err != nil {
+		return err
+	}
+	return self.loadCompanies()
+}
+
+func (self *LogisticsService) setRegistry(registry *companyRegistry) {
+	self.registryLock.Lock()
+	self.registry = registry
+	self.registryLock.Unlock()
+	self.providers.setCodeMapper(registry)
+}
+
+func (self *LogisticsService) getRegistry() *companyRegistry {
+	self.registryLock.RLock()
+	defer self.registryLock.RUnlock()
+	return self.registry
+}
+
+func (self *LogisticsService) isAdmin(username string) bool {
+	for _, admin := range self.config.Admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// addCompany adds or updates the company, args: code name [alias1,alias2]
+func (self *LogisticsService) addCompany(username string, args []string) (string, error) {
+	if !self.isAdmin(username) {
+		return "", errors.New("权限不足！")
+	}
+	if len(args) < 2 || len(args) > 3 {
+		return "", errors.New("参数错误！命令格式: addcom 公司代码 公司名称 [别名1,别名2]")
+	}
+	code := strings.ToLower(args[0])
+	if company := self.getRegistry().findByName(code, code); company != nil {
+		return "", errors.New(fmt.Sprintf("公司代码[%s]已被[%s]使用！", code, company.name))
+	}
+	entity, err := self.logisticsdb.GetLogisticsCompany(code)
+	if err != nil {
+		return "", err
+	}
+	if entity == nil {
+		entity = &LogisticsCompanyEntity{Code: code}
+	}
+	entity.Name = args[1]
+	entity.Active = 1
+	aliases := splitAliases(entity.Aliases)
+	if len(args) == 3 {
+		aliases = mergeAliases(aliases, splitAliases(args[2]))
+	}
+	if checkErr := self.checkAliases(code, append([]string{args[1]}, aliases...)); checkErr != nil {
+		return "", checkErr
+	}
+	entity.Aliases = strings.Join(aliases, ",")
+	if saveErr := self.saveCompany(entity); saveErr != nil {
+		return "", saveErr
+	}
+	return "添加成功！", nil
+}
+
+// aliasCompany adds the aliases of company, args: company alias1 [alias2...]
+func (self *LogisticsService) aliasCompany(username string, args []string) (string, error) {
+	if !self.isAdmin(username) {
+		return "", errors.New("权限不足！")
+	}
+	if len(args) < 2 {
+		return "", errors.New("参数错误！命令格式: aliascom 公司代码(或名称) 别名1 [别名2]")
+	}
+	code, check := self.checkCompany(args[0])
+	if !check {
+		return "", errors.New("错误的公司名称或代码!")
+	}
+	entity, err := self.logisticsdb.GetLogisticsCompany(code)
+	if err != nil {
+		return "", err
+	}
+	if entity == nil {
+		return "", errors.New("错误的公司名称或代码!")
+	}
+	var newAliases []string
+	for _, arg := range args[1:] {
+		newAliases = append(newAliases, splitAliases(arg)...)
+	}
+	if checkErr := self.checkAliases(code, newAliases); checkErr != nil {
+		return "", checkErr
+	}
+	entity.Aliases = strings.Join(mergeAliases(splitAliases(entity.Aliases), newAliases), ",")
+	if saveErr := self.saveCompany(entity); saveErr != nil {
+		return "", saveErr
+	}
+	return "OK", nil
+}
+
+// findByName returns the active company except the code whose code, name or alias is the name case-insensitively
+func (self *companyRegistry) findByName(exceptCode, name string) *logisticsCompany {
+	lowerName := strings.ToLower(name)
+	for _, company := range self.companies {
+		if company.code == exceptCode || !company.active {
+			continue
+		}
+		names := append([]string{company.code, company.name}, company.aliases...)
+		for _, n := range names {
+			if strings.ToLower(n) == lowerName {
+				return company
+			}
+		}
+	}
+	return nil
+}
+
+// checkAliases returns error if the alias is used by other company
+func (self *LogisticsService) checkAliases(code string, aliases []string) error {
+	registry := self.getRegistry()
+	for _, alias := range aliases {
+		if company := registry.findByName(code, alias); company != nil {
+			return errors.New(fmt.Sprintf("别名[%s]已被[%s]使用！", alias, company.name))
+		}
+	}
+	return nil
+}
+
+// mergeAliases appends the new aliases which are not in the list case-insensitively
+func mergeAliases(aliases, newAliases []string) []string {
+	for _, alias := range newAliases {
+		exists := false
+		for _, old := range aliases {
+			if strings.ToLower(old) == strings.ToLower(alias) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases
+}
+
+func (self *LogisticsService) getCompany(username string, args []string) (string, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("\n")
+	for _, company := range self.getRegistry().companies {
+		if !company.active {
+			continue
+		}
+		buffer.WriteString(fmt.Sprintf("公司名称[%s] ===> 公司代码[%s]", company.name, company.code))
+		if len(company.aliases) > 0 {
+			buffer.WriteString(fmt.Sprintf(" 别名[%s]", strings.Join(company.aliases, ",")))
+		}
+		buffer.WriteString("\n")
+	}
+	return buffer.String(), nil
+}
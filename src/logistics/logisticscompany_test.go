@@ -0,0 +1,157 @@
+package logistics
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var insertRegexp = regexp.MustCompile(`^insert into logistics_company_entity \(code, name, aliases, provider_codes, number_patterns, active\) values \('(.*)', '(.*)', '(.*)', '(.*)', '(.*)', (\d)\);$`)
+
+// loadScriptCompanies reads the companies seeded by companyMigration
+func loadScriptCompanies(t *testing.T) []LogisticsCompanyEntity {
+	file, err := os.Open(filepath.Join("..", "..", companyMigration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	companies := make([]LogisticsCompanyEntity, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := insertRegexp.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if fields == nil {
+			continue
+		}
+		active, _ := strconv.Atoi(fields[6])
+		companies = append(companies, LogisticsCompanyEntity{Id: len(companies) + 1, Code: fields[1], Name: fields[2],
+			Aliases: fields[3], ProviderCodes: fields[4], NumberPatterns: fields[5], Active: active})
+	}
+	if len(companies) == 0 {
+		t.Fatal("no company in", companyMigration)
+	}
+	return companies
+}
+
+func newTestRegistry(t *testing.T) *companyRegistry {
+	registry, err := newCompanyRegistry(loadScriptCompanies(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestCompanyRegistry(t *testing.T) {
+	entities := loadScriptCompanies(t)
+	entities = append(entities, LogisticsCompanyEntity{Id: len(entities) + 1, Code: "jd", Name: "京东", Aliases: "JDL,京东物流",
+		ProviderCodes: `{"kuaidi100api":"jingdong"}`, NumberPatterns: `[{"regex":"^JD\\d{13}$","score":80}]`, Active: 0})
+	registry, err := newCompanyRegistry(entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{"顺丰", "shunfeng"},
+		{"sf", "shunfeng"},
+		{"SHUNFENG", "shunfeng"},
+		{"顺丰速运", "shunfeng"},
+		{"sto", "shentong"},
+		{"百世", "huitongkuaidi"},
+		{"韵达快递", "yunda"},
+	}
+	for _, c := range cases {
+		if code, ok := registry.resolve(c.name); !ok || code != c.expected {
+			t.Errorf("unexpected company of %s: %s", c.name, code)
+		}
+	}
+	// the inactive company is not resolved or detected, but its name is kept for the old logistics
+	if code, ok := registry.resolve("jdl"); ok {
+		t.Error("the inactive company should not be resolved:", code)
+	}
+	if candidates := detectCompanies(registry.getPatterns(), "JD1234567890123", nil); len(candidates) != 0 {
+		t.Error("the inactive company should not be detected:", candidates)
+	}
+	if name := registry.getName("jd"); name != "京东" {
+		t.Error("unexpected name:", name)
+	}
+	if code := registry.providerCode("kuaidi100api", "jd"); code != "jingdong" {
+		t.Error("unexpected provider code:", code)
+	}
+	if code := registry.providerCode("kuaidi100web", "jd"); code != "jd" {
+		t.Error("unexpected provider code:", code)
+	}
+	if company := registry.companyByProviderCode("kuaidi100api", "jingdong"); company != "jd" {
+		t.Error("unexpected company:", company)
+	}
+	if _, err := newCompanyRegistry([]LogisticsCompanyEntity{{Code: "bad", NumberPatterns: `[{"regex":"^[0-9","score":30}]`}}); err == nil {
+		t.Error("the invalid pattern should fail")
+	}
+	if _, err := newCompanyRegistry([]LogisticsCompanyEntity{{Code: "bad", NumberPatterns: `[{"regex":"^\\d{10}$","check":"luhn"}]`}}); err == nil {
+		t.Error("the unknown check should fail")
+	}
+}
+
+func TestMergeAliases(t *testing.T) {
+	aliases := mergeAliases([]string{"SF", "顺丰速运"}, []string{"sf", "顺丰快递"})
+	if len(aliases) != 3 || aliases[2] != "顺丰快递" {
+		t.Error("unexpected aliases:", aliases)
+	}
+}
+
+func TestAddCompanyCodeCollision(t *testing.T) {
+	service := &LogisticsService{config: &config{Admins: []string{"admin"}}, registry: newTestRegistry(t)}
+	// the code is checked before the db is used
+	for _, code := range []string{"sf", "STO", "百世"} {
+		if _, err := service.addCompany("admin", []string{code, "新公司"}); err == nil {
+			t.Errorf("the code %s used by other company should be rejected", code)
+		}
+	}
+}
+
+func TestLoadCompanies(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logistics")
+	defer os.RemoveAll(dir)
+	db, err := NewLogisticsDb(filepath.Join(dir, "pilogistics.db"))
+	if err != nil {
+		t.Skip("sqlite3 is not available:", err)
+	}
+	defer db.Close()
+	service := &LogisticsService{logisticsdb: db, providers: &providerChain{},
+		config: &config{Admins: []string{"admin"}}}
+	// the migration is required if the table is missing
+	if loadErr := service.loadCompanies(); loadErr == nil || !strings.Contains(loadErr.Error(), companyMigration) {
+		t.Fatal("the migration should be required:", loadErr)
+	}
+	if _, execErr := db.dbConn.Exec(`create table logistics_company_entity (id integer PRIMARY KEY, code varchar(255),
+		name varchar(255), aliases varchar(255), provider_codes text, number_patterns text, active integer,
+		crt_date integer, upd_date integer)`); execErr != nil {
+		t.Fatal(execErr)
+	}
+	companies := loadScriptCompanies(t)
+	for i := range companies {
+		if saveErr := db.SaveLogisticsCompany(&companies[i]); saveErr != nil {
+			t.Fatal(saveErr)
+		}
+	}
+	if loadErr := service.loadCompanies(); loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	if code, ok := service.getRegistry().resolve("顺丰"); !ok || code != "shunfeng" {
+		t.Fatal("the companies in db should be loaded:", code)
+	}
+	if _, addErr := service.addCompany("admin", []string{"jd", "京东"}); addErr != nil {
+		t.Fatal(addErr)
+	}
+	if entities, _ := db.GetLogisticsCompanies(); len(entities) != len(companies)+1 {
+		t.Fatalf("the company should be added: %d", len(entities))
+	}
+	if code, ok := service.getRegistry().resolve("京东"); !ok || code != "jd" {
+		t.Fatal("the added company should be loaded:", code)
+	}
+}
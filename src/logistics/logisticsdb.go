@@ -38,6 +38,19 @@ type LogisticsRecordEntity struct {
 	UpdDate               int64
 }
 
+// LogisticsCompanyEntity is the logistics company, seeded by dbscript
+type LogisticsCompanyEntity struct {
+	Id             int    `PK`
+	Code           string // like shunfeng, saved in LogisticsInfoEntity.Company
+	Name           string // chinese name, like 顺丰
+	Aliases        string // separated by comma
+	ProviderCodes  string // json, the code used by provider if different, like {"kuaidi100api":"SF"}
+	NumberPatterns string // json, the formats of tracking number, like [{"regex":"^SF\\d{13}$","score":80}]
+	Active         int    // 1: active, 0: inactive
+	CrtDate        int64
+	UpdDate        int64
+}
+
 type LogisticsDb struct {
 	dbConn *sql.DB
 	orm    beedb.Model
@@ -214,6 +227,37 @@ func (self *LogisticsDb) GetUserLogisticsRefByName(username, logisticsName strin
 	return nil, nil
 }
 
+func (self *LogisticsDb) GetLogisticsCompanies() ([]LogisticsCompanyEntity, error) {
+	var entities []LogisticsCompanyEntity
+	err := self.orm.OrderBy("id").FindAll(&entities)
+	return entities, err
+}
+
+func (self *LogisticsDb) GetLogisticsCompany(code string) (*LogisticsCompanyEntity, error) {
+	var entities []LogisticsCompanyEntity
+	err := self.orm.Where("code = ?", code).FindAll(&entities) // not Find()
+	if err != nil {
+		return nil, err
+	}
+	l := len(entities)
+	if l == 1 {
+		return &entities[0], nil
+	} else if l > 1 {
+		return nil, errors.New("More than one record")
+	}
+	return nil, nil
+}
+
+func (self *LogisticsDb) SaveLogisticsCompany(entity *LogisticsCompanyEntity) error {
+	return self.orm.Save(entity)
+}
+
+func (self *LogisticsDb) GetDeliveringLogisticsInfos() ([]LogisticsInfoEntity, error) {
+	var entities []LogisticsInfoEntity
+	err := self.orm.Where("state in (-1, 0, 1)").FindAll(&entities)
+	return entities, err
+}
+
 func (self *LogisticsDb) GetUnfinishedLogistic(timeBefore int64, limit int) ([]LogisticsInfoEntity, error) {
 	var entities []LogisticsInfoEntity
 	err := self.orm.Where("upd_date < strftime('%s','now') - ? and state in (-1, 0, 1)", timeBefore).
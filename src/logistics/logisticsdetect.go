@@ -0,0 +1,200 @@
+package logistics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scoreCheckDigit = 100 // the number matches the format and the check digit
+	scorePrefix     = 80  // the number has the letter prefix of company
+	scoreNumPrefix  = 60  // the number has the digit prefix of company
+	scoreLength     = 30  // only the length matches
+	scoreAutoBonus  = 30  // the bonus of company suggested by provider
+	scoreMargin     = 20  // the top candidate is chosen if it leads the second by the margin
+
+	choiceExpiration = 10 * time.Minute
+)
+
+// numberPattern is the format of tracking number of company, configured in LogisticsCompanyEntity
+type numberPattern struct {
+	company string
+	regex   *regexp.Regexp
+	score   int
+	check   func(string) bool // verify the check digit, optional
+}
+
+// checkS10 verifies the check digit of UPU S10 number, like EA123456785CN
+func checkS10(number string) bool {
+	weights := []int{8, 6, 4, 2, 3, 5, 9, 7}
+	sum := 0
+	for i, w := range weights {
+		sum += int(number[2+i]-'0') * w
+	}
+	check := 11 - sum%11
+	switch check {
+	case 10:
+		check = 0
+	case 11:
+		check = 5
+	}
+	return int(number[10]-'0') == check
+}
+
+type companyCandidate struct {
+	Company string
+	Score   int
+}
+
+type byScore []companyCandidate
+
+func (s byScore) Len() int {
+	return len(s)
+}
+
+func (s byScore) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// the same score is ranked by company for the stable output
+func (s byScore) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
+	return s[i].Company < s[j].Company
+}
+
+// detectCompanies guesses the companies by the format of tracking number, the suggested companies
+// of provider get a bonus. the candidates are ranked by score
+func detectCompanies(patterns []*numberPattern, logisticsId string, suggested []string) []companyCandidate {
+	number := strings.ToUpper(strings.TrimSpace(logisticsId))
+	scores := make(map[string]int)
+	for _, p := range patterns {
+		if !p.regex.MatchString(number) {
+			continue
+		}
+		score := p.score
+		if p.check != nil && p.check(number) {
+			score = scoreCheckDigit
+		}
+		if score > scores[p.company] {
+			scores[p.company] = score
+		}
+	}
+	for _, company := range suggested {
+		if score, ok := scores[company]; ok {
+			scores[company] = score + scoreAutoBonus
+		} else {
+			scores[company] = scoreLength + scoreAutoBonus
+		}
+	}
+	candidates := make([]companyCandidate, 0, len(scores))
+	for company, score := range scores {
+		candidates = append(candidates, companyCandidate{company, score})
+	}
+	sort.Sort(byScore(candidates))
+	return candidates
+}
+
+// pickCompany returns the company if the top candidate is unique or leads by the margin
+func pickCompany(candidates []companyCandidate) (string, bool) {
+	if len(candidates) == 0 {
+		return "", false
+	}
+	if len(candidates) == 1 || candidates[0].Score-candidates[1].Score >= scoreMargin {
+		return candidates[0].Company, true
+	}
+	return "", false
+}
+
+// companyChoice is the ambiguous tracking number waiting for user to choose the company
+type companyChoice struct {
+	logisticsId string
+	candidates  []companyCandidate
+	expireTime  time.Time
+}
+
+type choiceStore struct {
+	choices map[string]*companyChoice // key: username and logistics name
+	mutex   sync.Mutex
+}
+
+func newChoiceStore() *choiceStore {
+	return &choiceStore{choices: make(map[string]*companyChoice)}
+}
+
+func (self *choiceStore) put(username, logisticsName string, choice *companyChoice) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	now := time.Now()
+	for key, c := range self.choices {
+		if now.After(c.expireTime) {
+			delete(self.choices, key)
+		}
+	}
+	choice.expireTime = now.Add(choiceExpiration)
+	self.choices[username+"\n"+logisticsName] = choice
+}
+
+func (self *choiceStore) take(username, logisticsName string) *companyChoice {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	key := username + "\n" + logisticsName
+	choice := self.choices[key]
+	if choice == nil || time.Now().After(choice.expireTime) {
+		delete(self.choices, key)
+		return nil
+	}
+	delete(self.choices, key)
+	return choice
+}
+
+func formatChoicePrompt(registry *companyRegistry, logisticsName, logisticsId string, candidates []companyCandidate) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("无法确定单号[%s]的物流公司，请回复“跟踪快递 %s 序号”选择:", logisticsId, logisticsName))
+	for i, candidate := range candidates {
+		buffer.WriteString(fmt.Sprintf("\n%d. %s (%s)", i+1, registry.getName(candidate.Company), candidate.Company))
+	}
+	return buffer.String()
+}
+
+// detectCompany returns the company of tracking number, and the candidates if it can not be decided
+func (self *LogisticsService) detectCompany(logisticsId string) (string, []companyCandidate, error) {
+	var suggested []string
+	if self.config.ProviderAutocomplete {
+		suggested = self.providers.DetectCompanies(logisticsId)
+	}
+	candidates := detectCompanies(self.getRegistry().getPatterns(), logisticsId, suggested)
+	if len(candidates) == 0 {
+		return "", nil, errors.New(fmt.Sprintf("无法识别单号[%s]的物流公司，请指定，如“跟踪快递 快递名称 物流公司 物流单号”", logisticsId))
+	}
+	company, ok := pickCompany(candidates)
+	if !ok {
+		return "", candidates, nil
+	}
+	return company, candidates, nil
+}
+
+// chooseCompany returns the company and tracking number chosen by index or company name from the pending choice
+func (self *LogisticsService) chooseCompany(username, logisticsName, answer string) (string, string, bool) {
+	choice := self.choices.take(username, logisticsName)
+	if choice == nil {
+		return "", "", false
+	}
+	if index, err := strconv.Atoi(answer); err == nil && index >= 1 && index <= len(choice.candidates) {
+		return choice.candidates[index-1].Company, choice.logisticsId, true
+	}
+	if company, ok := self.checkCompany(answer); ok {
+		return company, choice.logisticsId, true
+	}
+	// not an answer, keep waiting
+	self.choices.put(username, logisticsName, choice)
+	return "", "", false
+}
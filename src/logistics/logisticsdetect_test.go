@@ -0,0 +1,82 @@
+package logistics
+
+import (
+	"testing"
+)
+
+func TestDetectCompanies(t *testing.T) {
+	patterns := newTestRegistry(t).getPatterns()
+	cases := []struct {
+		number   string
+		expected string
+	}{
+		{"EA123456785CN", "ems"},
+		{"SF1234567890123", "shunfeng"},
+		{"668031148649", "shentong"},
+		{"1200722815552", "yunda"},
+		{"966053314784", "shunfeng"},
+		{"YT1234567890123", "yuantong"},
+		{"73123456789012", "zhongtong"},
+		{"dpk123456789012", "debangwuliu"},
+	}
+	for _, c := range cases {
+		company, ok := pickCompany(detectCompanies(patterns, c.number, nil))
+		if !ok || company != c.expected {
+			t.Errorf("unexpected company of %s: %s, candidates: %v", c.number, company, detectCompanies(patterns, c.number, nil))
+		}
+	}
+	// the 12 digits starting with 7 may be shunfeng or zhongtong
+	candidates := detectCompanies(patterns, "712345678901", nil)
+	if _, ok := pickCompany(candidates); ok || len(candidates) != 2 {
+		t.Fatal("the number should be ambiguous:", candidates)
+	}
+	if candidates[0].Company != "shunfeng" || candidates[1].Company != "zhongtong" {
+		t.Fatal("the candidates of same score should be ranked by company:", candidates)
+	}
+	// the suggestion of provider decides
+	if company, ok := pickCompany(detectCompanies(patterns, "712345678901", []string{"zhongtong"})); !ok || company != "zhongtong" {
+		t.Fatal("the suggested company should be chosen:", company)
+	}
+	if candidates := detectCompanies(patterns, "abc", nil); len(candidates) != 0 {
+		t.Fatal("unexpected candidates:", candidates)
+	}
+}
+
+func TestCheckS10(t *testing.T) {
+	patterns := newTestRegistry(t).getPatterns()
+	if !checkS10("EA123456785CN") {
+		t.Error("the check digit should be valid")
+	}
+	if checkS10("EA123456784CN") {
+		t.Error("the check digit should be invalid")
+	}
+	candidates := detectCompanies(patterns, "EA123456784CN", nil)
+	if len(candidates) != 1 || candidates[0].Score != scorePrefix {
+		t.Error("the number with wrong check digit should get less score:", candidates)
+	}
+}
+
+func TestChooseCompany(t *testing.T) {
+	service := &LogisticsService{choices: newChoiceStore(), registry: newTestRegistry(t)}
+	patterns := service.registry.getPatterns()
+	candidates := detectCompanies(patterns, "712345678901", nil)
+	service.choices.put("user", "book", &companyChoice{logisticsId: "712345678901", candidates: candidates})
+	if _, _, ok := service.chooseCompany("user", "other", "1"); ok {
+		t.Fatal("the choice of other name should not be used")
+	}
+	// not an answer, the choice is kept
+	if _, _, ok := service.chooseCompany("user", "book", "9"); ok {
+		t.Fatal("invalid index should not be chosen")
+	}
+	company, logisticsId, ok := service.chooseCompany("user", "book", "2")
+	if !ok || company != "zhongtong" || logisticsId != "712345678901" {
+		t.Fatal("unexpected choice:", company, logisticsId)
+	}
+	if _, _, ok := service.chooseCompany("user", "book", "1"); ok {
+		t.Fatal("the choice should be removed after chosen")
+	}
+	service.choices.put("user", "book", &companyChoice{logisticsId: "712345678901", candidates: candidates})
+	if company, _, ok := service.chooseCompany("user", "book", "顺丰"); !ok || company != "shunfeng" {
+		t.Fatal("the company should be chosen by name:", company)
+	}
+}
@@ -0,0 +1,75 @@
+package logistics
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// subscribe the logistics in csv file, every line is: name,company,logistics id or name,logistics id
+func (self *LogisticsService) handleFile(username string, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("缺少参数！")
+	}
+	f, err := os.Open(args[1])
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var buffer bytes.Buffer
+	lineNum := 0
+	successCount := 0
+	for {
+		record, readErr := reader.Read()
+		if readErr == io.EOF {
+			break
+		}
+		lineNum++
+		if readErr != nil {
+			buffer.WriteString(fmt.Sprintf("\n第%d行: 格式错误", lineNum))
+			continue
+		}
+		if len(record) == 0 || len(strings.TrimSpace(record[0])) == 0 || strings.HasPrefix(record[0], "#") {
+			continue
+		}
+		if len(record) != 2 && len(record) != 3 {
+			buffer.WriteString(fmt.Sprintf("\n第%d行: 格式应为“快递名称,物流公司,物流单号”或“快递名称,物流单号”", lineNum))
+			continue
+		}
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+		if len(record) == 2 {
+			// no choice in file, the company must be detected exactly
+			company, candidates, detectErr := self.detectCompany(record[1])
+			if detectErr != nil {
+				buffer.WriteString(fmt.Sprintf("\n第%d行[%s]: %s", lineNum, record[0], detectErr.Error()))
+				continue
+			}
+			if company == "" {
+				names := make([]string, 0, len(candidates))
+				for _, candidate := range candidates {
+					names = append(names, self.getRegistry().getName(candidate.Company))
+				}
+				buffer.WriteString(fmt.Sprintf("\n第%d行[%s]: 无法确定物流公司(%s)，请指定", lineNum, record[0], strings.Join(names, "/")))
+				continue
+			}
+			record = []string{record[0], company, record[1]}
+		}
+		if _, subErr := self.subLogi(username, record); subErr != nil {
+			buffer.WriteString(fmt.Sprintf("\n第%d行[%s]: %s", lineNum, record[0], subErr.Error()))
+			continue
+		}
+		successCount++
+		buffer.WriteString(fmt.Sprintf("\n第%d行[%s]: 跟踪成功", lineNum, record[0]))
+	}
+	return fmt.Sprintf("成功跟踪%d条快递:%s", successCount, buffer.String()), nil
+}
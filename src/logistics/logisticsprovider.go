@@ -0,0 +1,291 @@
+package logistics
+
+import (
+	l4g "code.google.com/p/log4go"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TrackingState is the normalized state of logistics, saved in LogisticsInfoEntity.State
+type TrackingState int
+
+const (
+	StateUnknown    = TrackingState(-1)
+	StateDelivering = TrackingState(0)
+	StateSent       = TrackingState(1)
+	StateProblem    = TrackingState(2)
+	StateReceived   = TrackingState(3)
+	StateReturned   = TrackingState(4)
+
+	defaultMaxProviderErrors = 3
+	defaultProviderCooldown  = 30 * 60 // seconds
+	kuaidi100NoRecordStatus  = "201"   // the tracking number does not exist or is expired
+)
+
+type TrackingEvent struct {
+	Time    int64
+	Context string
+}
+
+// TrackingResult is the logistics info queried by provider, Found is false if the provider
+// has no record of the logistics yet, and Message is the reason
+type TrackingResult struct {
+	Found   bool
+	Message string
+	State   TrackingState
+	Events  []TrackingEvent
+}
+
+// TrackingProvider queries the logistics from the api of kuaidi100 or carrier.
+// the company is the code of LogisticsCompanyEntity, converted to the provider code by codeMapper
+type TrackingProvider interface {
+	GetName() string
+	SupportedCompanies() []string // nil if all companies are supported
+	Query(company, logisticsId string) (*TrackingResult, error)
+}
+
+// CompanyDetector is implemented by the provider which suggests the companies of tracking number
+type CompanyDetector interface {
+	DetectCompanies(logisticsId string) ([]string, error)
+}
+
+type providerConfig struct {
+	Type      string   `json:"type,omitempty"` // kuaidi100web, kuaidi100api or sfexpress
+	Name      string   `json:"name,omitempty"`
+	Priority  int      `json:"priority,omitempty"` // the provider with less priority is queried first
+	Key       string   `json:"key,omitempty"`
+	Customer  string   `json:"customer,omitempty"`
+	Companies []string `json:"companies,omitempty"` // the supported companies, all if empty
+}
+
+var providerFactories = map[string]func(*providerConfig) (TrackingProvider, error){
+	"kuaidi100web": newKuaidi100WebProvider,
+	"kuaidi100api": newKuaidi100ApiProvider,
+	"sfexpress":    newSfExpressProvider,
+}
+
+func newProvider(c *providerConfig) (TrackingProvider, error) {
+	factory := providerFactories[c.Type]
+	if factory == nil {
+		return nil, errors.New("unknown logistics provider type: " + c.Type)
+	}
+	return factory(c)
+}
+
+func supportsCompany(provider TrackingProvider, company string) bool {
+	companies := provider.SupportedCompanies()
+	if companies == nil {
+		return true
+	}
+	for _, c := range companies {
+		if c == company {
+			return true
+		}
+	}
+	return false
+}
+
+type providerState struct {
+	provider     TrackingProvider
+	priority     int
+	errors       int   // the count of continuous errors
+	disableUntil int64 // the provider is skipped until the time after errors repeatedly
+}
+
+// codeMapper converts the company to the code used by provider and back
+type codeMapper interface {
+	providerCode(provider, company string) string
+	companyByProviderCode(provider, providerCode string) string
+}
+
+// providerChain queries the providers by priority, the next provider is used if one fails,
+// and the provider is skipped for a while after maxErrors continuous errors
+type providerChain struct {
+	states    []*providerState
+	maxErrors int
+	cooldown  int64
+	codes     codeMapper // optional
+	mutex     sync.Mutex
+}
+
+func newProviderChain(configs []*providerConfig, maxErrors int, cooldown int64) (*providerChain, error) {
+	if len(configs) == 0 {
+		configs = []*providerConfig{{Type: "kuaidi100web"}}
+	}
+	if maxErrors <= 0 {
+		maxErrors = defaultMaxProviderErrors
+	}
+	if cooldown <= 0 {
+		cooldown = defaultProviderCooldown
+	}
+	chain := &providerChain{maxErrors: maxErrors, cooldown: cooldown}
+	for _, c := range configs {
+		provider, err := newProvider(c)
+		if err != nil {
+			return nil, err
+		}
+		chain.states = append(chain.states, &providerState{provider: provider, priority: c.Priority})
+	}
+	sort.Stable(byPriority(chain.states))
+	return chain, nil
+}
+
+type byPriority []*providerState
+
+func (s byPriority) Len() int {
+	return len(s)
+}
+
+func (s byPriority) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byPriority) Less(i, j int) bool {
+	return s[i].priority < s[j].priority
+}
+
+// candidates returns the providers supporting the company or all providers if company is empty,
+// the disabled providers are put at the end so they are still tried if all others fail
+func (self *providerChain) candidates(company string, now int64) []*providerState {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	enabled := make([]*providerState, 0, len(self.states))
+	disabled := make([]*providerState, 0)
+	for _, state := range self.states {
+		if company != "" && !supportsCompany(state.provider, company) {
+			continue
+		}
+		if state.disableUntil > now {
+			disabled = append(disabled, state)
+		} else {
+			enabled = append(enabled, state)
+		}
+	}
+	return append(enabled, disabled...)
+}
+
+func (self *providerChain) setCodeMapper(codes codeMapper) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.codes = codes
+}
+
+func (self *providerChain) getCodeMapper() codeMapper {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.codes
+}
+
+func (self *providerChain) onResult(state *providerState, err error, now int64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err == nil {
+		state.errors = 0
+		state.disableUntil = 0
+		return
+	}
+	state.errors++
+	if state.errors >= self.maxErrors && state.disableUntil <= now {
+		state.disableUntil = now + self.cooldown
+		l4g.Warn("Logistics provider %s failed %d times, switch to other providers for %d seconds",
+			state.provider.GetName(), state.errors, self.cooldown)
+	}
+}
+
+func (self *providerChain) Query(company, logisticsId string) (*TrackingResult, error) {
+	candidates := self.candidates(company, time.Now().Unix())
+	if len(candidates) == 0 {
+		return nil, errors.New("no logistics provider supports " + company)
+	}
+	codes := self.getCodeMapper()
+	var lastErr error
+	for _, state := range candidates {
+		code := company
+		if codes != nil {
+			code = codes.providerCode(state.provider.GetName(), company)
+		}
+		result, err := state.provider.Query(code, logisticsId)
+		self.onResult(state, err, time.Now().Unix())
+		if err == nil {
+			return result, nil
+		}
+		l4g.Error("Query logistics [%s %s] by %s error: %v", company, logisticsId, state.provider.GetName(), err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// DetectCompanies returns the companies suggested by the first provider which detects the tracking number
+func (self *providerChain) DetectCompanies(logisticsId string) []string {
+	for _, state := range self.candidates("", time.Now().Unix()) {
+		detector, ok := state.provider.(CompanyDetector)
+		if !ok {
+			continue
+		}
+		companies, err := detector.DetectCompanies(logisticsId)
+		if err != nil {
+			l4g.Error("Detect company of %s by %s error: %v", logisticsId, state.provider.GetName(), err)
+			continue
+		}
+		if len(companies) > 0 {
+			if codes := self.getCodeMapper(); codes != nil {
+				for i, code := range companies {
+					companies[i] = codes.companyByProviderCode(state.provider.GetName(), code)
+				}
+			}
+			return companies
+		}
+	}
+	return nil
+}
+
+// the state of kuaidi100: 0 delivering, 1 sent, 2 problem, 3 received, 4 returned, 5 dispatching, 6 returning
+func normalizeKuaidi100State(state string) TrackingState {
+	s, err := strconv.Atoi(state)
+	if err != nil {
+		return StateUnknown
+	}
+	switch s {
+	case 5:
+		return StateDelivering
+	case 6:
+		return StateReturned
+	}
+	if s < int(StateUnknown) || s > int(StateReturned) {
+		return StateUnknown
+	}
+	return TrackingState(s)
+}
+
+// parseLocalTime parses the time of record as local time
+func parseLocalTime(t string) (int64, error) {
+	recTime, err := time.ParseInLocation("2006-01-02 15:04:05", t, time.Local)
+	if err != nil {
+		return 0, err
+	}
+	return recTime.Unix(), nil
+}
+
+// convertKuaidi100Info converts the response of kuaidi100 web and api, only the status of no record
+// is not found, the other failed status is returned as error so the next provider is queried
+func convertKuaidi100Info(info *LogisticsInfo) (*TrackingResult, error) {
+	if info.Status == kuaidi100NoRecordStatus {
+		return &TrackingResult{Found: false, Message: info.Message, State: StateUnknown}, nil
+	}
+	if info.Status != "200" {
+		return nil, errors.New(fmt.Sprintf("kuaidi100 error %s: %s", info.Status, info.Message))
+	}
+	result := &TrackingResult{Found: true, Message: info.Message, State: normalizeKuaidi100State(info.State)}
+	for _, rec := range info.Data {
+		t, err := parseLocalTime(rec.Time)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid record time: %s", rec.Time))
+		}
+		result.Events = append(result.Events, TrackingEvent{Time: t, Context: rec.Context})
+	}
+	return result, nil
+}
@@ -0,0 +1,185 @@
+package logistics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeProvider struct {
+	name      string
+	companies []string
+	err       error
+	queries   int
+}
+
+func (self *fakeProvider) GetName() string {
+	return self.name
+}
+
+func (self *fakeProvider) SupportedCompanies() []string {
+	return self.companies
+}
+
+func (self *fakeProvider) Query(company, logisticsId string) (*TrackingResult, error) {
+	self.queries++
+	if self.err != nil {
+		return nil, self.err
+	}
+	return &TrackingResult{Found: true, Message: self.name, State: StateDelivering}, nil
+}
+
+func TestProviderChain(t *testing.T) {
+	primary := &fakeProvider{name: "primary", err: errors.New("timeout")}
+	secondary := &fakeProvider{name: "secondary"}
+	sfOnly := &fakeProvider{name: "sf", companies: []string{"shunfeng"}}
+	chain := &providerChain{maxErrors: 2, cooldown: 600}
+	chain.states = []*providerState{
+		{provider: sfOnly, priority: 0},
+		{provider: primary, priority: 1},
+		{provider: secondary, priority: 2},
+	}
+	result, err := chain.Query("shunfeng", "123")
+	if err != nil || result.Message != "sf" {
+		t.Fatal("the provider of company should be used first:", result, err)
+	}
+	for i := 0; i < 3; i++ {
+		result, err = chain.Query("yunda", "123")
+		if err != nil || result.Message != "secondary" {
+			t.Fatal("the next provider should be used:", result, err)
+		}
+	}
+	// the primary is skipped after 2 continuous errors
+	if primary.queries != 2 {
+		t.Fatalf("unexpected queries of failed provider: %d", primary.queries)
+	}
+	// the disabled provider is still tried at last
+	secondary.err = errors.New("down")
+	if _, err = chain.Query("yunda", "123"); err == nil || primary.queries != 3 {
+		t.Fatal("all providers should be tried:", err, primary.queries)
+	}
+	primary.err = nil
+	chain.states[1].disableUntil = 0
+	if result, err = chain.Query("yunda", "123"); err != nil || result.Message != "primary" {
+		t.Fatal("the recovered provider should be used:", result, err)
+	}
+	if chain.states[1].errors != 0 {
+		t.Fatal("the errors should be reset after success")
+	}
+}
+
+func TestNormalizeKuaidi100State(t *testing.T) {
+	cases := map[string]TrackingState{
+		"0": StateDelivering, "1": StateSent, "3": StateReceived,
+		"5": StateDelivering, "6": StateReturned, "": StateUnknown, "9": StateUnknown,
+	}
+	for state, expected := range cases {
+		if s := normalizeKuaidi100State(state); s != expected {
+			t.Errorf("unexpected state of %s: %d", state, s)
+		}
+	}
+}
+
+func TestKuaidi100ApiProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		param := r.FormValue("param")
+		if r.FormValue("sign") != kuaidi100Sign(param, "key", "customer") {
+			fmt.Fprint(w, `{"result":false,"returnCode":"503","message":"验证签名失败"}`)
+			return
+		}
+		if param == `{"com":"yunda","num":"000"}` {
+			fmt.Fprint(w, `{"result":false,"returnCode":"500","message":"查询无结果，请隔段时间再查"}`)
+			return
+		}
+		fmt.Fprint(w, `{"message":"ok","state":"5","status":"200","com":"yunda","nu":"123",`+
+			`"data":[{"context":"派件中","time":"2014-06-01 12:30:00"},{"context":"已揽收","time":"2014-05-31 08:00:00"}]}`)
+	}))
+	defer server.Close()
+	oldUrl := kuaidi100ApiUrl
+	kuaidi100ApiUrl = server.URL
+	defer func() { kuaidi100ApiUrl = oldUrl }()
+
+	provider, _ := newKuaidi100ApiProvider(&providerConfig{Key: "key", Customer: "customer"})
+	result, err := provider.Query("yunda", "123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Found || result.State != StateDelivering || len(result.Events) != 2 || result.Events[0].Context != "派件中" {
+		t.Fatal("unexpected result:", result)
+	}
+	if result, err = provider.Query("yunda", "000"); err != nil || result.Found {
+		t.Fatal("no record should not be an error:", result, err)
+	}
+	badProvider, _ := newKuaidi100ApiProvider(&providerConfig{Key: "bad", Customer: "customer"})
+	if _, err = badProvider.Query("yunda", "123"); err == nil {
+		t.Fatal("the api error should be returned")
+	}
+	if _, err = newKuaidi100ApiProvider(&providerConfig{}); err == nil {
+		t.Fatal("the key should be required")
+	}
+}
+
+func TestConvertKuaidi100Info(t *testing.T) {
+	result, err := convertKuaidi100Info(&LogisticsInfo{Status: kuaidi100NoRecordStatus, Message: "单号不存在或者已经过期"})
+	if err != nil || result.Found {
+		t.Fatal("no record should not be an error:", result, err)
+	}
+	for _, status := range []string{"400", "403", "500", ""} {
+		if _, err = convertKuaidi100Info(&LogisticsInfo{Status: status, Message: "error"}); err == nil {
+			t.Errorf("the status %s should be an error so the next provider is queried", status)
+		}
+	}
+	result, err = convertKuaidi100Info(&LogisticsInfo{Status: "200", State: "3",
+		Data: []LogisticsRecord{{Context: "已签收", Time: "2014-06-01 12:30:00"}}})
+	if err != nil || !result.Found || result.State != StateReceived || len(result.Events) != 1 {
+		t.Fatal("unexpected result:", result, err)
+	}
+}
+
+func TestSfExpressProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		xmlReq := r.FormValue("xml")
+		if r.FormValue("verifyCode") != sfExpressSign(xmlReq, "checkword") {
+			fmt.Fprint(w, `<Response service="RouteService"><Head>ERR</Head><ERROR code="4001">系统发生数据错误或运行时异常</ERROR></Response>`)
+			return
+		}
+		if strings.Contains(xmlReq, `tracking_number="000"`) {
+			fmt.Fprint(w, `<Response service="RouteService"><Head>OK</Head><Body><RouteResponse mailno="000"></RouteResponse></Body></Response>`)
+			return
+		}
+		fmt.Fprint(w, `<Response service="RouteService"><Head>OK</Head><Body><RouteResponse mailno="123">`+
+			`<Route remark="顺丰速运 已收取快件" accept_time="2014-05-31 08:00:00" accept_address="深圳市" opcode="50"/>`+
+			`<Route remark="已签收,感谢使用顺丰" accept_time="2014-06-01 12:30:00" accept_address="上海市" opcode="80"/>`+
+			`</RouteResponse></Body></Response>`)
+	}))
+	defer server.Close()
+	oldUrl := sfExpressApiUrl
+	sfExpressApiUrl = server.URL
+	defer func() { sfExpressApiUrl = oldUrl }()
+
+	provider, _ := newSfExpressProvider(&providerConfig{Key: "checkword", Customer: "client"})
+	if !supportsCompany(provider, "shunfeng") || supportsCompany(provider, "yunda") {
+		t.Fatal("only shunfeng should be supported")
+	}
+	result, err := provider.Query("shunfeng", "123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Found || result.State != StateReceived || len(result.Events) != 2 ||
+		result.Events[0].Context != "[上海市] 已签收,感谢使用顺丰" {
+		t.Fatal("unexpected result:", result)
+	}
+	if result, err = provider.Query("shunfeng", "000"); err != nil || result.Found {
+		t.Fatal("no route should not be an error:", result, err)
+	}
+	badProvider, _ := newSfExpressProvider(&providerConfig{Key: "bad", Customer: "client"})
+	if _, err = badProvider.Query("shunfeng", "123"); err == nil {
+		t.Fatal("the api error should be returned")
+	}
+	if _, err = newSfExpressProvider(&providerConfig{}); err == nil {
+		t.Fatal("the checkword and client code should be required")
+	}
+}
@@ -1,10 +1,16 @@
 package logistics
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"utils"
 )
@@ -15,6 +21,12 @@ const (
 	QUERY_URL = "http://www.kuaidi100.com/query?type=%s&postid=%s&id=1&valicode=&temp=%f"
 )
 
+var (
+	kuaidi100ApiUrl  = "https://poll.kuaidi100.com/poll/query.do"
+	kuaidi100AutoUrl = "http://www.kuaidi100.com/autonumber/autoComNum?text=%s"
+	sfExpressApiUrl  = "https://bsp-oisp.sf-express.com/bsp-oisp/sfexpressService"
+)
+
 type LogisticsRecord struct {
 	Context string `json:"context,omitempty"`
 	Ftime   string `json:"ftime,omitempty"`
@@ -34,7 +46,7 @@ type LogisticsInfo struct {
 
 func Query(com, logisticsId string) (*LogisticsInfo, error) {
 	//request like a browser
-	url := fmt.Sprintf(QUERY_URL, com, logisticsId, utils.RandomFloat32)
+	url := fmt.Sprintf(QUERY_URL, com, logisticsId, utils.RandomFloat32())
 	queryReq, _ := http.NewRequest("GET", url, nil)
 	queryReq.Header.Set("Accept", "*/*")
 	queryReq.Header.Set("Referer", "http://www.kuaidi100.com/")
@@ -59,3 +71,255 @@ func Query(com, logisticsId string) (*LogisticsInfo, error) {
 	}
 	return logisticsInfo, nil
 }
+
+// kuaidi100WebProvider queries the web page of kuaidi100 like a browser, no key is needed
+type kuaidi100WebProvider struct {
+	config *providerConfig
+}
+
+func newKuaidi100WebProvider(c *providerConfig) (TrackingProvider, error) {
+	return &kuaidi100WebProvider{c}, nil
+}
+
+func (self *kuaidi100WebProvider) GetName() string {
+	if self.config.Name != "" {
+		return self.config.Name
+	}
+	return "kuaidi100web"
+}
+
+func (self *kuaidi100WebProvider) SupportedCompanies() []string {
+	return self.config.Companies
+}
+
+type kuaidi100AutoResp struct {
+	Auto []struct {
+		ComCode string `json:"comCode,omitempty"`
+	} `json:"auto,omitempty"`
+}
+
+// DetectCompanies returns the company codes of kuaidi100 guessed by its autocomplete
+func (self *kuaidi100WebProvider) DetectCompanies(logisticsId string) ([]string, error) {
+	resp, getErr := http.Get(fmt.Sprintf(kuaidi100AutoUrl, url.QueryEscape(logisticsId)))
+	if getErr != nil {
+		return nil, getErr
+	}
+	defer resp.Body.Close()
+	bytes, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+	autoResp := &kuaidi100AutoResp{}
+	if unmarshalErr := json.Unmarshal(bytes, autoResp); unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	companies := make([]string, 0, len(autoResp.Auto))
+	for _, auto := range autoResp.Auto {
+		if auto.ComCode != "" {
+			companies = append(companies, auto.ComCode)
+		}
+	}
+	return companies, nil
+}
+
+func (self *kuaidi100WebProvider) Query(company, logisticsId string) (*TrackingResult, error) {
+	info, err := Query(company, logisticsId)
+	if err != nil {
+		return nil, err
+	}
+	return convertKuaidi100Info(info)
+}
+
+// kuaidi100ApiProvider queries the official api of kuaidi100 with the key and customer id
+type kuaidi100ApiProvider struct {
+	config *providerConfig
+}
+
+type kuaidi100ApiResp struct {
+	LogisticsInfo
+	Result     *bool  `json:"result,omitempty"`
+	ReturnCode string `json:"returnCode,omitempty"`
+}
+
+func newKuaidi100ApiProvider(c *providerConfig) (TrackingProvider, error) {
+	if c.Key == "" || c.Customer == "" {
+		return nil, errors.New("the key and customer of kuaidi100 api are required")
+	}
+	return &kuaidi100ApiProvider{c}, nil
+}
+
+func (self *kuaidi100ApiProvider) GetName() string {
+	if self.config.Name != "" {
+		return self.config.Name
+	}
+	return "kuaidi100api"
+}
+
+func (self *kuaidi100ApiProvider) SupportedCompanies() []string {
+	return self.config.Companies
+}
+
+// the sign is upper case md5 of param + key + customer
+func kuaidi100Sign(param, key, customer string) string {
+	sum := md5.Sum([]byte(param + key + customer))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func (self *kuaidi100ApiProvider) Query(company, logisticsId string) (*TrackingResult, error) {
+	paramJson, _ := json.Marshal(map[string]string{
+		"com": company,
+		"num": logisticsId,
+	})
+	param := string(paramJson)
+	form := url.Values{}
+	form.Set("customer", self.config.Customer)
+	form.Set("param", param)
+	form.Set("sign", kuaidi100Sign(param, self.config.Key, self.config.Customer))
+	resp, postErr := http.PostForm(kuaidi100ApiUrl, form)
+	if postErr != nil {
+		return nil, postErr
+	}
+	defer resp.Body.Close()
+	bytes, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+	if Debug {
+		fmt.Printf("***Query logistics from kuaidi100 api: %s", strings.TrimSpace(string(bytes)))
+	}
+	apiResp := &kuaidi100ApiResp{}
+	if unmarshalErr := json.Unmarshal(bytes, apiResp); unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	if apiResp.Result != nil && !*apiResp.Result {
+		if apiResp.ReturnCode == "500" { // no record yet
+			return &TrackingResult{Found: false, Message: apiResp.Message, State: StateUnknown}, nil
+		}
+		return nil, errors.New(fmt.Sprintf("kuaidi100 api error %s: %s", apiResp.ReturnCode, apiResp.Message))
+	}
+	return convertKuaidi100Info(&apiResp.LogisticsInfo)
+}
+
+// sfExpressProvider queries the route service of SF Express with the client code and checkword,
+// only shunfeng is supported
+type sfExpressProvider struct {
+	config *providerConfig
+}
+
+type sfExpressRouteReq struct {
+	XMLName xml.Name `xml:"Request"`
+	Service string   `xml:"service,attr"`
+	Lang    string   `xml:"lang,attr"`
+	Head    string   `xml:"Head"`
+	Route   struct {
+		TrackingType   string `xml:"tracking_type,attr"`
+		MethodType     string `xml:"method_type,attr"`
+		TrackingNumber string `xml:"tracking_number,attr"`
+	} `xml:"Body>RouteRequest"`
+}
+
+type sfExpressRoute struct {
+	AcceptTime    string `xml:"accept_time,attr"`
+	AcceptAddress string `xml:"accept_address,attr"`
+	Remark        string `xml:"remark,attr"`
+	Opcode        string `xml:"opcode,attr"`
+}
+
+type sfExpressResp struct {
+	Head  string `xml:"Head"`
+	Error struct {
+		Code    string `xml:"code,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"ERROR"`
+	Routes []sfExpressRoute `xml:"Body>RouteResponse>Route"`
+}
+
+func newSfExpressProvider(c *providerConfig) (TrackingProvider, error) {
+	if c.Key == "" || c.Customer == "" {
+		return nil, errors.New("the checkword(key) and client code(customer) of sfexpress are required")
+	}
+	return &sfExpressProvider{c}, nil
+}
+
+func (self *sfExpressProvider) GetName() string {
+	if self.config.Name != "" {
+		return self.config.Name
+	}
+	return "sfexpress"
+}
+
+func (self *sfExpressProvider) SupportedCompanies() []string {
+	return []string{"shunfeng"}
+}
+
+// the verify code is base64 of md5 of xml + checkword
+func sfExpressSign(xmlReq, checkword string) string {
+	sum := md5.Sum([]byte(xmlReq + checkword))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// the opcode of SF route: 80 received, 70 or 33 problem, 99 or 648 returned, the others are delivering
+func normalizeSfExpressState(opcode string) TrackingState {
+	switch opcode {
+	case "80", "8000":
+		return StateReceived
+	case "70", "33":
+		return StateProblem
+	case "99", "648":
+		return StateReturned
+	}
+	return StateDelivering
+}
+
+func (self *sfExpressProvider) Query(company, logisticsId string) (*TrackingResult, error) {
+	req := &sfExpressRouteReq{Service: "RouteService", Lang: "zh-CN", Head: self.config.Customer}
+	req.Route.TrackingType = "1" // by tracking number
+	req.Route.MethodType = "1"   // standard routes
+	req.Route.TrackingNumber = logisticsId
+	reqBytes, marshalErr := xml.Marshal(req)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	xmlReq := string(reqBytes)
+	form := url.Values{}
+	form.Set("xml", xmlReq)
+	form.Set("verifyCode", sfExpressSign(xmlReq, self.config.Key))
+	resp, postErr := http.PostForm(sfExpressApiUrl, form)
+	if postErr != nil {
+		return nil, postErr
+	}
+	defer resp.Body.Close()
+	bytes, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+	if Debug {
+		fmt.Printf("***Query logistics from sfexpress: %s", strings.TrimSpace(string(bytes)))
+	}
+	sfResp := &sfExpressResp{}
+	if unmarshalErr := xml.Unmarshal(bytes, sfResp); unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	if sfResp.Head != "OK" {
+		return nil, errors.New(fmt.Sprintf("sfexpress error %s: %s", sfResp.Error.Code, sfResp.Error.Message))
+	}
+	if len(sfResp.Routes) == 0 {
+		return &TrackingResult{Found: false, Message: "暂无路由信息", State: StateUnknown}, nil
+	}
+	// the routes are in time order, the latest is the first event like kuaidi100
+	result := &TrackingResult{Found: true, Message: "ok",
+		State: normalizeSfExpressState(sfResp.Routes[len(sfResp.Routes)-1].Opcode)}
+	for i := len(sfResp.Routes) - 1; i >= 0; i-- {
+		route := sfResp.Routes[i]
+		t, err := parseLocalTime(route.AcceptTime)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid record time: %s", route.AcceptTime))
+		}
+		context := route.Remark
+		if route.AcceptAddress != "" {
+			context = fmt.Sprintf("[%s] %s", route.AcceptAddress, route.Remark)
+		}
+		result.Events = append(result.Events, TrackingEvent{Time: t, Context: context})
+	}
+	return result, nil
+}
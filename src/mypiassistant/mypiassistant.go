@@ -5,6 +5,7 @@ import (
 	l4g "code.google.com/p/log4go"
 	"encoding/json"
 	"errors"
+	"fileserver"
 	"flag"
 	"fmt"
 	"foodprice"
@@ -18,6 +19,7 @@ import (
 	"service"
 	"speech2text"
 	"strings"
+	"text2speech"
 	"time"
 )
 
@@ -55,15 +57,25 @@ type PiAssistant struct {
 	connErrorHandler xmpp.Handler
 	stopCh           chan int
 	ServiceMgr       *service.ServiceManager
+	phraseRegistry   *service.PhraseRegistry
 	pushMsgCh        chan *service.PushMessage
+	statusAggregator *service.StatusAggregator
 	piAssiConf       PiAssistantConfig
+	dbHelper         *PiAssistantDbHelper
+	synthesizer      text2speech.Synthesizer
+	fileServer       *fileserver.FileServer
+	voiceServer      *text2speech.VoiceServer
+	pendingFiles     map[string]*pendingFile
 }
 
 func NewPiAssistant() *PiAssistant {
 	pi := &PiAssistant{}
 	pi.stopCh = make(chan int, 1)
 	pi.ServiceMgr = &service.ServiceManager{}
+	pi.phraseRegistry = service.NewPhraseRegistry()
+	pi.pendingFiles = make(map[string]*pendingFile)
 	pi.pushMsgCh = make(chan *service.PushMessage, 10)
+	pi.statusAggregator = service.NewStatusAggregator()
 
 	return pi
 }
@@ -84,6 +96,23 @@ func (self *PiAssistant) Init(configPath string) error {
 	}
 	self.piAssiConf = piAssiConf
 
+	dbHelper, dbErr := NewPiAssistantDbHelper(self.piAssiConf.DbFile)
+	if dbErr != nil {
+		l4g.Error("Open PiAssistant DB error: %v", dbErr)
+		return dbErr
+	}
+	self.dbHelper = dbHelper
+
+	if fileServerErr := self.initFileServer(); fileServerErr != nil {
+		l4g.Error("File server init failed: %v", fileServerErr)
+		return fileServerErr
+	}
+
+	if ttsErr := self.initTts(); ttsErr != nil {
+		l4g.Error("Tts init failed: %v", ttsErr)
+		return ttsErr
+	}
+
 	self.piai = piai.NewPiAi(self.piAssiConf.PiAiConf.SessionTimeout)
 	serviceInitErr := self.initServices()
 	if serviceInitErr != nil {
@@ -92,6 +121,11 @@ func (self *PiAssistant) Init(configPath string) error {
 	}
 	l4g.Info("Initialize services successful!")
 
+	if loadErr := self.loadUserPhrases(); loadErr != nil {
+		l4g.Error("Load voice phrases failed: %v", loadErr)
+		return loadErr
+	}
+
 	return nil
 }
 
@@ -113,6 +147,10 @@ func (self *PiAssistant) initServices() error {
 					return errors.New(fmt.Sprintf("%s init error: %v", service.GetServiceId(), initErr))
 				}
 				l4g.Info("%s initialize successful!", service.GetServiceId())
+				registerErr := self.phraseRegistry.RegisterService(service.GetServiceId(), service.GetVoicePhrases())
+				if registerErr != nil {
+					return registerErr
+				}
 			}
 		}
 	}
@@ -135,6 +173,22 @@ func (self *PiAssistant) StartService() {
 	}
 	l4g.Info("Start services successful!")
 
+	if self.fileServer != nil {
+		if fileServerErr := self.fileServer.Start(); fileServerErr != nil {
+			l4g.Error("File server start error: %v", fileServerErr)
+			return
+		}
+		l4g.Info("File server start successful!")
+	}
+
+	if self.voiceServer != nil {
+		if voiceServerErr := self.voiceServer.Start(); voiceServerErr != nil {
+			l4g.Error("Voice server start error: %v", voiceServerErr)
+			return
+		}
+		l4g.Info("Voice server start successful!")
+	}
+
 	// connect xmpp server
 	connectError := self.connectXmppServer()
 	if connectError != nil {
@@ -157,6 +211,13 @@ func (self *PiAssistant) StartService() {
 	//make resource available
 	self.xmppClient.Send(&xmpp.Presence{})
 
+	rotateInterval := defaultStatusRotateInterval
+	if self.piAssiConf.StatusConf != nil && self.piAssiConf.StatusConf.RotateInterval > 0 {
+		rotateInterval = time.Duration(self.piAssiConf.StatusConf.RotateInterval) * time.Second
+	}
+	rotateTicker := time.NewTicker(rotateInterval)
+	defer rotateTicker.Stop()
+
 	stopService := false
 	for !stopService {
 		select {
@@ -168,6 +229,10 @@ func (self *PiAssistant) StartService() {
 			self.handleSubscribe(subsEvent.Stanza.(*xmpp.Presence))
 		case pushMsg := <-self.pushMsgCh:
 			self.handlePushMsg(pushMsg)
+		case <-rotateTicker.C:
+			if status, changed := self.statusAggregator.Rotate(); changed {
+				self.xmppClient.SendPresenceStatus(status)
+			}
 		case <-self.stopCh:
 			stopService = true
 		}
@@ -186,9 +251,19 @@ func (self *PiAssistant) handleSubscribe(subPresence *xmpp.Presence) {
 func (self *PiAssistant) handlePushMsg(pushMsg *service.PushMessage) {
 	switch pushMsg.Type {
 	case service.Status:
-		self.xmppClient.SendPresenceStatus(pushMsg.Message)
+		if status, changed := self.statusAggregator.Update(pushMsg.Source, pushMsg.Message); changed {
+			self.xmppClient.SendPresenceStatus(status)
+		}
 	case service.Notification:
-		self.xmppClient.SendChatMessage(pushMsg.Username, pushMsg.Message)
+		if len(pushMsg.Message) > 0 {
+			self.xmppClient.SendChatMessage(pushMsg.Username, pushMsg.Message)
+		}
+		if len(pushMsg.FilePath) > 0 {
+			self.sendFile(pushMsg.Username, pushMsg.FilePath)
+			if pushMsg.TempFile {
+				os.Remove(pushMsg.FilePath)
+			}
+		}
 	}
 }
 
@@ -204,12 +279,21 @@ func (self *PiAssistant) StopService() {
 			l4g.Error("%s service stop error: %v", s.GetServiceId(), stopErr)
 		}
 	}
+	if self.fileServer != nil {
+		self.fileServer.Stop()
+	}
+	if self.voiceServer != nil {
+		self.voiceServer.Stop()
+	}
+	self.dbHelper.Close()
 	self.stopCh <- 1
 }
 
 const (
 	voiceMsgPrefix = "Voice IM:"
 	fileMsgPrefix  = "I sent you a file through imo:"
+
+	defaultStatusRotateInterval = 30 * time.Second
 )
 
 var welcomeMsg = fmt.Sprintf("欢迎使用小Pi助手，输入help查看小Pi可以做什么。\n小Pi还支持语音命令，试试说\"上海的空气质量\"")
@@ -217,6 +301,7 @@ var welcomeMsg = fmt.Sprintf("欢迎使用小Pi助手，输入help查看小Pi可
 func (self *PiAssistant) handle(message *xmpp.Message) {
 	l4g.Info("Receive message from [%s]: %s", message.From, message.Body)
 	command := message.Body
+	isVoiceCommand := false
 
 	if strings.HasPrefix(command, voiceMsgPrefix) {
 		l4g.Debug("Receive voice message: %s", command)
@@ -233,20 +318,27 @@ func (self *PiAssistant) handle(message *xmpp.Message) {
 			return
 		}
 		command = text
+		isVoiceCommand = true
 	}
 
 	if strings.HasPrefix(command, fileMsgPrefix) {
-		l4g.Debug("Receive file command: %s", command)
-		fileUrl := strings.TrimSpace(command[len(fileMsgPrefix):])
-		filePath, getFileErr := self.getCommandFile(fileUrl)
-		defer os.Remove(filePath)
-		if getFileErr != nil {
-			l4g.Error("Get command file failed: %v", getFileErr)
-			msg := "Get command file failed!"
-			self.xmppClient.SendChatMessage(message.From, msg)
-			return
-		}
-		command = fmt.Sprintf("file %s %s", fileUrl, filePath)
+		l4g.Debug("Receive file message: %s", command)
+		fileUrl, options := splitFileMessage(command[len(fileMsgPrefix):])
+		content := self.handleFileMessage(xmpp.ToBareJID(message.From), fileUrl, options)
+		self.xmppClient.SendChatMessage(message.From, content)
+		return
+	}
+
+	if fileUrl, options, ok := self.getUploadedFile(message); !isVoiceCommand && ok {
+		l4g.Debug("Receive uploaded file: %s", fileUrl)
+		content := self.handleFileMessage(xmpp.ToBareJID(message.From), fileUrl, options)
+		self.xmppClient.SendChatMessage(message.From, content)
+		return
+	}
+
+	if content, ok := self.handleFileChoice(xmpp.ToBareJID(message.From), command); ok {
+		self.xmppClient.SendChatMessage(message.From, content)
+		return
 	}
 
 	command = strings.TrimSpace(command)
@@ -285,6 +377,23 @@ func (self *PiAssistant) handle(message *xmpp.Message) {
 		return
 	}
 	username := xmpp.ToBareJID(message.From)
+	if phraseFunc, ok := phraseCommandMap[comm]; ok {
+		content, err := phraseFunc(self, username, args)
+		if err != nil {
+			content = err.Error()
+		}
+		self.xmppClient.SendChatMessage(message.From, content)
+		return
+	}
+	comm, args = self.matchPhrase(username, command, comm, args, isVoiceCommand)
+	if comm == "voicereply" {
+		content, err := self.setVoiceReply(username, args)
+		if err != nil {
+			content = err.Error()
+		}
+		self.xmppClient.SendChatMessage(message.From, content)
+		return
+	}
 	var resp string
 	var err error
 	findService := false
@@ -310,10 +419,46 @@ func (self *PiAssistant) handle(message *xmpp.Message) {
 	}
 
 	self.xmppClient.SendChatMessage(message.From, content)
+	if isVoiceCommand && self.isVoiceReplyEnabled(username) {
+		self.sendVoiceReply(username, content)
+	}
+}
+
+// matchPhrase converts the voice phrase to command, the typed command which is registered
+// by services is kept as it is, because the spaces between the args are removed in phrase
+func (self *PiAssistant) matchPhrase(username, command, comm string, args []string, isVoiceCommand bool) (string, []string) {
+	if !isVoiceCommand && self.isRegisteredCommand(comm, args) {
+		return comm, args
+	}
+	if phraseComm, phraseArgs, ok := self.phraseRegistry.Match(username, command); ok {
+		l4g.Debug("Match voice phrase: %s, command: %s, param: %v", command, phraseComm, phraseArgs)
+		return phraseComm, phraseArgs
+	}
+	return comm, args
+}
+
+func (self *PiAssistant) isRegisteredCommand(comm string, args []string) bool {
+	if comm == "voicereply" {
+		return true
+	}
+	if _, ok := phraseCommandMap[comm]; ok {
+		return true
+	}
+	for _, s := range self.ServiceMgr.GetStartedServices() {
+		if s.CommandFilter(comm, args) {
+			return true
+		}
+	}
+	return false
 }
 
 func (self *PiAssistant) getHelpMessage() string {
 	helpMessage := "\n"
+	helpMessage = helpMessage + phraseHelp
+	if self.synthesizer != nil {
+		helpMessage = helpMessage + voiceReplyHelp
+	}
+	helpMessage = helpMessage + "------------------\n"
 	services := self.ServiceMgr.GetStartedServices()
 	for _, s := range services {
 		helpMessage = helpMessage +
@@ -1,12 +1,112 @@
 package main
 
 import (
+	"bytes"
+	l4g "code.google.com/p/log4go"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
 	"path/filepath"
+	"service"
+	"strconv"
+	"strings"
+	"time"
 	"utils"
 )
 
-func (self *PiAssistant) getCommandFile(fileUrl string) (string, error) {
-	ext := filepath.Ext(fileUrl)
-	fileName := utils.RandomString(7) + ext
-	return utils.DownloadHttpFile(fileUrl, fileName)
+const (
+	defaultMaxFileSize = 10 * 1024 * 1024
+	fileChoiceTimeout  = 10 * 60 // seconds
+)
+
+// the received file which is waiting for user to choose the service
+type pendingFile struct {
+	fileUrl  string
+	filePath string
+	mimeType string
+	options  []string // the options following the url in the message
+	services []service.Service
+	time     int64
+}
+
+func (self *PiAssistant) getMaxFileSize() int64 {
+	fileConf := self.piAssiConf.FileConf
+	if fileConf == nil || fileConf.MaxSize == 0 {
+		return defaultMaxFileSize
+	}
+	return fileConf.MaxSize
+}
+
+func getFileName(fileUrl string) string {
+	if u, err := url.Parse(fileUrl); err == nil {
+		return path.Base(u.Path)
+	}
+	return path.Base(fileUrl)
+}
+
+func (self *PiAssistant) handleFileMessage(username, fileUrl string, options []string) string {
+	fileName := getFileName(fileUrl)
+	localFileName := utils.RandomString(7) + filepath.Ext(fileName)
+	filePath, mimeType, getFileErr := utils.DownloadFile(fileUrl, localFileName, self.getMaxFileSize())
+	if getFileErr != nil {
+		l4g.Error("Get file failed: %v", getFileErr)
+		return "Get file failed!"
+	}
+	l4g.Debug("Receive file: %s, type: %s", fileName, mimeType)
+	file := &pendingFile{fileUrl, filePath, mimeType, options, nil, time.Now().Unix()}
+	acceptors := self.ServiceMgr.GetFileAcceptors(fileName, mimeType)
+	switch len(acceptors) {
+	case 0:
+		os.Remove(filePath)
+		return "没有可以处理该文件的服务！"
+	case 1:
+		return self.dispatchFile(username, acceptors[0], file)
+	}
+
+	self.removePendingFile(username)
+	file.services = acceptors
+	self.pendingFiles[username] = file
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("请回复序号选择处理文件[%s]的服务:\n", fileName))
+	for i, s := range acceptors {
+		buffer.WriteString(fmt.Sprintf("%d. %s\n", i+1, s.GetServiceName()))
+	}
+	return buffer.String()
+}
+
+// return false if the command is not the choice of pending file
+func (self *PiAssistant) handleFileChoice(username, command string) (string, bool) {
+	file := self.pendingFiles[username]
+	if file == nil {
+		return "", false
+	}
+	if time.Now().Unix()-file.time > fileChoiceTimeout {
+		self.removePendingFile(username)
+		return "", false
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(command))
+	if err != nil || choice < 1 || choice > len(file.services) {
+		return "", false
+	}
+	delete(self.pendingFiles, username)
+	return self.dispatchFile(username, file.services[choice-1], file), true
+}
+
+func (self *PiAssistant) removePendingFile(username string) {
+	if file := self.pendingFiles[username]; file != nil {
+		os.Remove(file.filePath)
+		delete(self.pendingFiles, username)
+	}
+}
+
+func (self *PiAssistant) dispatchFile(username string, s service.Service, file *pendingFile) string {
+	defer os.Remove(file.filePath)
+	l4g.Debug("Dispatch file %s to %s", file.fileUrl, s.GetServiceId())
+	args := append([]string{file.fileUrl, file.filePath, file.mimeType}, file.options...)
+	resp, err := s.Handle(username, service.FileCommand, args)
+	if err != nil {
+		return err.Error()
+	}
+	return resp
 }
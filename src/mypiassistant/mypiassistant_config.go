@@ -21,15 +21,48 @@ type VoiceConfig struct {
 	Confidence float64 `json:"confidence,omitempty"`
 }
 
+type TtsConfig struct {
+	Enable  bool     `json:"enable,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	Format  string   `json:"format,omitempty"`
+	FileDir string   `json:"fileDir,omitempty"`
+	// the voice server is used to send the url of voice if the file server is not configured
+	HttpAddr   string `json:"httpAddr,omitempty"`
+	BaseUrl    string `json:"baseUrl,omitempty"`
+	Expiration int64  `json:"expiration,omitempty"`
+}
+
+type FileConfig struct {
+	MaxSize     int64    `json:"maxSize,omitempty"`
+	UploadHosts []string `json:"uploadHosts,omitempty"` // hosts of xmpp http upload service
+}
+
+type FileServerConfig struct {
+	Dir        string `json:"dir,omitempty"`
+	HttpAddr   string `json:"httpAddr,omitempty"`
+	BaseUrl    string `json:"baseUrl,omitempty"`
+	Expiration int64  `json:"expiration,omitempty"`
+}
+
 type ServiceConfig struct {
 	ServiceId string           `json:"serviceId,omitempty"`
 	Autostart bool             `json:"autostart,omitempty"`
 	ConfigRaw *json.RawMessage `json:"config,omitempty"`
 }
 
+type StatusConfig struct {
+	RotateInterval int64 `json:"rotateInterval,omitempty"` // seconds
+}
+
 type PiAssistantConfig struct {
-	XmppConf       *XmppConfig     `json:"xmpp,omitempty"`
-	PiAiConf       *PiAiConfig     `json:"piai,omitempty"`
-	VoiceConf      *VoiceConfig    `json:"voice,omitempty"`
-	ServicesConfig []ServiceConfig `json:"services,omitempty"`
+	DbFile         string            `json:"dbFile,omitempty"`
+	StatusConf     *StatusConfig     `json:"status,omitempty"`
+	XmppConf       *XmppConfig       `json:"xmpp,omitempty"`
+	PiAiConf       *PiAiConfig       `json:"piai,omitempty"`
+	VoiceConf      *VoiceConfig      `json:"voice,omitempty"`
+	TtsConf        *TtsConfig        `json:"tts,omitempty"`
+	FileConf       *FileConfig       `json:"file,omitempty"`
+	FileServerConf *FileServerConfig `json:"fileServer,omitempty"`
+	ServicesConfig []ServiceConfig   `json:"services,omitempty"`
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	_ "github.com/NoahShen/go-sqlite3"
+	"github.com/NoahShen/gorp"
+	"time"
+)
+
+// UserSettingEntity keeps the personal settings of user
+type UserSettingEntity struct {
+	Id         int64
+	Username   string
+	VoiceReply int //0 for text reply only, 1 for voice reply to voice command
+	CrtDate    int64
+	UpdDate    int64
+	Version    int64
+}
+
+func (self *UserSettingEntity) PreInsert(s gorp.SqlExecutor) error {
+	now := time.Now().Unix()
+	self.CrtDate = now
+	self.UpdDate = now
+	return nil
+}
+
+func (self *UserSettingEntity) PreUpdate(s gorp.SqlExecutor) error {
+	self.UpdDate = time.Now().Unix()
+	return nil
+}
+
+// VoicePhraseEntity is the voice phrase added by user, the phrase is
+// used for everyone if username is empty
+type VoicePhraseEntity struct {
+	Id       int64
+	Username string
+	Phrase   string
+	Command  string
+	Args     string // separated by space
+	CrtDate  int64
+	UpdDate  int64
+	Version  int64
+}
+
+func (self *VoicePhraseEntity) PreInsert(s gorp.SqlExecutor) error {
+	now := time.Now().Unix()
+	self.CrtDate = now
+	self.UpdDate = now
+	return nil
+}
+
+func (self *VoicePhraseEntity) PreUpdate(s gorp.SqlExecutor) error {
+	self.UpdDate = time.Now().Unix()
+	return nil
+}
+
+type PiAssistantDbHelper struct {
+	dbConn *sql.DB
+	dbmap  *gorp.DbMap
+}
+
+func NewPiAssistantDbHelper(dbFile string) (*PiAssistantDbHelper, error) {
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dbHelper := &PiAssistantDbHelper{}
+	dbHelper.dbConn = db
+	dbHelper.dbmap = &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
+	initErr := dbHelper.init()
+	return dbHelper, initErr
+}
+
+func (self *PiAssistantDbHelper) init() error {
+	userSettingEntityTable := self.dbmap.AddTable(UserSettingEntity{}).SetKeys(true, "Id")
+	userSettingEntityTable.SetVersionCol("Version")
+	voicePhraseEntityTable := self.dbmap.AddTable(VoicePhraseEntity{}).SetKeys(true, "Id")
+	voicePhraseEntityTable.SetVersionCol("Version")
+	return self.dbmap.CreateTablesIfNotExists()
+}
+
+func (self *PiAssistantDbHelper) Close() error {
+	return self.dbConn.Close()
+}
+
+const (
+	GetUserSettingSql = `select u.Id,
+	                            u.Username,
+	                            u.VoiceReply,
+	                            u.CrtDate,
+	                            u.UpdDate,
+	                            u.Version
+	                       from UserSettingEntity u
+	                      where u.Username = ?`
+)
+
+func (self *PiAssistantDbHelper) GetUserSetting(username string) (*UserSettingEntity, error) {
+	list, err := self.dbmap.Select(UserSettingEntity{}, GetUserSettingSql, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > 0 {
+		return list[0].(*UserSettingEntity), nil
+	}
+	return nil, nil
+}
+
+func (self *PiAssistantDbHelper) AddUserSetting(entity *UserSettingEntity) error {
+	return self.dbmap.Insert(entity)
+}
+
+func (self *PiAssistantDbHelper) UpdateUserSetting(entity *UserSettingEntity) error {
+	_, err := self.dbmap.Update(entity)
+	return err
+}
+
+const (
+	GetAllVoicePhrasesSql = `select v.Id,
+	                                v.Username,
+	                                v.Phrase,
+	                                v.Command,
+	                                v.Args,
+	                                v.CrtDate,
+	                                v.UpdDate,
+	                                v.Version
+	                           from VoicePhraseEntity v`
+)
+
+func (self *PiAssistantDbHelper) GetAllVoicePhrases() ([]*VoicePhraseEntity, error) {
+	list, err := self.dbmap.Select(VoicePhraseEntity{}, GetAllVoicePhrasesSql)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]*VoicePhraseEntity, len(list))
+	for i, item := range list {
+		entities[i] = item.(*VoicePhraseEntity)
+	}
+	return entities, nil
+}
+
+const (
+	GetVoicePhraseSql = `select v.Id,
+	                            v.Username,
+	                            v.Phrase,
+	                            v.Command,
+	                            v.Args,
+	                            v.CrtDate,
+	                            v.UpdDate,
+	                            v.Version
+	                       from VoicePhraseEntity v
+	                      where v.Username = ?
+	                        and v.Phrase = ?`
+)
+
+func (self *PiAssistantDbHelper) GetVoicePhrase(username, phrase string) (*VoicePhraseEntity, error) {
+	list, err := self.dbmap.Select(VoicePhraseEntity{}, GetVoicePhraseSql, username, phrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > 0 {
+		return list[0].(*VoicePhraseEntity), nil
+	}
+	return nil, nil
+}
+
+func (self *PiAssistantDbHelper) AddVoicePhrase(entity *VoicePhraseEntity) error {
+	return self.dbmap.Insert(entity)
+}
+
+func (self *PiAssistantDbHelper) UpdateVoicePhrase(entity *VoicePhraseEntity) error {
+	_, err := self.dbmap.Update(entity)
+	return err
+}
+
+func (self *PiAssistantDbHelper) DeleteVoicePhrase(entity *VoicePhraseEntity) error {
+	_, err := self.dbmap.Delete(entity)
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	l4g "code.google.com/p/log4go"
+	"encoding/xml"
+	"fileserver"
+	"github.com/NoahShen/go-xmpp"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// message with out of band data (XEP-0066), the clients like Conversations
+// or Gajim show the url as a file
+type oobMessage struct {
+	XMLName xml.Name `xml:"jabber:client message"`
+	To      string   `xml:"to,attr"`
+	Type    string   `xml:"type,attr"`
+	Body    string   `xml:"body"`
+	Oob     oobData  `xml:"jabber:x:oob x"`
+}
+
+type oobData struct {
+	Url  string `xml:"url"`
+	Desc string `xml:"desc,omitempty"`
+}
+
+// the received message with the out of band data
+type receivedOobMessage struct {
+	XMLName xml.Name `xml:"message"`
+	Body    string   `xml:"body"`
+	Oob     *oobData `xml:"jabber:x:oob x"`
+}
+
+func (self *PiAssistant) initFileServer() error {
+	serverConf := self.piAssiConf.FileServerConf
+	if serverConf == nil {
+		return nil
+	}
+	fileServer, err := fileserver.NewFileServer(serverConf.Dir, serverConf.HttpAddr, serverConf.BaseUrl,
+		time.Duration(serverConf.Expiration)*time.Second)
+	if err != nil {
+		return err
+	}
+	self.fileServer = fileServer
+	return nil
+}
+
+func isHttpUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// parseOobUrl returns the url of out of band data (XEP-0066) in the message stanza
+func parseOobUrl(stanza []byte) (string, bool) {
+	msg := &receivedOobMessage{}
+	if err := xml.Unmarshal(stanza, msg); err != nil || msg.Oob == nil {
+		return "", false
+	}
+	oobUrl := strings.TrimSpace(msg.Oob.Url)
+	if !isHttpUrl(oobUrl) {
+		return "", false
+	}
+	return oobUrl, true
+}
+
+// splitFileMessage returns the file url and the options following it in the message, like
+// "https://host/a.torrent dir=/tmp category=movie", the options are passed to the service
+func splitFileMessage(text string) (string, []string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
+// the file uploaded by http upload (XEP-0363) is sent as a message which
+// body is the url of the file, the same url is in the out of band data.
+// the url of out of band data is accepted from any host, the body is
+// accepted only if it is the url of the configured upload hosts.
+// the options following the url in body are returned too
+func (self *PiAssistant) getUploadedFile(message *xmpp.Message) (string, []string, bool) {
+	fileConf := self.piAssiConf.FileConf
+	if fileConf == nil {
+		return "", nil, false
+	}
+	bodyUrl, options := splitFileMessage(message.Body)
+	// the extensions kept in the message are marshaled back for the out of band data
+	if stanza, err := xml.Marshal(message); err == nil {
+		if oobUrl, ok := parseOobUrl(stanza); ok {
+			if bodyUrl != oobUrl {
+				options = nil
+			}
+			return oobUrl, options, true
+		}
+	}
+	if !isHttpUrl(bodyUrl) {
+		return "", nil, false
+	}
+	u, _ := url.Parse(bodyUrl)
+	for _, host := range fileConf.UploadHosts {
+		if strings.EqualFold(u.Host, host) {
+			return bodyUrl, options, true
+		}
+	}
+	return "", nil, false
+}
+
+func (self *PiAssistant) sendFile(username, filePath string) {
+	if self.fileServer == nil {
+		l4g.Error("File server is not configured, can not send file: %s", filePath)
+		return
+	}
+	fileUrl, err := self.fileServer.Publish(filePath)
+	if err != nil {
+		l4g.Error("Publish file %s failed: %v", filePath, err)
+		return
+	}
+	msg := &oobMessage{
+		To:   username,
+		Type: "chat",
+		Body: fileUrl,
+		Oob:  oobData{Url: fileUrl, Desc: filepath.Base(filePath)},
+	}
+	self.xmppClient.Send(msg)
+}
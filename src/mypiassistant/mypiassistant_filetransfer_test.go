@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseOobUrl(t *testing.T) {
+	stanza := `<message from="master@example.com/phone" to="pi@example.com" type="chat" xmlns="jabber:client">` +
+		`<body>https://files.other.org/upload/abc/movie.torrent</body>` +
+		`<x xmlns="jabber:x:oob"><url>https://files.other.org/upload/abc/movie.torrent</url></x></message>`
+	if fileUrl, ok := parseOobUrl([]byte(stanza)); !ok || fileUrl != "https://files.other.org/upload/abc/movie.torrent" {
+		t.Fatal("unexpected oob url:", fileUrl, ok)
+	}
+	invalids := []string{
+		`<message type="chat"><body>https://files.other.org/a.torrent</body></message>`,
+		`<message type="chat"><x xmlns="jabber:x:oob"><url>file:///etc/passwd</url></x></message>`,
+		`<message type="chat"><x xmlns="jabber:x:data"><url>https://files.other.org/a.torrent</url></x></message>`,
+		`not xml`,
+	}
+	for _, s := range invalids {
+		if fileUrl, ok := parseOobUrl([]byte(s)); ok {
+			t.Errorf("%s should not have oob url: %s", s, fileUrl)
+		}
+	}
+}
+
+func TestSplitFileMessage(t *testing.T) {
+	fileUrl, options := splitFileMessage(" https://files.other.org/a.torrent @nas dir=/tmp/movie category=movie ")
+	if fileUrl != "https://files.other.org/a.torrent" || len(options) != 3 || options[0] != "@nas" || options[2] != "category=movie" {
+		t.Fatal("unexpected file message:", fileUrl, options)
+	}
+	if fileUrl, options := splitFileMessage("https://files.other.org/a.torrent"); fileUrl != "https://files.other.org/a.torrent" || len(options) != 0 {
+		t.Fatal("unexpected file message:", fileUrl, options)
+	}
+	if fileUrl, _ := splitFileMessage(" "); fileUrl != "" {
+		t.Fatal("unexpected file url:", fileUrl)
+	}
+}
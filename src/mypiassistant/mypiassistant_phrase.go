@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	l4g "code.google.com/p/log4go"
+	"errors"
+	"fmt"
+	"github.com/NoahShen/go-xmpp"
+	"service"
+	"strings"
+)
+
+type phraseFunc func(*PiAssistant, string, []string) (string, error)
+
+var phraseCommandMap = map[string]phraseFunc{
+	"addphrase": (*PiAssistant).addPhrase,
+	"rmphrase":  (*PiAssistant).removePhrase,
+	"myphrases": (*PiAssistant).listPhrases,
+}
+
+const (
+	phraseHelp = "[addphrase]: 添加自己的语音命令，如“addphrase 看看下载 getact”或“addphrase {city}空气好吗 currentaqi {city}”，主人可用“addphrase -g ...”添加所有人的语音命令\n" +
+		"[rmphrase]: 删除语音命令，如“rmphrase 看看下载”\n" +
+		"[myphrases]: 查看自己添加的语音命令\n"
+	globalPhraseFlag = "-g"
+)
+
+func (self *PiAssistant) loadUserPhrases() error {
+	entities, err := self.dbHelper.GetAllVoicePhrases()
+	if err != nil {
+		return err
+	}
+	for _, entity := range entities {
+		addErr := self.phraseRegistry.AddUserPhrase(entity.Username, entity.Phrase, entity.Command,
+			strings.Fields(entity.Args))
+		if addErr != nil {
+			l4g.Error("Invalid voice phrase [%s] of %s: %v", entity.Phrase, entity.Username, addErr)
+		}
+	}
+	return nil
+}
+
+func (self *PiAssistant) isMaster(username string) bool {
+	return strings.ToLower(xmpp.ToBareJID(username)) == strings.ToLower(self.piAssiConf.XmppConf.Master)
+}
+
+// return the owner of the phrase and the args without global flag
+func (self *PiAssistant) getPhraseOwner(username string, args []string) (string, []string, error) {
+	if len(args) > 0 && args[0] == globalPhraseFlag {
+		if !self.isMaster(username) {
+			return "", nil, errors.New("You are not my master!")
+		}
+		return "", args[1:], nil
+	}
+	return username, args, nil
+}
+
+func (self *PiAssistant) addPhrase(username string, args []string) (string, error) {
+	owner, phraseArgs, ownerErr := self.getPhraseOwner(username, args)
+	if ownerErr != nil {
+		return "", ownerErr
+	}
+	if len(phraseArgs) < 2 {
+		return "", errors.New("缺少参数!")
+	}
+	phrase := phraseArgs[0]
+	command := strings.ToLower(phraseArgs[1])
+	commandArgs := phraseArgs[2:]
+	if !self.isServiceCommand(command, commandArgs) {
+		return "", errors.New(fmt.Sprintf("不支持的命令[%s]！", command))
+	}
+	// the phrase is checked before saving, and added to the registry after saved
+	if checkErr := service.CheckPhrase(phrase, command, commandArgs); checkErr != nil {
+		return "", checkErr
+	}
+
+	entity, err := self.dbHelper.GetVoicePhrase(owner, phrase)
+	if err != nil {
+		l4g.Error("GetVoicePhrase error: username: %s, error: %v", owner, err)
+		return "", errors.New("添加失败！")
+	}
+	if entity == nil {
+		entity = &VoicePhraseEntity{}
+		entity.Username = owner
+		entity.Phrase = phrase
+		entity.Command = command
+		entity.Args = strings.Join(commandArgs, " ")
+		err = self.dbHelper.AddVoicePhrase(entity)
+	} else {
+		entity.Command = command
+		entity.Args = strings.Join(commandArgs, " ")
+		err = self.dbHelper.UpdateVoicePhrase(entity)
+	}
+	if err != nil {
+		l4g.Error("Save VoicePhrase error: username: %s, error: %v", owner, err)
+		return "", errors.New("添加失败！")
+	}
+	if addErr := self.phraseRegistry.AddUserPhrase(owner, phrase, command, commandArgs); addErr != nil {
+		return "", addErr
+	}
+	return "OK", nil
+}
+
+func (self *PiAssistant) isServiceCommand(command string, args []string) bool {
+	for _, s := range self.ServiceMgr.GetStartedServices() {
+		if s.CommandFilter(command, args) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *PiAssistant) removePhrase(username string, args []string) (string, error) {
+	owner, phraseArgs, ownerErr := self.getPhraseOwner(username, args)
+	if ownerErr != nil {
+		return "", ownerErr
+	}
+	if len(phraseArgs) == 0 {
+		return "", errors.New("缺少参数!")
+	}
+	phrase := phraseArgs[0]
+	entity, err := self.dbHelper.GetVoicePhrase(owner, phrase)
+	if err != nil {
+		l4g.Error("GetVoicePhrase error: username: %s, error: %v", owner, err)
+		return "", errors.New("删除失败！")
+	}
+	if entity == nil {
+		return "", errors.New("该语音命令不存在！")
+	}
+	if deleteErr := self.dbHelper.DeleteVoicePhrase(entity); deleteErr != nil {
+		l4g.Error("DeleteVoicePhrase error: username: %s, error: %v", owner, deleteErr)
+		return "", errors.New("删除失败！")
+	}
+	self.phraseRegistry.RemoveUserPhrase(owner, phrase)
+	return "OK", nil
+}
+
+func (self *PiAssistant) listPhrases(username string, args []string) (string, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("\n")
+	for _, phrase := range self.phraseRegistry.GetPhrases(username) {
+		buffer.WriteString(phrase + "\n")
+	}
+	globalPhrases := self.phraseRegistry.GetPhrases("")
+	if len(globalPhrases) > 0 {
+		buffer.WriteString("所有人的语音命令:\n")
+		for _, phrase := range globalPhrases {
+			buffer.WriteString(phrase + "\n")
+		}
+	}
+	if buffer.Len() == 1 {
+		return "无记录", nil
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"service"
+	"testing"
+)
+
+type fakeService struct {
+	commands map[string]bool
+}
+
+func (self *fakeService) GetServiceId() string                                     { return "fakeService" }
+func (self *fakeService) GetServiceName() string                                   { return "fake" }
+func (self *fakeService) Init(*json.RawMessage, chan<- *service.PushMessage) error { return nil }
+func (self *fakeService) StartService() error                                      { return nil }
+func (self *fakeService) IsStarted() bool                                          { return true }
+func (self *fakeService) Stop() error                                              { return nil }
+func (self *fakeService) GetHelpMessage() string                                   { return "" }
+func (self *fakeService) GetVoicePhrases() []service.VoicePhrase                   { return nil }
+func (self *fakeService) CommandFilter(command string, args []string) bool {
+	return self.commands[command]
+}
+func (self *fakeService) Handle(username, command string, args []string) (string, error) {
+	return "", nil
+}
+
+func TestMatchPhrase(t *testing.T) {
+	pi := NewPiAssistant()
+	pi.ServiceMgr.AddService(&fakeService{commands: map[string]bool{"getlogi": true, "查询快递": true}})
+	pi.phraseRegistry.RegisterService("fakeService", []service.VoicePhrase{
+		{Phrases: []string{"查询快递{name}"}, Command: "getlogi", Args: []string{"{name}"}},
+	})
+
+	// the typed command with args is kept
+	comm, args := pi.matchPhrase("user", "查询快递 顺丰 123456", "查询快递", []string{"顺丰", "123456"}, false)
+	if comm != "查询快递" || len(args) != 2 || args[0] != "顺丰" || args[1] != "123456" {
+		t.Fatal("unexpected typed command:", comm, args)
+	}
+	// the voice command is matched by phrase
+	comm, args = pi.matchPhrase("user", "查询快递 我的书", "查询快递", []string{"我的书"}, true)
+	if comm != "getlogi" || len(args) != 1 || args[0] != "我的书" {
+		t.Fatal("unexpected voice command:", comm, args)
+	}
+	// the typed text which is not a command is matched by phrase too
+	comm, args = pi.matchPhrase("user", "查询快递我的书", "查询快递我的书", []string{}, false)
+	if comm != "getlogi" || len(args) != 1 || args[0] != "我的书" {
+		t.Fatal("unexpected typed phrase:", comm, args)
+	}
+}
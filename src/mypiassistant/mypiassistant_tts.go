@@ -0,0 +1,112 @@
+package main
+
+import (
+	l4g "code.google.com/p/log4go"
+	"errors"
+	"fmt"
+	"service"
+	"strings"
+	"text2speech"
+	"time"
+)
+
+func (self *PiAssistant) initTts() error {
+	ttsConf := self.piAssiConf.TtsConf
+	if ttsConf == nil || !ttsConf.Enable {
+		return nil
+	}
+	if self.fileServer == nil {
+		if ttsConf.HttpAddr == "" {
+			return errors.New("voice reply needs file server or httpAddr of tts!")
+		}
+		voiceServer, err := text2speech.NewVoiceServer(ttsConf.FileDir, ttsConf.HttpAddr, ttsConf.BaseUrl,
+			time.Duration(ttsConf.Expiration)*time.Second)
+		if err != nil {
+			return err
+		}
+		self.voiceServer = voiceServer
+	}
+	self.synthesizer = text2speech.NewCommandSynthesizer(ttsConf.Command, ttsConf.Args, ttsConf.Format, ttsConf.FileDir)
+	return nil
+}
+
+const (
+	voiceReplyHelp = "[voicereply]: 语音命令的回复是否同时发送语音，如“voicereply on”或“voicereply off”\n"
+)
+
+var voiceReplyArgMap = map[string]int{
+	"on":  1,
+	"开":   1,
+	"off": 0,
+	"关":   0,
+}
+
+func (self *PiAssistant) setVoiceReply(username string, args []string) (string, error) {
+	if self.synthesizer == nil {
+		return "", errors.New("语音回复功能未开启！")
+	}
+	if len(args) == 0 {
+		return "", errors.New("缺少参数!")
+	}
+	voiceReply, ok := voiceReplyArgMap[strings.ToLower(args[0])]
+	if !ok {
+		return "", errors.New("参数错误！")
+	}
+	setting, err := self.dbHelper.GetUserSetting(username)
+	if err != nil {
+		l4g.Error("GetUserSetting error: username: %s, error: %v", username, err)
+		return "", errors.New("设置失败！")
+	}
+	if setting == nil {
+		setting = &UserSettingEntity{}
+		setting.Username = username
+		setting.VoiceReply = voiceReply
+		err = self.dbHelper.AddUserSetting(setting)
+	} else {
+		setting.VoiceReply = voiceReply
+		err = self.dbHelper.UpdateUserSetting(setting)
+	}
+	if err != nil {
+		l4g.Error("Save UserSetting error: username: %s, error: %v", username, err)
+		return "", errors.New("设置失败！")
+	}
+	return "OK", nil
+}
+
+func (self *PiAssistant) isVoiceReplyEnabled(username string) bool {
+	if self.synthesizer == nil {
+		return false
+	}
+	setting, err := self.dbHelper.GetUserSetting(username)
+	if err != nil {
+		l4g.Error("GetUserSetting error: username: %s, error: %v", username, err)
+		return false
+	}
+	return setting != nil && setting.VoiceReply == 1
+}
+
+// synthesize the reply in background, the voice file or url is sent by push message
+func (self *PiAssistant) sendVoiceReply(username, content string) {
+	go func() {
+		filePath, err := self.synthesizer.Synthesize(content)
+		if err != nil {
+			l4g.Error("Synthesize voice reply failed: %v", err)
+			return
+		}
+		pushMsg := &service.PushMessage{}
+		pushMsg.Type = service.Notification
+		pushMsg.Username = username
+		if self.voiceServer != nil {
+			url, publishErr := self.voiceServer.Publish(filePath)
+			if publishErr != nil {
+				l4g.Error("Publish voice reply failed: %v", publishErr)
+				return
+			}
+			pushMsg.Message = fmt.Sprintf("语音回复：%s", url)
+		} else {
+			pushMsg.FilePath = filePath
+			pushMsg.TempFile = true
+		}
+		self.pushMsgCh <- pushMsg
+	}()
+}
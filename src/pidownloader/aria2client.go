@@ -0,0 +1,241 @@
+package pidownloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// the rpc fails instead of blocking if the backend hangs, so the other backends are used
+const defaultRpcTimeout = 10 * time.Second
+
+type aria2Request struct {
+	JsonRpc string        `json:"jsonrpc"`
+	Id      string        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type aria2Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type aria2Response struct {
+	Id     string          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *aria2Error     `json:"error"`
+}
+
+// aria2Client calls the json rpc of an aria2 daemon
+type aria2Client struct {
+	name       string
+	rpcUrl     string
+	rpcVersion string
+	secret     string
+	wsUrl      string
+	local      bool
+	route      *routeRule
+	httpClient *http.Client
+	requestId  int64
+}
+
+func newAria2Client(c *backendConfig) *aria2Client {
+	client := &aria2Client{
+		name:       c.Name,
+		rpcUrl:     c.RpcUrl,
+		rpcVersion: c.RpcVersion,
+		secret:     c.RpcSecret,
+		wsUrl:      c.WsUrl,
+		local:      c.Local,
+		route:      c.Route,
+		httpClient: &http.Client{Timeout: defaultRpcTimeout},
+	}
+	if c.RpcTimeout > 0 {
+		client.httpClient.Timeout = time.Duration(c.RpcTimeout) * time.Second
+	}
+	if client.rpcVersion == "" {
+		client.rpcVersion = "2.0"
+	}
+	if client.wsUrl == "" {
+		client.wsUrl = getWsUrl(c.RpcUrl)
+	}
+	return client
+}
+
+func (self *aria2Client) getName() string {
+	return self.name
+}
+
+func (self *aria2Client) getAddress() string {
+	return self.rpcUrl
+}
+
+func (self *aria2Client) isLocal() bool {
+	return self.local
+}
+
+func (self *aria2Client) getRoute() *routeRule {
+	return self.route
+}
+
+// call the method of aria2, the result is unmarshaled to result if it is not nil
+func (self *aria2Client) call(method string, result interface{}, params ...interface{}) error {
+	id := atomic.AddInt64(&self.requestId, 1)
+	req := &aria2Request{self.rpcVersion, strconv.FormatInt(id, 10), "aria2." + method, []interface{}{}}
+	if self.secret != "" {
+		req.Params = append(req.Params, "token:"+self.secret)
+	}
+	req.Params = append(req.Params, params...)
+	reqBytes, marshalErr := json.Marshal(req)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	httpResp, postErr := self.httpClient.Post(self.rpcUrl, "application/json", bytes.NewReader(reqBytes))
+	if postErr != nil {
+		return postErr
+	}
+	defer httpResp.Body.Close()
+	respBytes, readErr := ioutil.ReadAll(httpResp.Body)
+	if readErr != nil {
+		return readErr
+	}
+	resp := &aria2Response{}
+	if unmarshalErr := json.Unmarshal(respBytes, resp); unmarshalErr != nil {
+		return unmarshalErr
+	}
+	if resp.Error != nil {
+		return errors.New(fmt.Sprintf("aria2 error %d: %s", resp.Error.Code, resp.Error.Message))
+	}
+	if result != nil {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+func (self *aria2Client) addUri(uris []string, options map[string]interface{}) (string, error) {
+	var gid string
+	err := self.call("addUri", &gid, uris, options)
+	return gid, err
+}
+
+// add the base64 encoded torrent
+func (self *aria2Client) addTorrent(torrent string, options map[string]interface{}) (string, error) {
+	var gid string
+	err := self.call("addTorrent", &gid, torrent, []string{}, options)
+	return gid, err
+}
+
+// add the base64 encoded metalink
+func (self *aria2Client) addMetalink(metalink string, options map[string]interface{}) ([]string, error) {
+	var gids []string
+	err := self.call("addMetalink", &gids, metalink, options)
+	return gids, err
+}
+
+func (self *aria2Client) remove(gid string) error {
+	return self.call("forceRemove", nil, gid)
+}
+
+func (self *aria2Client) pause(gid string) error {
+	return self.call("forcePause", nil, gid)
+}
+
+func (self *aria2Client) unpause(gid string) error {
+	return self.call("unpause", nil, gid)
+}
+
+func (self *aria2Client) pauseAll() error {
+	return self.call("forcePauseAll", nil)
+}
+
+func (self *aria2Client) unpauseAll() error {
+	return self.call("unpauseAll", nil)
+}
+
+func (self *aria2Client) changeGlobalOption(options map[string]string) error {
+	return self.call("changeGlobalOption", nil, options)
+}
+
+func (self *aria2Client) getGlobalStat() (map[string]string, error) {
+	var stat map[string]string
+	err := self.call("getGlobalStat", &stat)
+	return stat, err
+}
+
+func (self *aria2Client) tellStatus(gid string, keys []string) (map[string]interface{}, error) {
+	var task map[string]interface{}
+	var err error
+	if keys == nil {
+		err = self.call("tellStatus", &task, gid)
+	} else {
+		err = self.call("tellStatus", &task, gid, keys)
+	}
+	return task, err
+}
+
+func (self *aria2Client) tellActive(keys []string) ([]map[string]interface{}, error) {
+	var tasks []map[string]interface{}
+	err := self.call("tellActive", &tasks, keys)
+	return tasks, err
+}
+
+func (self *aria2Client) tellWaiting(offset, num int, keys []string) ([]map[string]interface{}, error) {
+	var tasks []map[string]interface{}
+	err := self.call("tellWaiting", &tasks, offset, num, keys)
+	return tasks, err
+}
+
+func (self *aria2Client) tellStopped(offset, num int, keys []string) ([]map[string]interface{}, error) {
+	var tasks []map[string]interface{}
+	err := self.call("tellStopped", &tasks, offset, num, keys)
+	return tasks, err
+}
+
+func (self *aria2Client) getGlobalOption() (map[string]string, error) {
+	var options map[string]string
+	err := self.call("getGlobalOption", &options)
+	return options, err
+}
+
+func (self *aria2Client) getFiles(gid string) ([]aria2File, error) {
+	var files []aria2File
+	err := self.call("getFiles", &files, gid)
+	return files, err
+}
+
+func (self *aria2Client) getOption(gid string) (map[string]string, error) {
+	var options map[string]string
+	err := self.call("getOption", &options, gid)
+	return options, err
+}
+
+func (self *aria2Client) changeOption(gid string, options map[string]interface{}) error {
+	return self.call("changeOption", nil, gid, options)
+}
+
+func (self *aria2Client) changePosition(gid string, pos int, how string) (int, error) {
+	var position int
+	err := self.call("changePosition", &position, gid, pos, how)
+	return position, err
+}
+
+func (self *aria2Client) getPeers(gid string) ([]interface{}, error) {
+	var peers []interface{}
+	err := self.call("getPeers", &peers, gid)
+	return peers, err
+}
+
+func (self *aria2Client) removeDownloadResult(gid string) error {
+	return self.call("removeDownloadResult", nil, gid)
+}
+
+func (self *aria2Client) purgeDownloadResult() error {
+	return self.call("purgeDownloadResult", nil)
+}
@@ -0,0 +1,751 @@
+package pidownloader
+
+import (
+	l4g "code.google.com/p/log4go"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"utils"
+)
+
+const (
+	nativeBackendType        = "native"
+	nativeBackendName        = "native"
+	defaultNativeConcurrent  = 2
+	partFileSuffix           = ".part"
+	nativeReadBufferSize     = 32 * 1024
+	nativeSpeedSampleSeconds = 1
+	nativeConnectTimeout     = 30 * time.Second
+	nativeHeaderTimeout      = 60 * time.Second // the body is not limited since the download may take hours
+)
+
+// newNativeTransport returns the transport which fails if the server hangs before responding
+func newNativeTransport(proxy *url.URL) *http.Transport {
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  (&net.Dialer{Timeout: nativeConnectTimeout, KeepAlive: 30 * time.Second}).Dial,
+		TLSHandshakeTimeout:   nativeConnectTimeout,
+		ResponseHeaderTimeout: nativeHeaderTimeout,
+	}
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return transport
+}
+
+// httpTask is the task of native downloader
+type httpTask struct {
+	gid             string
+	uris            []string
+	dir             string
+	out             string
+	options         map[string]string
+	headers         []string
+	status          string
+	totalLength     int64
+	completedLength int64
+	downloadSpeed   int64
+	errorCode       string
+	errorMessage    string
+	stop            chan bool // closed to stop the running download
+	speedStart      time.Time
+	speedBytes      int64
+}
+
+// httpDownloader downloads http and https uris without aria2, the files are resumed by range requests.
+// the tasks are described in the same way as aria2, so that the commands work on both of them
+type httpDownloader struct {
+	name          string
+	dir           string
+	maxConcurrent int
+	route         *routeRule
+	client        *http.Client
+	tasks         map[string]*httpTask
+	active        []string
+	waiting       []string // the waiting and paused tasks
+	stopped       []string
+	speedLimit    int64
+	windowStart   time.Time
+	windowBytes   int64
+	onStop        func(gid string) // called when the task is completed, failed or removed
+	lock          sync.Mutex
+}
+
+func newHttpDownloader(c *backendConfig) (*httpDownloader, error) {
+	if c.Dir == "" {
+		return nil, errors.New("dir of native backend is required")
+	}
+	maxConcurrent := c.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultNativeConcurrent
+	}
+	return &httpDownloader{
+		name:          c.Name,
+		dir:           c.Dir,
+		maxConcurrent: maxConcurrent,
+		route:         c.Route,
+		client:        &http.Client{Transport: newNativeTransport(nil)},
+		tasks:         make(map[string]*httpTask),
+		active:        make([]string, 0),
+		waiting:       make([]string, 0),
+		stopped:       make([]string, 0),
+	}, nil
+}
+
+func newGid() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// the file name is the last part of uri path
+func getUriFileName(uri string) string {
+	u, err := url.Parse(uri)
+	if err == nil {
+		name := path.Base(u.Path)
+		if name != "" && name != "." && name != "/" {
+			return name
+		}
+	}
+	return "index.html"
+}
+
+func removeGid(gids []string, gid string) ([]string, bool) {
+	for i, g := range gids {
+		if g == gid {
+			return append(gids[:i], gids[i+1:]...), true
+		}
+	}
+	return gids, false
+}
+
+func (self *httpDownloader) getName() string {
+	return self.name
+}
+
+func (self *httpDownloader) getAddress() string {
+	return self.dir
+}
+
+func (self *httpDownloader) isLocal() bool {
+	return true
+}
+
+func (self *httpDownloader) getRoute() *routeRule {
+	return self.route
+}
+
+func (self *httpDownloader) addUri(uris []string, options map[string]interface{}) (string, error) {
+	if len(uris) == 0 {
+		return "", errors.New("no uris")
+	}
+	for _, uri := range uris {
+		if !utils.IsHttpUrl(uri) {
+			return "", errors.New("only http and https are supported by native backend: " + uri)
+		}
+	}
+	task := &httpTask{
+		uris:    uris,
+		dir:     self.dir,
+		out:     getUriFileName(uris[0]),
+		options: make(map[string]string),
+		headers: toStringList(options["header"]),
+		status:  "waiting",
+	}
+	for key, value := range options {
+		task.options[key] = fmt.Sprint(value)
+	}
+	if len(task.headers) > 0 {
+		task.options["header"] = strings.Join(task.headers, "\n")
+	}
+	if dir := task.options["dir"]; dir != "" {
+		task.dir = dir
+	}
+	if out := task.options["out"]; out != "" {
+		task.out = out
+	}
+	if task.options["pause"] == "true" {
+		task.status = "paused"
+	}
+	self.lock.Lock()
+	task.gid = task.options["gid"]
+	if task.gid == "" {
+		task.gid = newGid()
+	} else if self.tasks[task.gid] != nil {
+		self.lock.Unlock()
+		return "", errors.New("gid is used: " + task.gid)
+	}
+	self.tasks[task.gid] = task
+	self.waiting = append(self.waiting, task.gid)
+	self.lock.Unlock()
+	self.schedule()
+	return task.gid, nil
+}
+
+func (self *httpDownloader) addTorrent(torrent string, options map[string]interface{}) (string, error) {
+	return "", errors.New("torrent is not supported by native backend")
+}
+
+func (self *httpDownloader) addMetalink(metalink string, options map[string]interface{}) ([]string, error) {
+	return nil, errors.New("metalink is not supported by native backend")
+}
+
+// schedule starts the waiting tasks until the concurrency limit is reached
+func (self *httpDownloader) schedule() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i := 0; i < len(self.waiting) && len(self.active) < self.maxConcurrent; {
+		task := self.tasks[self.waiting[i]]
+		if task.status != "waiting" {
+			i++
+			continue
+		}
+		self.waiting = append(self.waiting[:i], self.waiting[i+1:]...)
+		self.active = append(self.active, task.gid)
+		task.status = "active"
+		task.stop = make(chan bool)
+		go self.run(task, task.stop)
+	}
+}
+
+func (self *httpDownloader) run(task *httpTask, stop chan bool) {
+	var errorCode string
+	var err error
+	for _, uri := range task.uris {
+		errorCode, err = self.download(task, uri, stop)
+		if err == nil {
+			break
+		}
+		select {
+		case <-stop:
+			return // paused or removed
+		default:
+		}
+		l4g.Error("Download %s error: %v", uri, err)
+	}
+	self.lock.Lock()
+	if task.stop != stop {
+		self.lock.Unlock()
+		return
+	}
+	task.stop = nil
+	task.downloadSpeed = 0
+	if err != nil {
+		task.status = "error"
+		task.errorCode = errorCode
+		task.errorMessage = err.Error()
+	} else {
+		task.status = "complete"
+	}
+	self.active, _ = removeGid(self.active, task.gid)
+	self.stopped = append(self.stopped, task.gid)
+	self.lock.Unlock()
+	self.schedule()
+	self.notifyStop(task.gid)
+}
+
+func (self *httpDownloader) notifyStop(gid string) {
+	if self.onStop != nil {
+		go self.onStop(gid)
+	}
+}
+
+// download the uri to the part file, the downloaded part is resumed by range request.
+// the error code of aria2 is returned when failed
+func (self *httpDownloader) download(task *httpTask, uri string, stop chan bool) (string, error) {
+	filePath := filepath.Join(task.dir, task.out)
+	partPath := filePath + partFileSuffix
+	if err := os.MkdirAll(task.dir, 0755); err != nil {
+		return "18", err
+	}
+	var offset int64 = 0
+	if info, statErr := os.Stat(partPath); statErr == nil {
+		offset = info.Size()
+	}
+	req, reqErr := http.NewRequest("GET", uri, nil)
+	if reqErr != nil {
+		return "1", reqErr
+	}
+	setRequestHeaders(req, task)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	client, clientErr := self.getClient(task)
+	if clientErr != nil {
+		return "28", clientErr
+	}
+	resp, respErr := client.Do(req)
+	if respErr != nil {
+		return "6", respErr
+	}
+	defer resp.Body.Close()
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		// unblock the reading when the task is stopped
+		select {
+		case <-stop:
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+	flag := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flag |= os.O_APPEND
+	case http.StatusOK:
+		offset = 0
+		flag |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(partPath)
+		return "8", errors.New(resp.Status)
+	case http.StatusNotFound:
+		return "3", errors.New(resp.Status)
+	default:
+		return "22", errors.New(resp.Status)
+	}
+	var total int64 = 0
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	self.lock.Lock()
+	task.totalLength = total
+	task.completedLength = offset
+	task.speedStart = time.Now()
+	task.speedBytes = 0
+	self.lock.Unlock()
+	file, openErr := os.OpenFile(partPath, flag, 0644)
+	if openErr != nil {
+		return "16", openErr
+	}
+	buf := make([]byte, nativeReadBufferSize)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, writeErr := file.Write(buf[:n]); writeErr != nil {
+				file.Close()
+				return "17", writeErr
+			}
+			self.updateProgress(task, int64(n))
+			self.throttle(int64(n))
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			file.Close()
+			return "6", readErr
+		}
+	}
+	file.Close()
+	self.lock.Lock()
+	completed := task.completedLength
+	self.lock.Unlock()
+	if total > 0 && completed != total {
+		return "6", errors.New(fmt.Sprintf("incomplete download: %d/%d", completed, total))
+	}
+	if total == 0 {
+		self.lock.Lock()
+		task.totalLength = completed
+		self.lock.Unlock()
+	}
+	if err := os.Rename(partPath, filePath); err != nil {
+		return "14", err
+	}
+	return "", nil
+}
+
+// setRequestHeaders sets the header, user-agent and referer options of task
+func setRequestHeaders(req *http.Request, task *httpTask) {
+	for _, header := range task.headers {
+		nameValue := strings.SplitN(header, ":", 2)
+		if len(nameValue) == 2 {
+			req.Header.Add(strings.TrimSpace(nameValue[0]), strings.TrimSpace(nameValue[1]))
+		}
+	}
+	if userAgent := task.options["user-agent"]; userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	if referer := task.options["referer"]; referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+}
+
+// getClient returns the client using the all-proxy option of task
+func (self *httpDownloader) getClient(task *httpTask) (*http.Client, error) {
+	proxy := task.options["all-proxy"]
+	if proxy == "" {
+		return self.client, nil
+	}
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: newNativeTransport(proxyUrl)}, nil
+}
+
+func (self *httpDownloader) updateProgress(task *httpTask, n int64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	task.completedLength += n
+	task.speedBytes += n
+	elapsed := time.Since(task.speedStart)
+	if elapsed >= nativeSpeedSampleSeconds*time.Second {
+		task.downloadSpeed = int64(float64(task.speedBytes) / elapsed.Seconds())
+		task.speedStart = time.Now()
+		task.speedBytes = 0
+	}
+}
+
+// throttle sleeps until the next second once the overall speed limit is reached
+func (self *httpDownloader) throttle(n int64) {
+	self.lock.Lock()
+	if self.speedLimit <= 0 {
+		self.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	if now.Sub(self.windowStart) >= time.Second {
+		self.windowStart = now
+		self.windowBytes = 0
+	}
+	self.windowBytes += n
+	var wait time.Duration = 0
+	if self.windowBytes >= self.speedLimit {
+		wait = self.windowStart.Add(time.Second).Sub(now)
+	}
+	self.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// stopTask stops the running download, the lock should be held
+func (self *httpDownloader) stopTask(task *httpTask) {
+	if task.stop != nil {
+		close(task.stop)
+		task.stop = nil
+	}
+	task.downloadSpeed = 0
+	self.active, _ = removeGid(self.active, task.gid)
+}
+
+func (self *httpDownloader) remove(gid string) error {
+	self.lock.Lock()
+	task := self.tasks[gid]
+	if task == nil || task.status == "complete" || task.status == "error" || task.status == "removed" {
+		self.lock.Unlock()
+		return errors.New("no active or waiting task: " + gid)
+	}
+	self.stopTask(task)
+	self.waiting, _ = removeGid(self.waiting, gid)
+	task.status = "removed"
+	self.stopped = append(self.stopped, gid)
+	self.lock.Unlock()
+	self.schedule()
+	self.notifyStop(gid)
+	return nil
+}
+
+func (self *httpDownloader) pause(gid string) error {
+	self.lock.Lock()
+	task := self.tasks[gid]
+	if task == nil {
+		self.lock.Unlock()
+		return errors.New("no such task: " + gid)
+	}
+	switch task.status {
+	case "active":
+		self.stopTask(task)
+		self.waiting = append([]string{gid}, self.waiting...)
+	case "waiting":
+	default:
+		self.lock.Unlock()
+		return errors.New("task is not active or waiting: " + gid)
+	}
+	task.status = "paused"
+	self.lock.Unlock()
+	self.schedule()
+	return nil
+}
+
+func (self *httpDownloader) unpause(gid string) error {
+	self.lock.Lock()
+	task := self.tasks[gid]
+	if task == nil || task.status != "paused" {
+		self.lock.Unlock()
+		return errors.New("task is not paused: " + gid)
+	}
+	task.status = "waiting"
+	self.lock.Unlock()
+	self.schedule()
+	return nil
+}
+
+func (self *httpDownloader) pauseAll() error {
+	self.lock.Lock()
+	paused := make([]string, 0, len(self.active))
+	for _, gid := range self.active {
+		task := self.tasks[gid]
+		if task.stop != nil {
+			close(task.stop)
+			task.stop = nil
+		}
+		task.downloadSpeed = 0
+		task.status = "paused"
+		paused = append(paused, gid)
+	}
+	self.active = make([]string, 0)
+	self.waiting = append(paused, self.waiting...)
+	for _, gid := range self.waiting {
+		self.tasks[gid].status = "paused"
+	}
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *httpDownloader) unpauseAll() error {
+	self.lock.Lock()
+	for _, gid := range self.waiting {
+		self.tasks[gid].status = "waiting"
+	}
+	self.lock.Unlock()
+	self.schedule()
+	return nil
+}
+
+func (self *httpDownloader) changeGlobalOption(options map[string]string) error {
+	self.lock.Lock()
+	for key, value := range options {
+		switch key {
+		case "max-overall-download-limit":
+			limit, err := utils.ParseSize(value)
+			if err != nil {
+				self.lock.Unlock()
+				return err
+			}
+			self.speedLimit = limit
+		case "max-concurrent-downloads":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				self.lock.Unlock()
+				return errors.New("invalid max-concurrent-downloads: " + value)
+			}
+			self.maxConcurrent = n
+		case "dir":
+			self.dir = value
+		default:
+			self.lock.Unlock()
+			return errors.New("option is not supported by native backend: " + key)
+		}
+	}
+	self.lock.Unlock()
+	self.schedule()
+	return nil
+}
+
+func (self *httpDownloader) getGlobalOption() (map[string]string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return map[string]string{
+		"dir":                        self.dir,
+		"max-concurrent-downloads":   strconv.Itoa(self.maxConcurrent),
+		"max-overall-download-limit": strconv.FormatInt(self.speedLimit, 10),
+	}, nil
+}
+
+func (self *httpDownloader) getGlobalStat() (map[string]string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var speed int64 = 0
+	for _, gid := range self.active {
+		speed += self.tasks[gid].downloadSpeed
+	}
+	return map[string]string{
+		"downloadSpeed": strconv.FormatInt(speed, 10),
+		"uploadSpeed":   "0",
+		"numActive":     strconv.Itoa(len(self.active)),
+		"numWaiting":    strconv.Itoa(len(self.waiting)),
+		"numStopped":    strconv.Itoa(len(self.stopped)),
+	}, nil
+}
+
+// toStatus describes the task like the tellStatus of aria2, the lock should be held
+func (self *httpTask) toStatus() map[string]interface{} {
+	uris := make([]interface{}, 0, len(self.uris))
+	for _, uri := range self.uris {
+		uris = append(uris, map[string]interface{}{"uri": uri, "status": "used"})
+	}
+	connections := "0"
+	if self.status == "active" {
+		connections = "1"
+	}
+	status := map[string]interface{}{
+		"gid":             self.gid,
+		"status":          self.status,
+		"totalLength":     strconv.FormatInt(self.totalLength, 10),
+		"completedLength": strconv.FormatInt(self.completedLength, 10),
+		"downloadSpeed":   strconv.FormatInt(self.downloadSpeed, 10),
+		"uploadSpeed":     "0",
+		"uploadLength":    "0",
+		"connections":     connections,
+		"dir":             self.dir,
+		"files": []interface{}{map[string]interface{}{
+			"index":           "1",
+			"path":            filepath.Join(self.dir, self.out),
+			"length":          strconv.FormatInt(self.totalLength, 10),
+			"completedLength": strconv.FormatInt(self.completedLength, 10),
+			"selected":        "true",
+			"uris":            uris,
+		}},
+	}
+	if self.errorCode != "" {
+		status["errorCode"] = self.errorCode
+		status["errorMessage"] = self.errorMessage
+	}
+	return status
+}
+
+func (self *httpDownloader) tellStatus(gid string, keys []string) (map[string]interface{}, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	task := self.tasks[gid]
+	if task == nil {
+		return nil, errors.New("no such task: " + gid)
+	}
+	return task.toStatus(), nil
+}
+
+// tellTasks describes the tasks of gids from offset, the lock should be held
+func (self *httpDownloader) tellTasks(gids []string, offset, num int) []map[string]interface{} {
+	tasks := make([]map[string]interface{}, 0)
+	for i := offset; i < len(gids) && len(tasks) < num; i++ {
+		tasks = append(tasks, self.tasks[gids[i]].toStatus())
+	}
+	return tasks
+}
+
+func (self *httpDownloader) tellActive(keys []string) ([]map[string]interface{}, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.tellTasks(self.active, 0, len(self.active)), nil
+}
+
+func (self *httpDownloader) tellWaiting(offset, num int, keys []string) ([]map[string]interface{}, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.tellTasks(self.waiting, offset, num), nil
+}
+
+func (self *httpDownloader) tellStopped(offset, num int, keys []string) ([]map[string]interface{}, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.tellTasks(self.stopped, offset, num), nil
+}
+
+func (self *httpDownloader) getFiles(gid string) ([]aria2File, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	task := self.tasks[gid]
+	if task == nil {
+		return nil, errors.New("no such task: " + gid)
+	}
+	return []aria2File{{
+		Index:           "1",
+		Path:            filepath.Join(task.dir, task.out),
+		Length:          strconv.FormatInt(task.totalLength, 10),
+		CompletedLength: strconv.FormatInt(task.completedLength, 10),
+		Selected:        "true",
+	}}, nil
+}
+
+func (self *httpDownloader) getOption(gid string) (map[string]string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	task := self.tasks[gid]
+	if task == nil {
+		return nil, errors.New("no such task: " + gid)
+	}
+	options := make(map[string]string)
+	for key, value := range task.options {
+		options[key] = value
+	}
+	options["dir"] = task.dir
+	options["out"] = task.out
+	return options, nil
+}
+
+func (self *httpDownloader) changeOption(gid string, options map[string]interface{}) error {
+	return errors.New("changing task options is not supported by native backend")
+}
+
+func (self *httpDownloader) changePosition(gid string, pos int, how string) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	index := -1
+	for i, g := range self.waiting {
+		if g == gid {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return 0, errors.New("task is not waiting: " + gid)
+	}
+	var position int
+	switch how {
+	case "POS_SET":
+		position = pos
+	case "POS_CUR":
+		position = index + pos
+	case "POS_END":
+		position = len(self.waiting) - 1 + pos
+	default:
+		return 0, errors.New("invalid position: " + how)
+	}
+	if position < 0 {
+		position = 0
+	} else if position >= len(self.waiting) {
+		position = len(self.waiting) - 1
+	}
+	self.waiting = append(self.waiting[:index], self.waiting[index+1:]...)
+	self.waiting = append(self.waiting[:position], append([]string{gid}, self.waiting[position:]...)...)
+	return position, nil
+}
+
+func (self *httpDownloader) getPeers(gid string) ([]interface{}, error) {
+	return []interface{}{}, nil
+}
+
+func (self *httpDownloader) removeDownloadResult(gid string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var removed bool
+	if self.stopped, removed = removeGid(self.stopped, gid); !removed {
+		return errors.New("no download result: " + gid)
+	}
+	delete(self.tasks, gid)
+	return nil
+}
+
+func (self *httpDownloader) purgeDownloadResult() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, gid := range self.stopped {
+		delete(self.tasks, gid)
+	}
+	self.stopped = make([]string, 0)
+	return nil
+}
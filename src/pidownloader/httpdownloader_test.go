@@ -0,0 +1,93 @@
+package pidownloader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpDownloaderResume(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	var lastRange string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastRange = r.Header.Get("Range")
+		http.ServeContent(w, r, "test.bin", time.Now(), bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "httpdownloader")
+	defer os.RemoveAll(dir)
+	// the part downloaded before
+	ioutil.WriteFile(filepath.Join(dir, "test.bin"+partFileSuffix), content[:4000], 0644)
+
+	native, err := newHttpDownloader(&backendConfig{Name: "native", Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan string, 1)
+	native.onStop = func(gid string) {
+		stopped <- gid
+	}
+	gid, addErr := native.addUri([]string{server.URL + "/test.bin"}, nil)
+	if addErr != nil {
+		t.Fatal(addErr)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("download timeout")
+	}
+	task, _ := native.tellStatus(gid, nil)
+	if task["status"] != "complete" || task["totalLength"] != "10000" || task["completedLength"] != "10000" {
+		t.Fatalf("unexpected task: %v", task)
+	}
+	if lastRange != "bytes=4000-" {
+		t.Fatalf("unexpected range: %s", lastRange)
+	}
+	downloaded, _ := ioutil.ReadFile(filepath.Join(dir, "test.bin"))
+	if !bytes.Equal(downloaded, content) {
+		t.Fatal("downloaded content is different")
+	}
+	if stopped, _ := native.tellStopped(0, 10, nil); len(stopped) != 1 {
+		t.Fatalf("unexpected stopped tasks: %v", stopped)
+	}
+	if err := native.removeDownloadResult(gid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHttpDownloaderQueue(t *testing.T) {
+	native, _ := newHttpDownloader(&backendConfig{Name: "native", Dir: os.TempDir(), MaxConcurrent: 1})
+	native.pauseAll()
+	gids := make([]string, 0)
+	for _, uri := range []string{"http://example.com/a.zip", "http://example.com/b.zip", "http://example.com/c.zip"} {
+		gid, err := native.addUri([]string{uri}, map[string]interface{}{"pause": "true"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gids = append(gids, gid)
+	}
+	if _, err := native.addUri([]string{"magnet:?xt=urn:btih:abc"}, nil); err == nil {
+		t.Fatal("magnet link should be rejected")
+	}
+	position, err := native.changePosition(gids[2], 0, "POS_SET")
+	if err != nil || position != 0 {
+		t.Fatalf("unexpected position: %d, %v", position, err)
+	}
+	waiting, _ := native.tellWaiting(0, 10, nil)
+	if len(waiting) != 3 || waiting[0]["gid"] != gids[2] || waiting[0]["status"] != "paused" {
+		t.Fatalf("unexpected waiting tasks: %v", waiting)
+	}
+	if err := native.remove(gids[0]); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := native.getGlobalStat()
+	if stat["numWaiting"] != "2" || stat["numStopped"] != "1" {
+		t.Fatalf("unexpected stat: %v", stat)
+	}
+}
@@ -5,24 +5,44 @@ import (
 	l4g "code.google.com/p/log4go"
 	"encoding/json"
 	"errors"
+	"fileserver"
 	"fmt"
-	"github.com/NoahShen/aria2rpc"
 	"github.com/robfig/cron"
 	"path"
 	"service"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"utils"
 )
 
-type processFunc func(*PiDownloader, []string) (string, error)
+type processFunc func(*PiDownloader, string, []string) (string, error)
 
 var commandHelp = map[string]string{
-	"add":        "add download url",
-	"rm":         "remove specific task by gid",
-	"pause":      "get current logistics message, like getlogi name or getlogi company logistics id",
+	"add":        "add download url or magnet link, followed by options like dir=/tmp, category=movie, checksum=sha-1=hex, mirrors=url1;url2 or profile=name",
+	"addat":      "add download at the time, like addat 02:00 url, addat 明天凌晨2点 url or addat in 3h url",
+	"lsat":       "list scheduled downloads",
+	"rmat":       "cancel scheduled download by id",
+	"backends":   "list download backends, add @name to commands to specify the backend, like getact @nas",
+	"btfiles":    "list files of the bt task by gid",
+	"btselect":   "select files of the bt task to download, like btselect gid 1,3-5",
+	"dlhistory":  "search the download history, like dlhistory keyword",
+	"speedplan":  "show or edit the speed limit plan, type \"speedplan help\" for details",
+	"profile":    "show or edit the download profiles of sites, type \"profile help\" for details",
+	"addfeed":    "subscribe rss or atom feed, like addfeed name url include=regex exclude=regex dir=/tmp",
+	"lsfeed":     "list subscribed feeds",
+	"testfeed":   "show the matched items of feed, like testfeed name or testfeed url include=regex",
+	"rmfeed":     "remove subscribed feed by name",
+	"info":       "show the details of task by gid",
+	"share":      "share the files of completed task by links on LAN, like share gid, share gid 2 or share gid ttl=30m",
+	"opt":        "change the options of task, like opt gid max-download-limit=100K",
+	"prio":       "move the waiting task, like prio gid top|up|down|bottom",
+	"rm":         "remove tasks by gids or selectors: all, status=error, name~regex, owner=me",
+	"pause":      "pause tasks by gids or selectors: all, status=active, name~regex, owner=me",
 	"pauseall":   "pause all tasks",
-	"unpause":    "unpause specific task by gid",
+	"unpause":    "unpause tasks by gids or selectors: all, status=paused, name~regex, owner=me",
+	"purge":      "remove the results of stopped tasks, all if no gids or selectors",
 	"unpauseall": "unpause all tasks",
 	"maxspd":     "set max download speed, 0 for unlimit",
 	"getact":     "get active tasks",
@@ -32,17 +52,56 @@ var commandHelp = map[string]string{
 }
 
 type PiDownloader struct {
-	commandMap      map[string]processFunc
-	voiceCommandMap map[string]string
-	pushMsgChannel  chan<- *service.PushMessage
-	cron            *cron.Cron
-	started         bool
+	commandMap       map[string]processFunc
+	backends         []downloader
+	backendMap       map[string]downloader
+	fallback         downloader // the native backend used when aria2 is unavailable
+	pushMsgChannel   chan<- *service.PushMessage
+	cron             *cron.Cron
+	notifier         *taskNotifier
+	dbHelper         *DownloaderDbHelper
+	admins           []string
+	speedPlan        *speedPlan
+	appliedLimit     string
+	planPausedGids   map[string][]string // backend -> the gids paused by speed plan
+	statusTemplate   string
+	lastStatus       string
+	speedPlanLock    sync.Mutex
+	postProcessRules []*postProcessRule
+	configProfiles   []*downloadProfile
+	profiles         []*downloadProfile
+	profileLock      sync.Mutex
+	shareServer      *fileserver.ShareServer
+	shareTtl         time.Duration
+	scheduleTimers   map[int64]*time.Timer
+	scheduleLock     sync.Mutex
+	diskGuard        *diskGuard
+	maxRetries       int
+	retryDelay       time.Duration
+	retryTimers      map[string]*time.Timer // gid -> the timer of pending retry
+	retryLock        sync.Mutex
+	started          bool
 }
 
 type config struct {
-	RpcUrl         string `json:"rpcUrl,omitempty"`
-	RpcVersion     string `json:"rpcVersion,omitempty"`
-	StatUpdateCron string `json:"statUpdateCron,omitempty"`
+	RpcUrl         string             `json:"rpcUrl,omitempty"`
+	RpcVersion     string             `json:"rpcVersion,omitempty"`
+	RpcSecret      string             `json:"rpcSecret,omitempty"`
+	Backends       []*backendConfig   `json:"backends,omitempty"`
+	Fallback       *backendConfig     `json:"fallback,omitempty"`
+	StatUpdateCron string             `json:"statUpdateCron,omitempty"`
+	StatusTemplate string             `json:"statusTemplate,omitempty"`
+	WsUrl          string             `json:"wsUrl,omitempty"`
+	NotifyPollCron string             `json:"notifyPollCron,omitempty"`
+	DbFile         string             `json:"dbFile,omitempty"`
+	Admins         []string           `json:"admins,omitempty"`
+	SpeedPlan      *speedPlanConfig   `json:"speedPlan,omitempty"`
+	PostProcess    []*postProcessRule `json:"postProcess,omitempty"`
+	Profiles       []*downloadProfile `json:"profiles,omitempty"`
+	Share          *shareConfig       `json:"share,omitempty"`
+	FeedCron       string             `json:"feedCron,omitempty"`
+	DiskGuard      *diskGuardConfig   `json:"diskGuard,omitempty"`
+	Retry          *retryConfig       `json:"retry,omitempty"`
 }
 
 func (self *PiDownloader) GetServiceId() string {
@@ -60,15 +119,68 @@ func (self *PiDownloader) Init(configRawMsg *json.RawMessage, pushCh chan<- *ser
 	if err != nil {
 		return err
 	}
-	aria2rpc.RpcUrl = c.RpcUrl
-	aria2rpc.RpcVersion = c.RpcVersion
+	if backendErr := self.initBackends(&c); backendErr != nil {
+		return backendErr
+	}
+	dbHelper, dbErr := NewDownloaderDbHelper(c.DbFile)
+	if dbErr != nil {
+		return dbErr
+	}
+	l4g.Debug("Open downloader DB successful: %s", c.DbFile)
+	self.dbHelper = dbHelper
+	self.admins = c.Admins
+	self.statusTemplate = c.StatusTemplate
+	if self.statusTemplate == "" {
+		self.statusTemplate = defaultStatusTemplate
+	}
+	self.postProcessRules = c.PostProcess
+	self.configProfiles = c.Profiles
+	if profileErr := self.loadProfiles(); profileErr != nil {
+		return profileErr
+	}
+	guard, guardErr := newDiskGuard(c.DiskGuard)
+	if guardErr != nil {
+		return guardErr
+	}
+	self.diskGuard = guard
+	self.initRetry(c.Retry)
+	if shareErr := self.initShare(c.Share, path.Join(path.Dir(c.DbFile), shareSecretFile)); shareErr != nil {
+		return shareErr
+	}
 	self.pushMsgChannel = pushCh
 	self.cron = cron.New()
 	self.cron.AddFunc(c.StatUpdateCron, func() {
 		self.updateDownloadStat()
+		self.monitorDiskSpace()
+	})
+	self.notifier = newTaskNotifier()
+	self.scheduleTimers = make(map[int64]*time.Timer)
+	self.retryTimers = make(map[string]*time.Timer)
+	if loadErr := self.loadUnfinishedTasks(); loadErr != nil {
+		return loadErr
+	}
+	if planErr := self.initSpeedPlan(c.SpeedPlan); planErr != nil {
+		return planErr
+	}
+	feedCron := c.FeedCron
+	if feedCron == "" {
+		feedCron = defaultFeedCron
+	}
+	self.cron.AddFunc(feedCron, func() {
+		self.checkFeeds()
+	})
+	notifyPollCron := c.NotifyPollCron
+	if notifyPollCron == "" {
+		notifyPollCron = "0 * * * * *"
+	}
+	self.cron.AddFunc(notifyPollCron, func() {
+		self.pollTasks(false)
 	})
 	self.commandMap = map[string]processFunc{
 		"add":        (*PiDownloader).addUri,
+		"addat":      (*PiDownloader).addAt,
+		"lsat":       (*PiDownloader).listSchedules,
+		"rmat":       (*PiDownloader).removeSchedule,
 		"rm":         (*PiDownloader).remove,
 		"pause":      (*PiDownloader).pause,
 		"pauseall":   (*PiDownloader).pauseAll,
@@ -79,25 +191,45 @@ func (self *PiDownloader) Init(configRawMsg *json.RawMessage, pushCh chan<- *ser
 		"getwt":      (*PiDownloader).getWaiting,
 		"getstp":     (*PiDownloader).getStopped,
 		"getstat":    (*PiDownloader).getAria2GlobalStat,
+		"backends":   (*PiDownloader).listBackends,
+		"btfiles":    (*PiDownloader).btFiles,
+		"btselect":   (*PiDownloader).btSelect,
+		"dlhistory":  (*PiDownloader).dlHistory,
+		"speedplan":  (*PiDownloader).speedPlanCommand,
+		"profile":    (*PiDownloader).profileCommand,
+		"addfeed":    (*PiDownloader).addFeed,
+		"lsfeed":     (*PiDownloader).listFeeds,
+		"testfeed":   (*PiDownloader).testFeed,
+		"rmfeed":     (*PiDownloader).removeFeed,
+		"info":       (*PiDownloader).taskInfo,
+		"share":      (*PiDownloader).share,
+		"opt":        (*PiDownloader).changeOption,
+		"prio":       (*PiDownloader).changePosition,
+		"purge":      (*PiDownloader).purge,
 		"file":       (*PiDownloader).handleFile,
 	}
-	self.voiceCommandMap = map[string]string{
-		"全部停止": "pauseall",
-		"全部启动": "unpauseall",
-		"下载进度": "getact",
-		"任务统计": "getstat",
-	}
-
-	_, statErr := self.Handle("", "getstat", nil)
-	if statErr != nil {
-		l4g.Error("Call aria2 error: %v", statErr)
-		return statErr
-	}
 	return nil
 }
 
 func (self *PiDownloader) StartService() error {
+	self.checkBackends()
 	self.updateDownloadStat()
+	self.startNotifier()
+	if err := self.loadDiskGuard(); err != nil {
+		return err
+	}
+	self.applySpeedPlan()
+	if err := self.loadSchedules(); err != nil {
+		return err
+	}
+	if err := self.loadRetries(); err != nil {
+		return err
+	}
+	if self.shareServer != nil {
+		if err := self.shareServer.Start(); err != nil {
+			return err
+		}
+	}
 	self.cron.Start()
 	self.started = true
 	return nil
@@ -109,74 +241,95 @@ func (self *PiDownloader) IsStarted() bool {
 
 func (self *PiDownloader) Stop() error {
 	self.cron.Stop()
+	self.notifier.stop()
+	self.stopSchedules()
+	self.stopRetries()
+	if self.shareServer != nil {
+		self.shareServer.Stop()
+	}
+	err := self.dbHelper.Close()
 	self.started = false
-	return nil
+	return err
 }
 
 func (self *PiDownloader) CommandFilter(command string, args []string) bool {
-	if _, ok := self.voiceCommandMap[command]; ok {
-		return true
+	if command == service.FileCommand {
+		return false // file is dispatched by GetFileFilter
 	}
-
 	if _, ok := self.commandMap[command]; ok {
-		if command == "file" {
-			fileUrl := args[0]
-			i := strings.LastIndex(fileUrl, "/")
-			fileName := fileUrl[i+1:]
-			return fileName == "aria2.down"
-		}
 		return true
 	}
 	return false
 }
 
+func (self *PiDownloader) GetFileFilter() *service.FileFilter {
+	return &service.FileFilter{
+		Extensions:   []string{".torrent", ".metalink", ".meta4"},
+		MimeTypes:    []string{"application/x-bittorrent", "application/metalink+xml", "application/metalink4+xml"},
+		NamePatterns: []string{`^aria2\.down$`, `\.down\.(json|ya?ml)$`},
+	}
+}
+
 func (self *PiDownloader) GetHelpMessage() string {
 	var buffer bytes.Buffer
 	for command, helpMsg := range commandHelp {
 		buffer.WriteString(fmt.Sprintf("[%s]: %s\n", command, helpMsg))
 	}
 	buffer.WriteString("voice command:\n")
-	for voice, command := range self.voiceCommandMap {
-		buffer.WriteString(fmt.Sprintf("[%s] ===> %s\n", voice, command))
+	for _, voicePhrase := range self.GetVoicePhrases() {
+		buffer.WriteString(fmt.Sprintf("%v ===> %s\n", voicePhrase.Phrases, voicePhrase.Command))
 	}
 	return buffer.String()
 }
 
-var oldStatus = ""
+func (self *PiDownloader) GetVoicePhrases() []service.VoicePhrase {
+	return []service.VoicePhrase{
+		{Phrases: []string{"全部停止", "全部暂停", "停止下载"}, Command: "pauseall"},
+		{Phrases: []string{"全部启动", "全部开始", "开始下载"}, Command: "unpauseall"},
+		{Phrases: []string{"下载进度", "下载进展", "查看下载"}, Command: "getact"},
+		{Phrases: []string{"任务统计", "下载统计"}, Command: "getstat"},
+	}
+}
 
 func (self *PiDownloader) updateDownloadStat() {
 	currentStatus, err := self.getCurrentDownloadInfo()
 	pushMsg := &service.PushMessage{}
 	pushMsg.Type = service.Status
+	pushMsg.Source = self.GetServiceId()
 	if err != nil {
 		l4g.Error("Get download status error: %v", err)
 		currentStatus = "Getting download status error!"
 	}
-	if currentStatus != oldStatus {
+	if currentStatus != self.lastStatus {
 		pushMsg.Message = currentStatus
-		oldStatus = currentStatus
+		self.lastStatus = currentStatus
 		self.pushMsgChannel <- pushMsg
 	}
 }
 
 func (self *PiDownloader) getCurrentDownloadInfo() (string, error) {
-	globalStat, getStatErr := aria2rpc.GetGlobalStat()
+	globalStat, getStatErr := self.getTotalStat(self.backends)
 	if getStatErr != nil {
 		return "", getStatErr
 	}
 	// total active download task
-	numActive, _ := strconv.Atoi(globalStat["numActive"].(string))
+	numActive := globalStat["numActive"]
 	if numActive == 0 {
 		return "no active task", nil
 	}
+	status := &downloadStatus{
+		speed:  utils.FormatSize(globalStat["downloadSpeed"]),
+		active: numActive,
+	}
 
-	// total speed
-	speed := utils.FormatSizeString(globalStat["downloadSpeed"].(string))
-
-	// the longest left time in active download task
+	// the longest left time and the fastest task in active download task
 	var longestTimeLeft int64 = -1
+	var topSpeed int64 = -1
 	keys := []string{"gid", "totalLength", "completedLength", "downloadSpeed"}
-	tasks, getActErr := aria2rpc.GetActive(keys)
+	if strings.Contains(self.statusTemplate, "{top}") {
+		keys = append(keys, "files", "bittorrent")
+	}
+	tasks, getActErr := self.tellActive(self.backends, keys)
 	if getActErr != nil {
 		return "", getActErr
 	}
@@ -192,120 +345,135 @@ func (self *PiDownloader) getCurrentDownloadInfo() (string, error) {
 					longestTimeLeft = timeLeft
 				}
 			}
+			if spd > topSpeed {
+				topSpeed = spd
+				status.top = self.getTitle(task)
+				if total > 0 {
+					status.top = fmt.Sprintf("%s %d%%", status.top, completed*100/total)
+				}
+			}
 		}
 	}
 
-	var timeLeftFmt string
 	if longestTimeLeft > 0 {
-		timeLeftFmt = utils.FormatTime(longestTimeLeft)
+		status.eta = utils.FormatTime(longestTimeLeft)
 	} else {
-		timeLeftFmt = "N/A"
+		status.eta = "N/A"
+	}
+	status.diskFree = "N/A"
+	if strings.Contains(self.statusTemplate, "{diskfree}") {
+		if freeSpace, ok := self.getLocalFreeSpace(); ok {
+			status.diskFree = utils.FormatSize(freeSpace)
+		}
 	}
-	return fmt.Sprintf("spd: %s ; act: %d ; left: %s", speed, numActive, timeLeftFmt), nil
+	return status.format(self.statusTemplate), nil
 }
 
 func (self *PiDownloader) Handle(username, command string, args []string) (string, error) {
-	comm := self.voiceCommandMap[command]
-	if comm == "" || len(comm) == 0 {
-		comm = command
-	}
-
-	f := self.commandMap[comm]
+	f := self.commandMap[command]
 	if f == nil {
 		return "", errors.New("Invalided download command, please type \"help\" for helping information")
 	}
-	return f(self, args)
+	return f(self, username, args)
 }
 
-func (self *PiDownloader) handleFile(args []string) (string, error) {
+// handleFile adds the torrent or metalink file or executes the command file, the args are url, local path,
+// mime type and the options following the url in the file message, like @nas dir=/tmp category=movie
+func (self *PiDownloader) handleFile(username string, args []string) (string, error) {
 	filePath := args[1]
-	l4g.Debug("Starting parse commandfile: %s", filePath)
-	commands, err := self.parseCommandFile(filePath)
-	if err != nil {
-		return "", err
-	}
-	for _, command := range commands {
-		l4g.Debug("Exec command from file: %s", command)
-		commArr := strings.Split(command, " ")
-		comm := commArr[0]
-		c := strings.ToLower(comm)
-		_, execErr := self.Handle("", c, commArr[1:])
-		if execErr != nil {
-			return "", execErr
+	mimeType := ""
+	if len(args) > 2 {
+		mimeType = args[2]
+	}
+	if fileType := getMetaFileType(filePath, mimeType); fileType != "" {
+		l4g.Debug("Add torrent or metalink file: %s", filePath)
+		var optionArgs []string
+		if len(args) > 3 {
+			optionArgs = args[3:]
 		}
+		return self.addMetaFile(username, filePath, fileType, optionArgs)
 	}
-	return fmt.Sprintf("Command file executed successful! total: %d commands.", len(commands)), nil
+	l4g.Debug("Starting parse commandfile: %s", filePath)
+	return self.executeCommandFile(username, filePath)
 }
 
-func (self *PiDownloader) addUri(args []string) (string, error) {
-	if args == nil || len(args) == 0 {
-		return "", errors.New("missing args!")
-	}
+// parseAddArgs parses the uris and options like dir=/tmp, the values separated by ; are parsed as list
+func parseAddArgs(args []string) ([]string, map[string]interface{}, error) {
 	uris := make([]string, 0)
 	params := make(map[string]interface{})
 	for _, arg := range args {
-		if utils.IsHttpUrl(arg) {
+		if isDownloadUri(arg) {
 			uris = append(uris, arg)
-		} else {
-			argNameValue := strings.SplitN(arg, "=", 2)
-			if len(argNameValue) != 2 {
-				return "", errors.New("invalid args!")
-			}
-			values := strings.Split(strings.TrimSpace(argNameValue[1]), ";")
-			if len(values) == 1 {
-				params[argNameValue[0]] = values[0]
-			} else {
-				params[argNameValue[0]] = values
-			}
-
+		} else if err := parseOptionArg(params, arg); err != nil {
+			return nil, nil, err
 		}
+	}
+	if len(uris) == 0 {
+		return nil, nil, errors.New("no download uri!")
+	}
+	return uris, params, nil
+}
+
+// parseOptionArg parses the option like dir=/tmp into params
+func parseOptionArg(params map[string]interface{}, arg string) error {
+	argNameValue := strings.SplitN(arg, "=", 2)
+	if len(argNameValue) != 2 {
+		return errors.New("invalid args!")
+	}
+	values := strings.Split(strings.TrimSpace(argNameValue[1]), ";")
+	if len(values) == 1 {
+		params[argNameValue[0]] = values[0]
+	} else {
+		params[argNameValue[0]] = values
+	}
+	return nil
+}
 
+func (self *PiDownloader) addUri(username string, args []string) (string, error) {
+	targets, args, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	if args == nil || len(args) == 0 {
+		return "", errors.New("missing args!")
+	}
+	uris, params, parseErr := parseAddArgs(args)
+	if parseErr != nil {
+		return "", parseErr
 	}
 	gids := make([]string, 0)
+	aria2Params, localParams := splitTaskOptions(params)
+	mirrors := getMirrors(params)
+	if profileErr := self.applyProfile(append(append([]string{}, uris...), mirrors...), aria2Params, localParams); profileErr != nil {
+		return "", profileErr
+	}
+	if categoryErr := validateCategory(localParams["category"]); categoryErr != nil {
+		return "", categoryErr
+	}
+	backend := targets[0]
+	if len(targets) > 1 {
+		backend = self.routeBackend(uris, localParams["category"])
+	}
+	if spaceErr := self.checkDiskSpace(backend, uris, aria2Params); spaceErr != nil {
+		return "", spaceErr
+	}
 	for _, uri := range uris {
 		l4g.Debug("Dowanload uri: %v", uri)
 		l4g.Debug("Dowanload params: %v", params)
-		gid, err := aria2rpc.AddUri(uri, params)
+		taskUris := append([]string{uri}, mirrors...)
+		gid, err := backend.addUri(taskUris, aria2Params)
 		if err != nil {
 			return "", err
 		}
+		self.recordTask(gid, backend, username, taskUris, params, 0)
 		gids = append(gids, gid)
 	}
-
+	if len(self.backends) > 1 {
+		return fmt.Sprintf("Add successful, backend: %s, gids:%v", backend.getName(), gids), nil
+	}
 	return fmt.Sprintf("Add successful, gids:%v", gids), nil
 }
 
-//func (self *PiDownloader) addGdriveId(params map[string]interface{}) map[string]interface{} {
-//	headers := params["header"]
-//	if headers == nil {
-//		headers = []string{"Cookie:gdriveid=" + self.gdriveid}
-//		params["header"] = headers
-//	} else {
-
-//		switch headers.(type) {
-//		case []string:
-//			containGdrive := false
-//			headerArr := headers.([]string)
-//			for _, header := range headerArr {
-//				if strings.Contains(header, "gdriveid") {
-//					containGdrive = true
-//				}
-//			}
-//			if !containGdrive {
-//				headerArr = append(headerArr, "Cookie:gdriveid="+self.gdriveid)
-//			}
-//		case string:
-//			headerStr := headers.(string)
-//			if !strings.Contains(headerStr, "gdriveid") {
-//				headers := []string{headerStr, "Cookie:gdriveid=" + self.gdriveid}
-//				params["header"] = headers
-//			}
-//		}
-
-//	}
-//	return params
-//}
-
 //func (self *PiDownloader) addtorrent(args []string) (string, error) {
 //	if args == nil || len(args) == 0 {
 //		return "", errors.New("missing args!")
@@ -318,80 +486,82 @@ func (self *PiDownloader) addUri(args []string) (string, error) {
 //	return "Add successful, gid:" + gid, nil
 //}
 
-func (self *PiDownloader) remove(args []string) (string, error) {
-	if args == nil || len(args) == 0 {
-		return "", errors.New("missing args!")
-	}
-	gid := args[0]
-	rgid, err := aria2rpc.Remove(gid, true)
-	if err != nil {
-		return "", err
-	}
-	return "Remove successful, gid:" + rgid, nil
+func (self *PiDownloader) remove(username string, args []string) (string, error) {
+	return self.operateTasks(username, args, false, removeTask)
 }
 
-func (self *PiDownloader) pause(args []string) (string, error) {
-	if args == nil || len(args) == 0 {
-		return "", errors.New("missing args!")
-	}
-	gid := args[0]
-	_, err := aria2rpc.Pause(gid, true)
-	if err != nil {
-		return "", err
-	}
-	return "OK", nil
+func (self *PiDownloader) pause(username string, args []string) (string, error) {
+	return self.operateTasks(username, args, false, downloader.pause)
 }
 
-func (self *PiDownloader) unpause(args []string) (string, error) {
-	if args == nil || len(args) == 0 {
-		return "", errors.New("missing args!")
-	}
-	gid := args[0]
-	_, err := aria2rpc.Unpause(gid)
-	if err != nil {
-		return "", err
-	}
-	return "OK", nil
+func (self *PiDownloader) unpause(username string, args []string) (string, error) {
+	return self.operateTasks(username, args, false, downloader.unpause)
 }
 
-func (self *PiDownloader) maxspeed(args []string) (string, error) {
+func (self *PiDownloader) maxspeed(username string, args []string) (string, error) {
+	targets, args, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
 	if args == nil || len(args) == 0 {
 		return "", errors.New("missing args!")
 	}
 	params := make(map[string]string)
 	params["max-overall-download-limit"] = args[0]
-	_, err := aria2rpc.ChangeGlobalOption(params)
-	if err != nil {
-		return "", nil
-	}
-	return "OK", nil
+	return self.operateBackends(targets, func(backend downloader) error {
+		return backend.changeGlobalOption(params)
+	})
 }
 
-func (self *PiDownloader) getActive(args []string) (string, error) {
+func (self *PiDownloader) getActive(username string, args []string) (string, error) {
+	targets, _, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
 	keys := []string{"gid", "totalLength", "completedLength", "downloadSpeed", "bittorrent", "files"}
-	tasks, err := aria2rpc.GetActive(keys)
+	tasks, err := self.tellActive(targets, keys)
 	if err != nil {
 		return "", err
 	}
-	return self.formatOutput(tasks)
+	ownTasks, filterErr := self.filterOwnTasks(username, tasks)
+	if filterErr != nil {
+		return "", filterErr
+	}
+	return self.formatOutput(ownTasks)
 }
 
-func (self *PiDownloader) getWaiting(args []string) (string, error) {
+func (self *PiDownloader) getWaiting(username string, args []string) (string, error) {
+	targets, _, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
 	keys := []string{"gid", "totalLength", "completedLength", "bittorrent", "files"}
-	tasks, err := aria2rpc.GetWaiting(0, 100, keys)
+	tasks, err := self.tellWaiting(targets, keys)
 	if err != nil {
 		return "", err
 	}
-	return self.formatOutput(tasks)
+	ownTasks, filterErr := self.filterOwnTasks(username, tasks)
+	if filterErr != nil {
+		return "", filterErr
+	}
+	return self.formatOutput(ownTasks)
 }
 
-func (self *PiDownloader) getStopped(args []string) (string, error) {
+func (self *PiDownloader) getStopped(username string, args []string) (string, error) {
+	targets, _, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
 	keys := []string{"gid", "totalLength", "completedLength", "bittorrent", "files", "status", "errorCode"}
-	tasks, err := aria2rpc.GetStopped(0, 100, keys)
+	tasks, err := self.tellStopped(targets, keys)
 	if err != nil {
 		return "", err
 	}
-	return self.formatOutput(tasks)
+	ownTasks, filterErr := self.filterOwnTasks(username, tasks)
+	if filterErr != nil {
+		return "", filterErr
+	}
+	return self.formatOutput(ownTasks)
 }
 
 func (self *PiDownloader) formatOutput(tasks []map[string]interface{}) (string, error) {
@@ -404,6 +574,9 @@ func (self *PiDownloader) formatOutput(tasks []map[string]interface{}) (string,
 	for _, task := range tasks {
 		gid := task["gid"].(string)
 		buffer.WriteString(fmt.Sprintf("gid: %s\n", gid))
+		if len(self.backends) > 1 {
+			buffer.WriteString(fmt.Sprintf("backend: %v\n", task["backend"]))
+		}
 
 		title := self.getTitle(task)
 		buffer.WriteString(fmt.Sprintf("title: %s\n", title))
@@ -464,37 +637,71 @@ func (self *PiDownloader) getTitle(task map[string]interface{}) string {
 	if files != nil {
 		file := files.([]interface{})[0].(map[string]interface{})
 		filePath := file["path"]
-		if filePath != nil {
+		if filePath != nil && filePath.(string) != "" {
 			return path.Base(filePath.(string))
 		}
+		// magnet task before the metadata is downloaded
+		uris := file["uris"]
+		if uris != nil && len(uris.([]interface{})) > 0 {
+			uri := uris.([]interface{})[0].(map[string]interface{})["uri"]
+			if uri != nil {
+				return uri.(string)
+			}
+		}
 	}
 	return "No title"
 }
 
-func (self *PiDownloader) pauseAll(args []string) (string, error) {
-	_, err := aria2rpc.PauseAll()
-	if err != nil {
-		return "", err
+func (self *PiDownloader) pauseAll(username string, args []string) (string, error) {
+	targets, _, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
 	}
-	return "OK", nil
+	return self.operateBackends(targets, downloader.pauseAll)
 }
 
-func (self *PiDownloader) unpauseAll(args []string) (string, error) {
-	_, err := aria2rpc.UnpauseAll()
-	if err != nil {
-		return "", err
+func (self *PiDownloader) unpauseAll(username string, args []string) (string, error) {
+	targets, _, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
 	}
-	return "OK", nil
+	return self.operateBackends(targets, downloader.unpauseAll)
 }
 
-func (self *PiDownloader) getAria2GlobalStat(args []string) (string, error) {
-	globalStat, err := aria2rpc.GetGlobalStat()
+func (self *PiDownloader) getAria2GlobalStat(username string, args []string) (string, error) {
+	targets, _, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	if len(targets) == 1 {
+		globalStat, err := targets[0].getGlobalStat()
+		if err != nil {
+			return "", err
+		}
+		return formatGlobalStat(globalStat), nil
+	}
+	var buffer bytes.Buffer
+	for _, backend := range targets {
+		globalStat, err := backend.getGlobalStat()
+		if err != nil {
+			buffer.WriteString(fmt.Sprintf("\n%s: %v", backend.getName(), err))
+		} else {
+			buffer.WriteString(fmt.Sprintf("\n%s: %s", backend.getName(), formatGlobalStat(globalStat)))
+		}
+	}
+	totalStat, err := self.getTotalStat(targets)
 	if err != nil {
 		return "", err
 	}
-	speed := utils.FormatSizeString(globalStat["downloadSpeed"].(string))
-	numActive := globalStat["numActive"].(string)
-	numStopped := globalStat["numStopped"].(string)
-	numWaiting := globalStat["numWaiting"].(string)
-	return fmt.Sprintf("spd:%s ; act:%s ; wait:%s ; stop:%s", speed, numActive, numWaiting, numStopped), nil
+	buffer.WriteString(fmt.Sprintf("\ntotal: spd:%s ; act:%d ; wait:%d ; stop:%d", utils.FormatSize(totalStat["downloadSpeed"]),
+		totalStat["numActive"], totalStat["numWaiting"], totalStat["numStopped"]))
+	return buffer.String(), nil
+}
+
+func formatGlobalStat(globalStat map[string]string) string {
+	speed := utils.FormatSizeString(globalStat["downloadSpeed"])
+	numActive := globalStat["numActive"]
+	numStopped := globalStat["numStopped"]
+	numWaiting := globalStat["numWaiting"]
+	return fmt.Sprintf("spd:%s ; act:%s ; wait:%s ; stop:%s", speed, numActive, numWaiting, numStopped)
 }
@@ -0,0 +1,390 @@
+package pidownloader
+
+import (
+	"bytes"
+	l4g "code.google.com/p/log4go"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultBackendName = "default"
+	aria2BackendType   = "aria2"
+)
+
+type backendConfig struct {
+	Name          string     `json:"name"`
+	Type          string     `json:"type,omitempty"` // aria2 or native, aria2 by default
+	RpcUrl        string     `json:"rpcUrl,omitempty"`
+	RpcVersion    string     `json:"rpcVersion,omitempty"`
+	RpcSecret     string     `json:"rpcSecret,omitempty"`  // the --rpc-secret of aria2
+	RpcTimeout    int64      `json:"rpcTimeout,omitempty"` // seconds, 10 by default
+	WsUrl         string     `json:"wsUrl,omitempty"`
+	Local         bool       `json:"local,omitempty"` // aria2 runs on this machine, so the files can be accessed
+	Dir           string     `json:"dir,omitempty"`   // the download dir of native backend
+	MaxConcurrent int        `json:"maxConcurrent,omitempty"`
+	Route         *routeRule `json:"route,omitempty"`
+}
+
+// downloader is the backend which downloads the tasks, the tasks are described in the same way as aria2
+type downloader interface {
+	getName() string
+	getAddress() string
+	isLocal() bool
+	getRoute() *routeRule
+	addUri(uris []string, options map[string]interface{}) (string, error)
+	addTorrent(torrent string, options map[string]interface{}) (string, error)
+	addMetalink(metalink string, options map[string]interface{}) ([]string, error)
+	remove(gid string) error
+	pause(gid string) error
+	unpause(gid string) error
+	pauseAll() error
+	unpauseAll() error
+	changeGlobalOption(options map[string]string) error
+	getGlobalOption() (map[string]string, error)
+	getGlobalStat() (map[string]string, error)
+	tellStatus(gid string, keys []string) (map[string]interface{}, error)
+	tellActive(keys []string) ([]map[string]interface{}, error)
+	tellWaiting(offset, num int, keys []string) ([]map[string]interface{}, error)
+	tellStopped(offset, num int, keys []string) ([]map[string]interface{}, error)
+	getFiles(gid string) ([]aria2File, error)
+	getOption(gid string) (map[string]string, error)
+	changeOption(gid string, options map[string]interface{}) error
+	changePosition(gid string, pos int, how string) (int, error)
+	getPeers(gid string) ([]interface{}, error)
+	removeDownloadResult(gid string) error
+	purgeDownloadResult() error
+}
+
+// routeRule routes the new downloads to the backend
+type routeRule struct {
+	Domains    []string `json:"domains,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+}
+
+func (self *routeRule) match(uris []string, category string) bool {
+	if len(self.Domains) > 0 && matchDomains(uris, self.Domains) {
+		return true
+	}
+	if len(self.Extensions) > 0 && matchExtensions(uris, self.Extensions) {
+		return true
+	}
+	for _, c := range self.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *PiDownloader) newBackend(c *backendConfig) (downloader, error) {
+	switch c.Type {
+	case "", aria2BackendType:
+		if c.RpcUrl == "" {
+			return nil, errors.New("rpcUrl of backend is required: " + c.Name)
+		}
+		return newAria2Client(c), nil
+	case nativeBackendType:
+		native, err := newHttpDownloader(c)
+		if err != nil {
+			return nil, err
+		}
+		native.onStop = self.checkTask
+		return native, nil
+	}
+	return nil, errors.New("unknown backend type: " + c.Type)
+}
+
+// initBackends creates the backends, the rpcUrl of config is the only aria2 backend if no backends given.
+// the native fallback backend is added if configured
+func (self *PiDownloader) initBackends(c *config) error {
+	backendConfigs := c.Backends
+	if len(backendConfigs) == 0 && c.RpcUrl != "" {
+		backendConfigs = []*backendConfig{{
+			Name:       defaultBackendName,
+			RpcUrl:     c.RpcUrl,
+			RpcVersion: c.RpcVersion,
+			RpcSecret:  c.RpcSecret,
+			WsUrl:      c.WsUrl,
+			Local:      true,
+		}}
+	}
+	self.backends = make([]downloader, 0)
+	self.backendMap = make(map[string]downloader)
+	self.fallback = nil
+	for _, backendConf := range backendConfigs {
+		if _, addErr := self.addBackend(backendConf); addErr != nil {
+			return addErr
+		}
+	}
+	if c.Fallback != nil {
+		fallbackConf := *c.Fallback
+		fallbackConf.Type = nativeBackendType
+		if fallbackConf.Name == "" {
+			fallbackConf.Name = nativeBackendName
+		}
+		fallback, addErr := self.addBackend(&fallbackConf)
+		if addErr != nil {
+			return addErr
+		}
+		self.fallback = fallback
+	}
+	if len(self.backends) == 0 {
+		return errors.New("no download backend is configured")
+	}
+	return nil
+}
+
+func (self *PiDownloader) addBackend(c *backendConfig) (downloader, error) {
+	if c.Name == "" {
+		return nil, errors.New("name of backend is required")
+	}
+	if _, existed := self.backendMap[c.Name]; existed {
+		return nil, errors.New("duplicate backend: " + c.Name)
+	}
+	backend, err := self.newBackend(c)
+	if err != nil {
+		return nil, err
+	}
+	self.backends = append(self.backends, backend)
+	self.backendMap[c.Name] = backend
+	return backend, nil
+}
+
+// checkBackends logs the unavailable backends, the downloads are routed to the fallback while they are down
+func (self *PiDownloader) checkBackends() {
+	for _, backend := range self.backends {
+		if _, err := backend.getGlobalStat(); err != nil {
+			l4g.Warn("Backend %s is unavailable: %v", backend.getName(), err)
+		}
+	}
+}
+
+// resumeNativeTask adds the unfinished task of native backend again with the same gid,
+// the downloaded part is resumed
+func (self *PiDownloader) resumeNativeTask(backend downloader, entity *DownloadTaskEntity) error {
+	if entity.Uris == "" {
+		return nil
+	}
+	options := make(map[string]interface{})
+	if entity.Options != "" {
+		if err := json.Unmarshal([]byte(entity.Options), &options); err != nil {
+			return err
+		}
+	}
+	uris := strings.Split(entity.Uris, " ")
+	nativeOptions, localOptions := splitTaskOptions(options)
+	if err := self.applyProfile(uris, nativeOptions, localOptions); err != nil {
+		return err
+	}
+	nativeOptions["gid"] = entity.Gid
+	_, err := backend.addUri(uris, nativeOptions)
+	return err
+}
+
+// parseTarget picks the backend given like @nas from args, all backends are returned if no one given
+func (self *PiDownloader) parseTarget(args []string) ([]downloader, []string, error) {
+	targets := make([]downloader, 0)
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") {
+			backend := self.backendMap[arg[1:]]
+			if backend == nil {
+				return nil, nil, errors.New("no such backend: " + arg[1:])
+			}
+			targets = append(targets, backend)
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	if len(targets) == 0 {
+		targets = self.backends
+	}
+	return targets, rest, nil
+}
+
+// findBackend finds the backend which the task belongs to
+func (self *PiDownloader) findBackend(gid string) (downloader, error) {
+	if len(self.backends) == 1 {
+		return self.backends[0], nil
+	}
+	entity, err := self.dbHelper.GetDownloadTask(gid)
+	if err != nil {
+		return nil, err
+	}
+	if entity != nil && self.backendMap[entity.Backend] != nil {
+		return self.backendMap[entity.Backend], nil
+	}
+	for _, backend := range self.backends {
+		if _, statusErr := backend.tellStatus(gid, []string{"gid"}); statusErr == nil {
+			return backend, nil
+		}
+	}
+	return nil, errors.New("no such task: " + gid)
+}
+
+// findTargetBackend finds the backend of task in the targets
+func (self *PiDownloader) findTargetBackend(targets []downloader, gid string) (downloader, error) {
+	if len(targets) == 1 {
+		return targets[0], nil
+	}
+	return self.findBackend(gid)
+}
+
+// routeBackend chooses the backend for new download by the route rules, or the least load one
+func (self *PiDownloader) routeBackend(uris []string, category string) downloader {
+	if len(self.backends) == 1 {
+		return self.backends[0]
+	}
+	for _, backend := range self.backends {
+		if backend.getRoute() != nil && backend.getRoute().match(uris, category) {
+			return backend
+		}
+	}
+	var leastLoad downloader
+	minLoad := -1
+	for _, backend := range self.backends {
+		if backend == self.fallback {
+			continue
+		}
+		stat, err := backend.getGlobalStat()
+		if err != nil {
+			l4g.Error("Get stat of backend %s error: %v", backend.getName(), err)
+			continue
+		}
+		numActive, _ := strconv.Atoi(stat["numActive"])
+		numWaiting, _ := strconv.Atoi(stat["numWaiting"])
+		if load := numActive + numWaiting; minLoad < 0 || load < minLoad {
+			minLoad = load
+			leastLoad = backend
+		}
+	}
+	if leastLoad == nil {
+		if self.fallback != nil {
+			return self.fallback
+		}
+		return self.backends[0]
+	}
+	return leastLoad
+}
+
+type tellFunc func(backend downloader) ([]map[string]interface{}, error)
+
+// tellBackends gets the tasks from the backends, the tasks are tagged by the backend name.
+// the unavailable backends are skipped unless all of them are failed
+func tellBackends(targets []downloader, tell tellFunc) ([]map[string]interface{}, error) {
+	allTasks := make([]map[string]interface{}, 0)
+	var lastErr error
+	failed := 0
+	for _, backend := range targets {
+		tasks, err := tell(backend)
+		if err != nil {
+			l4g.Error("Get tasks of backend %s error: %v", backend.getName(), err)
+			lastErr = err
+			failed++
+			continue
+		}
+		for _, task := range tasks {
+			task["backend"] = backend.getName()
+		}
+		allTasks = append(allTasks, tasks...)
+	}
+	if failed == len(targets) && lastErr != nil {
+		return nil, lastErr
+	}
+	return allTasks, nil
+}
+
+func (self *PiDownloader) tellActive(targets []downloader, keys []string) ([]map[string]interface{}, error) {
+	return tellBackends(targets, func(backend downloader) ([]map[string]interface{}, error) {
+		return backend.tellActive(keys)
+	})
+}
+
+func (self *PiDownloader) tellWaiting(targets []downloader, keys []string) ([]map[string]interface{}, error) {
+	return tellBackends(targets, func(backend downloader) ([]map[string]interface{}, error) {
+		return backend.tellWaiting(0, bulkQueryLimit, keys)
+	})
+}
+
+func (self *PiDownloader) tellStopped(targets []downloader, keys []string) ([]map[string]interface{}, error) {
+	return tellBackends(targets, func(backend downloader) ([]map[string]interface{}, error) {
+		return backend.tellStopped(0, bulkQueryLimit, keys)
+	})
+}
+
+// getTotalStat sums the global stat of backends
+func (self *PiDownloader) getTotalStat(targets []downloader) (map[string]int64, error) {
+	total := make(map[string]int64)
+	var lastErr error
+	failed := 0
+	for _, backend := range targets {
+		stat, err := backend.getGlobalStat()
+		if err != nil {
+			l4g.Error("Get stat of backend %s error: %v", backend.getName(), err)
+			lastErr = err
+			failed++
+			continue
+		}
+		for key, value := range stat {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			total[key] += n
+		}
+	}
+	if failed == len(targets) && lastErr != nil {
+		return nil, lastErr
+	}
+	return total, nil
+}
+
+// operateBackends runs the operation on every backend, the outcomes are listed if there are multiple backends
+func (self *PiDownloader) operateBackends(targets []downloader, operation func(downloader) error) (string, error) {
+	if len(targets) == 1 {
+		if err := operation(targets[0]); err != nil {
+			return "", err
+		}
+		return "OK", nil
+	}
+	var buffer bytes.Buffer
+	for _, backend := range targets {
+		if err := operation(backend); err != nil {
+			buffer.WriteString(fmt.Sprintf("\n%s: %v", backend.getName(), err))
+		} else {
+			buffer.WriteString(fmt.Sprintf("\n%s: OK", backend.getName()))
+		}
+	}
+	return buffer.String(), nil
+}
+
+func (self *PiDownloader) listBackends(username string, args []string) (string, error) {
+	var buffer bytes.Buffer
+	for _, backend := range self.backends {
+		buffer.WriteString(fmt.Sprintf("\n%s: %s", backend.getName(), backend.getAddress()))
+		if stat, err := backend.getGlobalStat(); err != nil {
+			buffer.WriteString(fmt.Sprintf(" (%v)", err))
+		} else {
+			buffer.WriteString(fmt.Sprintf(" (%s)", formatGlobalStat(stat)))
+		}
+	}
+	return buffer.String(), nil
+}
+
+// parseTaskTarget finds the backend of the task whose gid is the first arg
+func (self *PiDownloader) parseTaskTarget(args []string) (downloader, []string, error) {
+	targets, rest, err := self.parseTarget(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) == 0 {
+		return nil, nil, errors.New("missing args!")
+	}
+	backend, findErr := self.findTargetBackend(targets, rest[0])
+	if findErr != nil {
+		return nil, nil, findErr
+	}
+	return backend, rest, nil
+}
@@ -0,0 +1,96 @@
+package pidownloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTarget(t *testing.T) {
+	piDer := &PiDownloader{}
+	err := piDer.initBackends(&config{Backends: []*backendConfig{
+		{Name: "pi", RpcUrl: "http://localhost:6800/jsonrpc"},
+		{Name: "nas", RpcUrl: "http://nas:6800/jsonrpc"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, rest, err := piDer.parseTarget([]string{"@nas", "active"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].getName() != "nas" || len(rest) != 1 || rest[0] != "active" {
+		t.Fatalf("unexpected target: %v %v", targets, rest)
+	}
+	if targets, _, _ = piDer.parseTarget([]string{"active"}); len(targets) != 2 {
+		t.Fatalf("all backends should be targeted: %v", targets)
+	}
+	if _, _, err = piDer.parseTarget([]string{"@foo"}); err == nil {
+		t.Fatal("unknown backend should be rejected")
+	}
+	if err = piDer.initBackends(&config{Backends: []*backendConfig{
+		{Name: "pi", RpcUrl: "http://localhost:6800/jsonrpc"},
+		{Name: "pi", RpcUrl: "http://nas:6800/jsonrpc"},
+	}}); err == nil {
+		t.Fatal("duplicate backend should be rejected")
+	}
+}
+
+func TestRouteRule(t *testing.T) {
+	rule := &routeRule{Domains: []string{"example.com"}, Categories: []string{"movie"}, Extensions: []string{".iso"}}
+	cases := []struct {
+		uris     []string
+		category string
+		expected bool
+	}{
+		{[]string{"http://dl.example.com/a.zip"}, "", true},
+		{[]string{"http://other.com/ubuntu.iso"}, "", true},
+		{[]string{"http://other.com/a.zip"}, "movie", true},
+		{[]string{"http://other.com/a.zip"}, "music", false},
+	}
+	for _, c := range cases {
+		if rule.match(c.uris, c.category) != c.expected {
+			t.Errorf("match %v %s should be %v", c.uris, c.category, c.expected)
+		}
+	}
+}
+
+func TestRpcSecret(t *testing.T) {
+	var lastReq aria2Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&lastReq)
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"%s","result":"2089b05ecca3d829"}`, lastReq.Id)
+	}))
+	defer server.Close()
+	client := newAria2Client(&backendConfig{Name: "pi", RpcUrl: server.URL, RpcSecret: "secret"})
+	gid, err := client.addUri([]string{"http://example.com/a.zip"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gid != "2089b05ecca3d829" {
+		t.Fatalf("unexpected gid: %s", gid)
+	}
+	if lastReq.Method != "aria2.addUri" || len(lastReq.Params) < 2 || lastReq.Params[0] != "token:secret" {
+		t.Fatalf("unexpected request: %v", lastReq)
+	}
+}
+
+func TestRpcTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	client := newAria2Client(&backendConfig{Name: "pi", RpcUrl: server.URL, RpcTimeout: 1})
+	start := time.Now()
+	if _, err := client.addUri([]string{"http://example.com/a.zip"}, nil); err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("rpc call took %v", elapsed)
+	}
+}
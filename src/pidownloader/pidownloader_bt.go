@@ -0,0 +1,191 @@
+package pidownloader
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"utils"
+)
+
+type aria2File struct {
+	Index           string `json:"index"`
+	Path            string `json:"path"`
+	Length          string `json:"length"`
+	CompletedLength string `json:"completedLength"`
+	Selected        string `json:"selected"`
+}
+
+func isDownloadUri(s string) bool {
+	return utils.IsHttpUrl(s) ||
+		strings.HasPrefix(s, "ftp://") ||
+		strings.HasPrefix(s, "sftp://") ||
+		strings.HasPrefix(s, "magnet:?")
+}
+
+const (
+	torrentFile  = "torrent"
+	metalinkFile = "metalink"
+)
+
+// getMetaFileType returns torrentFile or metalinkFile by the extension or mime type, the file
+// sent from url like download.php?id=1 has no extension. empty if it's not torrent or metalink
+func getMetaFileType(fileName, mimeType string) string {
+	mimeType = strings.ToLower(strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0]))
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".torrent":
+		return torrentFile
+	case ".metalink", ".meta4":
+		return metalinkFile
+	}
+	switch mimeType {
+	case "application/x-bittorrent":
+		return torrentFile
+	case "application/metalink4+xml", "application/metalink+xml":
+		return metalinkFile
+	}
+	return ""
+}
+
+// addMetaFile adds the .torrent or .metalink file with the options like the add command,
+// the profile is not applied since the file has no host to match
+func (self *PiDownloader) addMetaFile(username, filePath, fileType string, args []string) (string, error) {
+	targets, args, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	params := make(map[string]interface{})
+	for _, arg := range args {
+		if err := parseOptionArg(params, arg); err != nil {
+			return "", err
+		}
+	}
+	aria2Params, localParams := splitTaskOptions(params)
+	if profileErr := self.applyProfile(nil, aria2Params, localParams); profileErr != nil {
+		return "", profileErr
+	}
+	if categoryErr := validateCategory(localParams["category"]); categoryErr != nil {
+		return "", categoryErr
+	}
+	backend := targets[0]
+	if len(targets) > 1 {
+		backend = self.routeBackend([]string{filePath}, localParams["category"])
+	}
+	if spaceErr := self.checkDiskSpace(backend, nil, aria2Params); spaceErr != nil {
+		return "", spaceErr
+	}
+	gids, err := self.addTorrentOrMetalink(backend, filePath, fileType, aria2Params)
+	if err != nil {
+		return "", err
+	}
+	for _, gid := range gids {
+		self.recordTask(gid, backend, username, []string{path.Base(filePath)}, params, 0)
+	}
+	if len(self.backends) > 1 {
+		return fmt.Sprintf("Add successful, backend: %s, gids:%v", backend.getName(), gids), nil
+	}
+	return fmt.Sprintf("Add successful, gids:%v", gids), nil
+}
+
+// add the .torrent or .metalink file, return the gids
+func (self *PiDownloader) addTorrentOrMetalink(backend downloader, filePath, fileType string, options map[string]interface{}) ([]string, error) {
+	content, readErr := ioutil.ReadFile(filePath)
+	if readErr != nil {
+		return nil, readErr
+	}
+	encoded := base64.StdEncoding.EncodeToString(content)
+	if fileType == torrentFile {
+		gid, err := backend.addTorrent(encoded, options)
+		if err != nil {
+			return nil, err
+		}
+		return []string{gid}, nil
+	}
+	return backend.addMetalink(encoded, options)
+}
+
+func (self *PiDownloader) getFiles(backend downloader, gid string) ([]aria2File, error) {
+	return backend.getFiles(gid)
+}
+
+func (self *PiDownloader) btFiles(username string, args []string) (string, error) {
+	backend, args, targetErr := self.parseTaskTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	if ownerErr := self.checkOwner(username, args[0]); ownerErr != nil {
+		return "", ownerErr
+	}
+	files, err := self.getFiles(backend, args[0])
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "no records", nil
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("\n")
+	for _, f := range files {
+		selected := " "
+		if f.Selected == "true" {
+			selected = "*"
+		}
+		total, _ := strconv.ParseInt(f.Length, 10, 64)
+		completed, _ := strconv.ParseInt(f.CompletedLength, 10, 64)
+		var prog float64 = 0
+		if total > 0 {
+			prog = float64(completed) * 100 / float64(total)
+		}
+		buffer.WriteString(fmt.Sprintf("%s[%s] %s (%s, %.2f%%)\n", selected, f.Index, path.Base(f.Path),
+			utils.FormatSize(total), prog))
+	}
+	buffer.WriteString("* selected")
+	return buffer.String(), nil
+}
+
+func (self *PiDownloader) btSelect(username string, args []string) (string, error) {
+	backend, args, targetErr := self.parseTaskTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	if len(args) < 2 {
+		return "", errors.New("missing args!")
+	}
+	gid := args[0]
+	if ownerErr := self.checkOwner(username, gid); ownerErr != nil {
+		return "", ownerErr
+	}
+	selectFile, parseErr := parseFileSelection(args[1])
+	if parseErr != nil {
+		return "", parseErr
+	}
+	options := map[string]interface{}{"select-file": selectFile}
+	if err := backend.changeOption(gid, options); err != nil {
+		return "", err
+	}
+	return "OK", nil
+}
+
+// check and normalize the selection like "1,3-5"
+func parseFileSelection(s string) (string, error) {
+	parts := strings.Split(strings.Replace(s, " ", "", -1), ",")
+	for _, part := range parts {
+		bounds := strings.SplitN(part, "-", 2)
+		lower, lowerErr := strconv.Atoi(bounds[0])
+		if lowerErr != nil || lower < 1 {
+			return "", errors.New("invalid file index: " + part)
+		}
+		if len(bounds) == 2 {
+			upper, upperErr := strconv.Atoi(bounds[1])
+			if upperErr != nil || upper < lower {
+				return "", errors.New("invalid file index: " + part)
+			}
+		}
+	}
+	return strings.Join(parts, ","), nil
+}
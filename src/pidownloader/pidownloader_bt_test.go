@@ -0,0 +1,121 @@
+package pidownloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFileSelection(t *testing.T) {
+	valid := map[string]string{
+		"1":         "1",
+		"1,3-5":     "1,3-5",
+		" 2, 4-4 ":  "2,4-4",
+		"10-12,1,3": "10-12,1,3",
+	}
+	for s, expected := range valid {
+		selection, err := parseFileSelection(s)
+		if err != nil || selection != expected {
+			t.Fatalf("%s: expect %s, got %s, %v", s, expected, selection, err)
+		}
+	}
+	for _, s := range []string{"", "0", "a", "5-3", "1,,2", "-1"} {
+		if _, err := parseFileSelection(s); err == nil {
+			t.Fatalf("%s should be invalid", s)
+		}
+	}
+}
+
+func TestGetMetaFileType(t *testing.T) {
+	cases := []struct {
+		fileName string
+		mimeType string
+		expected string
+	}{
+		{"/tmp/ubuntu.torrent", "", torrentFile},
+		{"/tmp/ubuntu.meta4", "", metalinkFile},
+		{"/tmp/download.php", "application/x-bittorrent", torrentFile},
+		{"/tmp/download.php", "Application/Metalink4+xml; charset=utf-8", metalinkFile},
+		{"/tmp/download.php", "application/metalink+xml", metalinkFile},
+		{"/tmp/aria2.down", "text/plain", ""},
+	}
+	for _, c := range cases {
+		if fileType := getMetaFileType(c.fileName, c.mimeType); fileType != c.expected {
+			t.Errorf("%s %s: expect %s, got %s", c.fileName, c.mimeType, c.expected, fileType)
+		}
+	}
+}
+
+func TestIsDownloadUri(t *testing.T) {
+	for _, uri := range []string{"http://a/b", "https://a/b", "ftp://a/b", "magnet:?xt=urn:btih:abc"} {
+		if !isDownloadUri(uri) {
+			t.Fatalf("%s should be download uri", uri)
+		}
+	}
+	for _, arg := range []string{"dir=/tmp", "magnet", "header=Cookie:a=b"} {
+		if isDownloadUri(arg) {
+			t.Fatalf("%s should not be download uri", arg)
+		}
+	}
+}
+
+// btBackend records the options of added torrent
+type btBackend struct {
+	downloader
+	options map[string]interface{}
+}
+
+func (self *btBackend) getName() string {
+	return "pi"
+}
+
+func (self *btBackend) isLocal() bool {
+	return false
+}
+
+func (self *btBackend) addTorrent(torrent string, options map[string]interface{}) (string, error) {
+	self.options = options
+	return "2089b05ecca3d829", nil
+}
+
+func TestHandleFileOptions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bt")
+	defer os.RemoveAll(dir)
+	torrent := filepath.Join(dir, "a.torrent")
+	ioutil.WriteFile(torrent, []byte("d4:infoe"), 0644)
+	backend := &btBackend{}
+	piDer := &PiDownloader{notifier: newTaskNotifier(), diskGuard: &diskGuard{}}
+	piDer.backends = []downloader{backend}
+	piDer.backendMap = map[string]downloader{"pi": backend}
+	// the invalid options are rejected before the torrent is added
+	invalids := [][]string{
+		{"dir"},
+		{"@nas"},
+		{"category=../etc"},
+		{"profile=nas"},
+	}
+	for _, options := range invalids {
+		args := append([]string{"http://example.com/a.torrent", torrent, "application/x-bittorrent"}, options...)
+		if _, err := piDer.handleFile("user", args); err == nil || backend.options != nil {
+			t.Errorf("the options %v should be rejected", options)
+		}
+	}
+
+	dbHelper, dbErr := NewDownloaderDbHelper(filepath.Join(dir, "pidownloader.db"))
+	if dbErr != nil {
+		t.Skip("sqlite3 is not available:", dbErr)
+	}
+	defer dbHelper.Close()
+	piDer.dbHelper = dbHelper
+	args := []string{"http://example.com/a.torrent", torrent, "", "@pi", "dir=/tmp/movie", "category=movie"}
+	if _, err := piDer.handleFile("user", args); err != nil {
+		t.Fatal(err)
+	}
+	if backend.options["dir"] != "/tmp/movie" || backend.options["category"] != nil {
+		t.Fatal("unexpected options:", backend.options)
+	}
+	if task, _ := dbHelper.GetDownloadTask("2089b05ecca3d829"); task == nil || task.Username != "user" {
+		t.Fatal("the task should be recorded:", task)
+	}
+}
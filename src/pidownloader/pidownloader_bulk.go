@@ -0,0 +1,194 @@
+package pidownloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const bulkQueryLimit = 1000
+
+var bulkQueryKeys = []string{"gid", "status", "bittorrent", "files"}
+
+// taskSelector selects tasks by gids, "all", "status=error", "name~regex" or "owner=me",
+// the conditions are combined by "and"
+type taskSelector struct {
+	gids    map[string]bool
+	all     bool
+	status  string
+	name    *regexp.Regexp
+	ownerMe bool
+}
+
+func parseTaskSelector(args []string) (*taskSelector, error) {
+	if len(args) == 0 {
+		return nil, errors.New("missing args!")
+	}
+	selector := &taskSelector{gids: make(map[string]bool)}
+	for _, arg := range args {
+		switch {
+		case strings.ToLower(arg) == "all":
+			selector.all = true
+		case strings.HasPrefix(arg, "status="):
+			selector.status = strings.ToLower(strings.TrimPrefix(arg, "status="))
+		case strings.HasPrefix(arg, "name~"):
+			reg, err := regexp.Compile("(?i)" + strings.TrimPrefix(arg, "name~"))
+			if err != nil {
+				return nil, err
+			}
+			selector.name = reg
+		case arg == "owner=me":
+			selector.ownerMe = true
+		case strings.ContainsAny(arg, "=~"):
+			return nil, errors.New("invalid selector: " + arg)
+		default:
+			selector.gids[arg] = true
+		}
+	}
+	return selector, nil
+}
+
+// the tasks need to be queried from aria2 if it is not a gid list
+func (self *taskSelector) isFilter() bool {
+	return self.all || self.status != "" || self.name != nil || self.ownerMe
+}
+
+func (self *taskSelector) match(task map[string]interface{}, title string) bool {
+	if len(self.gids) > 0 && !self.gids[fmt.Sprint(task["gid"])] {
+		return false
+	}
+	if self.status != "" && self.status != task["status"] {
+		return false
+	}
+	if self.name != nil && !self.name.MatchString(title) {
+		return false
+	}
+	return true
+}
+
+type selectedTask struct {
+	gid     string
+	backend downloader
+	err     error // the error of finding the task
+}
+
+// selectTasks returns the selected tasks, only the stopped tasks are queried if stoppedOnly
+func (self *PiDownloader) selectTasks(username string, targets []downloader, selector *taskSelector,
+	stoppedOnly bool) ([]*selectedTask, error) {
+	if !selector.isFilter() && !stoppedOnly {
+		gids := make([]string, 0, len(selector.gids))
+		for gid, _ := range selector.gids {
+			gids = append(gids, gid)
+		}
+		sort.Strings(gids)
+		selected := make([]*selectedTask, 0, len(gids))
+		for _, gid := range gids {
+			backend, err := self.findTargetBackend(targets, gid)
+			selected = append(selected, &selectedTask{gid, backend, err})
+		}
+		return selected, nil
+	}
+	tasks, err := self.tellStopped(targets, bulkQueryKeys)
+	if err != nil {
+		return nil, err
+	}
+	if !stoppedOnly {
+		activeTasks, actErr := self.tellActive(targets, bulkQueryKeys)
+		if actErr != nil {
+			return nil, actErr
+		}
+		waitingTasks, wtErr := self.tellWaiting(targets, bulkQueryKeys)
+		if wtErr != nil {
+			return nil, wtErr
+		}
+		tasks = append(append(activeTasks, waitingTasks...), tasks...)
+	}
+	var ownGids map[string]bool
+	if selector.ownerMe || !self.isAdmin(username) {
+		if ownGids, err = self.dbHelper.GetUserDownloadGids(username); err != nil {
+			return nil, err
+		}
+	}
+	selected := make([]*selectedTask, 0)
+	for _, task := range tasks {
+		gid := fmt.Sprint(task["gid"])
+		if ownGids != nil && !ownGids[gid] {
+			continue
+		}
+		if selector.match(task, self.getTitle(task)) {
+			backend := self.backendMap[fmt.Sprint(task["backend"])]
+			selected = append(selected, &selectedTask{gid, backend, nil})
+		}
+	}
+	return selected, nil
+}
+
+type taskOperation func(backend downloader, gid string) error
+
+// operateTasks runs the operation on every selected task and summarizes the outcomes
+func (self *PiDownloader) operateTasks(username string, args []string, stoppedOnly bool,
+	operation taskOperation) (string, error) {
+	targets, args, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	selector, parseErr := parseTaskSelector(args)
+	if parseErr != nil {
+		return "", parseErr
+	}
+	tasks, selectErr := self.selectTasks(username, targets, selector, stoppedOnly)
+	if selectErr != nil {
+		return "", selectErr
+	}
+	if len(tasks) == 0 {
+		return "no matched tasks", nil
+	}
+	succeeded := 0
+	var buffer bytes.Buffer
+	for _, task := range tasks {
+		err := task.err
+		if err == nil && !selector.isFilter() {
+			err = self.checkOwner(username, task.gid)
+		}
+		if err == nil {
+			err = operation(task.backend, task.gid)
+		}
+		if err != nil {
+			buffer.WriteString(fmt.Sprintf("\n%s: %v", task.gid, err))
+		} else {
+			succeeded++
+			buffer.WriteString(fmt.Sprintf("\n%s: OK", task.gid))
+		}
+	}
+	return fmt.Sprintf("succeeded: %d, failed: %d%s", succeeded, len(tasks)-succeeded, buffer.String()), nil
+}
+
+// remove the active or waiting task, or the result of stopped task
+func removeTask(backend downloader, gid string) error {
+	err := backend.remove(gid)
+	if err != nil {
+		if resultErr := backend.removeDownloadResult(gid); resultErr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (self *PiDownloader) purge(username string, args []string) (string, error) {
+	targets, rest, targetErr := self.parseTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	if len(rest) == 0 {
+		if self.isAdmin(username) {
+			return self.operateBackends(targets, func(backend downloader) error {
+				return backend.purgeDownloadResult()
+			})
+		}
+		args = append(args, "all")
+	}
+	return self.operateTasks(username, args, true, downloader.removeDownloadResult)
+}
@@ -0,0 +1,40 @@
+package pidownloader
+
+import (
+	"testing"
+)
+
+func TestTaskSelector(t *testing.T) {
+	selector, err := parseTaskSelector([]string{"status=error", "name~s01e\\d+"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !selector.isFilter() {
+		t.Fatal("selector should be filter")
+	}
+	errorTask := map[string]interface{}{"gid": "1", "status": "error"}
+	completeTask := map[string]interface{}{"gid": "2", "status": "complete"}
+	if !selector.match(errorTask, "Show.S01E02.mkv") {
+		t.Fatal("error task should be matched")
+	}
+	if selector.match(errorTask, "Movie.mkv") || selector.match(completeTask, "Show.S01E02.mkv") {
+		t.Fatal("unexpected matched task")
+	}
+
+	gidSelector, err := parseTaskSelector([]string{"1", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gidSelector.isFilter() || len(gidSelector.gids) != 2 {
+		t.Fatalf("unexpected gid selector: %v", gidSelector)
+	}
+	if !gidSelector.match(errorTask, "") || gidSelector.match(completeTask, "") {
+		t.Fatal("unexpected gid selector result")
+	}
+
+	for _, args := range [][]string{{}, {"owner=you"}, {"name~("}} {
+		if _, err := parseTaskSelector(args); err == nil {
+			t.Fatalf("%v should be invalid", args)
+		}
+	}
+}
@@ -2,52 +2,295 @@ package pidownloader
 
 import (
 	"bufio"
+	"bytes"
 	l4g "code.google.com/p/log4go"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"gopkg.in/yaml.v1"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
-	"utils"
 )
 
-func (self *PiDownloader) parseCommandFile(filePath string) ([]string, error) {
+var varPattern = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// commandEntry is a command of command file
+type commandEntry struct {
+	source  string // the line or entry number in file
+	command string
+	args    []string
+	err     error // the error found when parsing
+}
+
+func (self *commandEntry) String() string {
+	return strings.TrimSpace(self.command + " " + strings.Join(self.args, " "))
+}
+
+// commandBatch is the json or yaml command file, the commands are string like "add url dir=/tmp"
+// or object like {"command": "add", "args": ["url", "dir=/tmp"]}. ${name} in commands is replaced by vars
+type commandBatch struct {
+	Vars     map[string]string `json:"vars" yaml:"vars"`
+	DryRun   bool              `json:"dryRun" yaml:"dryRun"`
+	Commands []interface{}     `json:"commands" yaml:"commands"`
+}
+
+// validate the args of commands before executing the command file
+var commandValidators = map[string]func(*PiDownloader, []string) error{
+	"add": func(self *PiDownloader, args []string) error {
+		_, args, targetErr := self.parseTarget(args)
+		if targetErr != nil {
+			return targetErr
+		}
+		uris, params, err := parseAddArgs(args)
+		if err != nil {
+			return err
+		}
+		_, localParams := splitTaskOptions(params)
+		if categoryErr := validateCategory(localParams["category"]); categoryErr != nil {
+			return categoryErr
+		}
+		_, profileErr := self.findProfile(uris, localParams["profile"])
+		return profileErr
+	},
+	"btselect": func(self *PiDownloader, args []string) error {
+		_, args, targetErr := self.parseTarget(args)
+		if targetErr != nil {
+			return targetErr
+		}
+		if len(args) < 2 {
+			return errors.New("missing args!")
+		}
+		_, err := parseFileSelection(args[1])
+		return err
+	},
+	"prio": func(self *PiDownloader, args []string) error {
+		_, args, targetErr := self.parseTarget(args)
+		if targetErr != nil {
+			return targetErr
+		}
+		if len(args) < 2 || positionArgs[strings.ToLower(args[1])] == nil {
+			return errors.New("invalid position, it should be top, up, down or bottom")
+		}
+		return nil
+	},
+}
+
+func isBatchFile(filePath string) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	return ext == ".json" || ext == ".yaml" || ext == ".yml"
+}
+
+// parseCommandFile parses the json, yaml or legacy aria2.down command file, return the commands and whether dry run
+func (self *PiDownloader) parseCommandFile(filePath string) ([]*commandEntry, bool, error) {
+	if !isBatchFile(filePath) {
+		return self.parseLegacyCommandFile(filePath)
+	}
+	content, readErr := ioutil.ReadFile(filePath)
+	if readErr != nil {
+		return nil, false, readErr
+	}
+	batch := &commandBatch{}
+	if strings.ToLower(filepath.Ext(filePath)) == ".json" {
+		if err := json.Unmarshal(stripComments(content), batch); err != nil {
+			return nil, false, err
+		}
+	} else {
+		if err := yaml.Unmarshal(content, batch); err != nil {
+			return nil, false, err
+		}
+	}
+	entries, err := parseBatchCommands(batch)
+	return entries, batch.DryRun, err
+}
+
+// json does not support comments, the lines start with # or // are removed
+func stripComments(content []byte) []byte {
+	var buffer bytes.Buffer
+	for _, line := range strings.Split(string(content), "\n") {
+		trimLine := strings.TrimSpace(line)
+		if strings.HasPrefix(trimLine, "#") || strings.HasPrefix(trimLine, "//") {
+			continue
+		}
+		buffer.WriteString(line)
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes()
+}
+
+func parseBatchCommands(batch *commandBatch) ([]*commandEntry, error) {
+	entries := make([]*commandEntry, 0, len(batch.Commands))
+	for i, c := range batch.Commands {
+		entry := &commandEntry{source: fmt.Sprintf("entry %d", i+1)}
+		var args []interface{}
+		switch v := c.(type) {
+		case string:
+			fields := strings.Fields(v)
+			if len(fields) > 0 {
+				entry.command = fields[0]
+				entry.args = fields[1:]
+			}
+		case map[string]interface{}:
+			entry.command = fmt.Sprint(v["command"])
+			args, _ = v["args"].([]interface{})
+		case map[interface{}]interface{}: // decoded by yaml
+			entry.command = fmt.Sprint(v["command"])
+			args, _ = v["args"].([]interface{})
+		default:
+			return nil, errors.New(entry.source + ": invalid command")
+		}
+		for _, arg := range args {
+			entry.args = append(entry.args, fmt.Sprint(arg))
+		}
+		entry.command = strings.ToLower(entry.command)
+		for j, arg := range entry.args {
+			expanded, err := expandVars(arg, batch.Vars)
+			if err != nil {
+				entry.err = err
+				break
+			}
+			entry.args[j] = expanded
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// expandVars replaces ${name} by the value of variable
+func expandVars(s string, vars map[string]string) (string, error) {
+	var undefined string
+	expanded := varPattern.ReplaceAllStringFunc(s, func(v string) string {
+		name := varPattern.FindStringSubmatch(v)[1]
+		value, ok := vars[name]
+		if !ok {
+			undefined = name
+		}
+		return value
+	})
+	if undefined != "" {
+		return "", errors.New("undefined variable: " + undefined)
+	}
+	return expanded, nil
+}
+
+// parseLegacyCommandFile parses the blocks of uri followed by option lines like dir=/tmp,
+// the line starts with # is comment and the line dryrun=true enables dry run
+func (self *PiDownloader) parseLegacyCommandFile(filePath string) ([]*commandEntry, bool, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer f.Close()
 	reader := bufio.NewReader(f)
-	commands := make([]string, 0)
-	var lastCommand string
+	entries := make([]*commandEntry, 0)
+	dryRun := false
+	var lastEntry *commandEntry
+	lineNum := 0
 	for {
 		line, e := readln(reader)
 		if e != nil {
 			if e == io.EOF {
-				if lastCommand != "" && len(lastCommand) > 0 {
-					commands = append(commands, lastCommand)
+				if lastEntry != nil {
+					entries = append(entries, lastEntry)
 				}
 				break
 			} else {
-				return nil, e
+				return nil, false, e
 			}
 		}
+		lineNum++
 		l4g.Debug("Read line from %s: %s", filePath, line)
 		trimLine := strings.TrimSpace(line)
+		if strings.HasPrefix(trimLine, "#") {
+			continue
+		}
 		if trimLine == "" || len(trimLine) == 0 {
-			if lastCommand != "" && len(lastCommand) > 0 {
-				commands = append(commands, lastCommand)
+			if lastEntry != nil {
+				entries = append(entries, lastEntry)
 			}
-			lastCommand = ""
+			lastEntry = nil
 			continue
 		}
-		if utils.IsHttpUrl(trimLine) {
-			lastCommand = "add " + trimLine
+		if isDownloadUri(trimLine) {
+			if lastEntry != nil {
+				entries = append(entries, lastEntry)
+			}
+			lastEntry = &commandEntry{source: fmt.Sprintf("line %d", lineNum), command: "add", args: []string{trimLine}}
+			continue
+		}
+		paramNameValue := strings.SplitN(trimLine, "=", 2)
+		if len(paramNameValue) != 2 {
+			return nil, false, errors.New(fmt.Sprintf("line %d: invalid option %s", lineNum, trimLine))
+		}
+		name := strings.TrimSpace(paramNameValue[0])
+		value := strings.Replace(paramNameValue[1], " ", "", -1)
+		if lastEntry == nil {
+			if name == "dryrun" {
+				dryRun = value == "true"
+				continue
+			}
+			return nil, false, errors.New(fmt.Sprintf("line %d: option without uri", lineNum))
+		}
+		lastEntry.args = append(lastEntry.args, fmt.Sprintf("%s=%s", name, value))
+	}
+	return entries, dryRun, nil
+}
+
+// validateCommands checks all commands, return the description of invalid ones
+func (self *PiDownloader) validateCommands(entries []*commandEntry) string {
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		err := entry.err
+		if err == nil {
+			if _, ok := self.commandMap[entry.command]; !ok || entry.command == "file" {
+				err = errors.New("unknown command: " + entry.command)
+			} else if validator := commandValidators[entry.command]; validator != nil {
+				err = validator(self, entry.args)
+			}
+		}
+		if err != nil {
+			buffer.WriteString(fmt.Sprintf("\n%s: %v", entry.source, err))
+		}
+	}
+	return buffer.String()
+}
+
+// executeCommandFile validates all commands of the file, then executes them one by one and reports the result of each.
+// the commands are only listed if dry run
+func (self *PiDownloader) executeCommandFile(username, filePath string) (string, error) {
+	entries, dryRun, parseErr := self.parseCommandFile(filePath)
+	if parseErr != nil {
+		return "", parseErr
+	}
+	if len(entries) == 0 {
+		return "", errors.New("no command in file!")
+	}
+	if invalid := self.validateCommands(entries); invalid != "" {
+		return "", errors.New("invalid command file:" + invalid)
+	}
+	var buffer bytes.Buffer
+	if dryRun {
+		buffer.WriteString(fmt.Sprintf("dry run, %d commands:", len(entries)))
+		for _, entry := range entries {
+			buffer.WriteString(fmt.Sprintf("\n%s: %s", entry.source, entry))
+		}
+		return buffer.String(), nil
+	}
+	succeeded := 0
+	for _, entry := range entries {
+		l4g.Debug("Exec command from file: %s", entry)
+		result, execErr := self.Handle(username, entry.command, entry.args)
+		if execErr != nil {
+			buffer.WriteString(fmt.Sprintf("\n%s: %s, failed: %v", entry.source, entry, execErr))
 		} else {
-			paramNameValue := strings.SplitN(trimLine, "=", 2)
-			lastCommand = lastCommand + fmt.Sprintf(" %s=%s", paramNameValue[0], strings.Replace(paramNameValue[1], " ", "", -1))
+			succeeded++
+			buffer.WriteString(fmt.Sprintf("\n%s: %s, %s", entry.source, entry, strings.TrimSpace(result)))
 		}
 	}
-	return commands, nil
+	return fmt.Sprintf("succeeded: %d, failed: %d%s", succeeded, len(entries)-succeeded, buffer.String()), nil
 }
 
 func readln(r *bufio.Reader) (string, error) {
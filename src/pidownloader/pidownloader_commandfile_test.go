@@ -0,0 +1,111 @@
+package pidownloader
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeCommandFile(t *testing.T, dir, name, content string) string {
+	filePath := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func newCommandFileDownloader(executed *[]string) *PiDownloader {
+	piDer := &PiDownloader{}
+	piDer.initBackends(&config{RpcUrl: "http://localhost:6800/jsonrpc"})
+	piDer.commandMap = map[string]processFunc{
+		"add": func(self *PiDownloader, username string, args []string) (string, error) {
+			*executed = append(*executed, "add "+strings.Join(args, " "))
+			return "Add successful", nil
+		},
+		"rm": func(self *PiDownloader, username string, args []string) (string, error) {
+			return "", errors.New("no such task")
+		},
+		"file": (*PiDownloader).handleFile,
+	}
+	return piDer
+}
+
+func TestLegacyCommandFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "commandfile")
+	defer os.RemoveAll(dir)
+	filePath := writeCommandFile(t, dir, "aria2.down", `# movies
+http://example.com/a.mkv
+  dir=/tmp/movie
+  out=a b.mkv
+
+magnet:?xt=urn:btih:abc
+`)
+	var executed []string
+	piDer := newCommandFileDownloader(&executed)
+	result, err := piDer.executeCommandFile("user", filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result, "succeeded: 2, failed: 0") || len(executed) != 2 ||
+		executed[0] != "add http://example.com/a.mkv dir=/tmp/movie out=ab.mkv" {
+		t.Fatalf("unexpected result: %s %v", result, executed)
+	}
+
+	filePath = writeCommandFile(t, dir, "dryrun.down", "dryrun=true\nhttp://example.com/a.mkv\n")
+	executed = nil
+	result, err = piDer.executeCommandFile("user", filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(executed) != 0 || !strings.Contains(result, "line 2: add http://example.com/a.mkv") {
+		t.Fatalf("unexpected dry run: %s %v", result, executed)
+	}
+}
+
+func TestBatchCommandFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "commandfile")
+	defer os.RemoveAll(dir)
+	var executed []string
+	piDer := newCommandFileDownloader(&executed)
+	filePath := writeCommandFile(t, dir, "batch.json", `{
+	# the download dir
+	"vars": {"dir": "/tmp/movie"},
+	"commands": [
+		"add http://example.com/a.mkv dir=${dir}",
+		{"command": "ADD", "args": ["http://example.com/b.mkv", "dir=${dir}/b"]},
+		"rm 2089b05ecca3d829"
+	]
+}`)
+	result, err := piDer.executeCommandFile("user", filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result, "succeeded: 2, failed: 1") ||
+		!strings.Contains(result, "entry 3: rm 2089b05ecca3d829, failed: no such task") {
+		t.Fatalf("unexpected result: %s", result)
+	}
+	if len(executed) != 2 || executed[1] != "add http://example.com/b.mkv dir=/tmp/movie/b" {
+		t.Fatalf("unexpected commands: %v", executed)
+	}
+
+	// nothing is executed if any command is invalid
+	filePath = writeCommandFile(t, dir, "invalid.json", `{"commands": [
+		"add http://example.com/a.mkv",
+		"add dir=${dir}",
+		"foo bar",
+		"file x"
+	]}`)
+	executed = nil
+	_, err = piDer.executeCommandFile("user", filePath)
+	if err == nil || len(executed) != 0 {
+		t.Fatalf("invalid file should be rejected: %v", executed)
+	}
+	for _, s := range []string{"entry 2: undefined variable: dir", "entry 3: unknown command: foo", "entry 4: unknown command: file"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("%s is not reported: %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package pidownloader
+
+import (
+	l4g "code.google.com/p/log4go"
+	"errors"
+	"fmt"
+	"net/http"
+	"service"
+	"syscall"
+	"time"
+	"utils"
+)
+
+const headTimeout = 10 * time.Second
+
+type diskGuardConfig struct {
+	MinFreeSpace    string `json:"minFreeSpace,omitempty"`    // like 500M
+	ResumeFreeSpace string `json:"resumeFreeSpace,omitempty"` // resume the tasks when the free space is recovered
+}
+
+type diskGuard struct {
+	minFree    int64
+	resumeFree int64
+	paused     map[string][]string // backend -> the gids paused by guard, guarded by speedPlanLock
+}
+
+func newDiskGuard(c *diskGuardConfig) (*diskGuard, error) {
+	guard := &diskGuard{paused: make(map[string][]string)}
+	if c == nil || c.MinFreeSpace == "" {
+		return guard, nil
+	}
+	var err error
+	if guard.minFree, err = utils.ParseSize(c.MinFreeSpace); err != nil {
+		return nil, err
+	}
+	guard.resumeFree = guard.minFree * 2
+	if c.ResumeFreeSpace != "" {
+		if guard.resumeFree, err = utils.ParseSize(c.ResumeFreeSpace); err != nil {
+			return nil, err
+		}
+	}
+	if guard.resumeFree < guard.minFree {
+		return nil, errors.New("resumeFreeSpace is less than minFreeSpace")
+	}
+	return guard, nil
+}
+
+func getFreeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// the download dir of aria2, the dir option of task is preferred
+func getDownloadDir(backend downloader, options map[string]interface{}) (string, error) {
+	if dir, ok := options["dir"].(string); ok && dir != "" {
+		return dir, nil
+	}
+	globalOptions, err := backend.getGlobalOption()
+	if err != nil {
+		return "", err
+	}
+	return globalOptions["dir"], nil
+}
+
+// get the size of http file by HEAD request, -1 if unknown
+func getContentLength(uri string) int64 {
+	if !utils.IsHttpUrl(uri) {
+		return -1
+	}
+	client := &http.Client{Timeout: headTimeout}
+	resp, err := client.Head(uri)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return -1
+	}
+	return resp.ContentLength
+}
+
+// checkDiskSpace checks the free space before adding the uris, only the local backend is checked
+func (self *PiDownloader) checkDiskSpace(backend downloader, uris []string, options map[string]interface{}) error {
+	if self.diskGuard.minFree <= 0 || !backend.isLocal() {
+		return nil
+	}
+	dir, dirErr := getDownloadDir(backend, options)
+	if dirErr != nil {
+		return dirErr
+	}
+	free, freeErr := getFreeSpace(dir)
+	if freeErr != nil {
+		return freeErr
+	}
+	var required int64 = 0
+	for _, uri := range uris {
+		if length := getContentLength(uri); length > 0 {
+			required += length
+		}
+	}
+	if free-required < self.diskGuard.minFree {
+		return errors.New(fmt.Sprintf("not enough disk space, free: %s, required: %s, reserved: %s",
+			utils.FormatSize(free), utils.FormatSize(required), utils.FormatSize(self.diskGuard.minFree)))
+	}
+	return nil
+}
+
+// monitorDiskSpace pauses the tasks of the local backends when the free space is low, and resumes them once recovered
+func (self *PiDownloader) monitorDiskSpace() {
+	if self.diskGuard.minFree <= 0 {
+		return
+	}
+	for _, backend := range self.backends {
+		if backend.isLocal() {
+			self.monitorBackendDiskSpace(backend)
+		}
+	}
+}
+
+// loadDiskGuard loads the tasks paused by guard before restarting, they are resumed once the space is recovered
+func (self *PiDownloader) loadDiskGuard() error {
+	entities, err := self.dbHelper.GetGuardPausedTasks()
+	if err != nil {
+		return err
+	}
+	self.speedPlanLock.Lock()
+	defer self.speedPlanLock.Unlock()
+	for _, entity := range entities {
+		self.diskGuard.paused[entity.Backend] = append(self.diskGuard.paused[entity.Backend], entity.Gid)
+	}
+	return nil
+}
+
+// holdByGuard records the gids paused by guard, the backend is held by guard even if no task is paused.
+// the lock should be held
+func (self *PiDownloader) holdByGuard(backend string, gids []string) {
+	if _, held := self.diskGuard.paused[backend]; !held {
+		self.diskGuard.paused[backend] = make([]string, 0, len(gids))
+	}
+	self.diskGuard.paused[backend] = append(self.diskGuard.paused[backend], gids...)
+	for _, gid := range gids {
+		if err := self.dbHelper.AddGuardPausedTask(&GuardPausedTaskEntity{Backend: backend, Gid: gid}); err != nil {
+			l4g.Error("Save task %s paused by disk guard error: %v", gid, err)
+		}
+	}
+}
+
+func (self *PiDownloader) monitorBackendDiskSpace(backend downloader) {
+	dir, dirErr := getDownloadDir(backend, nil)
+	if dirErr != nil {
+		l4g.Error("Get download dir of %s error: %v", backend.getName(), dirErr)
+		return
+	}
+	free, freeErr := getFreeSpace(dir)
+	if freeErr != nil {
+		l4g.Error("Get free space of %s error: %v", dir, freeErr)
+		return
+	}
+	if message := self.applyDiskGuard(backend, dir, free); message != "" {
+		self.notifyAdmins(message)
+	}
+}
+
+// applyDiskGuard pauses or resumes the tasks by the free space, returns the message to notify
+func (self *PiDownloader) applyDiskGuard(backend downloader, dir string, free int64) string {
+	self.speedPlanLock.Lock()
+	defer self.speedPlanLock.Unlock()
+	gids, held := self.diskGuard.paused[backend.getName()]
+	if !held && free < self.diskGuard.minFree {
+		pausedGids, err := pauseTasks(backend)
+		// the paused tasks are recorded even if some tasks are failed to pause
+		self.holdByGuard(backend.getName(), pausedGids)
+		if err != nil {
+			l4g.Error("Pause tasks of %s error: %v", backend.getName(), err)
+		}
+		return fmt.Sprintf("Free space of %s is %s, %d tasks are paused!", dir, utils.FormatSize(free), len(pausedGids))
+	} else if held && free >= self.diskGuard.resumeFree {
+		if self.appliedLimit == pauseLimit {
+			// the tasks are resumed by speed plan after the pause window
+			if self.planPausedGids == nil {
+				self.planPausedGids = make(map[string][]string)
+			}
+			self.planPausedGids[backend.getName()] = append(self.planPausedGids[backend.getName()], gids...)
+		} else {
+			for _, gid := range gids {
+				if err := backend.unpause(gid); err != nil {
+					l4g.Debug("Unpause %s after disk space recovered error: %v", gid, err)
+				}
+			}
+		}
+		delete(self.diskGuard.paused, backend.getName())
+		if err := self.dbHelper.DeleteGuardPausedTasks(backend.getName()); err != nil {
+			l4g.Error("Delete tasks paused by disk guard of %s error: %v", backend.getName(), err)
+		}
+		return fmt.Sprintf("Free space of %s is recovered to %s, tasks are resumed.", dir, utils.FormatSize(free))
+	}
+	return ""
+}
+
+func (self *PiDownloader) notifyAdmins(message string) {
+	l4g.Info(message)
+	for _, admin := range self.admins {
+		self.pushMsgChannel <- &service.PushMessage{
+			Type:     service.Notification,
+			Username: admin,
+			Message:  message,
+		}
+	}
+}
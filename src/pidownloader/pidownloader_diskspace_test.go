@@ -0,0 +1,145 @@
+package pidownloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"service"
+	"sort"
+	"testing"
+)
+
+func TestDiskGuard(t *testing.T) {
+	guard, err := newDiskGuard(&diskGuardConfig{MinFreeSpace: "500M"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if guard.minFree != 500<<20 || guard.resumeFree != 1000<<20 {
+		t.Fatalf("unexpected guard: %v", guard)
+	}
+	if _, err := newDiskGuard(&diskGuardConfig{MinFreeSpace: "1G", ResumeFreeSpace: "500M"}); err == nil {
+		t.Fatal("resume free space should not be less than min free space")
+	}
+	free, freeErr := getFreeSpace(os.TempDir())
+	if freeErr != nil || free <= 0 {
+		t.Fatalf("get free space error: %d, %v", free, freeErr)
+	}
+}
+
+// guardBackend keeps the status of tasks
+type guardBackend struct {
+	downloader
+	status   map[string]string
+	unpaused []string
+}
+
+func (self *guardBackend) getName() string {
+	return "pi"
+}
+
+func (self *guardBackend) isLocal() bool {
+	return true
+}
+
+func (self *guardBackend) getGlobalOption() (map[string]string, error) {
+	return map[string]string{"dir": os.TempDir()}, nil
+}
+
+func (self *guardBackend) tasks(status string) []map[string]interface{} {
+	tasks := make([]map[string]interface{}, 0)
+	for _, gid := range []string{"a", "b", "c"} {
+		if self.status[gid] == status {
+			tasks = append(tasks, map[string]interface{}{"gid": gid, "status": status})
+		}
+	}
+	return tasks
+}
+
+func (self *guardBackend) tellActive(keys []string) ([]map[string]interface{}, error) {
+	return self.tasks("active"), nil
+}
+
+func (self *guardBackend) tellWaiting(offset, num int, keys []string) ([]map[string]interface{}, error) {
+	return append(self.tasks("waiting"), self.tasks("paused")...), nil
+}
+
+func (self *guardBackend) pause(gid string) error {
+	self.status[gid] = "paused"
+	return nil
+}
+
+func (self *guardBackend) unpause(gid string) error {
+	self.status[gid] = "waiting"
+	self.unpaused = append(self.unpaused, gid)
+	return nil
+}
+
+func (self *guardBackend) changeGlobalOption(options map[string]string) error {
+	return nil
+}
+
+func TestMonitorDiskSpace(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "diskguard")
+	defer os.RemoveAll(dir)
+	dbHelper, dbErr := NewDownloaderDbHelper(filepath.Join(dir, "pidownloader.db"))
+	if dbErr != nil {
+		t.Skip("sqlite3 is not available:", dbErr)
+	}
+	defer dbHelper.Close()
+	backend := &guardBackend{status: map[string]string{"a": "active", "b": "waiting", "c": "paused"}}
+	newPiDer := func() *PiDownloader {
+		guard, _ := newDiskGuard(nil)
+		piDer := &PiDownloader{backends: []downloader{backend}, dbHelper: dbHelper, diskGuard: guard,
+			pushMsgChannel: make(chan *service.PushMessage, 10)}
+		piDer.speedPlan = &speedPlan{defaultLimit: "0"}
+		return piDer
+	}
+	piDer := newPiDer()
+	piDer.diskGuard.minFree = 1 << 62
+	piDer.monitorDiskSpace()
+	if backend.status["a"] != "paused" || backend.status["b"] != "paused" {
+		t.Fatalf("the tasks should be paused by guard: %v", backend.status)
+	}
+	// the speed plan does not resume the tasks during low space
+	piDer.speedPlan = &speedPlan{defaultLimit: pauseLimit}
+	piDer.applySpeedPlan()
+	piDer.speedPlan = &speedPlan{defaultLimit: "0"}
+	piDer.applySpeedPlan()
+	if len(backend.unpaused) != 0 {
+		t.Fatalf("the tasks should not be resumed during low space: %v", backend.unpaused)
+	}
+
+	// the guard state is kept after restarting
+	piDer = newPiDer()
+	if err := piDer.loadDiskGuard(); err != nil {
+		t.Fatal(err)
+	}
+	piDer.diskGuard.minFree, piDer.diskGuard.resumeFree = 1, 1
+	piDer.monitorDiskSpace()
+	sort.Strings(backend.unpaused)
+	if !reflect.DeepEqual(backend.unpaused, []string{"a", "b"}) || backend.status["c"] != "paused" {
+		t.Fatalf("only the tasks paused by guard should be resumed: %v, %v", backend.unpaused, backend.status)
+	}
+	if entities, _ := dbHelper.GetGuardPausedTasks(); len(entities) != 0 {
+		t.Fatalf("the guard state should be cleared: %v", entities)
+	}
+
+	// the tasks paused by plan during low space are resumed by guard
+	backend.unpaused = nil
+	piDer.speedPlan = &speedPlan{defaultLimit: pauseLimit}
+	piDer.applySpeedPlan()
+	piDer.diskGuard.minFree = 1 << 62
+	piDer.monitorDiskSpace()
+	piDer.speedPlan = &speedPlan{defaultLimit: "0"}
+	piDer.applySpeedPlan()
+	if len(backend.unpaused) != 0 {
+		t.Fatalf("the tasks should not be resumed during low space: %v", backend.unpaused)
+	}
+	piDer.diskGuard.minFree, piDer.diskGuard.resumeFree = 1, 1
+	piDer.monitorDiskSpace()
+	sort.Strings(backend.unpaused)
+	if !reflect.DeepEqual(backend.unpaused, []string{"a", "b"}) {
+		t.Fatalf("the tasks paused by plan should be resumed by guard: %v", backend.unpaused)
+	}
+}
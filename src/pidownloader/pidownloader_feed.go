@@ -0,0 +1,351 @@
+package pidownloader
+
+import (
+	"bytes"
+	l4g "code.google.com/p/log4go"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"service"
+	"strings"
+	"utils"
+)
+
+const (
+	defaultFeedCron = "0 0/15 * * * *"
+	feedTestLimit   = 20
+)
+
+type feedItem struct {
+	Guid  string
+	Title string
+	Link  string
+}
+
+// the elements of both rss and atom
+type rssLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Text string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title     string    `xml:"title"`
+	Links     []rssLink `xml:"link"`
+	Guid      string    `xml:"guid"`
+	Id        string    `xml:"id"`
+	Enclosure struct {
+		Url string `xml:"url,attr"`
+	} `xml:"enclosure"`
+}
+
+type rssFeed struct {
+	XMLName  xml.Name
+	Items    []rssItem `xml:"channel>item"`
+	RdfItems []rssItem `xml:"item"`
+	Entries  []rssItem `xml:"entry"`
+}
+
+// parseFeed parses the items of rss or atom, the enclosure is preferred as the link
+func parseFeed(data []byte) ([]*feedItem, error) {
+	feed := &rssFeed{}
+	if err := xml.Unmarshal(data, feed); err != nil {
+		return nil, err
+	}
+	if feed.XMLName.Local != "rss" && feed.XMLName.Local != "feed" && feed.XMLName.Local != "RDF" {
+		return nil, errors.New("not rss or atom feed")
+	}
+	items := make([]*feedItem, 0)
+	for _, entry := range append(append(feed.Items, feed.RdfItems...), feed.Entries...) {
+		item := &feedItem{Title: strings.TrimSpace(entry.Title)}
+		item.Link = strings.TrimSpace(entry.Enclosure.Url)
+		for _, link := range entry.Links {
+			if link.Href != "" && link.Rel == "enclosure" {
+				item.Link = link.Href
+			}
+		}
+		if item.Link == "" && len(entry.Links) > 0 {
+			item.Link = strings.TrimSpace(entry.Links[0].Href + entry.Links[0].Text)
+		}
+		item.Guid = strings.TrimSpace(entry.Guid)
+		if item.Guid == "" {
+			item.Guid = strings.TrimSpace(entry.Id)
+		}
+		if item.Guid == "" {
+			item.Guid = item.Link
+		}
+		if item.Guid != "" {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func fetchFeed(feedUrl string) ([]*feedItem, error) {
+	resp, err := http.Get(feedUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("fetch feed error: " + resp.Status)
+	}
+	data, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+	return parseFeed(data)
+}
+
+type feedFilter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+func newFeedFilter(include, exclude string) (*feedFilter, error) {
+	filter := &feedFilter{}
+	var err error
+	if include != "" {
+		if filter.include, err = regexp.Compile("(?i)" + include); err != nil {
+			return nil, err
+		}
+	}
+	if exclude != "" {
+		if filter.exclude, err = regexp.Compile("(?i)" + exclude); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+func (self *feedFilter) match(item *feedItem) bool {
+	if !isDownloadUri(item.Link) {
+		return false
+	}
+	if self.include != nil && !self.include.MatchString(item.Title) {
+		return false
+	}
+	if self.exclude != nil && self.exclude.MatchString(item.Title) {
+		return false
+	}
+	return true
+}
+
+// parse the args like "include=regex exclude=regex dir=/tmp", the other args are the download options
+func parseFeedArgs(args []string) (include, exclude string, options []string, err error) {
+	for _, arg := range args {
+		nameValue := strings.SplitN(arg, "=", 2)
+		if len(nameValue) != 2 {
+			return "", "", nil, errors.New("invalid args: " + arg)
+		}
+		switch nameValue[0] {
+		case "include":
+			include = nameValue[1]
+		case "exclude":
+			exclude = nameValue[1]
+		default:
+			options = append(options, arg)
+		}
+	}
+	return
+}
+
+func (self *PiDownloader) addFeed(username string, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("missing args!")
+	}
+	name, feedUrl := args[0], args[1]
+	if !utils.IsHttpUrl(feedUrl) {
+		return "", errors.New("invalid feed url: " + feedUrl)
+	}
+	existed, getErr := self.dbHelper.GetFeed(username, name)
+	if getErr != nil {
+		return "", getErr
+	}
+	if existed != nil {
+		return "", errors.New("feed existed: " + name)
+	}
+	include, exclude, options, parseErr := parseFeedArgs(args[2:])
+	if parseErr != nil {
+		return "", parseErr
+	}
+	if _, filterErr := newFeedFilter(include, exclude); filterErr != nil {
+		return "", filterErr
+	}
+	items, fetchErr := fetchFeed(feedUrl)
+	if fetchErr != nil {
+		return "", fetchErr
+	}
+	entity := &FeedEntity{
+		Username: username,
+		Name:     name,
+		Url:      feedUrl,
+		Include:  include,
+		Exclude:  exclude,
+		Options:  strings.Join(options, " "),
+	}
+	if err := self.dbHelper.AddFeed(entity); err != nil {
+		return "", err
+	}
+	// the existing items are not downloaded
+	for _, item := range items {
+		self.markFeedItem(entity, item)
+	}
+	return fmt.Sprintf("Add feed successful, %d existing items are skipped", len(items)), nil
+}
+
+func (self *PiDownloader) listFeeds(username string, args []string) (string, error) {
+	feeds, err := self.dbHelper.GetUserFeeds(username)
+	if err != nil {
+		return "", err
+	}
+	if len(feeds) == 0 {
+		return "no records", nil
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("\n")
+	for _, feed := range feeds {
+		buffer.WriteString(fmt.Sprintf("name: %s\n", feed.Name))
+		buffer.WriteString(fmt.Sprintf("url: %s\n", feed.Url))
+		if feed.Include != "" {
+			buffer.WriteString(fmt.Sprintf("include: %s\n", feed.Include))
+		}
+		if feed.Exclude != "" {
+			buffer.WriteString(fmt.Sprintf("exclude: %s\n", feed.Exclude))
+		}
+		if feed.Options != "" {
+			buffer.WriteString(fmt.Sprintf("options: %s\n", feed.Options))
+		}
+		buffer.WriteString("==================\n")
+	}
+	return buffer.String(), nil
+}
+
+// testfeed shows the matched items of the feed without downloading, the filters
+// in args replace the saved ones
+func (self *PiDownloader) testFeed(username string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("missing args!")
+	}
+	feedUrl := args[0]
+	include, exclude, _, parseErr := parseFeedArgs(args[1:])
+	if parseErr != nil {
+		return "", parseErr
+	}
+	if !utils.IsHttpUrl(feedUrl) {
+		feed, err := self.dbHelper.GetFeed(username, args[0])
+		if err != nil {
+			return "", err
+		}
+		if feed == nil {
+			return "", errors.New("no such feed: " + args[0])
+		}
+		feedUrl = feed.Url
+		if len(args) == 1 {
+			include, exclude = feed.Include, feed.Exclude
+		}
+	}
+	filter, filterErr := newFeedFilter(include, exclude)
+	if filterErr != nil {
+		return "", filterErr
+	}
+	items, fetchErr := fetchFeed(feedUrl)
+	if fetchErr != nil {
+		return "", fetchErr
+	}
+	var buffer bytes.Buffer
+	matched := 0
+	for _, item := range items {
+		if !filter.match(item) {
+			continue
+		}
+		matched++
+		if matched <= feedTestLimit {
+			buffer.WriteString(fmt.Sprintf("\n%s\n%s\n", item.Title, item.Link))
+		}
+	}
+	return fmt.Sprintf("%d of %d items matched\n%s", matched, len(items), buffer.String()), nil
+}
+
+func (self *PiDownloader) removeFeed(username string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("missing args!")
+	}
+	feed, err := self.dbHelper.GetFeed(username, args[0])
+	if err != nil {
+		return "", err
+	}
+	if feed == nil {
+		return "", errors.New("no such feed: " + args[0])
+	}
+	if err := self.dbHelper.DeleteFeed(feed); err != nil {
+		return "", err
+	}
+	return "Remove feed successful: " + feed.Name, nil
+}
+
+func (self *PiDownloader) markFeedItem(feed *FeedEntity, item *feedItem) {
+	entity := &FeedItemEntity{FeedId: feed.Id, Guid: item.Guid, Title: item.Title, Link: item.Link}
+	if err := self.dbHelper.AddFeedItem(entity); err != nil {
+		l4g.Error("Save feed item %s error: %v", item.Guid, err)
+	}
+}
+
+// checkFeeds polls all feeds and downloads the new matched items
+func (self *PiDownloader) checkFeeds() {
+	feeds, err := self.dbHelper.GetAllFeeds()
+	if err != nil {
+		l4g.Error("Get feeds error: %v", err)
+		return
+	}
+	for _, feed := range feeds {
+		self.checkFeed(feed)
+	}
+}
+
+func (self *PiDownloader) checkFeed(feed *FeedEntity) {
+	filter, filterErr := newFeedFilter(feed.Include, feed.Exclude)
+	if filterErr != nil {
+		l4g.Error("Invalid filter of feed %s: %v", feed.Name, filterErr)
+		return
+	}
+	items, fetchErr := fetchFeed(feed.Url)
+	if fetchErr != nil {
+		l4g.Error("Fetch feed %s error: %v", feed.Url, fetchErr)
+		return
+	}
+	for _, item := range items {
+		seen, err := self.dbHelper.IsFeedItemSeen(feed.Id, item.Guid)
+		if err != nil {
+			l4g.Error("Check feed item %s error: %v", item.Guid, err)
+			continue
+		}
+		if seen {
+			continue
+		}
+		if !filter.match(item) {
+			self.markFeedItem(feed, item)
+			continue
+		}
+		args := []string{item.Link}
+		if feed.Options != "" {
+			args = append(args, strings.Split(feed.Options, " ")...)
+		}
+		result, addErr := self.addUri(feed.Username, args)
+		if addErr != nil {
+			// the item is not marked, so it is added again in the next poll
+			l4g.Error("Add feed %s item %s error: %v", feed.Name, item.Title, addErr)
+			continue
+		}
+		self.markFeedItem(feed, item)
+		l4g.Info("Feed %s item %s: %s", feed.Name, item.Title, result)
+		self.pushMsgChannel <- &service.PushMessage{
+			Type:     service.Notification,
+			Username: feed.Username,
+			Message:  fmt.Sprintf("Feed %s: %s\n%s", feed.Name, item.Title, result),
+		}
+	}
+}
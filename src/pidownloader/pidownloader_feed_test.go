@@ -0,0 +1,147 @@
+package pidownloader
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"service"
+	"testing"
+)
+
+const testRss = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+<channel>
+<title>episodes</title>
+<item>
+	<title>Show S01E01 720p</title>
+	<link>http://example.com/show/1</link>
+	<guid>show-1</guid>
+	<enclosure url="http://example.com/show/1.torrent" type="application/x-bittorrent"/>
+</item>
+<item>
+	<title>Show S01E02 1080p</title>
+	<link>magnet:?xt=urn:btih:abc</link>
+</item>
+</channel>
+</rss>`
+
+const testAtom = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<title>episodes</title>
+<entry>
+	<title>Show S01E03</title>
+	<id>urn:show:3</id>
+	<link href="http://example.com/show/3"/>
+	<link rel="enclosure" href="http://example.com/show/3.torrent"/>
+</entry>
+</feed>`
+
+func TestParseFeed(t *testing.T) {
+	items, err := parseFeed([]byte(testRss))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expect 2 items, got %d", len(items))
+	}
+	if items[0].Guid != "show-1" || items[0].Link != "http://example.com/show/1.torrent" {
+		t.Fatalf("unexpected item: %v", items[0])
+	}
+	if items[1].Guid != "magnet:?xt=urn:btih:abc" || items[1].Link != "magnet:?xt=urn:btih:abc" {
+		t.Fatalf("unexpected item: %v", items[1])
+	}
+	atomItems, atomErr := parseFeed([]byte(testAtom))
+	if atomErr != nil {
+		t.Fatal(atomErr)
+	}
+	if len(atomItems) != 1 || atomItems[0].Guid != "urn:show:3" || atomItems[0].Link != "http://example.com/show/3.torrent" {
+		t.Fatalf("unexpected items: %v", atomItems)
+	}
+	if _, err := parseFeed([]byte("<html></html>")); err == nil {
+		t.Fatal("html should not be parsed")
+	}
+}
+
+func TestFeedFilter(t *testing.T) {
+	filter, err := newFeedFilter("s01e\\d+", "720p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, _ := parseFeed([]byte(testRss))
+	if filter.match(items[0]) || !filter.match(items[1]) {
+		t.Fatal("unexpected filter result")
+	}
+	if _, err := newFeedFilter("(", ""); err == nil {
+		t.Fatal("invalid regex should not be compiled")
+	}
+	include, exclude, options, parseErr := parseFeedArgs([]string{"include=a b", "exclude=c", "dir=/tmp"})
+	if parseErr != nil || include != "a b" || exclude != "c" || len(options) != 1 || options[0] != "dir=/tmp" {
+		t.Fatalf("unexpected args: %s %s %v %v", include, exclude, options, parseErr)
+	}
+}
+
+// feedBackend fails to add until it is up
+type feedBackend struct {
+	downloader
+	up    bool
+	added []string
+}
+
+func (self *feedBackend) getName() string {
+	return "pi"
+}
+
+func (self *feedBackend) isLocal() bool {
+	return false
+}
+
+func (self *feedBackend) addUri(uris []string, options map[string]interface{}) (string, error) {
+	if !self.up {
+		return "", errors.New("connection refused")
+	}
+	self.added = append(self.added, uris[0])
+	return "2089b05ecca3d829", nil
+}
+
+func TestCheckFeed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "feed")
+	defer os.RemoveAll(dir)
+	dbHelper, dbErr := NewDownloaderDbHelper(filepath.Join(dir, "pidownloader.db"))
+	if dbErr != nil {
+		t.Skip("sqlite3 is not available:", dbErr)
+	}
+	defer dbHelper.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testRss)
+	}))
+	defer server.Close()
+	feed := &FeedEntity{Username: "user", Name: "show", Url: server.URL, Include: "720p"}
+	dbHelper.AddFeed(feed)
+	backend := &feedBackend{}
+	piDer := &PiDownloader{dbHelper: dbHelper, notifier: newTaskNotifier(), diskGuard: &diskGuard{},
+		pushMsgChannel: make(chan *service.PushMessage, 10)}
+	piDer.backends = []downloader{backend}
+	piDer.backendMap = map[string]downloader{"pi": backend}
+
+	// the matched item is not marked if it is failed to add
+	piDer.checkFeed(feed)
+	if seen, _ := dbHelper.IsFeedItemSeen(feed.Id, "show-1"); seen {
+		t.Fatal("the failed item should be retried")
+	}
+	if seen, _ := dbHelper.IsFeedItemSeen(feed.Id, "magnet:?xt=urn:btih:abc"); !seen {
+		t.Fatal("the unmatched item should be marked")
+	}
+	backend.up = true
+	piDer.checkFeed(feed)
+	if seen, _ := dbHelper.IsFeedItemSeen(feed.Id, "show-1"); !seen || len(backend.added) != 1 {
+		t.Fatal("the item should be added in the next poll:", backend.added)
+	}
+	piDer.checkFeed(feed)
+	if len(backend.added) != 1 {
+		t.Fatal("the added item should not be added again:", backend.added)
+	}
+}
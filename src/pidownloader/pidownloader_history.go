@@ -0,0 +1,196 @@
+package pidownloader
+
+import (
+	"bytes"
+	l4g "code.google.com/p/log4go"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"utils"
+)
+
+const historyLimit = 20
+
+func (self *PiDownloader) isAdmin(username string) bool {
+	for _, admin := range self.admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// load the unfinished tasks, so that the owners are notified after restarting
+func (self *PiDownloader) loadUnfinishedTasks() error {
+	entities, err := self.dbHelper.GetUnfinishedDownloadTasks()
+	if err != nil {
+		return err
+	}
+	for _, entity := range entities {
+		backendName := entity.Backend
+		if backendName == "" {
+			backendName = self.backends[0].getName()
+		}
+		self.notifier.addOwner(entity.Gid, backendName, entity.Username, time.Unix(entity.StartTime, 0))
+		if backend, ok := self.backendMap[backendName].(*httpDownloader); ok {
+			// the tasks of native backend are lost after restarting
+			if resumeErr := self.resumeNativeTask(backend, entity); resumeErr != nil {
+				l4g.Error("Resume task %s error: %v", entity.Gid, resumeErr)
+			}
+		}
+	}
+	return nil
+}
+
+func (self *PiDownloader) recordTask(gid string, backend downloader, username string, uris []string,
+	options map[string]interface{}, retries int) {
+	self.notifier.addOwner(gid, backend.getName(), username, time.Now())
+	optionsJson, _ := json.Marshal(options)
+	entity := &DownloadTaskEntity{
+		Gid:       gid,
+		Backend:   backend.getName(),
+		Username:  username,
+		Uris:      strings.Join(uris, " "),
+		Options:   string(optionsJson),
+		Retries:   retries,
+		StartTime: time.Now().Unix(),
+	}
+	if err := self.dbHelper.AddDownloadTask(entity); err != nil {
+		l4g.Error("Save download task %s error: %v", gid, err)
+	}
+}
+
+// the new task is created by aria2 after the metadata of magnet link or torrent is downloaded
+func (self *PiDownloader) followTask(gid, followedGid string, owner *taskOwner) {
+	self.notifier.addOwner(followedGid, owner.backend, owner.username, owner.addTime)
+	entity, err := self.dbHelper.GetDownloadTask(gid)
+	if err != nil || entity == nil {
+		l4g.Error("Get download task %s error: %v", gid, err)
+		return
+	}
+	followed := &DownloadTaskEntity{
+		Gid:       followedGid,
+		Backend:   entity.Backend,
+		Username:  entity.Username,
+		Uris:      entity.Uris,
+		Options:   entity.Options,
+		Retries:   entity.Retries,
+		StartTime: entity.StartTime,
+	}
+	if err := self.dbHelper.AddDownloadTask(followed); err != nil {
+		l4g.Error("Save download task %s error: %v", followedGid, err)
+	}
+}
+
+// save the final status of the task
+func (self *PiDownloader) finishTask(gid string, task map[string]interface{}) {
+	entity, err := self.dbHelper.GetDownloadTask(gid)
+	if err != nil || entity == nil {
+		l4g.Error("Get download task %s error: %v", gid, err)
+		return
+	}
+	entity.Title = self.getTitle(task)
+	entity.Status, _ = task["status"].(string)
+	if entity.Status == "active" {
+		entity.Status = "complete" // bt task is seeding
+	}
+	entity.TotalLength, _ = strconv.ParseInt(fmt.Sprint(task["totalLength"]), 10, 64)
+	entity.CompletedLength, _ = strconv.ParseInt(fmt.Sprint(task["completedLength"]), 10, 64)
+	entity.ErrorCode, _ = task["errorCode"].(string)
+	entity.EndTime = time.Now().Unix()
+	if err := self.dbHelper.UpdateDownloadTask(entity); err != nil {
+		l4g.Error("Update download task %s error: %v", gid, err)
+	}
+}
+
+// finishLostTask saves the task which is not found in backend, like purged or lost after aria2 restarted.
+// return the title of the task
+func (self *PiDownloader) finishLostTask(gid string) string {
+	entity, err := self.dbHelper.GetDownloadTask(gid)
+	if err != nil || entity == nil {
+		l4g.Error("Get download task %s error: %v", gid, err)
+		return gid
+	}
+	entity.Status = "unknown"
+	entity.EndTime = time.Now().Unix()
+	if err := self.dbHelper.UpdateDownloadTask(entity); err != nil {
+		l4g.Error("Update download task %s error: %v", gid, err)
+	}
+	if entity.Title != "" {
+		return entity.Title
+	}
+	return entity.Uris
+}
+
+// only the tasks added by user are visible for non-admin users
+func (self *PiDownloader) filterOwnTasks(username string, tasks []map[string]interface{}) ([]map[string]interface{}, error) {
+	if self.isAdmin(username) {
+		return tasks, nil
+	}
+	gids, err := self.dbHelper.GetUserDownloadGids(username)
+	if err != nil {
+		return nil, err
+	}
+	ownTasks := make([]map[string]interface{}, 0)
+	for _, task := range tasks {
+		if gids[task["gid"].(string)] {
+			ownTasks = append(ownTasks, task)
+		}
+	}
+	return ownTasks, nil
+}
+
+func (self *PiDownloader) checkOwner(username, gid string) error {
+	if self.isAdmin(username) {
+		return nil
+	}
+	entity, err := self.dbHelper.GetDownloadTask(gid)
+	if err != nil {
+		return err
+	}
+	if entity == nil || entity.Username != username {
+		return errors.New("permission denied, the task was not added by you!")
+	}
+	return nil
+}
+
+func (self *PiDownloader) dlHistory(username string, args []string) (string, error) {
+	keyword := strings.Join(args, " ")
+	owner := username
+	if self.isAdmin(username) {
+		owner = ""
+	}
+	entities, err := self.dbHelper.SearchDownloadTasks(owner, keyword, historyLimit)
+	if err != nil {
+		return "", err
+	}
+	if len(entities) == 0 {
+		return "no records", nil
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("\n")
+	for _, entity := range entities {
+		title := entity.Title
+		if title == "" {
+			title = entity.Uris
+		}
+		status := entity.Status
+		if status == "" {
+			status = "unfinished"
+		}
+		buffer.WriteString(fmt.Sprintf("gid: %s\n", entity.Gid))
+		buffer.WriteString(fmt.Sprintf("title: %s\n", title))
+		if owner == "" {
+			buffer.WriteString(fmt.Sprintf("owner: %s\n", entity.Username))
+		}
+		buffer.WriteString(fmt.Sprintf("status: %s %s\n", status, entity.ErrorCode))
+		buffer.WriteString(fmt.Sprintf("size: %s/%s\n", utils.FormatSize(entity.CompletedLength),
+			utils.FormatSize(entity.TotalLength)))
+		buffer.WriteString(fmt.Sprintf("time: %s\n", time.Unix(entity.StartTime, 0).Format("2006-01-02 15:04")))
+		buffer.WriteString("==================\n")
+	}
+	return buffer.String(), nil
+}
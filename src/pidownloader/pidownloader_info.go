@@ -0,0 +1,200 @@
+package pidownloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"utils"
+)
+
+type positionArg struct {
+	pos int
+	how string
+}
+
+var positionArgs = map[string]*positionArg{
+	"top":    {0, "POS_SET"},
+	"bottom": {0, "POS_END"},
+	"up":     {-1, "POS_CUR"},
+	"down":   {1, "POS_CUR"},
+}
+
+func parseLength(v interface{}) int64 {
+	length, _ := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+	return length
+}
+
+// the options may have the cookie, password or proxy of profiles, they are only shown to admins
+var secretOptions = map[string]bool{
+	"header":             true,
+	"all-proxy":          true,
+	"all-proxy-user":     true,
+	"all-proxy-passwd":   true,
+	"http-proxy":         true,
+	"http-proxy-user":    true,
+	"http-proxy-passwd":  true,
+	"https-proxy":        true,
+	"https-proxy-user":   true,
+	"https-proxy-passwd": true,
+	"ftp-proxy":          true,
+	"ftp-proxy-user":     true,
+	"ftp-proxy-passwd":   true,
+	"http-user":          true,
+	"http-passwd":        true,
+	"ftp-user":           true,
+	"ftp-passwd":         true,
+	"load-cookies":       true,
+}
+
+const hiddenOptionValue = "******"
+
+func (self *PiDownloader) taskInfo(username string, args []string) (string, error) {
+	backend, args, targetErr := self.parseTaskTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	gid := args[0]
+	if ownerErr := self.checkOwner(username, gid); ownerErr != nil {
+		return "", ownerErr
+	}
+	task, statusErr := backend.tellStatus(gid, nil)
+	if statusErr != nil {
+		return "", statusErr
+	}
+	options, optionErr := backend.getOption(gid)
+	if optionErr != nil {
+		return "", optionErr
+	}
+	total := parseLength(task["totalLength"])
+	completed := parseLength(task["completedLength"])
+	uploaded := parseLength(task["uploadLength"])
+	var buffer bytes.Buffer
+	buffer.WriteString("\n")
+	buffer.WriteString(fmt.Sprintf("gid: %s\n", gid))
+	if len(self.backends) > 1 {
+		buffer.WriteString(fmt.Sprintf("backend: %s\n", backend.getName()))
+	}
+	buffer.WriteString(fmt.Sprintf("title: %s\n", self.getTitle(task)))
+	buffer.WriteString(fmt.Sprintf("status: %v\n", task["status"]))
+	if total > 0 {
+		buffer.WriteString(fmt.Sprintf("progress: %s/%s %.2f%%\n", utils.FormatSize(completed),
+			utils.FormatSize(total), float64(completed)*100/float64(total)))
+	}
+	buffer.WriteString(fmt.Sprintf("speed: %s/s down, %s/s up\n",
+		utils.FormatSize(parseLength(task["downloadSpeed"])), utils.FormatSize(parseLength(task["uploadSpeed"]))))
+	buffer.WriteString(fmt.Sprintf("connections: %v\n", task["connections"]))
+	if task["bittorrent"] != nil {
+		peers, _ := backend.getPeers(gid)
+		buffer.WriteString(fmt.Sprintf("seeders: %v, peers: %d\n", task["numSeeders"], len(peers)))
+		var ratio float64 = 0
+		if completed > 0 {
+			ratio = float64(uploaded) / float64(completed)
+		}
+		buffer.WriteString(fmt.Sprintf("upload: %s, ratio: %.2f\n", utils.FormatSize(uploaded), ratio))
+	}
+	if errorCode, _ := task["errorCode"].(string); errorCode != "" && errorCode != "0" {
+		buffer.WriteString(fmt.Sprintf("error: %s %s %v\n", errorCode, aria2ErrorText[errorCode], task["errorMessage"]))
+	}
+	uris := make([]string, 0)
+	addedUris := make(map[string]bool)
+	buffer.WriteString("files:\n")
+	if files, ok := task["files"].([]interface{}); ok {
+		for _, f := range files {
+			file := f.(map[string]interface{})
+			selected := " "
+			if file["selected"] == "true" {
+				selected = "*"
+			}
+			buffer.WriteString(fmt.Sprintf("%s[%v] %s (%s)\n", selected, file["index"], path.Base(fmt.Sprint(file["path"])),
+				utils.FormatSize(parseLength(file["length"]))))
+			fileUris, _ := file["uris"].([]interface{})
+			for _, u := range fileUris {
+				uri := fmt.Sprint(u.(map[string]interface{})["uri"])
+				if !addedUris[uri] {
+					addedUris[uri] = true
+					uris = append(uris, uri)
+				}
+			}
+		}
+	}
+	if len(uris) > 0 {
+		buffer.WriteString("uris:\n")
+		for _, uri := range uris {
+			buffer.WriteString(uri + "\n")
+		}
+	}
+	buffer.WriteString("options:\n")
+	buffer.WriteString(formatOptions(options, self.isAdmin(username)))
+	return buffer.String(), nil
+}
+
+// formatOptions lists the options sorted by name, the secret options are hidden if showSecrets is false
+func formatOptions(options map[string]string, showSecrets bool) string {
+	keys := make([]string, 0, len(options))
+	for key, _ := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buffer bytes.Buffer
+	for _, key := range keys {
+		value := options[key]
+		if !showSecrets && secretOptions[key] && value != "" {
+			value = hiddenOptionValue
+		}
+		buffer.WriteString(fmt.Sprintf("%s=%s\n", key, value))
+	}
+	return buffer.String()
+}
+
+func (self *PiDownloader) changeOption(username string, args []string) (string, error) {
+	backend, args, targetErr := self.parseTaskTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	if len(args) < 2 {
+		return "", errors.New("missing args!")
+	}
+	gid := args[0]
+	if ownerErr := self.checkOwner(username, gid); ownerErr != nil {
+		return "", ownerErr
+	}
+	options := make(map[string]interface{})
+	for _, arg := range args[1:] {
+		nameValue := strings.SplitN(arg, "=", 2)
+		if len(nameValue) != 2 {
+			return "", errors.New("invalid args!")
+		}
+		options[nameValue[0]] = strings.TrimSpace(nameValue[1])
+	}
+	if err := backend.changeOption(gid, options); err != nil {
+		return "", err
+	}
+	return "OK", nil
+}
+
+func (self *PiDownloader) changePosition(username string, args []string) (string, error) {
+	backend, args, targetErr := self.parseTaskTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	if len(args) < 2 {
+		return "", errors.New("missing args!")
+	}
+	gid := args[0]
+	positionArg := positionArgs[strings.ToLower(args[1])]
+	if positionArg == nil {
+		return "", errors.New("invalid position, it should be top, up, down or bottom")
+	}
+	if ownerErr := self.checkOwner(username, gid); ownerErr != nil {
+		return "", ownerErr
+	}
+	position, err := backend.changePosition(gid, positionArg.pos, positionArg.how)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("OK, position: %d", position), nil
+}
@@ -0,0 +1,317 @@
+package pidownloader
+
+import (
+	"code.google.com/p/go.net/websocket"
+	l4g "code.google.com/p/log4go"
+	"fmt"
+	"service"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"utils"
+)
+
+const wsRetryInterval = 30 * time.Second
+
+// error code returned by aria2, see the EXIT STATUS section of aria2c manual
+var aria2ErrorText = map[string]string{
+	"1":  "unknown error",
+	"2":  "timeout",
+	"3":  "resource was not found",
+	"4":  "resource was not found too many times",
+	"5":  "download speed was too slow",
+	"6":  "network problem",
+	"7":  "unfinished download on shutdown",
+	"8":  "remote server did not support resume",
+	"9":  "not enough disk space",
+	"10": "piece length was different",
+	"11": "same file was being downloaded",
+	"12": "same info hash torrent was being downloaded",
+	"13": "file already existed",
+	"14": "renaming file failed",
+	"15": "could not open existing file",
+	"16": "could not create new file",
+	"17": "file I/O error",
+	"18": "could not create directory",
+	"19": "name resolution failed",
+	"20": "could not parse metalink document",
+	"21": "FTP command failed",
+	"22": "bad HTTP response header",
+	"23": "too many redirects",
+	"24": "HTTP authorization failed",
+	"25": "could not parse bencoded file",
+	"26": "torrent file was corrupted",
+	"27": "bad magnet URI",
+	"28": "bad option",
+	"29": "remote server was overloaded",
+	"30": "could not parse JSON-RPC request",
+	"32": "checksum validation failed",
+}
+
+var notifyStatusKeys = []string{"gid", "status", "totalLength", "completedLength", "errorCode",
+	"errorMessage", "followedBy", "seeder", "dir", "files", "bittorrent"}
+
+type taskOwner struct {
+	backend  string
+	username string
+	addTime  time.Time
+}
+
+type aria2Notification struct {
+	Method string `json:"method"`
+	Params []struct {
+		Gid string `json:"gid"`
+	} `json:"params"`
+}
+
+type taskNotifier struct {
+	owners  map[string]*taskOwner
+	wsConns map[string]*websocket.Conn // websocket connection of each backend
+	stopped bool
+	lock    sync.Mutex
+}
+
+// the websocket url of aria2 is the same as rpc url except the scheme
+func getWsUrl(rpcUrl string) string {
+	if strings.HasPrefix(rpcUrl, "https://") {
+		return "wss://" + strings.TrimPrefix(rpcUrl, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(rpcUrl, "http://")
+}
+
+func newTaskNotifier() *taskNotifier {
+	return &taskNotifier{
+		owners:  make(map[string]*taskOwner),
+		wsConns: make(map[string]*websocket.Conn),
+	}
+}
+
+func (self *taskNotifier) addOwner(gid, backend, username string, addTime time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.owners[gid] = &taskOwner{backend, username, addTime}
+}
+
+func (self *taskNotifier) getOwner(gid string) *taskOwner {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.owners[gid]
+}
+
+func (self *taskNotifier) removeOwner(gid string) *taskOwner {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	owner := self.owners[gid]
+	delete(self.owners, gid)
+	return owner
+}
+
+// getPolledGids returns the owned gids whose backend is not connected by websocket, or all gids when forced
+func (self *taskNotifier) getPolledGids(force bool) []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	gids := make([]string, 0, len(self.owners))
+	for gid, owner := range self.owners {
+		if force || self.wsConns[owner.backend] == nil {
+			gids = append(gids, gid)
+		}
+	}
+	return gids
+}
+
+func (self *taskNotifier) setWsConn(backend string, conn *websocket.Conn) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stopped {
+		return false
+	}
+	if conn == nil {
+		delete(self.wsConns, backend)
+	} else {
+		self.wsConns[backend] = conn
+	}
+	return true
+}
+
+func (self *taskNotifier) isStopped() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stopped
+}
+
+func (self *taskNotifier) stop() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stopped = true
+	for _, conn := range self.wsConns {
+		conn.Close()
+	}
+}
+
+func (self *PiDownloader) startNotifier() {
+	self.notifier.lock.Lock()
+	self.notifier.stopped = false
+	self.notifier.lock.Unlock()
+	for _, backend := range self.backends {
+		if client, ok := backend.(*aria2Client); ok {
+			go self.listenNotification(client)
+		}
+	}
+}
+
+// listen the notifications from the websocket of aria2 backend, reconnect when the connection is lost.
+// the tasks of the backend are polled by cron while websocket is disconnected
+func (self *PiDownloader) listenNotification(backend *aria2Client) {
+	for !self.notifier.isStopped() {
+		conn, dialErr := websocket.Dial(backend.wsUrl, "", "http://localhost/")
+		if dialErr != nil {
+			l4g.Error("Connect websocket of %s error: %v", backend.getName(), dialErr)
+			time.Sleep(wsRetryInterval)
+			continue
+		}
+		if !self.notifier.setWsConn(backend.getName(), conn) {
+			conn.Close()
+			return
+		}
+		l4g.Info("Aria2 websocket connected: %s", backend.wsUrl)
+		// check the tasks finished while disconnected
+		self.pollTasks(true)
+		for {
+			notification := &aria2Notification{}
+			if err := websocket.JSON.Receive(conn, notification); err != nil {
+				l4g.Error("Receive notification of %s error: %v", backend.getName(), err)
+				break
+			}
+			l4g.Debug("Receive aria2 notification: %v", notification)
+			switch notification.Method {
+			case "aria2.onDownloadComplete", "aria2.onDownloadError", "aria2.onBtDownloadComplete":
+				for _, param := range notification.Params {
+					self.checkTask(param.Gid)
+				}
+			}
+		}
+		conn.Close()
+		self.notifier.setWsConn(backend.getName(), nil)
+	}
+}
+
+// poll the owned tasks whose backend is disconnected, all tasks are polled when forced
+func (self *PiDownloader) pollTasks(force bool) {
+	for _, gid := range self.notifier.getPolledGids(force) {
+		self.checkTask(gid)
+	}
+}
+
+func (self *PiDownloader) checkTask(gid string) {
+	owner := self.notifier.getOwner(gid)
+	if owner == nil {
+		return
+	}
+	backend := self.backendMap[owner.backend]
+	if backend == nil {
+		l4g.Error("Backend %s of %s is not found", owner.backend, gid)
+		self.notifier.removeOwner(gid)
+		return
+	}
+	task, err := backend.tellStatus(gid, notifyStatusKeys)
+	if err != nil {
+		l4g.Error("Get status of %s error: %v", gid, err)
+		if isGidNotFound(err, gid) && self.notifier.removeOwner(gid) != nil {
+			self.notifyLostTask(gid, owner)
+		}
+		return
+	}
+	// the metadata of magnet link is downloaded, the real task is followed
+	if followedBy, ok := task["followedBy"].([]interface{}); ok && len(followedBy) > 0 {
+		self.notifier.removeOwner(gid)
+		for _, followedGid := range followedBy {
+			self.followTask(gid, followedGid.(string), owner)
+		}
+		self.finishTask(gid, task)
+		return
+	}
+	var message string
+	completed := false
+	switch status := task["status"]; {
+	case status == "complete", status == "active" && task["seeder"] == "true":
+		message = self.formatCompleteMessage(task, owner)
+		completed = true
+	case status == "error":
+		message = self.formatErrorMessage(task)
+	case status == "removed":
+		self.notifier.removeOwner(gid)
+		self.finishTask(gid, task)
+		return
+	default:
+		return
+	}
+	if self.notifier.removeOwner(gid) == nil {
+		return // notified by others
+	}
+	self.finishTask(gid, task)
+	if task["status"] == "error" && self.retryTask(backend, gid, task) {
+		return // the owner is notified after final failure
+	}
+	if completed && backend.isLocal() {
+		// the result of post process is reported in the completion notification
+		go func() {
+			if report := self.postProcess(gid, task); report != "" {
+				message += "\n" + report
+			}
+			self.notifyOwner(owner.username, message)
+		}()
+		return
+	}
+	self.notifyOwner(owner.username, message)
+}
+
+func (self *PiDownloader) notifyOwner(username, message string) {
+	if username == "" {
+		return
+	}
+	self.pushMsgChannel <- &service.PushMessage{
+		Type:     service.Notification,
+		Username: username,
+		Message:  message,
+	}
+}
+
+// aria2 forgets the task after the result is purged or aria2 restarted
+func isGidNotFound(err error, gid string) bool {
+	message := err.Error()
+	return strings.Contains(message, fmt.Sprintf("GID %s is not found", gid)) ||
+		strings.Contains(message, "no such task: "+gid) // native backend
+}
+
+func (self *PiDownloader) notifyLostTask(gid string, owner *taskOwner) {
+	title := self.finishLostTask(gid)
+	if owner.username == "" {
+		return
+	}
+	self.pushMsgChannel <- &service.PushMessage{
+		Type:     service.Notification,
+		Username: owner.username,
+		Message:  fmt.Sprintf("Download lost: %s\nthe task is not found in %s", title, owner.backend),
+	}
+}
+
+func (self *PiDownloader) formatCompleteMessage(task map[string]interface{}, owner *taskOwner) string {
+	total, _ := strconv.ParseInt(task["totalLength"].(string), 10, 64)
+	duration := int64(time.Since(owner.addTime).Seconds())
+	return fmt.Sprintf("Download completed: %s\nsize: %s\ntime: %s", self.getTitle(task),
+		utils.FormatSize(total), utils.FormatTime(duration))
+}
+
+func (self *PiDownloader) formatErrorMessage(task map[string]interface{}) string {
+	errorCode, _ := task["errorCode"].(string)
+	errorText := aria2ErrorText[errorCode]
+	if errorText == "" {
+		errorText = "unknown error"
+	}
+	message := fmt.Sprintf("Download failed: %s\nerror: %s %s", self.getTitle(task), errorCode, errorText)
+	if errorMessage, _ := task["errorMessage"].(string); errorMessage != "" {
+		message += "\n" + errorMessage
+	}
+	return message
+}
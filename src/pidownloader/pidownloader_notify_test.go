@@ -0,0 +1,86 @@
+package pidownloader
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"service"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetWsUrl(t *testing.T) {
+	urls := map[string]string{
+		"http://127.0.0.1:6800/jsonrpc":    "ws://127.0.0.1:6800/jsonrpc",
+		"https://example.com:6800/jsonrpc": "wss://example.com:6800/jsonrpc",
+	}
+	for rpcUrl, expected := range urls {
+		if wsUrl := getWsUrl(rpcUrl); wsUrl != expected {
+			t.Fatalf("%s: expect %s, got %s", rpcUrl, expected, wsUrl)
+		}
+	}
+}
+
+// fakeBackend returns the error of tellStatus, the other methods are not implemented
+type fakeBackend struct {
+	downloader
+	name      string
+	statusErr error
+}
+
+func (self *fakeBackend) getName() string {
+	return self.name
+}
+
+func (self *fakeBackend) tellStatus(gid string, keys []string) (map[string]interface{}, error) {
+	return nil, self.statusErr
+}
+
+func TestCheckLostTask(t *testing.T) {
+	gid := "2089b05ecca3d829"
+	backend := &fakeBackend{name: "pi", statusErr: errors.New("aria2 error 1: connection refused")}
+	pushCh := make(chan *service.PushMessage, 1)
+	piDer := &PiDownloader{}
+	piDer.backendMap = map[string]downloader{"pi": backend}
+	piDer.notifier = newTaskNotifier()
+	piDer.pushMsgChannel = pushCh
+	piDer.notifier.addOwner(gid, "pi", "user", time.Now())
+
+	// the task is checked again after other errors
+	piDer.checkTask(gid)
+	if piDer.notifier.getOwner(gid) == nil {
+		t.Fatal("the owner should be kept after other errors")
+	}
+
+	dir, _ := ioutil.TempDir("", "notify")
+	defer os.RemoveAll(dir)
+	dbHelper, dbErr := NewDownloaderDbHelper(filepath.Join(dir, "pidownloader.db"))
+	if dbErr != nil {
+		t.Skip("sqlite3 is not available:", dbErr)
+	}
+	defer dbHelper.Close()
+	piDer.dbHelper = dbHelper
+	dbHelper.AddDownloadTask(&DownloadTaskEntity{Gid: gid, Backend: "pi", Username: "user",
+		Uris: "http://example.com/a.zip", StartTime: time.Now().Unix()})
+
+	backend.statusErr = errors.New(fmt.Sprintf("aria2 error 1: GID %s is not found", gid))
+	piDer.checkTask(gid)
+	if piDer.notifier.getOwner(gid) != nil {
+		t.Fatal("the owner of lost task should be removed")
+	}
+	select {
+	case pushMsg := <-pushCh:
+		if pushMsg.Username != "user" || !strings.HasPrefix(pushMsg.Message, "Download lost: http://example.com/a.zip") {
+			t.Fatalf("unexpected message: %v", pushMsg)
+		}
+	default:
+		t.Fatal("the owner should be notified")
+	}
+	entity, _ := dbHelper.GetDownloadTask(gid)
+	if entity == nil || entity.Status != "unknown" || entity.EndTime == 0 {
+		t.Fatalf("the lost task should be finished: %v", entity)
+	}
+}
@@ -0,0 +1,407 @@
+package pidownloader
+
+import (
+	"bytes"
+	l4g "code.google.com/p/log4go"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the options handled by PiDownloader, they are not passed to aria2
+var localTaskOptions = []string{"category", "checksum", "mirrors", "profile"}
+
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha1":    sha1.New,
+	"sha-1":   sha1.New,
+	"sha256":  sha256.New,
+	"sha-256": sha256.New,
+	"sha512":  sha512.New,
+	"sha-512": sha512.New,
+}
+
+// the commands to extract archive, {file} is the archive and {dir} is the output directory
+var extractCommands = map[string][]string{
+	".zip": {"unzip", "-o", "{file}", "-d", "{dir}"},
+	".rar": {"unrar", "x", "-o+", "{file}", "{dir}/"},
+	".7z":  {"7z", "x", "-y", "-o{dir}", "{file}"},
+}
+
+type postProcessMatch struct {
+	Extensions []string `json:"extensions,omitempty"`
+	MinSize    int64    `json:"minSize,omitempty"` // bytes
+	MaxSize    int64    `json:"maxSize,omitempty"`
+	Domains    []string `json:"domains,omitempty"`
+	Category   string   `json:"category,omitempty"`
+}
+
+type postProcessRule struct {
+	Match             postProcessMatch `json:"match"`
+	MoveTo            string           `json:"moveTo,omitempty"`
+	Extract           bool             `json:"extract,omitempty"`
+	Rename            string           `json:"rename,omitempty"` // like {date}_{name}{ext}
+	DeleteControlFile bool             `json:"deleteControlFile,omitempty"`
+}
+
+// the completed task to be processed
+type completedTask struct {
+	gid      string
+	dir      string
+	files    []string
+	size     int64
+	uris     []string
+	category string
+	checksum string
+	seeding  bool
+}
+
+// split the options to aria2 options and the options handled by PiDownloader
+func splitTaskOptions(options map[string]interface{}) (map[string]interface{}, map[string]string) {
+	aria2Options := make(map[string]interface{})
+	localOptions := make(map[string]string)
+	for key, value := range options {
+		isLocal := false
+		for _, localKey := range localTaskOptions {
+			if key == localKey {
+				localOptions[key] = fmt.Sprint(value)
+				isLocal = true
+				break
+			}
+		}
+		if !isLocal {
+			aria2Options[key] = value
+		}
+	}
+	return aria2Options, localOptions
+}
+
+// validateCategory checks the category is a single path element, because it is used in the paths by {category}
+func validateCategory(category string) error {
+	if strings.ContainsAny(category, `/\`) || strings.Contains(category, "..") {
+		return errors.New("invalid category, it should be a single name without / or ..: " + category)
+	}
+	return nil
+}
+
+func (self *postProcessMatch) match(task *completedTask) bool {
+	if self.Category != "" && self.Category != task.category {
+		return false
+	}
+	if self.MinSize > 0 && task.size < self.MinSize {
+		return false
+	}
+	if self.MaxSize > 0 && task.size > self.MaxSize {
+		return false
+	}
+	if len(self.Extensions) > 0 && !matchExtensions(task.files, self.Extensions) {
+		return false
+	}
+	if len(self.Domains) > 0 && !matchDomains(task.uris, self.Domains) {
+		return false
+	}
+	return true
+}
+
+func matchExtensions(files, extensions []string) bool {
+	for _, file := range files {
+		for _, ext := range extensions {
+			if strings.EqualFold(filepath.Ext(file), ext) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the domain matches its sub domains too
+func matchDomains(uris, domains []string) bool {
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(u.Host)
+		if h, _, splitErr := net.SplitHostPort(host); splitErr == nil {
+			host = h
+		}
+		for _, domain := range domains {
+			domain = strings.ToLower(domain)
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findPostProcessRules returns all the matched rules in the order of config
+func (self *PiDownloader) findPostProcessRules(task *completedTask) []*postProcessRule {
+	rules := make([]*postProcessRule, 0)
+	for _, rule := range self.postProcessRules {
+		if rule.Match.match(task) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func (self *PiDownloader) newCompletedTask(gid string, task map[string]interface{}) (*completedTask, error) {
+	entity, err := self.dbHelper.GetDownloadTask(gid)
+	if err != nil {
+		return nil, err
+	}
+	if entity == nil {
+		return nil, errors.New("no download task: " + gid)
+	}
+	completed := &completedTask{gid: gid}
+	completed.dir, _ = task["dir"].(string)
+	completed.size, _ = strconv.ParseInt(fmt.Sprint(task["totalLength"]), 10, 64)
+	completed.seeding = task["status"] == "active"
+	if entity.Uris != "" {
+		completed.uris = strings.Split(entity.Uris, " ")
+	}
+	options := make(map[string]interface{})
+	json.Unmarshal([]byte(entity.Options), &options)
+	_, localOptions := splitTaskOptions(options)
+	completed.category = localOptions["category"]
+	completed.checksum = localOptions["checksum"]
+	if files, ok := task["files"].([]interface{}); ok {
+		for _, f := range files {
+			file := f.(map[string]interface{})
+			if file["selected"] == "false" {
+				continue
+			}
+			if filePath, _ := file["path"].(string); filePath != "" {
+				completed.files = append(completed.files, filePath)
+			}
+		}
+	}
+	return completed, nil
+}
+
+// postProcess runs the steps of the matched rules, return the report for the completion
+// notification, empty if there is nothing to do
+func (self *PiDownloader) postProcess(gid string, task map[string]interface{}) string {
+	completed, err := self.newCompletedTask(gid, task)
+	if err != nil {
+		l4g.Error("Post process %s error: %v", gid, err)
+		return fmt.Sprintf("post process: failed, %v", err)
+	}
+	return self.processTask(completed)
+}
+
+// processTask runs all the steps even if some of them fail, the errors are collected in the report
+func (self *PiDownloader) processTask(completed *completedTask) string {
+	rules := self.findPostProcessRules(completed)
+	if len(rules) == 0 && completed.checksum == "" {
+		return ""
+	}
+	var buffer bytes.Buffer
+	steps, failed := 0, 0
+	report := func(step string, stepErr error) {
+		steps++
+		if stepErr != nil {
+			failed++
+			l4g.Error("Post process %s, %s error: %v", completed.gid, step, stepErr)
+			buffer.WriteString(fmt.Sprintf("\n%s: failed, %v", step, stepErr))
+		} else {
+			buffer.WriteString(fmt.Sprintf("\n%s: OK", step))
+		}
+	}
+	if completed.checksum != "" {
+		report("checksum", verifyChecksum(completed.files, completed.checksum))
+	}
+	for _, rule := range rules {
+		if rule.DeleteControlFile {
+			report("delete control file", deleteControlFiles(completed))
+		}
+		if rule.Extract {
+			report("extract", extractArchives(completed))
+		}
+		if completed.seeding && (rule.Rename != "" || rule.MoveTo != "") {
+			buffer.WriteString("\nrename and move: skipped, the task is seeding")
+			continue
+		}
+		if rule.Rename != "" {
+			report("rename", renameFiles(completed, rule.Rename))
+		}
+		if rule.MoveTo != "" {
+			report("move to "+rule.MoveTo, moveFiles(completed, rule.MoveTo))
+		}
+	}
+	if failed > 0 {
+		return fmt.Sprintf("post process: %d of %d steps failed", failed, steps) + buffer.String()
+	}
+	return "post process: OK" + buffer.String()
+}
+
+// verify the checksum like "sha-1=hex", only single file task is supported
+func verifyChecksum(files []string, checksum string) error {
+	if len(files) != 1 {
+		return errors.New("checksum is supported for single file only")
+	}
+	typeValue := strings.SplitN(checksum, "=", 2)
+	if len(typeValue) != 2 {
+		return errors.New("invalid checksum: " + checksum)
+	}
+	newHash := checksumHashes[strings.ToLower(typeValue[0])]
+	if newHash == nil {
+		return errors.New("unsupported checksum type: " + typeValue[0])
+	}
+	file, openErr := os.Open(files[0])
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+	h := newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(sum, typeValue[1]) {
+		return errors.New("mismatched, the checksum of file is " + sum)
+	}
+	return nil
+}
+
+// the top level files or directories of the task in the download dir
+func topLevelPaths(task *completedTask) []string {
+	paths := make([]string, 0)
+	added := make(map[string]bool)
+	for _, file := range task.files {
+		topPath := file
+		if rel, err := filepath.Rel(task.dir, file); err == nil && !strings.HasPrefix(rel, "..") {
+			topPath = filepath.Join(task.dir, strings.SplitN(rel, string(filepath.Separator), 2)[0])
+		}
+		if !added[topPath] {
+			added[topPath] = true
+			paths = append(paths, topPath)
+		}
+	}
+	return paths
+}
+
+func deleteControlFiles(task *completedTask) error {
+	for _, topPath := range topLevelPaths(task) {
+		controlFile := topPath + ".aria2"
+		if err := os.Remove(controlFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractArchives extracts all the archives, the errors of the archives are joined
+func extractArchives(task *completedTask) error {
+	extracted := 0
+	failures := make([]string, 0)
+	for _, file := range task.files {
+		ext := strings.ToLower(filepath.Ext(file))
+		command := extractCommands[ext]
+		if command == nil {
+			continue
+		}
+		outDir := strings.TrimSuffix(file, filepath.Ext(file))
+		args := make([]string, len(command)-1)
+		for i, arg := range command[1:] {
+			arg = strings.Replace(arg, "{file}", file, -1)
+			args[i] = strings.Replace(arg, "{dir}", outDir, -1)
+		}
+		if output, err := exec.Command(command[0], args...).CombinedOutput(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v %s", filepath.Base(file), err, strings.TrimSpace(string(output))))
+			continue
+		}
+		extracted++
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	if extracted == 0 {
+		return errors.New("no archive")
+	}
+	return nil
+}
+
+// format the rename template, the placeholders are {name}, {ext}, {date}, {category} and {gid}
+func formatFileName(template, file string, task *completedTask) string {
+	ext := filepath.Ext(file)
+	name := strings.TrimSuffix(filepath.Base(file), ext)
+	replacer := strings.NewReplacer(
+		"{name}", name,
+		"{ext}", ext,
+		"{date}", time.Now().Format("2006-01-02"),
+		"{category}", task.category,
+		"{gid}", task.gid)
+	return replacer.Replace(template)
+}
+
+func renameFiles(task *completedTask, template string) error {
+	topPaths := topLevelPaths(task)
+	if len(topPaths) != 1 {
+		return errors.New("rename is supported for single file or directory only")
+	}
+	newName := formatFileName(template, topPaths[0], task)
+	if newName == "" || strings.ContainsAny(newName, `/\`) || newName == "." || newName == ".." {
+		return errors.New("invalid new name: " + newName)
+	}
+	newPath := filepath.Join(filepath.Dir(topPaths[0]), newName)
+	if err := os.Rename(topPaths[0], newPath); err != nil {
+		return err
+	}
+	task.files = []string{newPath}
+	return nil
+}
+
+// isUnderDir checks whether the path is the dir or under it lexically, the path may not exist yet
+func isUnderDir(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// moveFiles moves the files to the dir, the target must stay under the dir before {category}
+func moveFiles(task *completedTask, dir string) error {
+	baseDir := dir
+	if index := strings.Index(dir, "{category}"); index >= 0 {
+		baseDir = filepath.Dir(dir[:index])
+	}
+	dir = strings.Replace(dir, "{category}", task.category, -1)
+	if !isUnderDir(baseDir, dir) {
+		return errors.New(fmt.Sprintf("the target %s is out of %s", dir, baseDir))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, topPath := range topLevelPaths(task) {
+		target := filepath.Join(dir, filepath.Base(topPath))
+		if err := os.Rename(topPath, target); err != nil {
+			// rename does not work across devices
+			if output, mvErr := exec.Command("mv", topPath, target).CombinedOutput(); mvErr != nil {
+				return errors.New(fmt.Sprintf("%v %s", mvErr, output))
+			}
+		}
+		// move the extracted directory too
+		extractedDir := strings.TrimSuffix(topPath, filepath.Ext(topPath))
+		if _, ok := extractCommands[strings.ToLower(filepath.Ext(topPath))]; ok {
+			if info, err := os.Stat(extractedDir); err == nil && info.IsDir() {
+				exec.Command("mv", extractedDir, dir).Run()
+			}
+		}
+	}
+	return nil
+}
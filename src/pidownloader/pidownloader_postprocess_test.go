@@ -0,0 +1,173 @@
+package pidownloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPostProcessMatch(t *testing.T) {
+	task := &completedTask{
+		dir:      "/data",
+		files:    []string{"/data/movie/a.mkv", "/data/movie/a.srt"},
+		size:     2 << 30,
+		uris:     []string{"http://dl.example.com:8080/a.torrent"},
+		category: "movie",
+	}
+	matched := []postProcessMatch{
+		{},
+		{Extensions: []string{".MKV"}},
+		{MinSize: 1 << 30, Category: "movie"},
+		{Domains: []string{"example.com"}},
+	}
+	for _, m := range matched {
+		if !m.match(task) {
+			t.Fatalf("%v should match", m)
+		}
+	}
+	unmatched := []postProcessMatch{
+		{Extensions: []string{".zip"}},
+		{MaxSize: 1 << 30},
+		{Domains: []string{"ample.com"}},
+		{Category: "music"},
+	}
+	for _, m := range unmatched {
+		if m.match(task) {
+			t.Fatalf("%v should not match", m)
+		}
+	}
+	topPaths := topLevelPaths(task)
+	if len(topPaths) != 1 || topPaths[0] != "/data/movie" {
+		t.Fatalf("unexpected top level paths: %v", topPaths)
+	}
+}
+
+func TestSplitTaskOptions(t *testing.T) {
+	options := map[string]interface{}{"dir": "/tmp", "category": "movie", "checksum": "md5=abc"}
+	aria2Options, localOptions := splitTaskOptions(options)
+	if len(aria2Options) != 1 || aria2Options["dir"] != "/tmp" {
+		t.Fatalf("unexpected aria2 options: %v", aria2Options)
+	}
+	if localOptions["category"] != "movie" || localOptions["checksum"] != "md5=abc" {
+		t.Fatalf("unexpected local options: %v", localOptions)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidownloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hello.txt")
+	ioutil.WriteFile(file, []byte("hello"), 0644)
+	if err := verifyChecksum([]string{file}, "md5=5D41402ABC4B2A76B9719D911017C592"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyChecksum([]string{file}, "sha-1=aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyChecksum([]string{file}, "sha-1=0000"); err == nil {
+		t.Fatal("checksum should be mismatched")
+	}
+	if err := verifyChecksum([]string{file}, "crc=0000"); err == nil {
+		t.Fatal("crc should be unsupported")
+	}
+}
+
+func TestRenameAndMoveFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidownloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.mkv")
+	ioutil.WriteFile(file, []byte("movie"), 0644)
+	ioutil.WriteFile(file+".aria2", []byte("control"), 0644)
+	task := &completedTask{gid: "1", dir: dir, files: []string{file}, category: "movie"}
+	if err := deleteControlFiles(task); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file + ".aria2"); !os.IsNotExist(err) {
+		t.Fatal("control file should be deleted")
+	}
+	if err := renameFiles(task, "{category}_{name}_{gid}{ext}"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(task.files[0], "movie_a_1.mkv") {
+		t.Fatalf("unexpected renamed file: %s", task.files[0])
+	}
+	if err := moveFiles(task, filepath.Join(dir, "{category}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "movie", "movie_a_1.mkv")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCategoryPath(t *testing.T) {
+	for _, category := range []string{"", "movie", "tv.show"} {
+		if err := validateCategory(category); err != nil {
+			t.Errorf("the category %s should be valid: %v", category, err)
+		}
+	}
+	for _, category := range []string{"..", "../etc", "a/b", `a\b`, "/tmp"} {
+		if err := validateCategory(category); err == nil {
+			t.Errorf("the category %s should be invalid", category)
+		}
+	}
+	dir, err := ioutil.TempDir("", "pidownloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.mkv")
+	ioutil.WriteFile(file, []byte("movie"), 0644)
+	task := &completedTask{gid: "1", dir: dir, files: []string{file}, category: "../escape"}
+	if err := renameFiles(task, "{category}{ext}"); err == nil {
+		t.Fatal("the name out of the dir should be rejected")
+	}
+	if err := moveFiles(task, filepath.Join(dir, "library", "{category}")); err == nil {
+		t.Fatal("the target out of the base dir should be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); !os.IsNotExist(err) {
+		t.Fatal("the dir out of the base dir should not be created")
+	}
+	task.category = ""
+	if err := moveFiles(task, filepath.Join(dir, "library", "{category}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "library", "a.mkv")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessTaskContinuesAfterFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidownloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.zip")
+	ioutil.WriteFile(file, []byte("not a zip"), 0644)
+	piDer := &PiDownloader{postProcessRules: []*postProcessRule{
+		{Match: postProcessMatch{Extensions: []string{".zip"}}, Extract: true},
+		{Match: postProcessMatch{Category: "soft"}, MoveTo: filepath.Join(dir, "{category}")},
+		{Match: postProcessMatch{Category: "movie"}, MoveTo: filepath.Join(dir, "movie")},
+	}}
+	task := &completedTask{gid: "1", dir: dir, files: []string{file}, category: "soft"}
+	report := piDer.processTask(task)
+	if !strings.HasPrefix(report, "post process: 1 of 2 steps failed") ||
+		!strings.Contains(report, "\nextract: failed") ||
+		!strings.Contains(report, "\nmove to "+filepath.Join(dir, "{category}")+": OK") {
+		t.Fatalf("unexpected report: %s", report)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "soft", "a.zip")); err != nil {
+		t.Fatal("the file should be moved after the failed extract:", err)
+	}
+	if report := piDer.processTask(&completedTask{gid: "2", dir: dir, files: []string{filepath.Join(dir, "b.mkv")}, category: "music"}); report != "" {
+		t.Fatalf("unexpected report of unmatched task: %s", report)
+	}
+}
@@ -0,0 +1,352 @@
+package pidownloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	noProfile      = "none"
+	profileHelpMsg = "profile: list the download profiles\n" +
+		"profile set name host example.com,*.example.net: use the profile for the hosts\n" +
+		"profile set name header X-Token: abc: add the http header\n" +
+		"profile set name cookie|ua|referer|proxy value: set the cookie, user-agent, referer or proxy\n" +
+		"profile unset name host|header|cookie|ua|referer|proxy: clear the field\n" +
+		"profile rm name: remove the profile\n" +
+		"add url profile=name: download with the profile of the url host, it is matched by host if not given, profile=none for no profile"
+)
+
+// downloadProfile is the headers, cookie, user-agent, referer and proxy used by the downloads of site
+type downloadProfile struct {
+	Name      string   `json:"name"`
+	Hosts     []string `json:"hosts,omitempty"` // like example.com or *.example.com, the sub domains are matched too
+	Headers   []string `json:"headers,omitempty"`
+	Cookie    string   `json:"cookie,omitempty"`
+	UserAgent string   `json:"userAgent,omitempty"`
+	Referer   string   `json:"referer,omitempty"`
+	Proxy     string   `json:"proxy,omitempty"`
+	fromDb    bool
+}
+
+func newProfileFromEntity(entity *ProfileEntity) *downloadProfile {
+	profile := &downloadProfile{
+		Name:      entity.Name,
+		Cookie:    entity.Cookie,
+		UserAgent: entity.UserAgent,
+		Referer:   entity.Referer,
+		Proxy:     entity.Proxy,
+		fromDb:    true,
+	}
+	profile.Hosts = strings.Fields(entity.Hosts)
+	if entity.Headers != "" {
+		json.Unmarshal([]byte(entity.Headers), &profile.Headers)
+	}
+	return profile
+}
+
+func (self *downloadProfile) toEntity(entity *ProfileEntity) {
+	headersJson, _ := json.Marshal(self.Headers)
+	entity.Name = self.Name
+	entity.Hosts = strings.Join(self.Hosts, " ")
+	entity.Headers = string(headersJson)
+	entity.Cookie = self.Cookie
+	entity.UserAgent = self.UserAgent
+	entity.Referer = self.Referer
+	entity.Proxy = self.Proxy
+}
+
+func (self *downloadProfile) match(uris []string) bool {
+	domains := make([]string, 0, len(self.Hosts))
+	for _, host := range self.Hosts {
+		domains = append(domains, strings.TrimPrefix(host, "*."))
+	}
+	if len(domains) == 0 || len(uris) == 0 {
+		return false
+	}
+	// all uris should match since the headers are sent to every uri of the task
+	for _, uri := range uris {
+		if !matchDomains([]string{uri}, domains) {
+			return false
+		}
+	}
+	return true
+}
+
+// the cookie is sent as header
+func (self *downloadProfile) getHeaders() []string {
+	headers := append([]string{}, self.Headers...)
+	if self.Cookie != "" {
+		headers = append(headers, "Cookie: "+self.Cookie)
+	}
+	return headers
+}
+
+func getHeaderName(header string) string {
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(header, ":", 2)[0]))
+}
+
+// toStringList converts the option value which may be a string or list
+func toStringList(v interface{}) []string {
+	switch value := v.(type) {
+	case nil:
+		return []string{}
+	case string:
+		return []string{value}
+	case []string:
+		return value
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			list = append(list, fmt.Sprint(item))
+		}
+		return list
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+// mergeInto adds the profile to aria2 options, the options given by user are kept
+func (self *downloadProfile) mergeInto(options map[string]interface{}) {
+	headers := toStringList(options["header"])
+	given := make(map[string]bool)
+	for _, header := range headers {
+		given[getHeaderName(header)] = true
+	}
+	for _, header := range self.getHeaders() {
+		if !given[getHeaderName(header)] {
+			headers = append(headers, header)
+		}
+	}
+	if len(headers) > 0 {
+		options["header"] = headers
+	}
+	defaultOptions := map[string]string{
+		"user-agent": self.UserAgent,
+		"referer":    self.Referer,
+		"all-proxy":  self.Proxy,
+	}
+	for key, value := range defaultOptions {
+		if _, ok := options[key]; !ok && value != "" {
+			options[key] = value
+		}
+	}
+}
+
+// loadProfiles loads the profiles of db and config, the profile of db overrides the one of config with the same name
+func (self *PiDownloader) loadProfiles() error {
+	entities, err := self.dbHelper.GetProfiles()
+	if err != nil {
+		return err
+	}
+	profiles := make([]*downloadProfile, 0, len(entities)+len(self.configProfiles))
+	names := make(map[string]bool)
+	for _, entity := range entities {
+		profiles = append(profiles, newProfileFromEntity(entity))
+		names[entity.Name] = true
+	}
+	for _, profile := range self.configProfiles {
+		if !names[profile.Name] {
+			profiles = append(profiles, profile)
+		}
+	}
+	self.profileLock.Lock()
+	self.profiles = profiles
+	self.profileLock.Unlock()
+	return nil
+}
+
+func (self *PiDownloader) getProfile(name string) *downloadProfile {
+	self.profileLock.Lock()
+	defer self.profileLock.Unlock()
+	for _, profile := range self.profiles {
+		if profile.Name == name {
+			return profile
+		}
+	}
+	return nil
+}
+
+// findProfile returns the profile by name, or the first one matching the host of uris if name not given.
+// the profile given by name should match the host of uris too, so the cookie is not sent to other sites
+func (self *PiDownloader) findProfile(uris []string, name string) (*downloadProfile, error) {
+	if name == noProfile {
+		return nil, nil
+	}
+	if name != "" {
+		profile := self.getProfile(name)
+		if profile == nil {
+			return nil, errors.New("no such profile: " + name)
+		}
+		if !profile.match(uris) {
+			return nil, errors.New(fmt.Sprintf("the hosts of profile %s do not match the uris", name))
+		}
+		return profile, nil
+	}
+	self.profileLock.Lock()
+	defer self.profileLock.Unlock()
+	for _, profile := range self.profiles {
+		if profile.match(uris) {
+			return profile, nil
+		}
+	}
+	return nil, nil
+}
+
+// applyProfile merges the profile of uris into aria2 options
+func (self *PiDownloader) applyProfile(uris []string, aria2Options map[string]interface{}, localOptions map[string]string) error {
+	profile, err := self.findProfile(uris, localOptions["profile"])
+	if err != nil {
+		return err
+	}
+	if profile != nil {
+		profile.mergeInto(aria2Options)
+	}
+	return nil
+}
+
+func (self *PiDownloader) profileCommand(username string, args []string) (string, error) {
+	if len(args) == 0 {
+		return self.showProfiles(username), nil
+	}
+	if strings.ToLower(args[0]) == "help" {
+		return profileHelpMsg, nil
+	}
+	if !self.isAdmin(username) {
+		return "", errors.New("permission denied!")
+	}
+	var err error
+	switch strings.ToLower(args[0]) {
+	case "set":
+		err = self.setProfile(args[1:], true)
+	case "unset":
+		err = self.setProfile(args[1:], false)
+	case "rm":
+		err = self.removeProfile(args[1:])
+	default:
+		return profileHelpMsg, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = self.loadProfiles(); err != nil {
+		return "", err
+	}
+	return self.showProfiles(username), nil
+}
+
+// showProfiles lists the profiles, the details are only shown to master
+func (self *PiDownloader) showProfiles(username string) string {
+	self.profileLock.Lock()
+	defer self.profileLock.Unlock()
+	if len(self.profiles) == 0 {
+		return "no profiles"
+	}
+	showDetails := self.isAdmin(username)
+	var buffer bytes.Buffer
+	for _, profile := range self.profiles {
+		source := "chat"
+		if !profile.fromDb {
+			source = "config"
+		}
+		buffer.WriteString(fmt.Sprintf("\n[%s] (%s) hosts: %s", profile.Name, source, strings.Join(profile.Hosts, ",")))
+		if !showDetails {
+			continue
+		}
+		for _, header := range profile.Headers {
+			buffer.WriteString("\n  header: " + header)
+		}
+		fields := [][]string{
+			{"cookie", profile.Cookie},
+			{"ua", profile.UserAgent},
+			{"referer", profile.Referer},
+			{"proxy", profile.Proxy},
+		}
+		for _, field := range fields {
+			if field[1] != "" {
+				buffer.WriteString(fmt.Sprintf("\n  %s: %s", field[0], field[1]))
+			}
+		}
+	}
+	return buffer.String()
+}
+
+// setProfile sets or clears the field of profile, the profile of config is copied to db when changed
+func (self *PiDownloader) setProfile(args []string, set bool) error {
+	if (set && len(args) < 3) || (!set && len(args) != 2) {
+		return errors.New("invalid args! " + profileHelpMsg)
+	}
+	name := args[0]
+	if name == noProfile {
+		return errors.New("invalid profile name: " + name)
+	}
+	field := strings.ToLower(args[1])
+	value := strings.Join(args[2:], " ")
+	entity, err := self.dbHelper.GetProfile(name)
+	if err != nil {
+		return err
+	}
+	var profile *downloadProfile
+	if entity != nil {
+		profile = newProfileFromEntity(entity)
+	} else if configProfile := self.getProfile(name); configProfile != nil {
+		copied := *configProfile
+		profile = &copied
+	} else {
+		profile = &downloadProfile{Name: name}
+	}
+	switch field {
+	case "host":
+		profile.Hosts = nil
+		if set {
+			for _, host := range strings.Split(value, ",") {
+				if host = strings.TrimSpace(host); host != "" {
+					profile.Hosts = append(profile.Hosts, host)
+				}
+			}
+		}
+	case "header":
+		if !set {
+			profile.Headers = nil
+		} else if !strings.Contains(value, ":") {
+			return errors.New("invalid header: " + value)
+		} else {
+			profile.Headers = append(profile.Headers, value)
+		}
+	case "cookie":
+		profile.Cookie = value
+	case "ua":
+		profile.UserAgent = value
+	case "referer":
+		profile.Referer = value
+	case "proxy":
+		profile.Proxy = value
+	default:
+		return errors.New("invalid field: " + args[1])
+	}
+	if entity == nil {
+		entity = &ProfileEntity{}
+		profile.toEntity(entity)
+		return self.dbHelper.AddProfile(entity)
+	}
+	profile.toEntity(entity)
+	return self.dbHelper.UpdateProfile(entity)
+}
+
+func (self *PiDownloader) removeProfile(args []string) error {
+	if len(args) != 1 {
+		return errors.New("invalid args! " + profileHelpMsg)
+	}
+	entity, err := self.dbHelper.GetProfile(args[0])
+	if err != nil {
+		return err
+	}
+	if entity == nil {
+		if self.getProfile(args[0]) != nil {
+			return errors.New("the profile is defined in config: " + args[0])
+		}
+		return errors.New("no such profile: " + args[0])
+	}
+	return self.dbHelper.DeleteProfile(entity)
+}
@@ -0,0 +1,64 @@
+package pidownloader
+
+import (
+	"testing"
+)
+
+func TestProfileMatch(t *testing.T) {
+	piDer := &PiDownloader{}
+	piDer.profiles = []*downloadProfile{
+		{Name: "lixian", Hosts: []string{"*.vip.xunlei.com"}, Cookie: "gdriveid=abc"},
+		{Name: "example", Hosts: []string{"example.com"}, UserAgent: "Wget/1.15"},
+	}
+	cases := []struct {
+		uri      string
+		name     string
+		expected string
+	}{
+		{"http://gdl.lixian.vip.xunlei.com/file?fid=1", "", "lixian"},
+		{"https://dl.example.com:8080/a.zip", "", "example"},
+		{"http://example.org/a.zip", "", ""},
+		{"https://dl.example.com/a.zip", "example", "example"},
+		{"https://dl.example.com/a.zip", noProfile, ""},
+	}
+	for _, c := range cases {
+		profile, err := piDer.findProfile([]string{c.uri}, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (profile == nil && c.expected != "") || (profile != nil && profile.Name != c.expected) {
+			t.Errorf("unexpected profile of %s: %v", c.uri, profile)
+		}
+	}
+	if _, err := piDer.findProfile([]string{"http://example.com/"}, "foo"); err == nil {
+		t.Error("unknown profile should be rejected")
+	}
+	// the cookie should not be sent to other hosts
+	if _, err := piDer.findProfile([]string{"http://attacker.org/a.zip"}, "lixian"); err == nil {
+		t.Error("the profile should not be used for other hosts")
+	}
+	if _, err := piDer.findProfile([]string{"http://gdl.lixian.vip.xunlei.com/a", "http://attacker.org/a"}, "lixian"); err == nil {
+		t.Error("the profile should not be used if any uri is of other hosts")
+	}
+}
+
+func TestProfileMergeInto(t *testing.T) {
+	profile := &downloadProfile{
+		Name:      "site",
+		Headers:   []string{"X-Token: abc", "Accept: */*"},
+		Cookie:    "sid=1",
+		UserAgent: "Wget/1.15",
+		Referer:   "http://example.com/",
+		Proxy:     "http://127.0.0.1:8087",
+	}
+	options := map[string]interface{}{"header": "accept:text/html", "referer": "http://other.com/"}
+	profile.mergeInto(options)
+	headers := options["header"].([]string)
+	if len(headers) != 3 || headers[0] != "accept:text/html" || headers[1] != "X-Token: abc" || headers[2] != "Cookie: sid=1" {
+		t.Fatalf("unexpected headers: %v", headers)
+	}
+	if options["user-agent"] != "Wget/1.15" || options["referer"] != "http://other.com/" ||
+		options["all-proxy"] != "http://127.0.0.1:8087" {
+		t.Fatalf("unexpected options: %v", options)
+	}
+}
@@ -0,0 +1,211 @@
+package pidownloader
+
+import (
+	l4g "code.google.com/p/log4go"
+	"encoding/json"
+	"fmt"
+	"service"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultRetryDelay = 60 // seconds
+)
+
+// the error codes of aria2 which may be recovered by retrying
+var retryableErrorCodes = map[string]bool{
+	"1":  true, // unknown error
+	"2":  true, // timeout
+	"5":  true, // download speed was too slow
+	"6":  true, // network problem
+	"8":  true, // remote server did not support resume
+	"19": true, // name resolution failed
+	"22": true, // bad HTTP response header
+	"23": true, // too many redirects
+	"29": true, // remote server was overloaded, like 503
+}
+
+type retryConfig struct {
+	MaxRetries int `json:"maxRetries,omitempty"`
+	Delay      int `json:"delay,omitempty"` // seconds, doubled by every retry
+}
+
+func isRetryable(errorCode string) bool {
+	return retryableErrorCodes[errorCode]
+}
+
+// the delay of the nth retry, starts from 0
+func getRetryDelay(baseDelay time.Duration, retries int) time.Duration {
+	return baseDelay << uint(retries)
+}
+
+// the mirrors are given by option like mirrors=url1;url2
+func getMirrors(options map[string]interface{}) []string {
+	mirrors := make([]string, 0)
+	switch value := options["mirrors"].(type) {
+	case string:
+		mirrors = append(mirrors, value)
+	case []string:
+		mirrors = append(mirrors, value...)
+	case []interface{}:
+		for _, v := range value {
+			mirrors = append(mirrors, fmt.Sprint(v))
+		}
+	}
+	return mirrors
+}
+
+// rotate the uris so that the next mirror is tried first
+func rotateUris(uris []string, n int) []string {
+	if len(uris) == 0 {
+		return uris
+	}
+	n = n % len(uris)
+	return append(append([]string{}, uris[n:]...), uris[:n]...)
+}
+
+func (self *PiDownloader) initRetry(c *retryConfig) {
+	self.maxRetries = defaultMaxRetries
+	self.retryDelay = defaultRetryDelay * time.Second
+	if c != nil {
+		if c.MaxRetries > 0 {
+			self.maxRetries = c.MaxRetries
+		}
+		if c.Delay > 0 {
+			self.retryDelay = time.Duration(c.Delay) * time.Second
+		}
+	}
+}
+
+// retryTask schedules the retry of failed task, return false if the task will not be retried
+func (self *PiDownloader) retryTask(backend downloader, gid string, task map[string]interface{}) bool {
+	errorCode, _ := task["errorCode"].(string)
+	if !isRetryable(errorCode) {
+		return false
+	}
+	entity, err := self.dbHelper.GetDownloadTask(gid)
+	if err != nil || entity == nil {
+		l4g.Error("Get download task %s error: %v", gid, err)
+		return false
+	}
+	if entity.Retries >= self.maxRetries || entity.Uris == "" {
+		return false
+	}
+	uris := strings.Split(entity.Uris, " ")
+	for _, uri := range uris {
+		if !isDownloadUri(uri) {
+			return false // added by torrent or metalink file
+		}
+	}
+	delay := getRetryDelay(self.retryDelay, entity.Retries)
+	l4g.Info("Retry task %s after %v, error code: %s", gid, delay, errorCode)
+	// the retry is saved so it is rescheduled after restarting
+	entity.RetryTime = time.Now().Add(delay).Unix()
+	if updateErr := self.dbHelper.UpdateDownloadTask(entity); updateErr != nil {
+		l4g.Error("Update download task %s error: %v", gid, updateErr)
+	}
+	self.scheduleRetry(backend, entity)
+	return true
+}
+
+// loadRetries schedules the retries saved before stopping, the missed retries are fired at once
+func (self *PiDownloader) loadRetries() error {
+	entities, err := self.dbHelper.GetPendingRetryTasks()
+	if err != nil {
+		return err
+	}
+	for _, entity := range entities {
+		backend := self.backendMap[entity.Backend]
+		if backend == nil {
+			backend = self.backends[0]
+		}
+		self.scheduleRetry(backend, entity)
+	}
+	return nil
+}
+
+func (self *PiDownloader) scheduleRetry(backend downloader, entity *DownloadTaskEntity) {
+	delay := time.Unix(entity.RetryTime, 0).Sub(time.Now())
+	if delay < 0 {
+		delay = 0
+	}
+	gid := entity.Gid
+	self.retryLock.Lock()
+	defer self.retryLock.Unlock()
+	if timer := self.retryTimers[gid]; timer != nil {
+		timer.Stop()
+	}
+	self.retryTimers[gid] = time.AfterFunc(delay, func() {
+		self.fireRetry(backend, gid)
+	})
+}
+
+func (self *PiDownloader) stopRetries() {
+	self.retryLock.Lock()
+	defer self.retryLock.Unlock()
+	for gid, timer := range self.retryTimers {
+		timer.Stop()
+		delete(self.retryTimers, gid)
+	}
+}
+
+func (self *PiDownloader) fireRetry(backend downloader, gid string) {
+	self.retryLock.Lock()
+	delete(self.retryTimers, gid)
+	self.retryLock.Unlock()
+	entity, err := self.dbHelper.GetDownloadTask(gid)
+	if err != nil || entity == nil || entity.RetryTime == 0 {
+		l4g.Error("Get download task %s error: %v", gid, err)
+		return
+	}
+	newGid, retryErr := self.readdTask(backend, entity, strings.Split(entity.Uris, " "), entity.ErrorCode)
+	entity.RetryTime = 0
+	if updateErr := self.dbHelper.UpdateDownloadTask(entity); updateErr != nil {
+		l4g.Error("Update download task %s error: %v", gid, updateErr)
+	}
+	if retryErr != nil {
+		l4g.Error("Retry task %s error: %v", gid, retryErr)
+		self.notifyRetryFailed(entity.Username, entity.Title, retryErr)
+		return
+	}
+	l4g.Info("Task %s is retried as %s", gid, newGid)
+	backend.removeDownloadResult(gid)
+}
+
+// readdTask adds the uris and options saved in history again
+func (self *PiDownloader) readdTask(backend downloader, entity *DownloadTaskEntity, uris []string, errorCode string) (string, error) {
+	options := make(map[string]interface{})
+	if entity.Options != "" {
+		if err := json.Unmarshal([]byte(entity.Options), &options); err != nil {
+			return "", err
+		}
+	}
+	aria2Options, localOptions := splitTaskOptions(options)
+	if err := self.applyProfile(uris, aria2Options, localOptions); err != nil {
+		return "", err
+	}
+	if errorCode == "8" {
+		// download from the beginning if resume is not supported
+		aria2Options["continue"] = "false"
+		aria2Options["allow-overwrite"] = "true"
+	}
+	gid, err := backend.addUri(rotateUris(uris, entity.Retries+1), aria2Options)
+	if err != nil {
+		return "", err
+	}
+	self.recordTask(gid, backend, entity.Username, uris, options, entity.Retries+1)
+	return gid, nil
+}
+
+func (self *PiDownloader) notifyRetryFailed(username, title string, err error) {
+	if username == "" {
+		return
+	}
+	self.pushMsgChannel <- &service.PushMessage{
+		Type:     service.Notification,
+		Username: username,
+		Message:  fmt.Sprintf("Download failed: %s\nretry error: %v", title, err),
+	}
+}
@@ -0,0 +1,107 @@
+package pidownloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	for _, code := range []string{"2", "6", "8", "29"} {
+		if !isRetryable(code) {
+			t.Fatalf("%s should be retryable", code)
+		}
+	}
+	for _, code := range []string{"0", "3", "9", "24", "32"} {
+		if isRetryable(code) {
+			t.Fatalf("%s should not be retryable", code)
+		}
+	}
+	delays := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, expected := range delays {
+		if delay := getRetryDelay(time.Minute, i); delay != expected {
+			t.Fatalf("retry %d: expect %v, got %v", i, expected, delay)
+		}
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	options := make(map[string]interface{})
+	json.Unmarshal([]byte(`{"dir":"/tmp","mirrors":["http://b/f","http://c/f"]}`), &options)
+	mirrors := getMirrors(options)
+	if !reflect.DeepEqual(mirrors, []string{"http://b/f", "http://c/f"}) {
+		t.Fatalf("unexpected mirrors: %v", mirrors)
+	}
+	if mirrors := getMirrors(map[string]interface{}{"mirrors": "http://b/f"}); len(mirrors) != 1 {
+		t.Fatalf("unexpected mirrors: %v", mirrors)
+	}
+	uris := []string{"http://a/f", "http://b/f", "http://c/f"}
+	if rotated := rotateUris(uris, 1); !reflect.DeepEqual(rotated, []string{"http://b/f", "http://c/f", "http://a/f"}) {
+		t.Fatalf("unexpected rotated uris: %v", rotated)
+	}
+	if rotated := rotateUris(uris, 3); !reflect.DeepEqual(rotated, uris) {
+		t.Fatalf("unexpected rotated uris: %v", rotated)
+	}
+}
+
+// retryBackend records the re-added uris
+type retryBackend struct {
+	downloader
+	added chan []string
+}
+
+func (self *retryBackend) getName() string {
+	return "pi"
+}
+
+func (self *retryBackend) addUri(uris []string, options map[string]interface{}) (string, error) {
+	self.added <- uris
+	return "d4f5a9e1c2b3a4f5", nil
+}
+
+func (self *retryBackend) removeDownloadResult(gid string) error {
+	return nil
+}
+
+func TestLoadRetries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "retry")
+	defer os.RemoveAll(dir)
+	dbHelper, dbErr := NewDownloaderDbHelper(filepath.Join(dir, "pidownloader.db"))
+	if dbErr != nil {
+		t.Skip("sqlite3 is not available:", dbErr)
+	}
+	defer dbHelper.Close()
+	// the retry saved before restarting is past
+	dbHelper.AddDownloadTask(&DownloadTaskEntity{Gid: "2089b05ecca3d829", Backend: "pi", Username: "user",
+		Uris: "http://a/f http://b/f", Options: "{}", Status: "error", ErrorCode: "6",
+		RetryTime: time.Now().Add(-time.Minute).Unix()})
+	backend := &retryBackend{added: make(chan []string, 1)}
+	piDer := &PiDownloader{dbHelper: dbHelper, notifier: newTaskNotifier()}
+	piDer.backends = []downloader{backend}
+	piDer.backendMap = map[string]downloader{"pi": backend}
+	piDer.retryTimers = make(map[string]*time.Timer)
+	if err := piDer.loadRetries(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case uris := <-backend.added:
+		if !reflect.DeepEqual(uris, []string{"http://b/f", "http://a/f"}) {
+			t.Fatalf("the next mirror should be tried first: %v", uris)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the saved retry should be fired")
+	}
+	time.Sleep(100 * time.Millisecond)
+	entity, _ := dbHelper.GetDownloadTask("2089b05ecca3d829")
+	if entity == nil || entity.RetryTime != 0 {
+		t.Fatalf("the retry should be cleared: %v", entity)
+	}
+	retried, _ := dbHelper.GetDownloadTask("d4f5a9e1c2b3a4f5")
+	if retried == nil || retried.Retries != 1 || retried.Username != "user" {
+		t.Fatalf("unexpected retried task: %v", retried)
+	}
+}
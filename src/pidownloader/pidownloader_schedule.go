@@ -0,0 +1,342 @@
+package pidownloader
+
+import (
+	"bytes"
+	l4g "code.google.com/p/log4go"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"service"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scheduleTimeLayout = "2006-01-02 15:04"
+	scheduleStarted    = "started"
+	scheduleFailed     = "failed"
+)
+
+var (
+	clockPattern     = regexp.MustCompile(`^(\d{1,2}):(\d{2})$`)
+	datePattern      = regexp.MustCompile(`^\d{4}-\d{1,2}-\d{1,2}$`)
+	cnNum            = `[0-9]{1,2}|[零一二两三四五六七八九十]{1,3}`
+	cnClockPattern   = regexp.MustCompile(`^(今天|今晚|明天|明早|明晚|后天)?(凌晨|早上|早晨|上午|中午|下午|傍晚|晚上)?(` + cnNum + `)(?:点|时)(?:(半)|(` + cnNum + `)分?)?$`)
+	cnDelayPattern   = regexp.MustCompile(`^([0-9]+|[一二两三四五六七八九十]+)个?(分钟|小时|钟头|天)(?:后|以后|之后)$`)
+	cnDigits         = map[rune]int{'零': 0, '一': 1, '二': 2, '两': 2, '三': 3, '四': 4, '五': 5, '六': 6, '七': 7, '八': 8, '九': 9}
+	cnDayOffsets     = map[string]int{"今天": 0, "今晚": 0, "明天": 1, "明早": 1, "明晚": 1, "后天": 2}
+	cnAfternoonWords = map[string]bool{"下午": true, "傍晚": true, "晚上": true, "今晚": true, "明晚": true}
+	cnNightWords     = map[string]bool{"晚上": true, "今晚": true, "明晚": true}
+	cnDelayUnits     = map[string]time.Duration{"分钟": time.Minute, "小时": time.Hour, "钟头": time.Hour, "天": 24 * time.Hour}
+)
+
+// parseChineseNumber parses the number less than 100, like "12", "十二" or "二十五".
+// the malformed numbers like "二二" or "十零" are rejected
+func parseChineseNumber(s string) (int, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, nil
+	}
+	invalidErr := errors.New("invalid number: " + s)
+	runes := []rune(s)
+	tensIndex := -1
+	for i, r := range runes {
+		if r == '十' {
+			if tensIndex >= 0 {
+				return 0, invalidErr
+			}
+			tensIndex = i
+		} else if _, ok := cnDigits[r]; !ok {
+			return 0, invalidErr
+		}
+	}
+	if tensIndex < 0 {
+		// a single digit
+		if len(runes) != 1 {
+			return 0, invalidErr
+		}
+		return cnDigits[runes[0]], nil
+	}
+	// the forms: 十, 二十, 十二 and 二十五
+	n := 10
+	if tensIndex == 1 {
+		if cnDigits[runes[0]] == 0 {
+			return 0, invalidErr
+		}
+		n = cnDigits[runes[0]] * 10
+	} else if tensIndex != 0 {
+		return 0, invalidErr
+	}
+	units := runes[tensIndex+1:]
+	if len(units) > 1 || (len(units) == 1 && cnDigits[units[0]] == 0) {
+		return 0, invalidErr
+	}
+	if len(units) == 1 {
+		n += cnDigits[units[0]]
+	}
+	return n, nil
+}
+
+// parseDelay parses the positive duration like "3h", "1h30m" or "2d"
+func parseDelay(s string) (time.Duration, error) {
+	var d time.Duration
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, errors.New("invalid delay: " + s)
+		}
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, errors.New("invalid delay: " + s)
+		}
+	}
+	if d <= 0 {
+		return 0, errors.New("the delay should be positive: " + s)
+	}
+	return d, nil
+}
+
+// nextClock returns the time of hour and minute after days, the next day is used if the time is past and days not given
+func nextClock(now time.Time, days, hour, minute int, daysGiven bool) (time.Time, error) {
+	if hour > 23 || minute > 59 {
+		return time.Time{}, errors.New(fmt.Sprintf("invalid time: %d:%02d", hour, minute))
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day()+days, hour, minute, 0, 0, now.Location())
+	if !t.After(now) {
+		if daysGiven {
+			return time.Time{}, errors.New("the time is past: " + t.Format(scheduleTimeLayout))
+		}
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func parseChineseClock(now time.Time, m []string) (time.Time, error) {
+	hour, hourErr := parseChineseNumber(m[3])
+	if hourErr != nil {
+		return time.Time{}, hourErr
+	}
+	minute := 0
+	if m[4] != "" {
+		minute = 30
+	} else if m[5] != "" {
+		var minuteErr error
+		if minute, minuteErr = parseChineseNumber(m[5]); minuteErr != nil {
+			return time.Time{}, minuteErr
+		}
+	}
+	days, daysGiven := cnDayOffsets[m[1]]
+	switch {
+	case (cnNightWords[m[1]] || cnNightWords[m[2]]) && hour == 12:
+		// 12 o'clock at night is the midnight of the next day
+		hour = 0
+		days++
+	case (cnAfternoonWords[m[1]] || cnAfternoonWords[m[2]]) && hour < 12:
+		hour += 12
+	case m[2] == "中午" && hour < 11:
+		hour += 12
+	case m[2] == "凌晨" && hour == 12:
+		hour = 0
+	}
+	return nextClock(now, days, hour, minute, daysGiven)
+}
+
+// parseScheduleTime parses the time at the beginning of args, like "02:00", "2014-06-01 02:00", "in 3h",
+// "明天凌晨2点" or "3小时后". return the time and the count of args used
+func parseScheduleTime(args []string, now time.Time) (time.Time, int, error) {
+	if len(args) == 0 {
+		return time.Time{}, 0, errors.New("missing time!")
+	}
+	first := strings.TrimSpace(args[0])
+	if strings.ToLower(first) == "in" {
+		if len(args) < 2 {
+			return time.Time{}, 0, errors.New("missing delay!")
+		}
+		d, err := parseDelay(strings.ToLower(args[1]))
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		return now.Add(d), 2, nil
+	}
+	if m := clockPattern.FindStringSubmatch(first); m != nil {
+		hour, _ := strconv.Atoi(m[1])
+		minute, _ := strconv.Atoi(m[2])
+		t, err := nextClock(now, 0, hour, minute, false)
+		return t, 1, err
+	}
+	if datePattern.MatchString(first) && len(args) > 1 {
+		t, err := time.ParseInLocation("2006-1-2 15:04", first+" "+args[1], now.Location())
+		if err != nil {
+			return time.Time{}, 0, errors.New("invalid time: " + first + " " + args[1])
+		}
+		if !t.After(now) {
+			return time.Time{}, 0, errors.New("the time is past: " + t.Format(scheduleTimeLayout))
+		}
+		return t, 2, nil
+	}
+	if m := cnClockPattern.FindStringSubmatch(first); m != nil {
+		t, err := parseChineseClock(now, m)
+		return t, 1, err
+	}
+	if m := cnDelayPattern.FindStringSubmatch(first); m != nil {
+		n, err := parseChineseNumber(m[1])
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		if n <= 0 {
+			return time.Time{}, 0, errors.New("the delay should be positive: " + first)
+		}
+		return now.Add(time.Duration(n) * cnDelayUnits[m[2]]), 1, nil
+	}
+	return time.Time{}, 0, errors.New("invalid time: " + first)
+}
+
+// addAt schedules the download, args: time url [options]
+func (self *PiDownloader) addAt(username string, args []string) (string, error) {
+	fireTime, used, timeErr := parseScheduleTime(args, time.Now())
+	if timeErr != nil {
+		return "", timeErr
+	}
+	addArgs := args[used:]
+	if err := commandValidators["add"](self, addArgs); err != nil {
+		return "", err
+	}
+	argsJson, _ := json.Marshal(addArgs)
+	entity := &ScheduleEntity{
+		Username: username,
+		FireTime: fireTime.Unix(),
+		Args:     string(argsJson),
+	}
+	if err := self.dbHelper.AddSchedule(entity); err != nil {
+		return "", err
+	}
+	self.scheduleJob(entity)
+	return fmt.Sprintf("OK, the download [%d] will start at %s", entity.Id, fireTime.Format(scheduleTimeLayout)), nil
+}
+
+// loadSchedules schedules the pending jobs, the jobs missed while stopped are started at once
+func (self *PiDownloader) loadSchedules() error {
+	entities, err := self.dbHelper.GetPendingSchedules()
+	if err != nil {
+		return err
+	}
+	for _, entity := range entities {
+		self.scheduleJob(entity)
+	}
+	return nil
+}
+
+func (self *PiDownloader) scheduleJob(entity *ScheduleEntity) {
+	delay := time.Unix(entity.FireTime, 0).Sub(time.Now())
+	if delay < 0 {
+		delay = 0
+	}
+	id := entity.Id
+	self.scheduleLock.Lock()
+	defer self.scheduleLock.Unlock()
+	if timer := self.scheduleTimers[id]; timer != nil {
+		timer.Stop()
+	}
+	self.scheduleTimers[id] = time.AfterFunc(delay, func() {
+		self.fireSchedule(id)
+	})
+}
+
+func (self *PiDownloader) stopSchedules() {
+	self.scheduleLock.Lock()
+	defer self.scheduleLock.Unlock()
+	for id, timer := range self.scheduleTimers {
+		timer.Stop()
+		delete(self.scheduleTimers, id)
+	}
+}
+
+func (self *PiDownloader) fireSchedule(id int64) {
+	self.scheduleLock.Lock()
+	delete(self.scheduleTimers, id)
+	self.scheduleLock.Unlock()
+	entity, err := self.dbHelper.GetSchedule(id)
+	if err != nil || entity == nil || entity.Status != "" {
+		return // cancelled
+	}
+	var args []string
+	json.Unmarshal([]byte(entity.Args), &args)
+	l4g.Info("Start scheduled download [%d]: %v", id, args)
+	result, addErr := self.addUri(entity.Username, args)
+	var message string
+	if addErr != nil {
+		entity.Status = scheduleFailed
+		entity.Result = addErr.Error()
+		message = fmt.Sprintf("Scheduled download [%d] failed: %v", id, addErr)
+	} else {
+		entity.Status = scheduleStarted
+		entity.Result = result
+		message = fmt.Sprintf("Scheduled download [%d] started: %s", id, result)
+	}
+	if updateErr := self.dbHelper.UpdateSchedule(entity); updateErr != nil {
+		l4g.Error("Update schedule %d error: %v", id, updateErr)
+	}
+	if entity.Username != "" {
+		self.pushMsgChannel <- &service.PushMessage{
+			Type:     service.Notification,
+			Username: entity.Username,
+			Message:  message,
+		}
+	}
+}
+
+// listSchedules lists the pending jobs of user, all jobs for master
+func (self *PiDownloader) listSchedules(username string, args []string) (string, error) {
+	entities, err := self.dbHelper.GetPendingSchedules()
+	if err != nil {
+		return "", err
+	}
+	isAdmin := self.isAdmin(username)
+	var buffer bytes.Buffer
+	for _, entity := range entities {
+		if !isAdmin && entity.Username != username {
+			continue
+		}
+		var addArgs []string
+		json.Unmarshal([]byte(entity.Args), &addArgs)
+		buffer.WriteString(fmt.Sprintf("\n[%d] %s add %s", entity.Id,
+			time.Unix(entity.FireTime, 0).Format(scheduleTimeLayout), strings.Join(addArgs, " ")))
+		if isAdmin && entity.Username != username {
+			buffer.WriteString(" (" + entity.Username + ")")
+		}
+	}
+	if buffer.Len() == 0 {
+		return "no scheduled downloads", nil
+	}
+	return buffer.String(), nil
+}
+
+func (self *PiDownloader) removeSchedule(username string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("missing args!")
+	}
+	id, parseErr := strconv.ParseInt(args[0], 10, 64)
+	if parseErr != nil {
+		return "", errors.New("invalid id: " + args[0])
+	}
+	entity, err := self.dbHelper.GetSchedule(id)
+	if err != nil {
+		return "", err
+	}
+	if entity == nil || entity.Status != "" || (entity.Username != username && !self.isAdmin(username)) {
+		return "", errors.New("no such scheduled download: " + args[0])
+	}
+	if err := self.dbHelper.DeleteSchedule(entity); err != nil {
+		return "", err
+	}
+	self.scheduleLock.Lock()
+	if timer := self.scheduleTimers[id]; timer != nil {
+		timer.Stop()
+		delete(self.scheduleTimers, id)
+	}
+	self.scheduleLock.Unlock()
+	return "OK", nil
+}
@@ -0,0 +1,75 @@
+package pidownloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleTime(t *testing.T) {
+	now := time.Date(2014, 6, 1, 20, 30, 0, 0, time.Local)
+	cases := []struct {
+		args     []string
+		expected string
+		used     int
+	}{
+		{[]string{"02:00", "http://a"}, "2014-06-02 02:00", 1},
+		{[]string{"21:15"}, "2014-06-01 21:15", 1},
+		{[]string{"in", "3h", "http://a"}, "2014-06-01 23:30", 2},
+		{[]string{"in", "1d"}, "2014-06-02 20:30", 2},
+		{[]string{"2014-06-03", "8:05", "http://a"}, "2014-06-03 08:05", 2},
+		{[]string{"明天凌晨2点", "http://a"}, "2014-06-02 02:00", 1},
+		{[]string{"明晚八点半"}, "2014-06-02 20:30", 1},
+		{[]string{"晚上10点15分"}, "2014-06-01 22:15", 1},
+		{[]string{"后天中午12点"}, "2014-06-03 12:00", 1},
+		{[]string{"下午3点"}, "2014-06-02 15:00", 1},
+		{[]string{"晚上12点"}, "2014-06-02 00:00", 1},
+		{[]string{"今晚12点半"}, "2014-06-02 00:30", 1},
+		{[]string{"明晚十二点"}, "2014-06-03 00:00", 1},
+		{[]string{"中午12点"}, "2014-06-02 12:00", 1},
+		{[]string{"两个小时后"}, "2014-06-01 22:30", 1},
+		{[]string{"30分钟后"}, "2014-06-01 21:00", 1},
+	}
+	for _, c := range cases {
+		fireTime, used, err := parseScheduleTime(c.args, now)
+		if err != nil {
+			t.Errorf("parse %v error: %v", c.args, err)
+			continue
+		}
+		if fireTime.Format(scheduleTimeLayout) != c.expected || used != c.used {
+			t.Errorf("unexpected time of %v: %s, %d", c.args, fireTime.Format(scheduleTimeLayout), used)
+		}
+	}
+	invalids := [][]string{
+		{},
+		{"http://a"},
+		{"in", "soon"},
+		{"25:00"},
+		{"今天早上8点"},
+		{"2014-05-01", "08:00"},
+		{"in", "-3h"},
+		{"in", "0d"},
+		{"0分钟后"},
+		{"二二点"},
+		{"明天十十点"},
+		{"八点二二分"},
+	}
+	for _, args := range invalids {
+		if _, _, err := parseScheduleTime(args, now); err == nil {
+			t.Errorf("%v should be rejected", args)
+		}
+	}
+}
+
+func TestParseChineseNumber(t *testing.T) {
+	cases := map[string]int{"8": 8, "十": 10, "十二": 12, "二十": 20, "二十五": 25, "两": 2, "零": 0}
+	for s, expected := range cases {
+		if n, err := parseChineseNumber(s); err != nil || n != expected {
+			t.Errorf("unexpected number of %s: %d, %v", s, n, err)
+		}
+	}
+	for _, s := range []string{"十十", "二二", "二十二十", "十零", "零十", "二二十", "十二二", "三百", ""} {
+		if _, err := parseChineseNumber(s); err == nil {
+			t.Errorf("invalid number should be rejected: %s", s)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package pidownloader
+
+import (
+	"bytes"
+	l4g "code.google.com/p/log4go"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fileserver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultShareTtl   = 2 * time.Hour
+	shareFileLimit    = 20
+	shareSecretFile   = "share.secret" // saved in the dir of DB file
+	shareSecretLength = 32             // bytes
+)
+
+type shareConfig struct {
+	Addr    string `json:"addr"`
+	BaseUrl string `json:"baseUrl,omitempty"` // the LAN address is used if not given
+	Secret  string `json:"secret,omitempty"`  // the key to sign links, generated and saved next to the DB if not given
+	Ttl     int64  `json:"ttl,omitempty"`     // seconds
+}
+
+func (self *PiDownloader) initShare(c *shareConfig, secretFile string) error {
+	self.shareServer = nil
+	if c == nil || c.Addr == "" {
+		return nil
+	}
+	secret := c.Secret
+	if secret == "" {
+		var secretErr error
+		if secret, secretErr = loadShareSecret(secretFile); secretErr != nil {
+			return secretErr
+		}
+	}
+	server, err := fileserver.NewShareServer(c.Addr, c.BaseUrl, secret, self.getShareRoot)
+	if err != nil {
+		return err
+	}
+	self.shareServer = server
+	self.shareTtl = defaultShareTtl
+	if c.Ttl > 0 {
+		self.shareTtl = time.Duration(c.Ttl) * time.Second
+	}
+	return nil
+}
+
+// loadShareSecret reads the secret from file, the random secret is generated and saved if the file does not exist,
+// so the shared links are still valid after restarting
+func loadShareSecret(secretFile string) (string, error) {
+	data, err := ioutil.ReadFile(secretFile)
+	if err == nil {
+		if secret := strings.TrimSpace(string(data)); len(secret) >= shareSecretLength*2 {
+			return secret, nil
+		}
+		l4g.Warn("Share secret is too short, generate a new one: %s", secretFile)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	b := make([]byte, shareSecretLength)
+	if _, randErr := rand.Read(b); randErr != nil {
+		return "", randErr
+	}
+	secret := hex.EncodeToString(b)
+	if writeErr := ioutil.WriteFile(secretFile, []byte(secret), 0600); writeErr != nil {
+		return "", writeErr
+	}
+	l4g.Info("Share secret is generated: %s", secretFile)
+	return secret, nil
+}
+
+// getShareRoot returns the download dir of local backend, the files are shared under it
+func (self *PiDownloader) getShareRoot(name string) (string, error) {
+	backend := self.backendMap[name]
+	if backend == nil || !backend.isLocal() {
+		return "", errors.New("no local backend: " + name)
+	}
+	globalOptions, err := backend.getGlobalOption()
+	if err != nil {
+		return "", err
+	}
+	if globalOptions["dir"] == "" {
+		return "", errors.New("no download dir of backend: " + name)
+	}
+	return globalOptions["dir"], nil
+}
+
+// share the files of completed task by the signed links, args: gid [file index] [ttl=2h]
+func (self *PiDownloader) share(username string, args []string) (string, error) {
+	if self.shareServer == nil {
+		return "", errors.New("share is not enabled!")
+	}
+	backend, args, targetErr := self.parseTaskTarget(args)
+	if targetErr != nil {
+		return "", targetErr
+	}
+	gid := args[0]
+	if ownerErr := self.checkOwner(username, gid); ownerErr != nil {
+		return "", ownerErr
+	}
+	if !backend.isLocal() {
+		return "", errors.New("the files of backend are not accessible: " + backend.getName())
+	}
+	ttl := self.shareTtl
+	index := ""
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "ttl=") {
+			d, parseErr := time.ParseDuration(strings.TrimPrefix(arg, "ttl="))
+			if parseErr != nil || d <= 0 {
+				return "", errors.New("invalid ttl: " + arg)
+			}
+			ttl = d
+		} else if _, parseErr := strconv.Atoi(arg); parseErr == nil {
+			index = arg
+		} else {
+			return "", errors.New("invalid args!")
+		}
+	}
+	task, statusErr := backend.tellStatus(gid, []string{"gid", "status", "seeder", "files"})
+	if statusErr != nil {
+		return "", statusErr
+	}
+	if task["status"] != "complete" && !(task["status"] == "active" && task["seeder"] == "true") {
+		return "", errors.New("the task is not completed: " + gid)
+	}
+	downloadDir, rootErr := self.getShareRoot(backend.getName())
+	if rootErr != nil {
+		return "", rootErr
+	}
+	files, _ := task["files"].([]interface{})
+	var buffer bytes.Buffer
+	shared := 0
+	for _, f := range files {
+		file := f.(map[string]interface{})
+		if (index != "" && fmt.Sprint(file["index"]) != index) || file["selected"] == "false" {
+			continue
+		}
+		if shared >= shareFileLimit {
+			buffer.WriteString(fmt.Sprintf("\n%d files are shared at most, use \"share gid index\" for the others", shareFileLimit))
+			break
+		}
+		filePath := fmt.Sprint(file["path"])
+		if !fileserver.IsInDir(downloadDir, filePath) {
+			buffer.WriteString(fmt.Sprintf("\n%s: file is not in the download dir", path.Base(filePath)))
+			continue
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			buffer.WriteString(fmt.Sprintf("\n%s: file is moved or removed", path.Base(filePath)))
+			continue
+		}
+		relPath, relErr := filepath.Rel(downloadDir, filePath)
+		if relErr != nil {
+			return "", relErr
+		}
+		link, shareErr := self.shareServer.Share(backend.getName(), relPath, ttl)
+		if shareErr != nil {
+			return "", shareErr
+		}
+		buffer.WriteString(fmt.Sprintf("\n%s\n%s", path.Base(filePath), link))
+		shared++
+	}
+	if shared == 0 {
+		return "", errors.New("no file to share!" + buffer.String())
+	}
+	return fmt.Sprintf("expires in %v:%s", ttl, buffer.String()), nil
+}
@@ -0,0 +1,87 @@
+package pidownloader
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShare(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "share")
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "movie.mkv")
+	ioutil.WriteFile(filePath, []byte("movie"), 0644)
+	status := "complete"
+	outsideDir, _ := ioutil.TempDir("", "outside")
+	defer os.RemoveAll(outsideDir)
+	outsidePath := filepath.Join(outsideDir, "passwd")
+	ioutil.WriteFile(outsidePath, []byte("secret"), 0644)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req aria2Request
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Method == "aria2.getGlobalOption" {
+			fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"%s","result":{"dir":"%s"}}`, req.Id, dir)
+			return
+		}
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"%s","result":{"gid":"2089b05ecca3d829","status":"%s",`+
+			`"files":[{"index":"1","path":"%s","selected":"true"},{"index":"2","path":"%s","selected":"true"},`+
+			`{"index":"3","path":"%s","selected":"true"}]}}`,
+			req.Id, status, filePath, filepath.Join(dir, "removed.txt"), outsidePath)
+	}))
+	defer server.Close()
+	piDer := &PiDownloader{admins: []string{"admin"}}
+	piDer.initBackends(&config{RpcUrl: server.URL})
+	if _, err := piDer.share("admin", []string{"2089b05ecca3d829"}); err == nil {
+		t.Fatal("share should be disabled")
+	}
+	piDer.initShare(&shareConfig{Addr: "127.0.0.1:18091", Secret: "secret"}, "")
+	result, err := piDer.share("admin", []string{"2089b05ecca3d829", "ttl=30m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result, "expires in 30m0s:\nmovie.mkv\nhttp://127.0.0.1:18091/share/"+defaultBackendName+"/movie.mkv?") ||
+		strings.Contains(result, dir) ||
+		!strings.Contains(result, "removed.txt: file is moved or removed") ||
+		!strings.Contains(result, "passwd: file is not in the download dir") {
+		t.Fatalf("unexpected result: %s", result)
+	}
+	if _, err := piDer.share("admin", []string{"2089b05ecca3d829", "3"}); err == nil {
+		t.Fatal("the file outside the download dir should not be shared")
+	}
+	status = "active"
+	if _, err := piDer.share("admin", []string{"2089b05ecca3d829"}); err == nil {
+		t.Fatal("the active task should not be shared")
+	}
+}
+
+func TestLoadShareSecret(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "secret")
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, shareSecretFile)
+	secret, err := loadShareSecret(secretFile)
+	if err != nil {
+		t.Fatal("secret should be generated:", err)
+	}
+	if b, hexErr := hex.DecodeString(secret); hexErr != nil || len(b) != shareSecretLength {
+		t.Fatalf("unexpected secret: %s", secret)
+	}
+	// the same secret is used after restarting
+	if loaded, _ := loadShareSecret(secretFile); loaded != secret {
+		t.Fatalf("secret should be saved: %s != %s", loaded, secret)
+	}
+	// the weak secret is replaced
+	ioutil.WriteFile(secretFile, []byte("abc"), 0600)
+	if loaded, _ := loadShareSecret(secretFile); loaded == "abc" || len(loaded) != shareSecretLength*2 {
+		t.Fatalf("short secret should be replaced: %s", loaded)
+	}
+	if _, err := loadShareSecret(filepath.Join(dir, "missing", shareSecretFile)); err == nil {
+		t.Fatal("secret file in missing dir should fail")
+	}
+}
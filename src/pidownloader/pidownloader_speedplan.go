@@ -0,0 +1,406 @@
+package pidownloader
+
+import (
+	"bytes"
+	l4g "code.google.com/p/log4go"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	speedPlanCron    = "30 * * * * *"
+	pauseLimit       = "pause"
+	unlimited        = "0"
+	defaultPlanDays  = "default"
+	speedPlanHelpMsg = "speedplan: show the plan\n" +
+		"speedplan add weekdays 08:00-23:00 200K: limit the speed in the window, \"pause\" for pausing all tasks\n" +
+		"speedplan default 0: the speed out of all windows, 0 for unlimit\n" +
+		"speedplan rm 1: remove the window"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+var speedLimitReg = regexp.MustCompile(`^\d+[KkMm]?$`)
+
+type speedPlanConfig struct {
+	Default string `json:"default,omitempty"`
+	Rules   []struct {
+		Days   string `json:"days"`
+		Window string `json:"window"`
+		Limit  string `json:"limit"`
+	} `json:"rules,omitempty"`
+}
+
+type speedRule struct {
+	days  [7]bool
+	start int // minutes of day
+	end   int
+	limit string
+}
+
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	switch strings.ToLower(s) {
+	case "daily", "everyday":
+		for i := range days {
+			days[i] = true
+		}
+	case "weekdays":
+		for i := time.Monday; i <= time.Friday; i++ {
+			days[i] = true
+		}
+	case "weekends":
+		days[time.Saturday] = true
+		days[time.Sunday] = true
+	default:
+		for _, name := range strings.Split(strings.ToLower(s), ",") {
+			day, ok := weekdayNames[name]
+			if !ok {
+				return days, errors.New("invalid days: " + s)
+			}
+			days[day] = true
+		}
+	}
+	return days, nil
+}
+
+func parseMinutes(s string) (int, error) {
+	hourMinute := strings.SplitN(s, ":", 2)
+	if len(hourMinute) != 2 {
+		return 0, errors.New("invalid time: " + s)
+	}
+	hour, hourErr := strconv.Atoi(hourMinute[0])
+	minute, minuteErr := strconv.Atoi(hourMinute[1])
+	if hourErr != nil || minuteErr != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, errors.New("invalid time: " + s)
+	}
+	return hour*60 + minute, nil
+}
+
+func checkSpeedLimit(limit string) error {
+	if limit != pauseLimit && !speedLimitReg.MatchString(limit) {
+		return errors.New("invalid speed: " + limit)
+	}
+	return nil
+}
+
+// parse the rule like "weekdays", "08:00-23:00", "200K"
+func parseSpeedRule(days, window, limit string) (*speedRule, error) {
+	rule := &speedRule{limit: limit}
+	var err error
+	if rule.days, err = parseDays(days); err != nil {
+		return nil, err
+	}
+	startEnd := strings.SplitN(window, "-", 2)
+	if len(startEnd) != 2 {
+		return nil, errors.New("invalid window: " + window)
+	}
+	if rule.start, err = parseMinutes(startEnd[0]); err != nil {
+		return nil, err
+	}
+	if rule.end, err = parseMinutes(startEnd[1]); err != nil {
+		return nil, err
+	}
+	if rule.start == rule.end {
+		return nil, errors.New("invalid window: " + window)
+	}
+	if err = checkSpeedLimit(limit); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// the window across midnight belongs to the day it starts
+func (self *speedRule) match(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	if self.start < self.end {
+		return self.days[t.Weekday()] && minutes >= self.start && minutes < self.end
+	}
+	if minutes >= self.start {
+		return self.days[t.Weekday()]
+	}
+	return minutes < self.end && self.days[(t.Weekday()+6)%7]
+}
+
+type speedPlan struct {
+	rules        []*speedRule
+	defaultLimit string // empty if no default, the global option is left alone out of the windows
+}
+
+// the first matched rule wins
+func (self *speedPlan) getLimit(t time.Time) string {
+	for _, rule := range self.rules {
+		if rule.match(t) {
+			return rule.limit
+		}
+	}
+	return self.defaultLimit
+}
+
+// seed the plan from config if nothing is saved
+func (self *PiDownloader) initSpeedPlan(c *speedPlanConfig) error {
+	entities, err := self.dbHelper.GetSpeedPlans()
+	if err != nil {
+		return err
+	}
+	if len(entities) == 0 && c != nil {
+		if c.Default != "" {
+			entity := &SpeedPlanEntity{Days: defaultPlanDays, SpeedLimit: c.Default}
+			if err := self.dbHelper.AddSpeedPlan(entity); err != nil {
+				return err
+			}
+		}
+		for _, r := range c.Rules {
+			if _, parseErr := parseSpeedRule(r.Days, r.Window, r.Limit); parseErr != nil {
+				return parseErr
+			}
+			entity := &SpeedPlanEntity{Days: r.Days, TimeWindow: r.Window, SpeedLimit: r.Limit}
+			if err := self.dbHelper.AddSpeedPlan(entity); err != nil {
+				return err
+			}
+		}
+	}
+	if err := self.loadSpeedPlan(); err != nil {
+		return err
+	}
+	self.cron.AddFunc(speedPlanCron, func() {
+		self.applySpeedPlan()
+	})
+	return nil
+}
+
+func (self *PiDownloader) loadSpeedPlan() error {
+	entities, err := self.dbHelper.GetSpeedPlans()
+	if err != nil {
+		return err
+	}
+	plan := &speedPlan{}
+	for _, entity := range entities {
+		if entity.Days == defaultPlanDays {
+			plan.defaultLimit = entity.SpeedLimit
+			continue
+		}
+		rule, parseErr := parseSpeedRule(entity.Days, entity.TimeWindow, entity.SpeedLimit)
+		if parseErr != nil {
+			l4g.Error("Invalid speed plan %d: %v", entity.Id, parseErr)
+			continue
+		}
+		plan.rules = append(plan.rules, rule)
+	}
+	self.speedPlanLock.Lock()
+	self.speedPlan = plan
+	self.speedPlanLock.Unlock()
+	return nil
+}
+
+// apply the plan when the limit is changed, so maxspd and pauseall
+// keep working until the next window. without the default, nothing is
+// applied out of the windows except removing the limit of the last window
+func (self *PiDownloader) applySpeedPlan() {
+	self.speedPlanLock.Lock()
+	defer self.speedPlanLock.Unlock()
+	limit := self.speedPlan.getLimit(time.Now())
+	if limit == self.appliedLimit {
+		return
+	}
+	target := limit
+	if target == "" {
+		target = unlimited
+	}
+	l4g.Info("Apply speed plan: %s", target)
+	applied := true
+	for _, backend := range self.backends {
+		if err := self.applySpeedLimit(backend, target); err != nil {
+			l4g.Error("Apply speed plan to %s error: %v", backend.getName(), err)
+			applied = false
+		}
+	}
+	if applied {
+		self.appliedLimit = limit
+	}
+}
+
+func (self *PiDownloader) applySpeedLimit(backend downloader, limit string) error {
+	if limit == pauseLimit {
+		return self.pauseForPlan(backend)
+	}
+	if self.appliedLimit == pauseLimit {
+		self.unpauseForPlan(backend)
+	}
+	params := map[string]string{"max-overall-download-limit": limit}
+	return backend.changeGlobalOption(params)
+}
+
+// pauseTasks pauses the active and waiting tasks, returns the gids paused
+func pauseTasks(backend downloader) ([]string, error) {
+	active, err := backend.tellActive([]string{"gid", "status"})
+	if err != nil {
+		return nil, err
+	}
+	waiting, err := backend.tellWaiting(0, bulkQueryLimit, []string{"gid", "status"})
+	if err != nil {
+		return nil, err
+	}
+	var pauseErr error
+	gids := make([]string, 0)
+	for _, task := range append(active, waiting...) {
+		if task["status"] != "active" && task["status"] != "waiting" {
+			continue
+		}
+		gid := task["gid"].(string)
+		if err := backend.pause(gid); err != nil {
+			pauseErr = err
+			continue
+		}
+		gids = append(gids, gid)
+	}
+	return gids, pauseErr
+}
+
+// pauseForPlan pauses the active and waiting tasks, the gids are recorded so the tasks
+// paused by user or disk guard are not resumed after the window. the lock should be held
+func (self *PiDownloader) pauseForPlan(backend downloader) error {
+	if self.planPausedGids == nil {
+		self.planPausedGids = make(map[string][]string)
+	}
+	gids, err := pauseTasks(backend)
+	self.planPausedGids[backend.getName()] = append(self.planPausedGids[backend.getName()], gids...)
+	return err
+}
+
+// unpauseForPlan resumes the tasks paused by plan, the tasks removed or resumed by user are ignored.
+// the tasks of backend held by disk guard are handed over to the guard, so they are resumed once
+// the free space is recovered
+func (self *PiDownloader) unpauseForPlan(backend downloader) {
+	gids := self.planPausedGids[backend.getName()]
+	delete(self.planPausedGids, backend.getName())
+	if self.diskGuard != nil {
+		if _, held := self.diskGuard.paused[backend.getName()]; held {
+			self.holdByGuard(backend.getName(), gids)
+			return
+		}
+	}
+	for _, gid := range gids {
+		if err := backend.unpause(gid); err != nil {
+			l4g.Debug("Unpause %s after speed plan error: %v", gid, err)
+		}
+	}
+}
+
+func (self *PiDownloader) speedPlanCommand(username string, args []string) (string, error) {
+	if len(args) == 0 {
+		return self.showSpeedPlan()
+	}
+	if strings.ToLower(args[0]) == "help" {
+		return speedPlanHelpMsg, nil
+	}
+	if !self.isAdmin(username) {
+		return "", errors.New("permission denied!")
+	}
+	var err error
+	switch strings.ToLower(args[0]) {
+	case "add":
+		err = self.addSpeedPlan(args[1:])
+	case "rm":
+		err = self.removeSpeedPlan(args[1:])
+	case "default":
+		err = self.setDefaultSpeed(args[1:])
+	default:
+		return speedPlanHelpMsg, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = self.loadSpeedPlan(); err != nil {
+		return "", err
+	}
+	self.applySpeedPlan()
+	return self.showSpeedPlan()
+}
+
+func (self *PiDownloader) showSpeedPlan() (string, error) {
+	entities, err := self.dbHelper.GetSpeedPlans()
+	if err != nil {
+		return "", err
+	}
+	defaultLimit := "unchanged"
+	var buffer bytes.Buffer
+	buffer.WriteString("\n")
+	for _, entity := range entities {
+		if entity.Days == defaultPlanDays {
+			defaultLimit = entity.SpeedLimit
+			continue
+		}
+		buffer.WriteString(fmt.Sprintf("[%d] %s %s %s\n", entity.Id, entity.Days, entity.TimeWindow, entity.SpeedLimit))
+	}
+	buffer.WriteString(fmt.Sprintf("otherwise: %s\n", defaultLimit))
+	self.speedPlanLock.Lock()
+	current := self.appliedLimit
+	if current == "" {
+		current = "unchanged"
+	}
+	buffer.WriteString(fmt.Sprintf("current: %s", current))
+	self.speedPlanLock.Unlock()
+	return buffer.String(), nil
+}
+
+func (self *PiDownloader) addSpeedPlan(args []string) error {
+	if len(args) != 3 {
+		return errors.New("invalid args! " + speedPlanHelpMsg)
+	}
+	if _, err := parseSpeedRule(args[0], args[1], args[2]); err != nil {
+		return err
+	}
+	entity := &SpeedPlanEntity{Days: strings.ToLower(args[0]), TimeWindow: args[1], SpeedLimit: args[2]}
+	return self.dbHelper.AddSpeedPlan(entity)
+}
+
+func (self *PiDownloader) removeSpeedPlan(args []string) error {
+	if len(args) != 1 {
+		return errors.New("invalid args! " + speedPlanHelpMsg)
+	}
+	id, parseErr := strconv.ParseInt(args[0], 10, 64)
+	if parseErr != nil {
+		return errors.New("invalid id: " + args[0])
+	}
+	entity, err := self.dbHelper.GetSpeedPlan(id)
+	if err != nil {
+		return err
+	}
+	if entity == nil || entity.Days == defaultPlanDays {
+		return errors.New("no such window: " + args[0])
+	}
+	return self.dbHelper.DeleteSpeedPlan(entity)
+}
+
+func (self *PiDownloader) setDefaultSpeed(args []string) error {
+	if len(args) != 1 {
+		return errors.New("invalid args! " + speedPlanHelpMsg)
+	}
+	if err := checkSpeedLimit(args[0]); err != nil {
+		return err
+	}
+	entities, err := self.dbHelper.GetSpeedPlans()
+	if err != nil {
+		return err
+	}
+	for _, entity := range entities {
+		if entity.Days == defaultPlanDays {
+			entity.SpeedLimit = args[0]
+			return self.dbHelper.UpdateSpeedPlan(entity)
+		}
+	}
+	return self.dbHelper.AddSpeedPlan(&SpeedPlanEntity{Days: defaultPlanDays, SpeedLimit: args[0]})
+}
@@ -0,0 +1,141 @@
+package pidownloader
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpeedPlan(t *testing.T) {
+	weekdays, err := parseSpeedRule("weekdays", "08:00-23:00", "200K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	night, err := parseSpeedRule("fri,sat", "23:30-02:00", "pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := &speedPlan{[]*speedRule{weekdays, night}, "0"}
+	// 2014-03-07 is Friday
+	cases := map[string]string{
+		"2014-03-07 07:59": "0",
+		"2014-03-07 08:00": "200K",
+		"2014-03-07 22:59": "200K",
+		"2014-03-07 23:00": "0",
+		"2014-03-07 23:30": "pause",
+		"2014-03-08 01:59": "pause",
+		"2014-03-08 02:00": "0",
+		"2014-03-08 10:00": "0",
+		"2014-03-09 01:00": "pause",
+		"2014-03-10 01:00": "0",
+	}
+	for s, expected := range cases {
+		tm, _ := time.Parse("2006-01-02 15:04", s)
+		if limit := plan.getLimit(tm); limit != expected {
+			t.Fatalf("%s: expect %s, got %s", s, expected, limit)
+		}
+	}
+}
+
+func TestParseSpeedRule(t *testing.T) {
+	invalid := [][]string{
+		{"someday", "08:00-23:00", "200K"},
+		{"daily", "08:00", "200K"},
+		{"daily", "08:00-25:00", "200K"},
+		{"daily", "08:00-08:00", "200K"},
+		{"daily", "08:00-09:00", "fast"},
+	}
+	for _, args := range invalid {
+		if _, err := parseSpeedRule(args[0], args[1], args[2]); err == nil {
+			t.Fatalf("%v should be invalid", args)
+		}
+	}
+	if _, err := parseSpeedRule("mon,wed", "00:00-24:00", "1M"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// planBackend records the paused and unpaused gids
+type planBackend struct {
+	downloader
+	tasks    []map[string]interface{}
+	paused   []string
+	unpaused []string
+	limit    string
+}
+
+func (self *planBackend) getName() string {
+	return "pi"
+}
+
+func (self *planBackend) tellActive(keys []string) ([]map[string]interface{}, error) {
+	return self.tasks[:1], nil
+}
+
+func (self *planBackend) tellWaiting(offset, num int, keys []string) ([]map[string]interface{}, error) {
+	return self.tasks[1:], nil
+}
+
+func (self *planBackend) pause(gid string) error {
+	self.paused = append(self.paused, gid)
+	return nil
+}
+
+func (self *planBackend) unpause(gid string) error {
+	self.unpaused = append(self.unpaused, gid)
+	return nil
+}
+
+func (self *planBackend) changeGlobalOption(options map[string]string) error {
+	self.limit = options["max-overall-download-limit"]
+	return nil
+}
+
+func TestApplySpeedPlanPause(t *testing.T) {
+	backend := &planBackend{tasks: []map[string]interface{}{
+		{"gid": "a", "status": "active"},
+		{"gid": "b", "status": "waiting"},
+		{"gid": "c", "status": "paused"}, // paused by user
+	}}
+	piDer := &PiDownloader{backends: []downloader{backend}}
+	piDer.speedPlan = &speedPlan{defaultLimit: pauseLimit}
+	piDer.applySpeedPlan()
+	if !reflect.DeepEqual(backend.paused, []string{"a", "b"}) {
+		t.Fatalf("unexpected paused tasks: %v", backend.paused)
+	}
+	piDer.speedPlan = &speedPlan{defaultLimit: "200K"}
+	piDer.applySpeedPlan()
+	if !reflect.DeepEqual(backend.unpaused, []string{"a", "b"}) || backend.limit != "200K" {
+		t.Fatalf("unexpected unpaused tasks: %v, limit: %s", backend.unpaused, backend.limit)
+	}
+}
+
+func TestApplySpeedPlanWithoutDefault(t *testing.T) {
+	backend := &planBackend{}
+	piDer := &PiDownloader{backends: []downloader{backend}}
+	piDer.speedPlan = &speedPlan{}
+	piDer.applySpeedPlan()
+	if backend.limit != "" {
+		t.Fatal("the global option should be left alone without plan:", backend.limit)
+	}
+	allDay, err := parseSpeedRule("daily", "00:00-24:00", "200K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	piDer.speedPlan = &speedPlan{rules: []*speedRule{allDay}}
+	piDer.applySpeedPlan()
+	if backend.limit != "200K" {
+		t.Fatal("unexpected limit in the window:", backend.limit)
+	}
+	// the limit of the window is removed after it
+	piDer.speedPlan = &speedPlan{}
+	piDer.applySpeedPlan()
+	if backend.limit != unlimited || piDer.appliedLimit != "" {
+		t.Fatal("unexpected limit out of the window:", backend.limit, piDer.appliedLimit)
+	}
+	backend.limit = "100K" // set by maxspd
+	piDer.applySpeedPlan()
+	if backend.limit != "100K" {
+		t.Fatal("the global option should be left alone out of the windows:", backend.limit)
+	}
+}
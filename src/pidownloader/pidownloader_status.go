@@ -0,0 +1,53 @@
+package pidownloader
+
+import (
+	"strconv"
+	"strings"
+)
+
+// the fields of status template: {speed}, {active}, {eta}, {diskfree} and {top}
+const defaultStatusTemplate = "spd: {speed} ; act: {active} ; left: {eta}"
+
+type downloadStatus struct {
+	speed    string
+	active   int64
+	eta      string // the longest left time of active tasks
+	diskFree string // the free space of local download dir
+	top      string // the title and progress of the fastest task
+}
+
+func (self *downloadStatus) format(template string) string {
+	if template == "" {
+		template = defaultStatusTemplate
+	}
+	replacer := strings.NewReplacer(
+		"{speed}", self.speed,
+		"{active}", strconv.FormatInt(self.active, 10),
+		"{eta}", self.eta,
+		"{diskfree}", self.diskFree,
+		"{top}", self.top,
+	)
+	return replacer.Replace(template)
+}
+
+// getLocalFreeSpace returns the least free space of the download dirs of local backends
+func (self *PiDownloader) getLocalFreeSpace() (int64, bool) {
+	var least int64 = -1
+	for _, backend := range self.backends {
+		if !backend.isLocal() {
+			continue
+		}
+		dir, dirErr := getDownloadDir(backend, map[string]interface{}{})
+		if dirErr != nil || dir == "" {
+			continue
+		}
+		freeSpace, err := getFreeSpace(dir)
+		if err != nil {
+			continue
+		}
+		if least < 0 || freeSpace < least {
+			least = freeSpace
+		}
+	}
+	return least, least >= 0
+}
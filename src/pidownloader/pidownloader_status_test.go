@@ -0,0 +1,21 @@
+package pidownloader
+
+import (
+	"testing"
+)
+
+func TestDownloadStatusFormat(t *testing.T) {
+	status := &downloadStatus{
+		speed:    "1.2MB",
+		active:   2,
+		eta:      "3m",
+		diskFree: "20.5GB",
+		top:      "ubuntu.iso 45%",
+	}
+	if s := status.format(""); s != "spd: 1.2MB ; act: 2 ; left: 3m" {
+		t.Errorf("unexpected default status: %s", s)
+	}
+	if s := status.format("↓{speed} {top} | free {diskfree}"); s != "↓1.2MB ubuntu.iso 45% | free 20.5GB" {
+		t.Errorf("unexpected status: %s", s)
+	}
+}
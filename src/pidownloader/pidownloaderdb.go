@@ -0,0 +1,635 @@
+package pidownloader
+
+import (
+	"database/sql"
+	_ "github.com/NoahShen/go-sqlite3"
+	"github.com/NoahShen/gorp"
+	"strings"
+	"time"
+)
+
+// DownloadTaskEntity records the download task added by user
+type DownloadTaskEntity struct {
+	Id              int64
+	Gid             string
+	Backend         string // the name of aria2 backend
+	Username        string
+	Uris            string // separated by space
+	Options         string // json
+	Title           string
+	Status          string // the final status of aria2, empty if the task is not finished
+	TotalLength     int64
+	CompletedLength int64
+	ErrorCode       string
+	Retries         int   // the times of retry, the retried task is saved as a new record
+	RetryTime       int64 // the time of the pending retry, 0 if not retried
+	StartTime       int64
+	EndTime         int64
+	CrtDate         int64
+	UpdDate         int64
+	Version         int64
+}
+
+func (self *DownloadTaskEntity) PreInsert(s gorp.SqlExecutor) error {
+	now := time.Now().Unix()
+	self.CrtDate = now
+	self.UpdDate = now
+	return nil
+}
+
+func (self *DownloadTaskEntity) PreUpdate(s gorp.SqlExecutor) error {
+	self.UpdDate = time.Now().Unix()
+	return nil
+}
+
+// SpeedPlanEntity is the window of speed limit, the limit out of all
+// windows is saved with days "default"
+type SpeedPlanEntity struct {
+	Id         int64
+	Days       string
+	TimeWindow string
+	SpeedLimit string
+	CrtDate    int64
+	UpdDate    int64
+	Version    int64
+}
+
+func (self *SpeedPlanEntity) PreInsert(s gorp.SqlExecutor) error {
+	now := time.Now().Unix()
+	self.CrtDate = now
+	self.UpdDate = now
+	return nil
+}
+
+func (self *SpeedPlanEntity) PreUpdate(s gorp.SqlExecutor) error {
+	self.UpdDate = time.Now().Unix()
+	return nil
+}
+
+// FeedEntity is the rss or atom feed subscribed by user
+type FeedEntity struct {
+	Id       int64
+	Username string
+	Name     string
+	Url      string
+	Include  string // regex of title
+	Exclude  string
+	Options  string // download options separated by space
+	CrtDate  int64
+	UpdDate  int64
+	Version  int64
+}
+
+func (self *FeedEntity) PreInsert(s gorp.SqlExecutor) error {
+	now := time.Now().Unix()
+	self.CrtDate = now
+	self.UpdDate = now
+	return nil
+}
+
+func (self *FeedEntity) PreUpdate(s gorp.SqlExecutor) error {
+	self.UpdDate = time.Now().Unix()
+	return nil
+}
+
+// FeedItemEntity is the item seen in feed
+type FeedItemEntity struct {
+	Id      int64
+	FeedId  int64
+	Guid    string
+	Title   string
+	Link    string
+	CrtDate int64
+	UpdDate int64
+	Version int64
+}
+
+func (self *FeedItemEntity) PreInsert(s gorp.SqlExecutor) error {
+	now := time.Now().Unix()
+	self.CrtDate = now
+	self.UpdDate = now
+	return nil
+}
+
+func (self *FeedItemEntity) PreUpdate(s gorp.SqlExecutor) error {
+	self.UpdDate = time.Now().Unix()
+	return nil
+}
+
+// ProfileEntity is the download profile managed by master, it overrides the profile of config with the same name
+type ProfileEntity struct {
+	Id        int64
+	Name      string
+	Hosts     string // separated by space
+	Headers   string // json
+	Cookie    string
+	UserAgent string
+	Referer   string
+	Proxy     string
+	CrtDate   int64
+	UpdDate   int64
+	Version   int64
+}
+
+func (self *ProfileEntity) PreInsert(s gorp.SqlExecutor) error {
+	now := time.Now().Unix()
+	self.CrtDate = now
+	self.UpdDate = now
+	return nil
+}
+
+func (self *ProfileEntity) PreUpdate(s gorp.SqlExecutor) error {
+	self.UpdDate = time.Now().Unix()
+	return nil
+}
+
+// ScheduleEntity is the download scheduled by addat, Status is empty until the download is started
+type ScheduleEntity struct {
+	Id       int64
+	Username string
+	FireTime int64
+	Args     string // json of add args
+	Status   string
+	Result   string
+	CrtDate  int64
+	UpdDate  int64
+	Version  int64
+}
+
+func (self *ScheduleEntity) PreInsert(s gorp.SqlExecutor) error {
+	now := time.Now().Unix()
+	self.CrtDate = now
+	self.UpdDate = now
+	return nil
+}
+
+func (self *ScheduleEntity) PreUpdate(s gorp.SqlExecutor) error {
+	self.UpdDate = time.Now().Unix()
+	return nil
+}
+
+// GuardPausedTaskEntity is the task paused by disk guard, it is resumed once the free space is recovered
+type GuardPausedTaskEntity struct {
+	Id      int64
+	Backend string
+	Gid     string
+	CrtDate int64
+	UpdDate int64
+	Version int64
+}
+
+func (self *GuardPausedTaskEntity) PreInsert(s gorp.SqlExecutor) error {
+	now := time.Now().Unix()
+	self.CrtDate = now
+	self.UpdDate = now
+	return nil
+}
+
+func (self *GuardPausedTaskEntity) PreUpdate(s gorp.SqlExecutor) error {
+	self.UpdDate = time.Now().Unix()
+	return nil
+}
+
+type DownloaderDbHelper struct {
+	dbConn *sql.DB
+	dbmap  *gorp.DbMap
+}
+
+func NewDownloaderDbHelper(dbFile string) (*DownloaderDbHelper, error) {
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dbHelper := &DownloaderDbHelper{}
+	dbHelper.dbConn = db
+	dbHelper.dbmap = &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
+	initErr := dbHelper.init()
+	return dbHelper, initErr
+}
+
+func (self *DownloaderDbHelper) init() error {
+	downloadTaskEntityTable := self.dbmap.AddTable(DownloadTaskEntity{}).SetKeys(true, "Id")
+	downloadTaskEntityTable.SetVersionCol("Version")
+	speedPlanEntityTable := self.dbmap.AddTable(SpeedPlanEntity{}).SetKeys(true, "Id")
+	speedPlanEntityTable.SetVersionCol("Version")
+	feedEntityTable := self.dbmap.AddTable(FeedEntity{}).SetKeys(true, "Id")
+	feedEntityTable.SetVersionCol("Version")
+	feedItemEntityTable := self.dbmap.AddTable(FeedItemEntity{}).SetKeys(true, "Id")
+	feedItemEntityTable.SetVersionCol("Version")
+	profileEntityTable := self.dbmap.AddTable(ProfileEntity{}).SetKeys(true, "Id")
+	profileEntityTable.SetVersionCol("Version")
+	scheduleEntityTable := self.dbmap.AddTable(ScheduleEntity{}).SetKeys(true, "Id")
+	scheduleEntityTable.SetVersionCol("Version")
+	guardPausedTaskEntityTable := self.dbmap.AddTable(GuardPausedTaskEntity{}).SetKeys(true, "Id")
+	guardPausedTaskEntityTable.SetVersionCol("Version")
+	if err := self.dbmap.CreateTablesIfNotExists(); err != nil {
+		return err
+	}
+	return self.addColumns()
+}
+
+// the columns added after the table is created by old version
+var addedColumns = []string{
+	"alter table DownloadTaskEntity add column RetryTime integer not null default 0",
+}
+
+func (self *DownloaderDbHelper) addColumns() error {
+	for _, alterSql := range addedColumns {
+		if _, err := self.dbConn.Exec(alterSql); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *DownloaderDbHelper) Close() error {
+	return self.dbConn.Close()
+}
+
+const (
+	selectDownloadTaskSql = `select d.Id,
+	                                d.Gid,
+	                                d.Backend,
+	                                d.Username,
+	                                d.Uris,
+	                                d.Options,
+	                                d.Title,
+	                                d.Status,
+	                                d.TotalLength,
+	                                d.CompletedLength,
+	                                d.ErrorCode,
+	                                d.Retries,
+	                                d.RetryTime,
+	                                d.StartTime,
+	                                d.EndTime,
+	                                d.CrtDate,
+	                                d.UpdDate,
+	                                d.Version
+	                           from DownloadTaskEntity d`
+
+	GetDownloadTaskSql = selectDownloadTaskSql + `
+	                          where d.Gid = ?
+	                          order by d.Id desc`
+
+	GetUnfinishedDownloadTasksSql = selectDownloadTaskSql + `
+	                          where d.Status = ''`
+
+	GetPendingRetryTasksSql = selectDownloadTaskSql + `
+	                          where d.RetryTime > 0`
+
+	GetUserDownloadTasksSql = selectDownloadTaskSql + `
+	                          where d.Username = ?`
+
+	SearchDownloadTasksSql = selectDownloadTaskSql + `
+	                          where (? = '' or d.Username = ?)
+	                            and (d.Title like ? or d.Uris like ?)
+	                          order by d.Id desc
+	                          limit ?`
+)
+
+func (self *DownloaderDbHelper) selectDownloadTasks(query string, args ...interface{}) ([]*DownloadTaskEntity, error) {
+	list, err := self.dbmap.Select(DownloadTaskEntity{}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]*DownloadTaskEntity, len(list))
+	for i, item := range list {
+		entities[i] = item.(*DownloadTaskEntity)
+	}
+	return entities, nil
+}
+
+// GetDownloadTask returns the latest task of the gid
+func (self *DownloaderDbHelper) GetDownloadTask(gid string) (*DownloadTaskEntity, error) {
+	entities, err := self.selectDownloadTasks(GetDownloadTaskSql, gid)
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) > 0 {
+		return entities[0], nil
+	}
+	return nil, nil
+}
+
+func (self *DownloaderDbHelper) GetUnfinishedDownloadTasks() ([]*DownloadTaskEntity, error) {
+	return self.selectDownloadTasks(GetUnfinishedDownloadTasksSql)
+}
+
+func (self *DownloaderDbHelper) GetPendingRetryTasks() ([]*DownloadTaskEntity, error) {
+	return self.selectDownloadTasks(GetPendingRetryTasksSql)
+}
+
+func (self *DownloaderDbHelper) GetUserDownloadGids(username string) (map[string]bool, error) {
+	entities, err := self.selectDownloadTasks(GetUserDownloadTasksSql, username)
+	if err != nil {
+		return nil, err
+	}
+	gidSet := make(map[string]bool)
+	for _, entity := range entities {
+		gidSet[entity.Gid] = true
+	}
+	return gidSet, nil
+}
+
+// SearchDownloadTasks searches the tasks by title or uri, all users' tasks are searched if username is empty
+func (self *DownloaderDbHelper) SearchDownloadTasks(username, keyword string, limit int) ([]*DownloadTaskEntity, error) {
+	like := "%" + keyword + "%"
+	return self.selectDownloadTasks(SearchDownloadTasksSql, username, username, like, like, limit)
+}
+
+func (self *DownloaderDbHelper) AddDownloadTask(entity *DownloadTaskEntity) error {
+	return self.dbmap.Insert(entity)
+}
+
+func (self *DownloaderDbHelper) UpdateDownloadTask(entity *DownloadTaskEntity) error {
+	_, err := self.dbmap.Update(entity)
+	return err
+}
+
+const (
+	GetSpeedPlansSql = `select s.Id,
+	                           s.Days,
+	                           s.TimeWindow,
+	                           s.SpeedLimit,
+	                           s.CrtDate,
+	                           s.UpdDate,
+	                           s.Version
+	                      from SpeedPlanEntity s
+	                     order by s.Id`
+)
+
+func (self *DownloaderDbHelper) GetSpeedPlans() ([]*SpeedPlanEntity, error) {
+	list, err := self.dbmap.Select(SpeedPlanEntity{}, GetSpeedPlansSql)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]*SpeedPlanEntity, len(list))
+	for i, item := range list {
+		entities[i] = item.(*SpeedPlanEntity)
+	}
+	return entities, nil
+}
+
+func (self *DownloaderDbHelper) GetSpeedPlan(id int64) (*SpeedPlanEntity, error) {
+	obj, err := self.dbmap.Get(SpeedPlanEntity{}, id)
+	if err != nil || obj == nil {
+		return nil, err
+	}
+	return obj.(*SpeedPlanEntity), nil
+}
+
+func (self *DownloaderDbHelper) AddSpeedPlan(entity *SpeedPlanEntity) error {
+	return self.dbmap.Insert(entity)
+}
+
+func (self *DownloaderDbHelper) UpdateSpeedPlan(entity *SpeedPlanEntity) error {
+	_, err := self.dbmap.Update(entity)
+	return err
+}
+
+func (self *DownloaderDbHelper) DeleteSpeedPlan(entity *SpeedPlanEntity) error {
+	_, err := self.dbmap.Delete(entity)
+	return err
+}
+
+const (
+	GetGuardPausedTasksSql = `select g.Id,
+	                                 g.Backend,
+	                                 g.Gid,
+	                                 g.CrtDate,
+	                                 g.UpdDate,
+	                                 g.Version
+	                            from GuardPausedTaskEntity g
+	                           order by g.Id`
+	DeleteGuardPausedTasksSql = `delete from GuardPausedTaskEntity where Backend = ?`
+)
+
+func (self *DownloaderDbHelper) GetGuardPausedTasks() ([]*GuardPausedTaskEntity, error) {
+	list, err := self.dbmap.Select(GuardPausedTaskEntity{}, GetGuardPausedTasksSql)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]*GuardPausedTaskEntity, len(list))
+	for i, item := range list {
+		entities[i] = item.(*GuardPausedTaskEntity)
+	}
+	return entities, nil
+}
+
+func (self *DownloaderDbHelper) AddGuardPausedTask(entity *GuardPausedTaskEntity) error {
+	return self.dbmap.Insert(entity)
+}
+
+func (self *DownloaderDbHelper) DeleteGuardPausedTasks(backend string) error {
+	_, err := self.dbmap.Exec(DeleteGuardPausedTasksSql, backend)
+	return err
+}
+
+const (
+	selectFeedSql = `select f.Id,
+	                        f.Username,
+	                        f.Name,
+	                        f.Url,
+	                        f.Include,
+	                        f.Exclude,
+	                        f.Options,
+	                        f.CrtDate,
+	                        f.UpdDate,
+	                        f.Version
+	                   from FeedEntity f`
+
+	GetAllFeedsSql = selectFeedSql + `
+	                  order by f.Id`
+
+	GetUserFeedsSql = selectFeedSql + `
+	                  where f.Username = ?
+	                  order by f.Id`
+
+	GetFeedSql = selectFeedSql + `
+	                  where f.Username = ?
+	                    and f.Name = ?`
+
+	CountFeedItemSql = `select count(*)
+	                      from FeedItemEntity i
+	                     where i.FeedId = ?
+	                       and i.Guid = ?`
+
+	DeleteFeedItemsSql = `delete from FeedItemEntity where FeedId = ?`
+)
+
+func (self *DownloaderDbHelper) selectFeeds(query string, args ...interface{}) ([]*FeedEntity, error) {
+	list, err := self.dbmap.Select(FeedEntity{}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]*FeedEntity, len(list))
+	for i, item := range list {
+		entities[i] = item.(*FeedEntity)
+	}
+	return entities, nil
+}
+
+func (self *DownloaderDbHelper) GetAllFeeds() ([]*FeedEntity, error) {
+	return self.selectFeeds(GetAllFeedsSql)
+}
+
+func (self *DownloaderDbHelper) GetUserFeeds(username string) ([]*FeedEntity, error) {
+	return self.selectFeeds(GetUserFeedsSql, username)
+}
+
+func (self *DownloaderDbHelper) GetFeed(username, name string) (*FeedEntity, error) {
+	entities, err := self.selectFeeds(GetFeedSql, username, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) > 0 {
+		return entities[0], nil
+	}
+	return nil, nil
+}
+
+func (self *DownloaderDbHelper) AddFeed(entity *FeedEntity) error {
+	return self.dbmap.Insert(entity)
+}
+
+// DeleteFeed deletes the feed and its items
+func (self *DownloaderDbHelper) DeleteFeed(entity *FeedEntity) error {
+	if _, err := self.dbmap.Exec(DeleteFeedItemsSql, entity.Id); err != nil {
+		return err
+	}
+	_, err := self.dbmap.Delete(entity)
+	return err
+}
+
+func (self *DownloaderDbHelper) IsFeedItemSeen(feedId int64, guid string) (bool, error) {
+	count, err := self.dbmap.SelectInt(CountFeedItemSql, feedId, guid)
+	return count > 0, err
+}
+
+func (self *DownloaderDbHelper) AddFeedItem(entity *FeedItemEntity) error {
+	return self.dbmap.Insert(entity)
+}
+
+const (
+	selectProfileSql = `select p.Id,
+	                           p.Name,
+	                           p.Hosts,
+	                           p.Headers,
+	                           p.Cookie,
+	                           p.UserAgent,
+	                           p.Referer,
+	                           p.Proxy,
+	                           p.CrtDate,
+	                           p.UpdDate,
+	                           p.Version
+	                      from ProfileEntity p`
+
+	GetProfilesSql = selectProfileSql + `
+	                     order by p.Id`
+
+	GetProfileSql = selectProfileSql + `
+	                     where p.Name = ?`
+)
+
+func (self *DownloaderDbHelper) selectProfiles(query string, args ...interface{}) ([]*ProfileEntity, error) {
+	list, err := self.dbmap.Select(ProfileEntity{}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]*ProfileEntity, len(list))
+	for i, item := range list {
+		entities[i] = item.(*ProfileEntity)
+	}
+	return entities, nil
+}
+
+func (self *DownloaderDbHelper) GetProfiles() ([]*ProfileEntity, error) {
+	return self.selectProfiles(GetProfilesSql)
+}
+
+func (self *DownloaderDbHelper) GetProfile(name string) (*ProfileEntity, error) {
+	entities, err := self.selectProfiles(GetProfileSql, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) > 0 {
+		return entities[0], nil
+	}
+	return nil, nil
+}
+
+func (self *DownloaderDbHelper) AddProfile(entity *ProfileEntity) error {
+	return self.dbmap.Insert(entity)
+}
+
+func (self *DownloaderDbHelper) UpdateProfile(entity *ProfileEntity) error {
+	_, err := self.dbmap.Update(entity)
+	return err
+}
+
+func (self *DownloaderDbHelper) DeleteProfile(entity *ProfileEntity) error {
+	_, err := self.dbmap.Delete(entity)
+	return err
+}
+
+const (
+	selectScheduleSql = `select s.Id,
+	                            s.Username,
+	                            s.FireTime,
+	                            s.Args,
+	                            s.Status,
+	                            s.Result,
+	                            s.CrtDate,
+	                            s.UpdDate,
+	                            s.Version
+	                       from ScheduleEntity s`
+
+	GetPendingSchedulesSql = selectScheduleSql + `
+	                      where s.Status = ''
+	                      order by s.FireTime, s.Id`
+
+	GetScheduleSql = selectScheduleSql + `
+	                      where s.Id = ?`
+)
+
+func (self *DownloaderDbHelper) selectSchedules(query string, args ...interface{}) ([]*ScheduleEntity, error) {
+	list, err := self.dbmap.Select(ScheduleEntity{}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]*ScheduleEntity, len(list))
+	for i, item := range list {
+		entities[i] = item.(*ScheduleEntity)
+	}
+	return entities, nil
+}
+
+func (self *DownloaderDbHelper) GetPendingSchedules() ([]*ScheduleEntity, error) {
+	return self.selectSchedules(GetPendingSchedulesSql)
+}
+
+func (self *DownloaderDbHelper) GetSchedule(id int64) (*ScheduleEntity, error) {
+	entities, err := self.selectSchedules(GetScheduleSql, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) > 0 {
+		return entities[0], nil
+	}
+	return nil, nil
+}
+
+func (self *DownloaderDbHelper) AddSchedule(entity *ScheduleEntity) error {
+	return self.dbmap.Insert(entity)
+}
+
+func (self *DownloaderDbHelper) UpdateSchedule(entity *ScheduleEntity) error {
+	_, err := self.dbmap.Update(entity)
+	return err
+}
+
+func (self *DownloaderDbHelper) DeleteSchedule(entity *ScheduleEntity) error {
+	_, err := self.dbmap.Delete(entity)
+	return err
+}
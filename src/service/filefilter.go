@@ -0,0 +1,49 @@
+package service
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	FileCommand = "file"
+)
+
+// FileFilter declares the files which service accepts, the file is
+// accepted if any of the extensions, mime types or name patterns matches
+type FileFilter struct {
+	Extensions   []string // like ".torrent"
+	MimeTypes    []string // like "application/x-bittorrent" or "audio/*"
+	NamePatterns []string // regex of file name, like `^aria2\.down$`
+}
+
+// FileAcceptor is implemented by the service which handles file message.
+// The file is passed to Handle by command "file" with args: url, local path, mime type
+// and the options following the url in the file message
+type FileAcceptor interface {
+	GetFileFilter() *FileFilter
+}
+
+func (self *FileFilter) Accept(fileName, mimeType string) bool {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, e := range self.Extensions {
+		if len(ext) > 0 && strings.ToLower(e) == ext {
+			return true
+		}
+	}
+	mimeType = strings.ToLower(strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0]))
+	for _, m := range self.MimeTypes {
+		m = strings.ToLower(m)
+		if m == mimeType ||
+			(strings.HasSuffix(m, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(m, "*"))) {
+			return true
+		}
+	}
+	for _, pattern := range self.NamePatterns {
+		if matched, _ := regexp.MatchString(pattern, fileName); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"testing"
+)
+
+func TestFileFilterAccept(t *testing.T) {
+	filter := &FileFilter{
+		Extensions:   []string{".torrent"},
+		MimeTypes:    []string{"application/metalink4+xml", "audio/*"},
+		NamePatterns: []string{`^aria2\.down$`},
+	}
+	accepted := [][]string{
+		{"ubuntu.TORRENT", "application/octet-stream"},
+		{"a.meta4", "application/metalink4+xml; charset=utf-8"},
+		{"voice", "audio/mpeg"},
+		{"aria2.down", "text/plain"},
+	}
+	for _, f := range accepted {
+		if !filter.Accept(f[0], f[1]) {
+			t.Fatalf("%v should be accepted", f)
+		}
+	}
+	rejected := [][]string{
+		{"a.txt", "text/plain"},
+		{"my.aria2.down", "text/plain"},
+		{"torrent", "application/octet-stream"},
+	}
+	for _, f := range rejected {
+		if filter.Accept(f[0], f[1]) {
+			t.Fatalf("%v should be rejected", f)
+		}
+	}
+}
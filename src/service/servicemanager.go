@@ -49,6 +49,20 @@ func (self *ServiceManager) GetStartedServices() []Service {
 	return startedServices
 }
 
+// return the started services which accept the file
+func (self *ServiceManager) GetFileAcceptors(fileName, mimeType string) []Service {
+	acceptors := make([]Service, 0)
+	for _, service := range self.GetStartedServices() {
+		if acceptor, ok := service.(FileAcceptor); ok {
+			filter := acceptor.GetFileFilter()
+			if filter != nil && filter.Accept(fileName, mimeType) {
+				acceptors = append(acceptors, service)
+			}
+		}
+	}
+	return acceptors
+}
+
 func (self *ServiceManager) GetAllServices() []Service {
 	newServices := make([]Service, len(self.services))
 	copy(newServices, self.services)
@@ -12,6 +12,7 @@ type Service interface {
 	IsStarted() bool
 	Stop() error
 	GetHelpMessage() string
+	GetVoicePhrases() []VoicePhrase
 	CommandFilter(string, []string) bool
 	Handle(string, string, []string) (string, error)
 }
@@ -25,6 +26,9 @@ const (
 
 type PushMessage struct {
 	Type     MessageType
+	Source   string // the service id of status, the status lines of services are rotated
 	Username string
 	Message  string
+	FilePath string // the file sent to user with the notification, optional
+	TempFile bool   // remove the file after sent
 }
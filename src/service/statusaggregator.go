@@ -0,0 +1,81 @@
+package service
+
+import (
+	"sync"
+)
+
+// StatusAggregator collects the status lines pushed by services, and rotates them as the presence status
+type StatusAggregator struct {
+	lines   map[string]string
+	sources []string // in the order of first update
+	index   int      // the index of source shown
+	current string
+	mutex   sync.Mutex
+}
+
+func NewStatusAggregator() *StatusAggregator {
+	return &StatusAggregator{lines: make(map[string]string), index: -1}
+}
+
+// Update sets the status line of source, the line is removed if status is empty.
+// return the status to show and whether it's changed
+func (self *StatusAggregator) Update(source, status string) (string, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	shown := self.index >= 0 && self.index < len(self.sources) && self.sources[self.index] == source
+	if _, ok := self.lines[source]; !ok && status != "" {
+		self.sources = append(self.sources, source)
+	}
+	if status == "" {
+		self.removeSource(source)
+	} else {
+		self.lines[source] = status
+	}
+	if self.index < 0 || self.index >= len(self.sources) {
+		self.index = 0
+		if len(self.sources) == 0 {
+			self.index = -1
+		}
+		shown = true
+	}
+	if shown {
+		return self.show()
+	}
+	return self.current, false
+}
+
+func (self *StatusAggregator) removeSource(source string) {
+	delete(self.lines, source)
+	for i, s := range self.sources {
+		if s == source {
+			self.sources = append(self.sources[:i], self.sources[i+1:]...)
+			if i < self.index {
+				self.index--
+			}
+			break
+		}
+	}
+}
+
+// Rotate shows the line of next source, return the status to show and whether it's changed
+func (self *StatusAggregator) Rotate() (string, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.sources) == 0 {
+		return self.current, false
+	}
+	self.index = (self.index + 1) % len(self.sources)
+	return self.show()
+}
+
+func (self *StatusAggregator) show() (string, bool) {
+	status := ""
+	if self.index >= 0 && self.index < len(self.sources) {
+		status = self.lines[self.sources[self.index]]
+	}
+	if status == self.current {
+		return status, false
+	}
+	self.current = status
+	return status, true
+}
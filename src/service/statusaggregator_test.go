@@ -0,0 +1,38 @@
+package service
+
+import (
+	"testing"
+)
+
+func TestStatusAggregator(t *testing.T) {
+	aggregator := NewStatusAggregator()
+	if status, changed := aggregator.Update("pidownloader", "spd: 1MB"); !changed || status != "spd: 1MB" {
+		t.Fatal("the first line should be shown:", status)
+	}
+	// the line of other source is shown by rotating
+	if _, changed := aggregator.Update("aqiService", "AQI 85"); changed {
+		t.Fatal("the line not shown should not change status")
+	}
+	if status, changed := aggregator.Rotate(); !changed || status != "AQI 85" {
+		t.Fatal("unexpected rotated status:", status)
+	}
+	if status, changed := aggregator.Update("aqiService", "AQI 90"); !changed || status != "AQI 90" {
+		t.Fatal("the shown line should be updated:", status)
+	}
+	if status, _ := aggregator.Rotate(); status != "spd: 1MB" {
+		t.Fatal("unexpected rotated status:", status)
+	}
+	// the removed line is skipped
+	aggregator.Update("aqiService", "AQI 95")
+	if status, changed := aggregator.Update("pidownloader", ""); !changed || status != "AQI 95" {
+		t.Fatal("the next line should be shown after removed:", status)
+	}
+	if status, changed := aggregator.Rotate(); changed || status != "AQI 95" {
+		t.Fatal("unexpected status after removed:", status)
+	}
+	aggregator.Update("aqiService", "")
+	aggregator.Update("pidownloader", "spd: 1MB")
+	if status, changed := aggregator.Update("pidownloader", ""); !changed || status != "" {
+		t.Fatal("the status should be cleared:", status)
+	}
+}
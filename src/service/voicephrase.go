@@ -0,0 +1,219 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// VoicePhrase maps spoken phrases to a command, the phrases contain
+// the synonyms and homophone variants. A phrase can have slots like
+// "{city}的空气质量", the value of the slot is used in args like "{city}".
+type VoicePhrase struct {
+	Phrases []string
+	Command string
+	Args    []string
+}
+
+type compiledPhrase struct {
+	owner      string // service id or username
+	phrase     string
+	command    string
+	args       []string
+	regex      *regexp.Regexp
+	slots      []string
+	literalLen int
+}
+
+type byLiteralLen []*compiledPhrase
+
+func (s byLiteralLen) Len() int {
+	return len(s)
+}
+
+func (s byLiteralLen) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byLiteralLen) Less(i, j int) bool {
+	return s[i].literalLen > s[j].literalLen
+}
+
+var slotRegex = regexp.MustCompile(`\{([^{}]+)\}`)
+
+func compilePhrase(owner, phrase, command string, args []string) (*compiledPhrase, error) {
+	phrase = normalizePhrase(phrase)
+	if len(phrase) == 0 || len(command) == 0 {
+		return nil, errors.New("empty phrase or command!")
+	}
+	cp := &compiledPhrase{owner: owner, phrase: phrase, command: command, args: args}
+	var buffer bytes.Buffer
+	buffer.WriteString("^")
+	last := 0
+	for _, loc := range slotRegex.FindAllStringSubmatchIndex(phrase, -1) {
+		literal := phrase[last:loc[0]]
+		cp.literalLen += len([]rune(literal))
+		buffer.WriteString(regexp.QuoteMeta(literal))
+		buffer.WriteString("(.+?)")
+		cp.slots = append(cp.slots, phrase[loc[2]:loc[3]])
+		last = loc[1]
+	}
+	literal := phrase[last:]
+	cp.literalLen += len([]rune(literal))
+	buffer.WriteString(regexp.QuoteMeta(literal))
+	buffer.WriteString("$")
+	if cp.literalLen == 0 {
+		return nil, errors.New("phrase must contain words besides slots!")
+	}
+	regex, err := regexp.Compile(buffer.String())
+	if err != nil {
+		return nil, err
+	}
+	cp.regex = regex
+	for _, arg := range args {
+		for _, m := range slotRegex.FindAllStringSubmatch(arg, -1) {
+			if !cp.hasSlot(m[1]) {
+				return nil, errors.New(fmt.Sprintf("unknown slot {%s} in args", m[1]))
+			}
+		}
+	}
+	return cp, nil
+}
+
+func (self *compiledPhrase) hasSlot(slot string) bool {
+	for _, s := range self.slots {
+		if s == slot {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *compiledPhrase) match(text string) (string, []string, bool) {
+	subMatches := self.regex.FindStringSubmatch(text)
+	if subMatches == nil {
+		return "", nil, false
+	}
+	args := make([]string, 0, len(self.args))
+	for _, arg := range self.args {
+		for i, slot := range self.slots {
+			arg = strings.Replace(arg, "{"+slot+"}", subMatches[i+1], -1)
+		}
+		args = append(args, arg)
+	}
+	return self.command, args, true
+}
+
+// strip the spaces and the punctuations which speech recognition may add
+func normalizePhrase(text string) string {
+	text = strings.Replace(strings.TrimSpace(text), " ", "", -1)
+	return strings.TrimRight(text, "。？！，.?!,")
+}
+
+// PhraseRegistry holds the voice phrases declared by services and the
+// phrases added by users. The phrases of user are only used for himself,
+// the phrases with empty username are used for everyone.
+type PhraseRegistry struct {
+	servicePhrases []*compiledPhrase
+	userPhrases    map[string][]*compiledPhrase
+	mutex          sync.RWMutex
+}
+
+func NewPhraseRegistry() *PhraseRegistry {
+	registry := &PhraseRegistry{}
+	registry.servicePhrases = make([]*compiledPhrase, 0)
+	registry.userPhrases = make(map[string][]*compiledPhrase)
+	return registry
+}
+
+func (self *PhraseRegistry) RegisterService(serviceId string, voicePhrases []VoicePhrase) error {
+	compiled := make([]*compiledPhrase, 0)
+	for _, vp := range voicePhrases {
+		for _, phrase := range vp.Phrases {
+			cp, err := compilePhrase(serviceId, phrase, vp.Command, vp.Args)
+			if err != nil {
+				return errors.New(fmt.Sprintf("%s phrase [%s] error: %v", serviceId, phrase, err))
+			}
+			compiled = append(compiled, cp)
+		}
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.servicePhrases = append(self.servicePhrases, compiled...)
+	sort.Stable(byLiteralLen(self.servicePhrases))
+	return nil
+}
+
+// CheckPhrase returns the error AddUserPhrase would return, so the phrase can be
+// checked before it is saved
+func CheckPhrase(phrase, command string, args []string) error {
+	_, err := compilePhrase("", phrase, command, args)
+	return err
+}
+
+func (self *PhraseRegistry) AddUserPhrase(username, phrase, command string, args []string) error {
+	cp, err := compilePhrase(username, phrase, command, args)
+	if err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	phrases := self.removePhrase(self.userPhrases[username], cp.phrase)
+	phrases = append(phrases, cp)
+	sort.Stable(byLiteralLen(phrases))
+	self.userPhrases[username] = phrases
+	return nil
+}
+
+func (self *PhraseRegistry) RemoveUserPhrase(username, phrase string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.userPhrases[username] = self.removePhrase(self.userPhrases[username], normalizePhrase(phrase))
+}
+
+func (self *PhraseRegistry) removePhrase(phrases []*compiledPhrase, phrase string) []*compiledPhrase {
+	newPhrases := make([]*compiledPhrase, 0, len(phrases))
+	for _, cp := range phrases {
+		if cp.phrase != phrase {
+			newPhrases = append(newPhrases, cp)
+		}
+	}
+	return newPhrases
+}
+
+// Match the text with the phrases of user first, then the global phrases,
+// at last the phrases of services. Return the command and args.
+func (self *PhraseRegistry) Match(username, text string) (string, []string, bool) {
+	text = normalizePhrase(text)
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	for _, phrases := range [][]*compiledPhrase{self.userPhrases[username], self.userPhrases[""], self.servicePhrases} {
+		for _, cp := range phrases {
+			if command, args, ok := cp.match(text); ok {
+				return command, args, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// return phrase ===> command of the service or user
+func (self *PhraseRegistry) GetPhrases(owner string) []string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	phrases := self.userPhrases[owner]
+	if phrases == nil {
+		phrases = self.servicePhrases
+	}
+	result := make([]string, 0)
+	for _, cp := range phrases {
+		if cp.owner == owner {
+			result = append(result, fmt.Sprintf("[%s] ===> %s", cp.phrase, strings.TrimSpace(cp.command+" "+strings.Join(cp.args, " "))))
+		}
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"testing"
+)
+
+func TestPhraseRegistryMatch(t *testing.T) {
+	registry := NewPhraseRegistry()
+	err := registry.RegisterService("aqiService", []VoicePhrase{
+		{Phrases: []string{"{city}的空气质量", "{city}空气质量"}, Command: "currentaqi", Args: []string{"{city}"}},
+		{Phrases: []string{"订阅{city}的空气质量"}, Command: "subaqidata", Args: []string{"{city}"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.RegisterService("pidownloader", []VoicePhrase{
+		{Phrases: []string{"全部停止"}, Command: "pauseall"},
+	})
+
+	cases := []struct {
+		text    string
+		command string
+		args    []string
+	}{
+		{"上海的空气质量", "currentaqi", []string{"上海"}},
+		{"北京空气质量。", "currentaqi", []string{"北京"}},
+		{"订阅上海的空气质量", "subaqidata", []string{"上海"}},
+		{"全部 停止", "pauseall", []string{}},
+	}
+	for _, c := range cases {
+		command, args, ok := registry.Match("user@example.com", c.text)
+		if !ok || command != c.command || len(args) != len(c.args) {
+			t.Fatalf("%s: unexpected match %s %v %v", c.text, command, args, ok)
+		}
+		for i := range args {
+			if args[i] != c.args[i] {
+				t.Fatalf("%s: unexpected args %v", c.text, args)
+			}
+		}
+	}
+	if _, _, ok := registry.Match("user@example.com", "空气质量"); ok {
+		t.Fatal("slot should not be empty")
+	}
+}
+
+func TestPhraseRegistryUserPhrase(t *testing.T) {
+	registry := NewPhraseRegistry()
+	registry.RegisterService("pidownloader", []VoicePhrase{
+		{Phrases: []string{"全部停止"}, Command: "pauseall"},
+	})
+	if err := registry.AddUserPhrase("a@example.com", "看看下载", "getact", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.AddUserPhrase("", "全部停止", "getstat", nil); err != nil {
+		t.Fatal(err)
+	}
+	if command, _, _ := registry.Match("a@example.com", "看看下载"); command != "getact" {
+		t.Fatal("user phrase not matched")
+	}
+	if _, _, ok := registry.Match("b@example.com", "看看下载"); ok {
+		t.Fatal("phrase of other user should not be matched")
+	}
+	if command, _, _ := registry.Match("b@example.com", "全部停止"); command != "getstat" {
+		t.Fatal("global phrase should override the phrase of service")
+	}
+	registry.RemoveUserPhrase("a@example.com", "看看下载")
+	if _, _, ok := registry.Match("a@example.com", "看看下载"); ok {
+		t.Fatal("removed phrase should not be matched")
+	}
+	if err := registry.AddUserPhrase("a@example.com", "{a}", "currentaqi", []string{"{a}"}); err == nil {
+		t.Fatal("phrase with only slots should be rejected")
+	}
+	if err := registry.AddUserPhrase("a@example.com", "{a}空气", "currentaqi", []string{"{b}"}); err == nil {
+		t.Fatal("unknown slot should be rejected")
+	}
+	if err := CheckPhrase("{a}空气", "currentaqi", []string{"{b}"}); err == nil {
+		t.Fatal("unknown slot should be rejected by check")
+	}
+	if err := CheckPhrase("{a}空气", "currentaqi", []string{"{a}"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := registry.Match("a@example.com", "北京空气"); ok {
+		t.Fatal("the checked phrase should not be added")
+	}
+}
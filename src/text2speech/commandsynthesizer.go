@@ -0,0 +1,71 @@
+package text2speech
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"utils"
+)
+
+const (
+	TextPlaceholder = "{text}"
+	FilePlaceholder = "{file}"
+)
+
+// CommandSynthesizer calls a local tts program, like espeak or ekho.
+// The args may contain {text} and {file}, if {text} is not in the args,
+// the text will be written to the stdin of the program.
+type CommandSynthesizer struct {
+	Command string
+	Args    []string
+	Format  string
+	OutDir  string
+}
+
+func NewCommandSynthesizer(command string, args []string, format, outDir string) *CommandSynthesizer {
+	synthesizer := &CommandSynthesizer{}
+	synthesizer.Command = command
+	synthesizer.Args = args
+	synthesizer.Format = format
+	synthesizer.OutDir = outDir
+	return synthesizer
+}
+
+func (self *CommandSynthesizer) Synthesize(text string) (string, error) {
+	if len(strings.TrimSpace(text)) == 0 {
+		return "", errors.New("empty text!")
+	}
+	if mkdirErr := os.MkdirAll(self.OutDir, 0755); mkdirErr != nil {
+		return "", mkdirErr
+	}
+	filePath, _ := filepath.Abs(filepath.Join(self.OutDir, utils.RandomString(7)+"."+self.Format))
+
+	textInArgs := false
+	args := make([]string, len(self.Args))
+	for i, arg := range self.Args {
+		if strings.Contains(arg, TextPlaceholder) {
+			textInArgs = true
+			arg = strings.Replace(arg, TextPlaceholder, text, -1)
+		}
+		args[i] = strings.Replace(arg, FilePlaceholder, filePath, -1)
+	}
+	cmd := exec.Command(self.Command, args...)
+	if !textInArgs {
+		cmd.Stdin = strings.NewReader(text)
+	}
+	output, execErr := cmd.CombinedOutput()
+	if Debug {
+		fmt.Printf("***Exec %s %v: %s\n", self.Command, args, strings.TrimSpace(string(output)))
+	}
+	if execErr != nil {
+		os.Remove(filePath)
+		return "", execErr
+	}
+	if _, statErr := os.Stat(filePath); statErr != nil {
+		return "", statErr
+	}
+	return filePath, nil
+}
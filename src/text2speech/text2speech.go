@@ -0,0 +1,10 @@
+package text2speech
+
+import ()
+
+var Debug = false
+
+type Synthesizer interface {
+	// convert the text to an audio file, return the absolute path of the file
+	Synthesize(text string) (string, error)
+}
@@ -0,0 +1,69 @@
+package text2speech
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCommandSynthesizer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tts")
+	defer os.RemoveAll(dir)
+	synthesizer := NewCommandSynthesizer("sh", []string{"-c", "cat > {file}"}, "wav", dir)
+	filePath, err := synthesizer.Synthesize("上海空气质量指数为50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(filePath)
+	if string(content) != "上海空气质量指数为50" {
+		t.Fatal("unexpected content:", string(content))
+	}
+
+	_, emptyErr := synthesizer.Synthesize(" ")
+	if emptyErr == nil {
+		t.Fatal("empty text should not be synthesized")
+	}
+}
+
+func TestVoiceServer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tts")
+	defer os.RemoveAll(dir)
+	server, err := NewVoiceServer(dir, "127.0.0.1:18090", "http://127.0.0.1:18090/", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if startErr := server.Start(); startErr != nil {
+		t.Fatal(startErr)
+	}
+	defer server.Stop()
+	synthesizer := NewCommandSynthesizer("sh", []string{"-c", "echo -n {text} > {file}"}, "wav", dir)
+	filePath, _ := synthesizer.Synthesize("hello")
+	url, publishErr := server.Publish(filePath)
+	if publishErr != nil {
+		t.Fatal(publishErr)
+	}
+	resp, getErr := http.Get(url)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Fatal("unexpected body:", string(body))
+	}
+
+	listResp, listErr := http.Get("http://127.0.0.1:18090/voice/")
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+	listResp.Body.Close()
+	if listResp.StatusCode != http.StatusNotFound {
+		t.Fatal("the dir should not be listed:", listResp.Status)
+	}
+
+	if _, outsideErr := server.Publish("/etc/passwd"); outsideErr == nil {
+		t.Fatal("file outside the dir should not be published")
+	}
+}
@@ -0,0 +1,91 @@
+package text2speech
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	voicePathPrefix = "/voice/"
+)
+
+// VoiceServer serves the synthesized audio files through http
+type VoiceServer struct {
+	dir        string
+	addr       string
+	baseUrl    string
+	expiration time.Duration
+	listener   net.Listener
+}
+
+func NewVoiceServer(dir, addr, baseUrl string, expiration time.Duration) (*VoiceServer, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if mkdirErr := os.MkdirAll(absDir, 0755); mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	server := &VoiceServer{}
+	server.dir = absDir
+	server.addr = addr
+	server.baseUrl = strings.TrimRight(baseUrl, "/")
+	server.expiration = expiration
+	return server, nil
+}
+
+func (self *VoiceServer) Start() error {
+	listener, err := net.Listen("tcp", self.addr)
+	if err != nil {
+		return err
+	}
+	self.listener = listener
+	mux := http.NewServeMux()
+	fileHandler := http.FileServer(http.Dir(self.dir))
+	mux.Handle(voicePathPrefix, http.StripPrefix(voicePathPrefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the files are in the dir directly, the dir is not listed
+		if r.URL.Path == "" || strings.Contains(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		fileHandler.ServeHTTP(w, r)
+	})))
+	go http.Serve(listener, mux)
+	return nil
+}
+
+func (self *VoiceServer) Stop() error {
+	if self.listener == nil {
+		return nil
+	}
+	return self.listener.Close()
+}
+
+// return the url of the audio file, the file must be in the dir of server
+func (self *VoiceServer) Publish(filePath string) (string, error) {
+	self.removeExpiredFiles()
+	absPath, _ := filepath.Abs(filePath)
+	if filepath.Dir(absPath) != self.dir {
+		return "", errors.New(fmt.Sprintf("%s is not in %s", absPath, self.dir))
+	}
+	return self.baseUrl + voicePathPrefix + filepath.Base(absPath), nil
+}
+
+func (self *VoiceServer) removeExpiredFiles() {
+	files, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if !f.IsDir() && time.Since(f.ModTime()) > self.expiration {
+			os.Remove(filepath.Join(self.dir, f.Name()))
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,13 +27,32 @@ func FormatSize(size int64) string {
 	return sizeStr + unit
 }
 
+// ParseSize parses the size like "500M", "1.5G" or "1024"
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	var multiple int64 = 1
+	for i, unit := range unitArr[1:] {
+		prefix := unit[:1]
+		if strings.HasSuffix(s, prefix) {
+			s = strings.TrimSuffix(s, prefix)
+			multiple = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, errors.New("invalid size: " + size)
+	}
+	return int64(f * float64(multiple)), nil
+}
+
 func FormatFloatString(f string, decimal int) string {
 	a, _ := strconv.ParseFloat(f, 64)
-	return fmt.Sprintf("%."+string(decimal)+"f", a)
+	return fmt.Sprintf("%."+strconv.Itoa(decimal)+"f", a)
 }
 
 func FormatFloat(f float64, decimal int) string {
-	return fmt.Sprintf("%."+string(decimal)+"f", f)
+	return fmt.Sprintf("%."+strconv.Itoa(decimal)+"f", f)
 }
 
 func FormatTime(sec int64) string {
@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]int64{
+		"1024":  1024,
+		"500M":  500 << 20,
+		"1.5G":  3 << 29,
+		"200KB": 200 << 10,
+		"2g":    2 << 30,
+	}
+	for s, expected := range sizes {
+		size, err := ParseSize(s)
+		if err != nil || size != expected {
+			t.Fatalf("%s: expect %d, got %d, %v", s, expected, size, err)
+		}
+	}
+	for _, s := range []string{"", "M", "-1M", "abc"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Fatalf("%s should be invalid", s)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 )
 
 func IsHttpUrl(s string) bool {
@@ -14,21 +18,69 @@ func IsHttpUrl(s string) bool {
 }
 
 func DownloadHttpFile(fileUrl, localFilePath string) (string, error) {
-	f, createFileErr := os.Create(localFilePath)
-	defer f.Close()
-	if createFileErr != nil {
-		return "", createFileErr
-	}
+	p, _, err := DownloadFile(fileUrl, localFilePath, -1)
+	return p, err
+}
+
+const (
+	sniffLen = 512
+)
 
+// DownloadFile downloads the file no larger than maxSize (no limit if maxSize < 0),
+// return the absolute path and the mime type of the file. The mime type is sniffed
+// from the content, if it is not recognized, the type from the header or the extension is used.
+func DownloadFile(fileUrl, localFilePath string, maxSize int64) (string, string, error) {
 	resp, downloadFileErr := http.Get(fileUrl)
-	defer resp.Body.Close()
 	if downloadFileErr != nil {
-		return "", downloadFileErr
+		return "", "", downloadFileErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", errors.New(fmt.Sprintf("download %s failed: %s", fileUrl, resp.Status))
+	}
+	if maxSize >= 0 && resp.ContentLength > maxSize {
+		return "", "", errors.New(fmt.Sprintf("file is too large: %s", FormatSize(resp.ContentLength)))
+	}
+
+	f, createFileErr := os.Create(localFilePath)
+	if createFileErr != nil {
+		return "", "", createFileErr
+	}
+	defer f.Close()
+	var reader io.Reader = resp.Body
+	if maxSize >= 0 {
+		reader = io.LimitReader(resp.Body, maxSize+1)
+	}
+	written, writeFileErr := io.Copy(f, reader)
+	if writeFileErr == nil && maxSize >= 0 && written > maxSize {
+		writeFileErr = errors.New(fmt.Sprintf("file is larger than %s", FormatSize(maxSize)))
 	}
-	_, writeFileErr := io.Copy(f, resp.Body)
 	if writeFileErr != nil {
-		return "", writeFileErr
+		f.Close()
+		os.Remove(localFilePath)
+		return "", "", writeFileErr
+	}
+
+	mimeType, sniffErr := sniffMimeType(f)
+	if sniffErr != nil {
+		return "", "", sniffErr
+	}
+	if mimeType == "application/octet-stream" || strings.HasPrefix(mimeType, "text/plain") {
+		if headerType := resp.Header.Get("Content-Type"); len(headerType) > 0 && headerType != "application/octet-stream" {
+			mimeType = headerType
+		} else if extType := mime.TypeByExtension(filepath.Ext(fileUrl)); len(extType) > 0 {
+			mimeType = extType
+		}
 	}
 	p, _ := filepath.Abs(f.Name())
-	return p, nil
+	return p, mimeType, nil
+}
+
+func sniffMimeType(f *os.File) (string, error) {
+	buf := make([]byte, sniffLen)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
 }
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		switch r.URL.Path {
+		case "/a.png":
+			w.Write([]byte("\x89PNG\x0D\x0A\x1A\x0A0000"))
+		case "/a.torrent":
+			w.Write([]byte("d8:announce"))
+		}
+	}))
+	defer server.Close()
+	localFile := filepath.Join(os.TempDir(), RandomString(7))
+	defer os.Remove(localFile)
+
+	_, mimeType, err := DownloadFile(server.URL+"/a.png", localFile, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "image/png" {
+		t.Fatal("unexpected mime type:", mimeType)
+	}
+
+	largeFile := filepath.Join(os.TempDir(), RandomString(7))
+	if _, _, err := DownloadFile(server.URL+"/a.torrent", largeFile, 5); err == nil {
+		t.Fatal("file larger than max size should fail")
+	}
+	if _, err := os.Stat(largeFile); !os.IsNotExist(err) {
+		t.Fatal("file larger than max size should be removed")
+	}
+}